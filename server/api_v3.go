@@ -0,0 +1,559 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License for license information.
+
+package main
+
+import (
+	_ "embed" // the OpenAPI document of the v3 API
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	jira "github.com/andygrunwald/go-jira"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-plugin-jira/server/utils/kvstore"
+	"github.com/mattermost/mattermost-plugin-jira/server/utils/types"
+)
+
+const (
+	routeAPIv3                 = "/api/v3"
+	routeAPIv3OpenAPI          = "/openapi.json"
+	routeAPIv3Me               = "/me"
+	routeAPIv3Issues           = "/issues"
+	routeAPIv3Issue            = "/issues/{key}"
+	routeAPIv3IssueTransitions = "/issues/{key}/transitions"
+	routeAPIv3IssueComments    = "/issues/{key}/comments"
+	routeAPIv3IssueWorklogs    = "/issues/{key}/worklogs"
+	routeAPIv3IssueWorklog     = "/issues/{key}/worklogs/{id}"
+	routeAPIv3Subscriptions    = "/subscriptions"
+	routeAPIv3Subscription     = "/subscriptions/{id:[A-Za-z0-9]+}"
+)
+
+//go:embed api_v3_openapi.json
+var apiV3OpenAPI []byte
+
+// APIError is the body of every failed v3 API call.
+type APIError struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+type apiErrorResponse struct {
+	Error APIError `json:"error"`
+}
+
+// APIConnection describes the Jira account a Mattermost user connected on an instance.
+type APIConnection struct {
+	InstanceID   types.ID `json:"instance_id"`
+	JiraBaseURL  string   `json:"jira_base_url"`
+	AccountID    string   `json:"account_id,omitempty"`
+	Name         string   `json:"name,omitempty"`
+	DisplayName  string   `json:"display_name"`
+	EmailAddress string   `json:"email_address,omitempty"`
+}
+
+// APIUserStatus is the connection status of a Mattermost user.
+type APIUserStatus struct {
+	MattermostUserID  string          `json:"mattermost_user_id"`
+	Connected         bool            `json:"connected"`
+	DefaultInstanceID types.ID        `json:"default_instance_id,omitempty"`
+	Connections       []APIConnection `json:"connections"`
+}
+
+// APIWorklog is the body of the worklog create and update calls. TimeSpent is in the Jira
+// format, e.g. "1h 30m", and takes precedence over TimeSpentSeconds.
+type APIWorklog struct {
+	TimeSpent        string     `json:"time_spent,omitempty"`
+	TimeSpentSeconds int        `json:"time_spent_seconds,omitempty"`
+	Comment          string     `json:"comment,omitempty"`
+	Started          *time.Time `json:"started,omitempty"`
+}
+
+// APITransition is the body of the transition call, either the ID of a transition or the
+// name of the target state.
+type APITransition struct {
+	TransitionID string `json:"transition_id,omitempty"`
+	ToState      string `json:"to_state,omitempty"`
+	Resolution   string `json:"resolution,omitempty"`
+}
+
+func respondAPIError(w http.ResponseWriter, status int, err error) (int, error) {
+	data, _ := json.Marshal(apiErrorResponse{Error: APIError{Status: status, Message: err.Error()}})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(data)
+	return status, err
+}
+
+func respondAPIJSON(w http.ResponseWriter, status int, obj interface{}) (int, error) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return respondAPIError(w, http.StatusInternalServerError, errors.WithMessage(err, "failed to marshal response"))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err = w.Write(data); err != nil {
+		return status, errors.WithMessage(err, "failed to write response")
+	}
+	return status, nil
+}
+
+// apiErrorStatus returns the status to respond with for an error of Jira or of the plugin stores.
+func apiErrorStatus(err error) int {
+	if errors.Cause(err) == kvstore.ErrNotFound {
+		return http.StatusNotFound
+	}
+	if errors.Is(err, errWorklogNotOwned) {
+		return http.StatusForbidden
+	}
+	status := StatusCode(errors.Cause(err))
+	if status < http.StatusBadRequest {
+		return http.StatusInternalServerError
+	}
+	return status
+}
+
+func (p *Plugin) initializeAPIv3Router() {
+	apiV3Router := p.router.PathPrefix(routeAPIv3).Subrouter()
+	handle := func(route string, fn func(w http.ResponseWriter, r *http.Request) (int, error), methods ...string) {
+		apiV3Router.HandleFunc(route, p.checkAPIv3Auth(p.handleResponse(fn))).Methods(methods...)
+	}
+
+	apiV3Router.HandleFunc(routeAPIv3OpenAPI, p.handleResponse(p.httpAPIv3GetOpenAPI)).Methods(http.MethodGet)
+	handle(routeAPIv3Me, p.httpAPIv3GetMe, http.MethodGet)
+	handle(routeAPIv3Issues, p.httpAPIv3CreateIssue, http.MethodPost)
+	handle(routeAPIv3Issue, p.httpAPIv3GetIssue, http.MethodGet)
+	handle(routeAPIv3Issue, p.httpAPIv3UpdateIssue, http.MethodPut)
+	handle(routeAPIv3IssueTransitions, p.httpAPIv3GetTransitions, http.MethodGet)
+	handle(routeAPIv3IssueTransitions, p.httpAPIv3TransitionIssue, http.MethodPost)
+	handle(routeAPIv3IssueComments, p.httpAPIv3AddComment, http.MethodPost)
+	handle(routeAPIv3IssueWorklogs, p.httpAPIv3GetWorklogs, http.MethodGet)
+	handle(routeAPIv3IssueWorklogs, p.httpAPIv3CreateWorklog, http.MethodPost)
+	handle(routeAPIv3IssueWorklog, p.httpAPIv3UpdateWorklog, http.MethodPut)
+	handle(routeAPIv3IssueWorklog, p.httpAPIv3DeleteWorklog, http.MethodDelete)
+	handle(routeAPIv3Subscriptions, p.httpAPIv3GetSubscriptions, http.MethodGet)
+	handle(routeAPIv3Subscriptions, p.httpAPIv3CreateSubscription, http.MethodPost)
+	handle(routeAPIv3Subscription, p.httpAPIv3EditSubscription, http.MethodPut)
+	handle(routeAPIv3Subscription, p.httpAPIv3DeleteSubscription, http.MethodDelete)
+
+	apiV3Router.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = respondAPIError(w, http.StatusNotFound, errors.New("not found"))
+	})
+	apiV3Router.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = respondAPIError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	})
+}
+
+func (p *Plugin) checkAPIv3Auth(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(HeaderMattermostUserID) == "" {
+			_, _ = respondAPIError(w, http.StatusUnauthorized, errors.New("not authorized"))
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// apiV3Client returns the Jira client of the calling user for the instance given by the
+// instance_id query parameter, or the user's default instance.
+func (p *Plugin) apiV3Client(r *http.Request) (Client, Instance, *Connection, error) {
+	mattermostUserID := types.ID(r.Header.Get(HeaderMattermostUserID))
+	_, instanceID, err := p.ResolveUserInstanceURL(mattermostUserID, r.URL.Query().Get("instance_id"))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return p.getClient(instanceID, mattermostUserID)
+}
+
+func (p *Plugin) httpAPIv3GetOpenAPI(w http.ResponseWriter, r *http.Request) (int, error) {
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(apiV3OpenAPI); err != nil {
+		return http.StatusInternalServerError, errors.WithMessage(err, "failed to write response")
+	}
+	return http.StatusOK, nil
+}
+
+func (p *Plugin) httpAPIv3GetMe(w http.ResponseWriter, r *http.Request) (int, error) {
+	mattermostUserID := types.ID(r.Header.Get(HeaderMattermostUserID))
+	status := APIUserStatus{
+		MattermostUserID: mattermostUserID.String(),
+		Connections:      []APIConnection{},
+	}
+
+	user, err := p.userStore.LoadUser(mattermostUserID)
+	if errors.Cause(err) == kvstore.ErrNotFound {
+		return respondAPIJSON(w, http.StatusOK, status)
+	}
+	if err != nil {
+		return respondAPIError(w, http.StatusInternalServerError, err)
+	}
+	status.DefaultInstanceID = user.DefaultInstanceID
+
+	for _, instanceID := range user.ConnectedInstances.IDs() {
+		instance, err := p.instanceStore.LoadInstance(instanceID)
+		if err != nil {
+			continue
+		}
+		connection, err := p.userStore.LoadConnection(instanceID, mattermostUserID)
+		if err != nil {
+			continue
+		}
+		status.Connections = append(status.Connections, APIConnection{
+			InstanceID:   instanceID,
+			JiraBaseURL:  instance.GetJiraBaseURL(),
+			AccountID:    connection.AccountID,
+			Name:         connection.Name,
+			DisplayName:  connection.DisplayName,
+			EmailAddress: connection.EmailAddress,
+		})
+	}
+	status.Connected = len(status.Connections) > 0
+	return respondAPIJSON(w, http.StatusOK, status)
+}
+
+func (p *Plugin) httpAPIv3GetIssue(w http.ResponseWriter, r *http.Request) (int, error) {
+	client, _, _, err := p.apiV3Client(r)
+	if err != nil {
+		return respondAPIError(w, apiErrorStatus(err), err)
+	}
+
+	issue, err := client.GetIssue(mux.Vars(r)["key"], nil)
+	if err != nil {
+		return respondAPIError(w, apiErrorStatus(err), err)
+	}
+	return respondAPIJSON(w, http.StatusOK, issue)
+}
+
+func (p *Plugin) httpAPIv3CreateIssue(w http.ResponseWriter, r *http.Request) (int, error) {
+	issue := &jira.Issue{}
+	if err := json.NewDecoder(r.Body).Decode(issue); err != nil || issue.Fields == nil {
+		return respondAPIError(w, http.StatusBadRequest, errors.New("the body must be an issue with fields"))
+	}
+
+	client, _, _, err := p.apiV3Client(r)
+	if err != nil {
+		return respondAPIError(w, apiErrorStatus(err), err)
+	}
+
+	created, err := client.CreateIssue(issue)
+	if err != nil {
+		return respondAPIError(w, apiErrorStatus(err), err)
+	}
+	return respondAPIJSON(w, http.StatusCreated, created)
+}
+
+func (p *Plugin) httpAPIv3UpdateIssue(w http.ResponseWriter, r *http.Request) (int, error) {
+	var data map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil || (data["fields"] == nil && data["update"] == nil) {
+		return respondAPIError(w, http.StatusBadRequest, errors.New("the body must have fields or update operations"))
+	}
+
+	client, _, _, err := p.apiV3Client(r)
+	if err != nil {
+		return respondAPIError(w, apiErrorStatus(err), err)
+	}
+
+	issueKey := mux.Vars(r)["key"]
+	if err = client.UpdateIssue(issueKey, data); err != nil {
+		return respondAPIError(w, apiErrorStatus(err), err)
+	}
+	issue, err := client.GetIssue(issueKey, nil)
+	if err != nil {
+		return respondAPIError(w, apiErrorStatus(err), err)
+	}
+	return respondAPIJSON(w, http.StatusOK, issue)
+}
+
+func (p *Plugin) httpAPIv3GetTransitions(w http.ResponseWriter, r *http.Request) (int, error) {
+	client, _, _, err := p.apiV3Client(r)
+	if err != nil {
+		return respondAPIError(w, apiErrorStatus(err), err)
+	}
+
+	transitions, err := client.GetTransitions(mux.Vars(r)["key"])
+	if err != nil {
+		return respondAPIError(w, apiErrorStatus(err), err)
+	}
+	return respondAPIJSON(w, http.StatusOK, transitions)
+}
+
+func (p *Plugin) httpAPIv3TransitionIssue(w http.ResponseWriter, r *http.Request) (int, error) {
+	in := APITransition{}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil || (in.TransitionID == "" && in.ToState == "") {
+		return respondAPIError(w, http.StatusBadRequest, errors.New("transition_id or to_state is required"))
+	}
+
+	client, _, _, err := p.apiV3Client(r)
+	if err != nil {
+		return respondAPIError(w, apiErrorStatus(err), err)
+	}
+
+	issueKey := mux.Vars(r)["key"]
+	transitionID := in.TransitionID
+	if transitionID == "" {
+		transitions, err := client.GetTransitions(issueKey)
+		if err != nil {
+			return respondAPIError(w, apiErrorStatus(err), err)
+		}
+		transition, err := p.findMatchingTransition(transitions, in.ToState)
+		if err != nil {
+			return respondAPIError(w, http.StatusBadRequest, err)
+		}
+		transitionID = transition.ID
+	}
+
+	resolution := ""
+	if in.Resolution != "" {
+		resolution, err = p.findMatchingResolution(client, in.Resolution)
+		if err != nil {
+			return respondAPIError(w, http.StatusBadRequest, err)
+		}
+	}
+
+	if err = client.DoTransition(issueKey, transitionID, resolution); err != nil {
+		return respondAPIError(w, apiErrorStatus(err), err)
+	}
+	issue, err := client.GetIssue(issueKey, nil)
+	if err != nil {
+		return respondAPIError(w, apiErrorStatus(err), err)
+	}
+	return respondAPIJSON(w, http.StatusOK, issue)
+}
+
+func (p *Plugin) httpAPIv3AddComment(w http.ResponseWriter, r *http.Request) (int, error) {
+	comment := &jira.Comment{}
+	if err := json.NewDecoder(r.Body).Decode(comment); err != nil || strings.TrimSpace(comment.Body) == "" {
+		return respondAPIError(w, http.StatusBadRequest, errors.New("the comment body is required"))
+	}
+
+	client, _, _, err := p.apiV3Client(r)
+	if err != nil {
+		return respondAPIError(w, apiErrorStatus(err), err)
+	}
+
+	added, err := client.AddComment(mux.Vars(r)["key"], comment)
+	if err != nil {
+		return respondAPIError(w, apiErrorStatus(err), err)
+	}
+	return respondAPIJSON(w, http.StatusCreated, added)
+}
+
+func (p *Plugin) httpAPIv3GetWorklogs(w http.ResponseWriter, r *http.Request) (int, error) {
+	client, _, _, err := p.apiV3Client(r)
+	if err != nil {
+		return respondAPIError(w, apiErrorStatus(err), err)
+	}
+
+	worklogs, err := client.GetWorklogs(mux.Vars(r)["key"])
+	if err != nil {
+		return respondAPIError(w, apiErrorStatus(err), err)
+	}
+	return respondAPIJSON(w, http.StatusOK, worklogs)
+}
+
+// worklogRecord converts the body of a worklog call to a Jira worklog.
+func (in *APIWorklog) worklogRecord() (*jira.WorklogRecord, error) {
+	seconds := in.TimeSpentSeconds
+	if in.TimeSpent != "" {
+		var remaining []string
+		var err error
+		seconds, remaining, err = parseWorklogDuration(strings.Fields(in.TimeSpent))
+		if err != nil {
+			return nil, err
+		}
+		if len(remaining) > 0 {
+			return nil, errors.Errorf("invalid time_spent %q", in.TimeSpent)
+		}
+	}
+	if seconds < 60 {
+		return nil, errors.New("time_spent or time_spent_seconds of at least a minute is required")
+	}
+
+	record := &jira.WorklogRecord{
+		TimeSpentSeconds: seconds,
+		Comment:          in.Comment,
+	}
+	if in.Started != nil {
+		started := jira.Time(*in.Started)
+		record.Started = &started
+	}
+	return record, nil
+}
+
+func (p *Plugin) httpAPIv3CreateWorklog(w http.ResponseWriter, r *http.Request) (int, error) {
+	in := APIWorklog{}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		return respondAPIError(w, http.StatusBadRequest, errors.WithMessage(err, "failed to decode the worklog"))
+	}
+	record, err := in.worklogRecord()
+	if err != nil {
+		return respondAPIError(w, http.StatusBadRequest, err)
+	}
+
+	client, _, _, err := p.apiV3Client(r)
+	if err != nil {
+		return respondAPIError(w, apiErrorStatus(err), err)
+	}
+
+	created, _, err := client.createWorkLog(mux.Vars(r)["key"], record)
+	if err != nil {
+		return respondAPIError(w, apiErrorStatus(err), err)
+	}
+	return respondAPIJSON(w, http.StatusCreated, created)
+}
+
+func (p *Plugin) httpAPIv3UpdateWorklog(w http.ResponseWriter, r *http.Request) (int, error) {
+	in := APIWorklog{}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		return respondAPIError(w, http.StatusBadRequest, errors.WithMessage(err, "failed to decode the worklog"))
+	}
+	record, err := in.worklogRecord()
+	if err != nil {
+		return respondAPIError(w, http.StatusBadRequest, err)
+	}
+
+	client, _, connection, err := p.apiV3Client(r)
+	if err != nil {
+		return respondAPIError(w, apiErrorStatus(err), err)
+	}
+
+	vars := mux.Vars(r)
+	updated, err := updateOwnWorklog(client, connection, vars["key"], vars["id"], record)
+	if err != nil {
+		return respondAPIError(w, apiErrorStatus(err), err)
+	}
+	return respondAPIJSON(w, http.StatusOK, updated)
+}
+
+func (p *Plugin) httpAPIv3DeleteWorklog(w http.ResponseWriter, r *http.Request) (int, error) {
+	client, _, connection, err := p.apiV3Client(r)
+	if err != nil {
+		return respondAPIError(w, apiErrorStatus(err), err)
+	}
+
+	vars := mux.Vars(r)
+	if err = deleteOwnWorklog(client, connection, vars["key"], vars["id"]); err != nil {
+		return respondAPIError(w, apiErrorStatus(err), err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return http.StatusNoContent, nil
+}
+
+// apiV3SubscriptionInstance resolves the instance of a subscription call and checks that
+// the calling user may manage the subscriptions of the channel.
+func (p *Plugin) apiV3SubscriptionInstance(r *http.Request, channelID string) (types.ID, int, error) {
+	mattermostUserID := types.ID(r.Header.Get(HeaderMattermostUserID))
+	_, instanceID, err := p.ResolveUserInstanceURL(mattermostUserID, r.URL.Query().Get("instance_id"))
+	if err != nil {
+		return "", apiErrorStatus(err), err
+	}
+	if channelID == "" {
+		return "", http.StatusBadRequest, errors.New("channel_id is required")
+	}
+	if err = p.hasPermissionToManageSubscription(instanceID, mattermostUserID.String(), channelID); err != nil {
+		return "", http.StatusForbidden, err
+	}
+	return instanceID, http.StatusOK, nil
+}
+
+func (p *Plugin) httpAPIv3GetSubscriptions(w http.ResponseWriter, r *http.Request) (int, error) {
+	channelID := r.URL.Query().Get("channel_id")
+	instanceID, status, err := p.apiV3SubscriptionInstance(r, channelID)
+	if err != nil {
+		return respondAPIError(w, status, err)
+	}
+
+	subscriptions, err := p.getSubscriptionsForChannel(instanceID, channelID)
+	if err != nil {
+		return respondAPIError(w, http.StatusInternalServerError, err)
+	}
+	if subscriptions == nil {
+		subscriptions = []ChannelSubscription{}
+	}
+	return respondAPIJSON(w, http.StatusOK, subscriptions)
+}
+
+func (p *Plugin) httpAPIv3CreateSubscription(w http.ResponseWriter, r *http.Request) (int, error) {
+	subscription := ChannelSubscription{}
+	if err := json.NewDecoder(r.Body).Decode(&subscription); err != nil {
+		return respondAPIError(w, http.StatusBadRequest, errors.WithMessage(err, "failed to decode the subscription"))
+	}
+	instanceID, status, err := p.apiV3SubscriptionInstance(r, subscription.ChannelID)
+	if err != nil {
+		return respondAPIError(w, status, err)
+	}
+
+	mattermostUserID := types.ID(r.Header.Get(HeaderMattermostUserID))
+	client, _, _, err := p.getClient(instanceID, mattermostUserID)
+	if err != nil {
+		return respondAPIError(w, apiErrorStatus(err), err)
+	}
+
+	subscription.ID = ""
+	subscription.InstanceID = instanceID
+	subscription.MattermostUserID = mattermostUserID.String()
+	if err = p.addChannelSubscription(instanceID, &subscription, client); err != nil {
+		return respondAPIError(w, http.StatusBadRequest, err)
+	}
+	return respondAPIJSON(w, http.StatusCreated, subscription)
+}
+
+func (p *Plugin) httpAPIv3EditSubscription(w http.ResponseWriter, r *http.Request) (int, error) {
+	subscription := ChannelSubscription{}
+	if err := json.NewDecoder(r.Body).Decode(&subscription); err != nil {
+		return respondAPIError(w, http.StatusBadRequest, errors.WithMessage(err, "failed to decode the subscription"))
+	}
+	subscription.ID = mux.Vars(r)["id"]
+
+	mattermostUserID := types.ID(r.Header.Get(HeaderMattermostUserID))
+	_, instanceID, err := p.ResolveUserInstanceURL(mattermostUserID, r.URL.Query().Get("instance_id"))
+	if err != nil {
+		return respondAPIError(w, apiErrorStatus(err), err)
+	}
+	existing, err := p.getChannelSubscription(instanceID, subscription.ID)
+	if err != nil {
+		return respondAPIError(w, http.StatusNotFound, err)
+	}
+	subscription.ChannelID = existing.ChannelID
+	if _, status, err := p.apiV3SubscriptionInstance(r, existing.ChannelID); err != nil {
+		return respondAPIError(w, status, err)
+	}
+
+	client, _, _, err := p.getClient(instanceID, mattermostUserID)
+	if err != nil {
+		return respondAPIError(w, apiErrorStatus(err), err)
+	}
+
+	subscription.InstanceID = instanceID
+	subscription.MattermostUserID = mattermostUserID.String()
+	if err = p.editChannelSubscription(instanceID, &subscription, client); err != nil {
+		return respondAPIError(w, http.StatusBadRequest, err)
+	}
+	return respondAPIJSON(w, http.StatusOK, subscription)
+}
+
+func (p *Plugin) httpAPIv3DeleteSubscription(w http.ResponseWriter, r *http.Request) (int, error) {
+	mattermostUserID := types.ID(r.Header.Get(HeaderMattermostUserID))
+	_, instanceID, err := p.ResolveUserInstanceURL(mattermostUserID, r.URL.Query().Get("instance_id"))
+	if err != nil {
+		return respondAPIError(w, apiErrorStatus(err), err)
+	}
+
+	subscriptionID := mux.Vars(r)["id"]
+	existing, err := p.getChannelSubscription(instanceID, subscriptionID)
+	if err != nil {
+		return respondAPIError(w, http.StatusNotFound, err)
+	}
+	if _, status, err := p.apiV3SubscriptionInstance(r, existing.ChannelID); err != nil {
+		return respondAPIError(w, status, err)
+	}
+
+	if err = p.removeChannelSubscription(instanceID, subscriptionID); err != nil {
+		return respondAPIError(w, http.StatusInternalServerError, err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return http.StatusNoContent, nil
+}
@@ -0,0 +1,157 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License for license information.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mattermost/mattermost-plugin-jira/server/utils/kvstore"
+)
+
+func setupTestAPIv3(t *testing.T) *Plugin {
+	p, _ := setupTestWebhookQueue(t)
+	api := p.API.(*plugintest.API)
+	for _, method := range []string{"LogWarn", "LogDebug"} {
+		// message, then key value pairs
+		args := []interface{}{mock.AnythingOfType("string")}
+		for i := 0; i < 10; i++ {
+			args = append(args, mock.Anything)
+		}
+		for n := 1; n <= len(args); n += 2 {
+			api.On(method, args[:n]...).Maybe().Return(nil)
+		}
+	}
+	p.userStore = mockUserStore{}
+	p.instanceStore = mockInstanceStore{}
+	p.router = mux.NewRouter()
+	p.initializeAPIv3Router()
+	return p
+}
+
+func TestAPIv3Errors(t *testing.T) {
+	p := setupTestAPIv3(t)
+
+	for name, tc := range map[string]struct {
+		method, path, userID string
+		expectedStatus       int
+	}{
+		"not authorized":     {method: http.MethodGet, path: "/api/v3/issues/TEST-1", expectedStatus: http.StatusUnauthorized},
+		"not connected":      {method: http.MethodGet, path: "/api/v3/issues/TEST-1", userID: "user1", expectedStatus: http.StatusNotFound},
+		"unknown route":      {method: http.MethodGet, path: "/api/v3/unknown", userID: "user1", expectedStatus: http.StatusNotFound},
+		"method not allowed": {method: http.MethodPatch, path: "/api/v3/issues/TEST-1", userID: "user1", expectedStatus: http.StatusMethodNotAllowed},
+		"invalid body":       {method: http.MethodPost, path: "/api/v3/issues", userID: "user1", expectedStatus: http.StatusBadRequest},
+	} {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, tc.path, nil)
+			if tc.userID != "" {
+				r.Header.Set(HeaderMattermostUserID, tc.userID)
+			}
+			w := httptest.NewRecorder()
+			p.router.ServeHTTP(w, r)
+
+			assert.Equal(t, tc.expectedStatus, w.Code)
+			assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+			body := apiErrorResponse{}
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+			assert.Equal(t, tc.expectedStatus, body.Error.Status)
+			assert.NotEmpty(t, body.Error.Message)
+		})
+	}
+}
+
+func TestAPIv3DoesNotShadowDisconnect(t *testing.T) {
+	p := setupTestAPIv3(t)
+	p.initializeRouter()
+
+	r := httptest.NewRequest(http.MethodPost, routeAPIUserDisconnect, strings.NewReader("not json"))
+	r.Header.Set(HeaderMattermostUserID, "user1")
+	w := httptest.NewRecorder()
+	p.router.ServeHTTP(w, r)
+
+	// The payload reaches the disconnect handler, which rejects it.
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Contains(t, w.Body.String(), "failed to unmarshal disconnect payload")
+}
+
+func TestAPIv3Me(t *testing.T) {
+	p := setupTestAPIv3(t)
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v3/me", nil)
+	r.Header.Set(HeaderMattermostUserID, "user1")
+	w := httptest.NewRecorder()
+	p.router.ServeHTTP(w, r)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	status := APIUserStatus{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.Equal(t, "user1", status.MattermostUserID)
+	assert.False(t, status.Connected)
+	assert.Empty(t, status.Connections)
+}
+
+func TestAPIv3OpenAPI(t *testing.T) {
+	p := setupTestAPIv3(t)
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v3/openapi.json", nil)
+	w := httptest.NewRecorder()
+	p.router.ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var doc struct {
+		OpenAPI string                     `json:"openapi"`
+		Paths   map[string]json.RawMessage `json:"paths"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &doc))
+	assert.Equal(t, "3.0.3", doc.OpenAPI)
+
+	// Every route of the API is documented.
+	err := p.router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		tmpl, err := route.GetPathTemplate()
+		if err != nil || tmpl == routeAPIv3 {
+			return nil
+		}
+		path := tmpl[len(routeAPIv3):]
+		if path == routeAPIv3Subscription {
+			path = "/subscriptions/{id}"
+		}
+		assert.Contains(t, doc.Paths, path)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestAPIv3WorklogRecord(t *testing.T) {
+	record, err := (&APIWorklog{TimeSpent: "1h 30m", TimeSpentSeconds: 60, Comment: "review"}).worklogRecord()
+	require.NoError(t, err)
+	assert.Equal(t, 90*60, record.TimeSpentSeconds)
+	assert.Equal(t, "review", record.Comment)
+	assert.Nil(t, record.Started)
+
+	record, err = (&APIWorklog{TimeSpentSeconds: 600}).worklogRecord()
+	require.NoError(t, err)
+	assert.Equal(t, 600, record.TimeSpentSeconds)
+
+	_, err = (&APIWorklog{TimeSpent: "1h review"}).worklogRecord()
+	assert.Error(t, err)
+	_, err = (&APIWorklog{}).worklogRecord()
+	assert.Error(t, err)
+}
+
+func TestAPIErrorStatus(t *testing.T) {
+	assert.Equal(t, http.StatusNotFound, apiErrorStatus(errors.Wrap(kvstore.ErrNotFound, "no instance")))
+	assert.Equal(t, http.StatusForbidden, apiErrorStatus(errWorklogNotOwned))
+	assert.Equal(t, http.StatusBadRequest, apiErrorStatus(RESTError{errors.New("bad"), http.StatusBadRequest}))
+	assert.Equal(t, http.StatusInternalServerError, apiErrorStatus(errors.New("unknown")))
+}
@@ -7,38 +7,56 @@ import (
 	"github.com/mattermost/mattermost-plugin-jira/server/utils/types"
 	"github.com/pkg/errors"
 	"net/http"
-	"slices"
-	"strings"
 )
 
-func (p *Plugin) checkIsAuthBackdoors(handler http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		userID := r.Header.Get("Mattermost-User-ID")
-		if !slices.Contains(strings.Split(p.conf.ListBackdoorsBots, ","), userID) {
-			http.Error(w, "Not authorized", http.StatusUnauthorized)
-			return
-		}
-		handler(w, r)
+func (p *Plugin) getBackdoorClient(r *http.Request) (Client, error) {
+	client, _, err := p.getBackdoorClientConnection(r)
+	return client, err
+}
+
+// backdoorUserID returns the Mattermost user whose Jira connection a backdoor API call uses, the
+// caller. Tokens with the act-for-user scope, and the bots of the deprecated ListBackdoorsBots
+// setting, may act for the user they pass.
+func (p *Plugin) backdoorUserID(r *http.Request, requestedUserID string) (types.ID, error) {
+	callerID := r.Header.Get("Mattermost-User-ID")
+	if requestedUserID == "" || requestedUserID == callerID {
+		return types.ID(callerID), nil
+	}
+	if token := integrationTokenFromRequest(r); token != nil && token.hasScope(ScopeActForUser) {
+		return types.ID(requestedUserID), nil
+	}
+	if p.isLegacyBackdoorBot(callerID) {
+		return types.ID(requestedUserID), nil
 	}
+	return "", errors.Errorf("not authorized to act for user %s", requestedUserID)
 }
 
-func (p *Plugin) getBackdoorClient(r *http.Request) (Client, error) {
+// getBackdoorClientConnection returns the Jira client of the user the call acts for. Its errors
+// are RESTErrors with the status to respond with.
+func (p *Plugin) getBackdoorClientConnection(r *http.Request) (Client, *Connection, error) {
 	instanceID, err := validateQueryKey(r, "instance_id")
 	if err != nil {
-		return nil, err
+		return nil, nil, RESTError{err, http.StatusBadRequest}
 	}
 
-	userID, err := validateQueryKey(r, "user_id")
+	userID, err := p.backdoorUserID(r, r.URL.Query().Get("user_id"))
 	if err != nil {
-		return nil, err
+		return nil, nil, RESTError{err, http.StatusForbidden}
 	}
 
-	client, _, _, err := p.getClient(types.ID(instanceID), types.ID(userID))
+	client, _, connection, err := p.getClient(types.ID(instanceID), userID)
 	if err != nil {
-		return nil, errors.New(fmt.Sprintf("%s not authorizated", userID))
+		return nil, nil, RESTError{errors.New(fmt.Sprintf("%s not authorizated", userID)), http.StatusUnauthorized}
 	}
 
-	return client, nil
+	return client, connection, nil
+}
+
+func respondWorklogErr(w http.ResponseWriter, err error) (int, error) {
+	if errors.Is(err, errWorklogNotOwned) {
+		return respondErr(w, http.StatusForbidden, err)
+	}
+	return respondErr(w, http.StatusInternalServerError, err)
 }
 
 func (p *Plugin) httpBackdoorCheckUserAuth(w http.ResponseWriter, r *http.Request) (int, error) {
@@ -63,7 +81,12 @@ func (p *Plugin) httpBackdoorCreateWorkLog(w http.ResponseWriter, r *http.Reques
 			errors.New("unmarshall the body"))
 	}
 
-	client, _, _, err := p.getClient(types.ID(body.InstanceID), types.ID(body.UserID))
+	userID, err := p.backdoorUserID(r, body.UserID)
+	if err != nil {
+		return respondErr(w, http.StatusForbidden, err)
+	}
+
+	client, _, _, err := p.getClient(types.ID(body.InstanceID), userID)
 	if err != nil {
 		return respondErr(w, http.StatusInternalServerError, err)
 	}
@@ -79,6 +102,85 @@ func (p *Plugin) httpBackdoorCreateWorkLog(w http.ResponseWriter, r *http.Reques
 	return respondJSON(w, workLog)
 }
 
+func (p *Plugin) httpBackdoorListWorkLogs(w http.ResponseWriter, r *http.Request) (int, error) {
+	issueKey, err := validateQueryKey(r, "issue_key")
+	if err != nil {
+		return respondErr(w, http.StatusBadRequest, err)
+	}
+	client, connection, err := p.getBackdoorClientConnection(r)
+	if err != nil {
+		return respondErr(w, StatusCode(err), err)
+	}
+
+	workLogs, err := getOwnWorklogs(client, connection, issueKey)
+	if err != nil {
+		return respondErr(w, http.StatusInternalServerError, err)
+	}
+
+	return respondJSON(w, workLogs)
+}
+
+func (p *Plugin) httpBackdoorUpdateWorkLog(w http.ResponseWriter, r *http.Request) (int, error) {
+	var body struct {
+		InstanceID string `json:"instance_id"`
+		UserID     string `json:"user_id"`
+		IssueKEY   string `json:"issue_key"`
+		WorklogID  string `json:"worklog_id"`
+		Minutes    int    `json:"minutes"`
+		Comment    string `json:"comment"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		return respondErr(w, http.StatusBadRequest,
+			errors.New("unmarshall the body"))
+	}
+	if body.IssueKEY == "" || body.WorklogID == "" || body.Minutes <= 0 {
+		return respondErr(w, http.StatusBadRequest,
+			errors.New("issue_key, worklog_id and positive minutes are required"))
+	}
+
+	userID, err := p.backdoorUserID(r, body.UserID)
+	if err != nil {
+		return respondErr(w, http.StatusForbidden, err)
+	}
+
+	client, _, connection, err := p.getClient(types.ID(body.InstanceID), userID)
+	if err != nil {
+		return respondErr(w, http.StatusUnauthorized, err)
+	}
+
+	workLog, err := updateOwnWorklog(client, connection, body.IssueKEY, body.WorklogID, &jira.WorklogRecord{
+		TimeSpentSeconds: body.Minutes * 60,
+		Comment:          body.Comment,
+	})
+	if err != nil {
+		return respondWorklogErr(w, err)
+	}
+
+	return respondJSON(w, workLog)
+}
+
+func (p *Plugin) httpBackdoorDeleteWorkLog(w http.ResponseWriter, r *http.Request) (int, error) {
+	issueKey, err := validateQueryKey(r, "issue_key")
+	if err != nil {
+		return respondErr(w, http.StatusBadRequest, err)
+	}
+	worklogID, err := validateQueryKey(r, "worklog_id")
+	if err != nil {
+		return respondErr(w, http.StatusBadRequest, err)
+	}
+	client, connection, err := p.getBackdoorClientConnection(r)
+	if err != nil {
+		return respondErr(w, StatusCode(err), err)
+	}
+
+	if err = deleteOwnWorklog(client, connection, issueKey, worklogID); err != nil {
+		return respondWorklogErr(w, err)
+	}
+
+	return respondJSON(w, []string{"OK"})
+}
+
 func (p *Plugin) httpBackdoorGetIssue(w http.ResponseWriter, r *http.Request) (int, error) {
 	issueKey, err := validateQueryKey(r, "issue_key")
 	if err != nil {
@@ -86,7 +188,7 @@ func (p *Plugin) httpBackdoorGetIssue(w http.ResponseWriter, r *http.Request) (i
 	}
 	client, err := p.getBackdoorClient(r)
 	if err != nil {
-		return respondErr(w, http.StatusUnauthorized, err)
+		return respondErr(w, StatusCode(err), err)
 	}
 
 	issue, err := client.GetIssue(issueKey, nil)
@@ -122,7 +224,7 @@ func (p *Plugin) httpBackdoorCheckCreateWorklogIssue(w http.ResponseWriter, r *h
 	}
 	client, err := p.getBackdoorClient(r)
 	if err != nil {
-		return respondErr(w, http.StatusUnauthorized, err)
+		return respondErr(w, StatusCode(err), err)
 	}
 
 	permission, err := client.HasWorkLogPermission(issueKey)
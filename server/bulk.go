@@ -0,0 +1,413 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License for license information.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	jira "github.com/andygrunwald/go-jira"
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+	"github.com/mattermost/mattermost/server/public/pluginapi"
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-plugin-jira/server/utils/types"
+)
+
+const (
+	prefixBulkOperation = "bulk_" // + operation ID, a bulk operation waiting for confirmation
+
+	bulkUsage = "Please use `/jira bulk [JQL] transition [state]`, `/jira bulk [JQL] assign [assignee]` or `/jira bulk [JQL] label +[add] -[remove]`."
+
+	bulkActionTransition = "transition"
+	bulkActionAssign     = "assign"
+	bulkActionLabel      = "label"
+
+	bulkMaxIssues     = 100
+	bulkPreviewIssues = 10
+	bulkWorkers       = 5
+
+	// bulkConfirmTTL is how long a bulk operation can be confirmed after it was requested.
+	bulkConfirmTTL = 15 * time.Minute
+)
+
+var errBulkOperationNotOwned = errors.New("the bulk change was requested by another user")
+
+// BulkOperation is a change to many issues, stored until the user confirms or cancels it.
+type BulkOperation struct {
+	ID               string     `json:"id"`
+	InstanceID       types.ID   `json:"instance_id"`
+	MattermostUserID string     `json:"mattermost_user_id"`
+	ChannelID        string     `json:"channel_id"`
+	RootID           string     `json:"root_id"`
+	JQL              string     `json:"jql"`
+	Action           string     `json:"action"`
+	ToState          string     `json:"to_state,omitempty"`
+	UserSearch       string     `json:"user_search,omitempty"`
+	Assignee         *jira.User `json:"assignee,omitempty"`
+	AddLabels        []string   `json:"add_labels,omitempty"`
+	RemoveLabels     []string   `json:"remove_labels,omitempty"`
+	IssueKeys        []string   `json:"issue_keys"`
+}
+
+type bulkResult struct {
+	IssueKey string
+	Err      error
+}
+
+// parseBulkArgs splits the arguments of /jira bulk into the JQL query and the action. The action
+// is the last transition, assign or label word that is followed by a value, so that the query
+// may use these words too.
+func parseBulkArgs(args []string) (*BulkOperation, error) {
+	for i := len(args) - 2; i > 0; i-- {
+		action := strings.ToLower(args[i])
+		if action != bulkActionTransition && action != bulkActionAssign && action != bulkActionLabel {
+			continue
+		}
+
+		values, err := splitQuotedArgs(strings.Join(args[i+1:], " "))
+		if err != nil {
+			return nil, err
+		}
+		if len(values) == 0 {
+			continue
+		}
+
+		op := &BulkOperation{
+			JQL:    strings.Join(args[:i], " "),
+			Action: action,
+		}
+		switch action {
+		case bulkActionTransition:
+			op.ToState = strings.Join(values, " ")
+		case bulkActionAssign:
+			op.UserSearch = strings.Join(values, " ")
+		case bulkActionLabel:
+			if op.AddLabels, op.RemoveLabels, err = parseBulkLabels(values); err != nil {
+				return nil, err
+			}
+		}
+		return op, nil
+	}
+
+	return nil, errors.New(bulkUsage)
+}
+
+func parseBulkLabels(values []string) (add, remove []string, err error) {
+	for _, value := range values {
+		label := strings.TrimLeft(value, "+-")
+		switch {
+		case label == "":
+			return nil, nil, errors.Errorf("`%s` is not a label", value)
+		case strings.ContainsAny(label, " \t"):
+			return nil, nil, errors.Errorf("the label %q has a space, labels can not have spaces", label)
+		case strings.HasPrefix(value, "+"):
+			add = appendUnique(add, label)
+		case strings.HasPrefix(value, "-"):
+			remove = appendUnique(remove, label)
+		default:
+			return nil, nil, errors.Errorf("`%s` must start with + to add the label or - to remove it", value)
+		}
+	}
+	return add, remove, nil
+}
+
+func makeBulkLabelsUpdate(add, remove []string) map[string]interface{} {
+	var ops []map[string]string
+	for _, label := range add {
+		ops = append(ops, map[string]string{"add": label})
+	}
+	for _, label := range remove {
+		ops = append(ops, map[string]string{"remove": label})
+	}
+	return map[string]interface{}{
+		"update": map[string]interface{}{
+			"labels": ops,
+		},
+	}
+}
+
+func (op *BulkOperation) describe() string {
+	switch op.Action {
+	case bulkActionTransition:
+		return fmt.Sprintf("Transition to `%s`", op.ToState)
+	case bulkActionAssign:
+		return fmt.Sprintf("Assign to `%s`", op.UserSearch)
+	default:
+		var changes []string
+		if len(op.AddLabels) > 0 {
+			changes = append(changes, "add `"+strings.Join(op.AddLabels, "`, `")+"`")
+		}
+		if len(op.RemoveLabels) > 0 {
+			changes = append(changes, "remove `"+strings.Join(op.RemoveLabels, "`, `")+"`")
+		}
+		return "Labels: " + strings.Join(changes, ", ")
+	}
+}
+
+// runBulk calls apply for every issue key with at most workers calls running at once, and
+// returns the results in the order of the keys.
+func runBulk(issueKeys []string, workers int, apply func(issueKey string) error) []bulkResult {
+	results := make([]bulkResult, len(issueKeys))
+	indexes := make(chan int)
+
+	wg := sync.WaitGroup{}
+	for w := 0; w < workers && w < len(issueKeys); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				results[i] = bulkResult{IssueKey: issueKeys[i], Err: apply(issueKeys[i])}
+			}
+		}()
+	}
+	for i := range issueKeys {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	return results
+}
+
+func makeBulkSummary(op *BulkOperation, baseURL string, results []bulkResult) string {
+	failed := 0
+	lines := ""
+	for _, result := range results {
+		link := fmt.Sprintf("[%s](%s/browse/%s)", result.IssueKey, baseURL, result.IssueKey)
+		if result.Err != nil {
+			failed++
+			lines += fmt.Sprintf("* :x: %s: %v\n", link, result.Err)
+			continue
+		}
+		lines += fmt.Sprintf("* :white_check_mark: %s\n", link)
+	}
+
+	return fmt.Sprintf("#### Bulk change of `%s`\n%s: %d of %d issues updated, %d failed.\n%s",
+		op.JQL, op.describe(), len(results)-failed, len(results), failed, lines)
+}
+
+func (p *Plugin) loadBulkOperation(id string) (*BulkOperation, []byte, error) {
+	var data []byte
+	if err := p.client.KV.Get(prefixBulkOperation+id, &data); err != nil {
+		return nil, nil, err
+	}
+	if len(data) == 0 {
+		return nil, nil, errors.New("this bulk change has expired, please run the command again")
+	}
+	op := &BulkOperation{}
+	if err := json.Unmarshal(data, op); err != nil {
+		return nil, nil, err
+	}
+	return op, data, nil
+}
+
+// claimBulkOperation takes the pending bulk change of the user out of the store, so that it is
+// applied once even if it is confirmed twice at the same time.
+func (p *Plugin) claimBulkOperation(id, mattermostUserID string) (*BulkOperation, error) {
+	op, data, err := p.loadBulkOperation(id)
+	if err != nil {
+		return nil, err
+	}
+	if op.MattermostUserID != mattermostUserID {
+		return nil, errBulkOperationNotOwned
+	}
+	claimed, err := p.client.KV.Set(prefixBulkOperation+id, nil, pluginapi.SetAtomic(data))
+	if err != nil {
+		return nil, err
+	}
+	if !claimed {
+		return nil, errors.New("this bulk change was already confirmed or cancelled")
+	}
+	return op, nil
+}
+
+func (p *Plugin) applyBulkOperation(op *BulkOperation) ([]bulkResult, string, error) {
+	client, instance, _, err := p.getClient(op.InstanceID, types.ID(op.MattermostUserID))
+	if err != nil {
+		return nil, "", err
+	}
+
+	apply := func(issueKey string) error {
+		switch op.Action {
+		case bulkActionTransition:
+			_, err := p.TransitionIssue(&InTransitionIssue{
+				mattermostUserID: types.ID(op.MattermostUserID),
+				InstanceID:       op.InstanceID,
+				IssueKey:         issueKey,
+				ToState:          op.ToState,
+			})
+			return err
+		case bulkActionAssign:
+			_, err := p.AssignIssue(instance, types.ID(op.MattermostUserID), issueKey, op.UserSearch, op.Assignee)
+			return err
+		default:
+			if err := client.UpdateIssue(issueKey, makeBulkLabelsUpdate(op.AddLabels, op.RemoveLabels)); err != nil {
+				return err
+			}
+			p.issueCache.invalidate(op.InstanceID, issueKey)
+			return nil
+		}
+	}
+
+	return runBulk(op.IssueKeys, bulkWorkers, apply), instance.GetJiraBaseURL(), nil
+}
+
+func (p *Plugin) makeBulkConfirmationPost(op *BulkOperation, issues []jira.Issue, baseURL string) *model.Post {
+	preview := ""
+	for i, issue := range issues {
+		if i == bulkPreviewIssues {
+			preview += fmt.Sprintf("* and %d more\n", len(issues)-bulkPreviewIssues)
+			break
+		}
+		summary := ""
+		if issue.Fields != nil {
+			summary = issue.Fields.Summary
+		}
+		preview += fmt.Sprintf("* [%s](%s/browse/%s) %s\n", issue.Key, baseURL, issue.Key, summary)
+	}
+
+	integration := func(confirm bool) *model.PostActionIntegration {
+		return &model.PostActionIntegration{
+			URL: fmt.Sprintf("/plugins/%s%s%s", manifest.Id, routeAPI, routeAPIBulkConfirm),
+			Context: map[string]interface{}{
+				"bulk_id": op.ID,
+				"confirm": confirm,
+			},
+		}
+	}
+
+	post := makePost(p.getUserID(), op.ChannelID, "")
+	post.RootId = op.RootID
+	post.AddProp("attachments", []*model.SlackAttachment{{
+		Title: fmt.Sprintf("%s for %d issues?", op.describe(), len(issues)),
+		Text:  preview,
+		Actions: []*model.PostAction{
+			{Name: "Confirm", Type: model.PostActionTypeButton, Style: "primary", Integration: integration(true)},
+			{Name: "Cancel", Type: model.PostActionTypeButton, Integration: integration(false)},
+		},
+	}})
+	return post
+}
+
+// searchBulkIssues returns the issues matching jql, which are all changed at once.
+func searchBulkIssues(client Client, jql string) ([]jira.Issue, error) {
+	issues, total, err := client.SearchIssuesPage(jql, &jira.SearchOptions{
+		MaxResults: bulkMaxIssues,
+		Fields:     []string{"key", "summary"},
+	})
+	if err != nil {
+		return nil, errors.Errorf("Failed to run the JQL query. Error: %v.", err)
+	}
+	if total == 0 || len(issues) == 0 {
+		return nil, errors.Errorf("No issues match `%s`.", jql)
+	}
+	if total > bulkMaxIssues {
+		return nil, errors.Errorf("%d issues match `%s`, more than the %d that can be changed at once. Please narrow the query.",
+			total, jql, bulkMaxIssues)
+	}
+	// Jira may return fewer issues than asked for, the change is only offered for all of them.
+	if len(issues) < total {
+		return nil, errors.Errorf("Jira returned %d of the %d issues matching `%s`. Please narrow the query.",
+			len(issues), total, jql)
+	}
+	return issues, nil
+}
+
+func executeBulk(p *Plugin, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	instanceURL, args, err := p.parseCommandFlagInstanceURL(args)
+	if err != nil {
+		return p.responsef(header, "Failed to load your connection to Jira. Error: %v.", err)
+	}
+	op, err := parseBulkArgs(args)
+	if err != nil {
+		return p.responsef(header, "%v", err)
+	}
+
+	client, instance, _, err := p.getCommandClient(header, instanceURL)
+	if err != nil {
+		return p.responsef(header, "%v", err)
+	}
+	if op.Action == bulkActionAssign && strings.HasPrefix(op.UserSearch, "@") {
+		op.Assignee, err = p.GetJiraUserFromMentions(instance.GetID(), header.UserMentions, op.UserSearch)
+		if err != nil {
+			return p.responsef(header, "%v", err)
+		}
+	}
+
+	issues, err := searchBulkIssues(client, op.JQL)
+	if err != nil {
+		return p.responsef(header, "%v", err)
+	}
+
+	op.ID = model.NewId()
+	op.InstanceID = instance.GetID()
+	op.MattermostUserID = header.UserId
+	op.ChannelID = header.ChannelId
+	op.RootID = header.RootId
+	for _, issue := range issues {
+		op.IssueKeys = append(op.IssueKeys, issue.Key)
+	}
+	if _, err = p.client.KV.Set(prefixBulkOperation+op.ID, op, pluginapi.SetExpiry(bulkConfirmTTL)); err != nil {
+		return p.responsef(header, "Failed to save the bulk change. Error: %v.", err)
+	}
+
+	p.client.Post.SendEphemeralPost(header.UserId, p.makeBulkConfirmationPost(op, issues, instance.GetJiraBaseURL()))
+	return &model.CommandResponse{}
+}
+
+func (p *Plugin) httpBulkConfirm(w http.ResponseWriter, r *http.Request) (int, error) {
+	var requestData model.PostActionIntegrationRequest
+	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
+		return respondErr(w, http.StatusBadRequest, errors.New("unmarshall the body"))
+	}
+
+	jiraBotID := p.getUserID()
+	channelID := requestData.ChannelId
+	mattermostUserID := r.Header.Get("Mattermost-User-Id")
+
+	bulkID, _ := requestData.Context["bulk_id"].(string)
+	confirm, _ := requestData.Context["confirm"].(bool)
+
+	op, err := p.claimBulkOperation(bulkID, mattermostUserID)
+	if errors.Is(err, errBulkOperationNotOwned) {
+		return p.respondErrWithFeedback(mattermostUserID, makePost(jiraBotID, channelID,
+			"Only the user who requested this bulk change can confirm it."), w, http.StatusForbidden)
+	}
+	if err != nil {
+		return p.respondErrWithFeedback(mattermostUserID, makePost(jiraBotID, channelID, err.Error()), w, http.StatusNotFound)
+	}
+
+	p.client.Post.DeleteEphemeralPost(mattermostUserID, requestData.PostId)
+	if !confirm {
+		return respondJSON(w, &model.PostActionIntegrationResponse{})
+	}
+
+	go func() {
+		results, baseURL, err := p.applyBulkOperation(op)
+		msg := ""
+		if err != nil {
+			msg = fmt.Sprintf("Failed to apply the bulk change of `%s`. Error: %v.", op.JQL, err)
+		} else {
+			msg = makeBulkSummary(op, baseURL, results)
+		}
+
+		_, _, conn, err := p.getClient(op.InstanceID, types.ID(op.MattermostUserID))
+		if err == nil && p.createNotificationPost(op.ChannelID, op.MattermostUserID, msg, conn, op.RootID) == nil {
+			return
+		}
+		post := makePost(jiraBotID, op.ChannelID, msg)
+		post.RootId = op.RootID
+		p.client.Post.SendEphemeralPost(op.MattermostUserID, post)
+	}()
+
+	return respondJSON(w, &model.PostActionIntegrationResponse{
+		EphemeralText: fmt.Sprintf("Updating %d issues, a summary will follow.", len(op.IssueKeys)),
+	})
+}
@@ -0,0 +1,138 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License for license information.
+
+package main
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	jira "github.com/andygrunwald/go-jira"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseBulkArgs(t *testing.T) {
+	for name, tc := range map[string]struct {
+		command     string
+		expected    *BulkOperation
+		expectedErr string
+	}{
+		"transition": {
+			command:  `project = PROJ AND status = "To Do" transition "In Progress"`,
+			expected: &BulkOperation{JQL: `project = PROJ AND status = "To Do"`, Action: bulkActionTransition, ToState: "In Progress"},
+		},
+		"assign": {
+			command:  `assignee is EMPTY assign @user`,
+			expected: &BulkOperation{JQL: `assignee is EMPTY`, Action: bulkActionAssign, UserSearch: "@user"},
+		},
+		"labels": {
+			command:  `labels = label label +triaged -new +triaged`,
+			expected: &BulkOperation{JQL: `labels = label`, Action: bulkActionLabel, AddLabels: []string{"triaged"}, RemoveLabels: []string{"new"}},
+		},
+		"no action":        {command: `project = PROJ`, expectedErr: bulkUsage},
+		"no jql":           {command: `transition Done`, expectedErr: bulkUsage},
+		"unsigned label":   {command: `project = PROJ label triaged`, expectedErr: "`triaged` must start with + to add the label or - to remove it"},
+		"empty label":      {command: `project = PROJ label +`, expectedErr: "`+` is not a label"},
+		"label with space": {command: `project = PROJ label "+a b"`, expectedErr: `the label "a b" has a space, labels can not have spaces`},
+	} {
+		t.Run(name, func(t *testing.T) {
+			op, err := parseBulkArgs(strings.Fields(tc.command))
+			if tc.expectedErr != "" {
+				require.EqualError(t, err, tc.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, op)
+		})
+	}
+}
+
+func TestMakeBulkLabelsUpdate(t *testing.T) {
+	assert.Equal(t, map[string]interface{}{
+		"update": map[string]interface{}{
+			"labels": []map[string]string{{"add": "a"}, {"remove": "b"}},
+		},
+	}, makeBulkLabelsUpdate([]string{"a"}, []string{"b"}))
+}
+
+func TestRunBulk(t *testing.T) {
+	keys := []string{"PROJ-1", "PROJ-2", "PROJ-3", "PROJ-4", "PROJ-5"}
+
+	var running, maxRunning int32
+	results := runBulk(keys, 2, func(issueKey string) error {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			m := atomic.LoadInt32(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+				break
+			}
+		}
+		if issueKey == "PROJ-3" {
+			return errors.New("no permission")
+		}
+		return nil
+	})
+
+	require.Len(t, results, len(keys))
+	assert.LessOrEqual(t, maxRunning, int32(2))
+	for i, result := range results {
+		assert.Equal(t, keys[i], result.IssueKey)
+		if result.IssueKey == "PROJ-3" {
+			assert.EqualError(t, result.Err, "no permission")
+		} else {
+			assert.NoError(t, result.Err)
+		}
+	}
+
+	summary := makeBulkSummary(&BulkOperation{JQL: "project = PROJ", Action: bulkActionTransition, ToState: "Done"}, "https://jira.example.com", results)
+	assert.Contains(t, summary, "Transition to `Done`: 4 of 5 issues updated, 1 failed.")
+	assert.Contains(t, summary, "* :x: [PROJ-3](https://jira.example.com/browse/PROJ-3): no permission")
+}
+
+func TestClaimBulkOperation(t *testing.T) {
+	p, _ := setupTestWebhookQueue(t)
+	op := &BulkOperation{ID: "bulk1", MattermostUserID: "user1", JQL: "project = PROJ", Action: bulkActionAssign}
+	_, err := p.client.KV.Set(prefixBulkOperation+op.ID, op)
+	require.NoError(t, err)
+
+	_, err = p.claimBulkOperation(op.ID, "user2")
+	assert.ErrorIs(t, err, errBulkOperationNotOwned)
+
+	claimed, err := p.claimBulkOperation(op.ID, "user1")
+	require.NoError(t, err)
+	assert.Equal(t, op.JQL, claimed.JQL)
+
+	_, err = p.claimBulkOperation(op.ID, "user1")
+	assert.Error(t, err, "a bulk change is applied once")
+}
+
+type bulkTestClient struct {
+	testClient
+	issues []jira.Issue
+	total  int
+}
+
+func (client bulkTestClient) SearchIssuesPage(jql string, options *jira.SearchOptions) ([]jira.Issue, int, error) {
+	return client.issues, client.total, nil
+}
+
+func TestSearchBulkIssues(t *testing.T) {
+	page := []jira.Issue{{Key: "PROJ-1"}, {Key: "PROJ-2"}}
+
+	issues, err := searchBulkIssues(bulkTestClient{issues: page, total: 2}, "project = PROJ")
+	require.NoError(t, err)
+	assert.Equal(t, page, issues)
+
+	_, err = searchBulkIssues(bulkTestClient{}, "project = PROJ")
+	assert.EqualError(t, err, "No issues match `project = PROJ`.")
+
+	_, err = searchBulkIssues(bulkTestClient{issues: page, total: 5000}, "project = PROJ")
+	assert.EqualError(t, err, "5000 issues match `project = PROJ`, more than the 100 that can be changed at once. Please narrow the query.")
+
+	_, err = searchBulkIssues(bulkTestClient{issues: page, total: 3}, "project = PROJ")
+	assert.Error(t, err, "only some of the issues were returned")
+}
@@ -47,6 +47,9 @@ type RESTService interface {
 	RESTGet(endpoint string, params map[string]string, dest interface{}) error
 	RESTPostAttachment(issueID string, data io.Reader, name string) (*jira.Attachment, error)
 	createWorkLog(issueID string, record *jira.WorklogRecord) (*jira.WorklogRecord, *jira.Response, error)
+	getWorkLog(issueID, worklogID string) (*jira.WorklogRecord, *jira.Response, error)
+	updateWorkLog(issueID, worklogID string, record *jira.WorklogRecord) (*jira.WorklogRecord, *jira.Response, error)
+	deleteWorkLog(issueID, worklogID string) (*jira.Response, error)
 	getEditMeta(issueKey string) (*EditMeta, error)
 }
 
@@ -68,6 +71,7 @@ type ProjectService interface {
 // SearchService is the interface for search-related APIs.
 type SearchService interface {
 	SearchIssues(jql string, options *jira.SearchOptions) ([]jira.Issue, error)
+	SearchIssuesPage(jql string, options *jira.SearchOptions) ([]jira.Issue, int, error)
 	SearchUsersAssignableToIssue(issueKey, query string, maxResults int) ([]jira.User, error)
 	SearchUsersAssignableInProject(projectKey, query string, maxResults int) ([]jira.User, error)
 	SearchAutoCompleteFields(params map[string]string) (*AutoCompleteResult, error)
@@ -80,14 +84,21 @@ type IssueService interface {
 
 	AddAttachment(mmClient pluginapi.Client, issueKey, fileID string, maxSize utils.ByteSize) (mattermostName, jiraName, mime string, err error)
 	AddComment(issueKey string, comment *jira.Comment) (*jira.Comment, error)
+	DeleteComment(issueKey, commentID string) error
 	DoTransition(issueKey, transitionID, resolution string) error
 	GetCreateMetaInfo(api plugin.API, options *jira.GetQueryOptions) (*jira.CreateMetaInfo, error)
 	GetTransitions(issueKey string) ([]jira.Transition, error)
 	UpdateAssignee(issueKey string, user *jira.User) error
+	AddWatcher(issueKey string, user *jira.User) error
+	RemoveWatcher(issueKey string, user *jira.User) error
+	GetWatchers(issueKey string) ([]jira.User, error)
+	GetPriorities() ([]jira.Priority, error)
 	UpdateComment(issueKey string, comment *jira.Comment) (*jira.Comment, error)
+	UpdateIssue(issueKey string, data map[string]interface{}) error
 	getResolutions() ([]jira.Resolution, error)
 	getDoneTransition(issueKey string) (*jira.Transition, error)
 	HasWorkLogPermission(issueKey string) (bool, error)
+	GetWorklogs(issueKey string) ([]jira.WorklogRecord, error)
 }
 
 // JiraClient is the common implementation of most Jira APIs, except those that are
@@ -237,6 +248,72 @@ func (client JiraClient) UpdateAssignee(issueKey string, user *jira.User) error
 	return err
 }
 
+// AddWatcher makes a user watch an issue. Jira Cloud identifies the user by account ID, Jira
+// Server by name.
+func (client JiraClient) AddWatcher(issueKey string, user *jira.User) error {
+	userID := user.AccountID
+	if userID == "" {
+		userID = user.Name
+	}
+	req, err := client.Jira.NewRequest(http.MethodPost, fmt.Sprintf("rest/api/2/issue/%s/watchers", issueKey), userID)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Jira.Do(req, nil)
+	if err != nil {
+		return userFriendlyJiraError(resp, err)
+	}
+	return nil
+}
+
+// RemoveWatcher stops a user watching an issue. Unlike the go-jira implementation it passes
+// the user as a query parameter, which is where Jira expects it.
+func (client JiraClient) RemoveWatcher(issueKey string, user *jira.User) error {
+	req, err := client.Jira.NewRequest(http.MethodDelete, fmt.Sprintf("rest/api/2/issue/%s/watchers", issueKey), nil)
+	if err != nil {
+		return err
+	}
+	q := req.URL.Query()
+	if user.AccountID != "" {
+		q.Add("accountId", user.AccountID)
+	} else {
+		q.Add("username", user.Name)
+	}
+	req.URL.RawQuery = q.Encode()
+
+	resp, err := client.Jira.Do(req, nil)
+	if err != nil {
+		return userFriendlyJiraError(resp, err)
+	}
+	return nil
+}
+
+// GetWatchers returns the users watching an issue. Unlike the go-jira implementation it does
+// not load each watcher again, the watchers list has the account IDs and names already.
+func (client JiraClient) GetWatchers(issueKey string) ([]jira.User, error) {
+	req, err := client.Jira.NewRequest(http.MethodGet, fmt.Sprintf("rest/api/2/issue/%s/watchers", issueKey), nil)
+	if err != nil {
+		return nil, err
+	}
+	result := struct {
+		Watchers []jira.User `json:"watchers"`
+	}{}
+	resp, err := client.Jira.Do(req, &result)
+	if err != nil {
+		return nil, userFriendlyJiraError(resp, err)
+	}
+	return result.Watchers, nil
+}
+
+// GetPriorities returns the issue priorities of the instance.
+func (client JiraClient) GetPriorities() ([]jira.Priority, error) {
+	priorities, resp, err := client.Jira.Priority.GetList()
+	if err != nil {
+		return nil, userFriendlyJiraError(resp, err)
+	}
+	return priorities, nil
+}
+
 // AddComment adds a comment to an issue.
 func (client JiraClient) AddComment(issueKey string, comment *jira.Comment) (*jira.Comment, error) {
 	added, resp, err := client.Jira.Issue.AddComment(issueKey, comment)
@@ -246,6 +323,22 @@ func (client JiraClient) AddComment(issueKey string, comment *jira.Comment) (*ji
 	return added, err
 }
 
+// DeleteComment removes a comment from an issue. Unlike the go-jira implementation it returns
+// the response of Jira with the error.
+func (client JiraClient) DeleteComment(issueKey, commentID string) error {
+	req, err := client.Jira.NewRequest(http.MethodDelete,
+		fmt.Sprintf("rest/api/2/issue/%s/comment/%s", url.PathEscape(issueKey), url.PathEscape(commentID)), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Jira.Do(req, nil)
+	if err != nil {
+		return userFriendlyJiraError(resp, err)
+	}
+	return nil
+}
+
 // UpdateComment changes a comment of an issue.
 func (client JiraClient) UpdateComment(issueKey string, comment *jira.Comment) (*jira.Comment, error) {
 	updated, resp, err := client.Jira.Issue.UpdateComment(issueKey, comment)
@@ -255,6 +348,15 @@ func (client JiraClient) UpdateComment(issueKey string, comment *jira.Comment) (
 	return updated, err
 }
 
+// UpdateIssue edits an issue, data holds the "fields" and "update" operations of the Jira API.
+func (client JiraClient) UpdateIssue(issueKey string, data map[string]interface{}) error {
+	resp, err := client.Jira.Issue.UpdateIssue(issueKey, data)
+	if err != nil {
+		return userFriendlyJiraError(resp, err)
+	}
+	return nil
+}
+
 // SearchIssues searches issues as specified by jql and options.
 func (client JiraClient) SearchIssues(jql string, options *jira.SearchOptions) ([]jira.Issue, error) {
 	found, resp, err := client.Jira.Issue.Search(jql, options)
@@ -267,6 +369,19 @@ func (client JiraClient) SearchIssues(jql string, options *jira.SearchOptions) (
 	return found, nil
 }
 
+// SearchIssuesPage searches one page of the issues as specified by jql and options, and returns
+// the number of issues the jql matches in total. Jira may return fewer issues than asked for.
+func (client JiraClient) SearchIssuesPage(jql string, options *jira.SearchOptions) ([]jira.Issue, int, error) {
+	found, resp, err := client.Jira.Issue.Search(jql, options)
+	if err != nil {
+		if resp != nil && (resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusUnauthorized) {
+			return nil, 0, errors.New("not authorized to search issues")
+		}
+		return nil, 0, userFriendlyJiraError(resp, err)
+	}
+	return found, resp.Total, nil
+}
+
 type Result struct {
 	Value       string `json:"value"`
 	DisplayName string `json:"displayName"`
@@ -5,8 +5,8 @@ import (
 	"fmt"
 	"net/url"
 	"sort"
-	"strconv"
 	"strings"
+	"time"
 
 	jira "github.com/andygrunwald/go-jira"
 	"github.com/pkg/errors"
@@ -27,6 +27,7 @@ var jiraCommandHandler = CommandHandler{
 	handlers: map[string]CommandHandlerFunc{
 		"assign":                       executeAssign,
 		"connect":                      executeConnect,
+		"create":                       executeCreate,
 		"disconnect":                   executeDisconnect,
 		"help":                         executeHelp,
 		"me":                           executeMe,
@@ -46,6 +47,7 @@ var jiraCommandHandler = CommandHandler{
 		"instance/uninstall":           executeInstanceUninstall,
 		"instance/v2":                  executeInstanceV2Legacy,
 		"issue/assign":                 executeAssign,
+		"issue/create":                 executeCreate,
 		"issue/transition":             executeTransition,
 		"issue/unassign":               executeUnassign,
 		"issue/view":                   executeView,
@@ -56,11 +58,51 @@ var jiraCommandHandler = CommandHandler{
 		"view":                         executeView,
 		"v2revert":                     executeV2Revert,
 		"webhook":                      executeWebhookURL,
+		"webhook/failed":               executeWebhookFailedList,
+		"webhook/failed/list":          executeWebhookFailedList,
+		"webhook/failed/replay":        executeWebhookFailedReplay,
+		"webhook/failed/delete":        executeWebhookFailedDelete,
 		"setup":                        executeSetup,
 		"worklog":                      executeWorkLog,
 		"issue/worklog":                executeWorkLog,
+		"worklog/report":               executeWorkLogReport,
+		"issue/worklog/report":         executeWorkLogReport,
+		"worklog/list":                 executeWorkLogList,
+		"issue/worklog/list":           executeWorkLogList,
+		"worklog/edit":                 executeWorkLogEdit,
+		"issue/worklog/edit":           executeWorkLogEdit,
+		"worklog/delete":               executeWorkLogDelete,
+		"issue/worklog/delete":         executeWorkLogDelete,
 		"resolution":                   executeResolution,
 		"issue/resolution":             executeResolution,
+		"digest/add":                   executeDigestAdd,
+		"digest/list":                  executeDigestList,
+		"digest/edit":                  executeDigestEdit,
+		"digest/delete":                executeDigestDelete,
+		"timer/start":                  executeTimerStart,
+		"timer/stop":                   executeTimerStop,
+		"timer/status":                 executeTimerStatus,
+		"template/add":                 executeTemplateAdd,
+		"template/list":                executeTemplateList,
+		"template/delete":              executeTemplateDelete,
+		"thread/link":                  executeThreadLink,
+		"thread/unlink":                executeThreadUnlink,
+		"unfurl":                       executeUnfurl,
+		"bulk":                         executeBulk,
+		"watch":                        executeWatch,
+		"issue/watch":                  executeWatch,
+		"unwatch":                      executeUnwatch,
+		"issue/unwatch":                executeUnwatch,
+		"watching":                     executeWatching,
+		"token/create":                 executeTokenCreate,
+		"token/list":                   executeTokenList,
+		"token/revoke":                 executeTokenRevoke,
+		"token/audit":                  executeTokenAudit,
+		"encryption/rotate":            executeEncryptionRotate,
+		"encryption/status":            executeEncryptionStatus,
+		"subscribe/transfer":           executeSubscribeTransfer,
+		"subscribe/delete":             executeSubscribeDelete,
+		"subscribe/orphaned":           executeSubscribeOrphaned,
 	},
 	defaultHandler: executeJiraDefault,
 }
@@ -71,12 +113,34 @@ const commonHelpText = "\n" +
 	"* `/jira connect [jiraURL]` - Connect your Mattermost account to your Jira account\n" +
 	"* `/jira disconnect [jiraURL]` - Disconnect your Mattermost account from your Jira account\n" +
 	"* `/jira [issue] assign [issue-key] [assignee]` - Change the assignee of a Jira issue\n" +
-	//"* `/jira [issue] create [text]` - Create a new Issue with 'text' inserted into the description field\n" +
+	"* `/jira [issue] create [project-key] [issue-type] \"[summary]\" [--priority P] [--assignee @user] [--labels a,b] [--component C] [--description \"text\"] [--field name=value]` - Create an issue, a dialog asks for the other required fields\n" +
 	"* `/jira [issue] transition [issue-key] [state]` - Change the state of a Jira issue\n" +
+	"* `/jira bulk [JQL] transition [state]`, `/jira bulk [JQL] assign [assignee]` or `/jira bulk [JQL] label +[add] -[remove]` - Change up to 100 issues matching a JQL query at once, after a confirmation\n" +
 	"* `/jira [issue] unassign [issue-key]` - Unassign the Jira issue\n" +
 	"* `/jira [issue] view [issue-key]` - View the details of a specific Jira issue\n" +
-	"* `/jira [issue] worklog [issue-key] [minutes]` - Record labour costs in minutes per issue\n" +
+	"* `/jira [issue] watch [issue-key]` - Watch an issue, its changes are sent to you as direct messages\n" +
+	"* `/jira [issue] unwatch [issue-key]` - Stop watching an issue\n" +
+	"* `/jira watching` - List the issues you watch\n" +
+	"* `/jira [issue] worklog [issue-key] [duration] [comment] [--started=YYYY-MM-DDTHH:MM]` - Log work on an issue, [duration] is minutes or Jira time like `1h 30m` or `2d`\n" +
+	"* `/jira [issue] worklog report [today|week|YYYY-MM-DD..YYYY-MM-DD]` - Show the work you logged per day and issue\n" +
+	"* `/jira [issue] worklog list [issue-key]` - List the work you logged on an issue\n" +
+	"* `/jira [issue] worklog edit [issue-key] [worklog-id] [duration] [comment] [--started=YYYY-MM-DDTHH:MM]` - Change one of your worklogs\n" +
+	"* `/jira [issue] worklog delete [issue-key] [worklog-id]` - Delete one of your worklogs\n" +
+	"* `/jira timer start [issue-key]` - Start a timer on an issue\n" +
+	"* `/jira timer stop [comment]` - Stop your timer and log the elapsed time on its issue\n" +
+	"* `/jira timer status` - Show your running timer\n" +
+	"* `/jira create --template [name] [text]` - Create an issue from a template, [text] fills its `{text}` placeholder or is the summary\n" +
+	"* `/jira template add [name] [project-key] [issue-type] \"[summary]\" [--description \"text\"] [--priority P] [--labels a,b] [--component C] [--field name=value] [--global]` - Save an issue template for this channel, or for every channel with `--global` (admins). The summary, description and field values may use `{text}`, `{user}`, `{user_name}`, `{channel}`, `{team}`, `{date}`, `{post}` and `{post_link}`\n" +
+	"* `/jira template list` - List the issue templates of this channel\n" +
+	"* `/jira template delete [name] [--global]` - Delete an issue template\n" +
+	"* `/jira thread link [issue-key]` - Run in a thread to sync its replies with the comments of an issue\n" +
+	"* `/jira thread unlink` - Run in a linked thread to stop syncing it\n" +
+	"* `/jira unfurl [on|off]` - Turn the previews of the Jira issues mentioned in this channel on or off\n" +
 	"* `/jira [issue] resolution [issue-key] [resolution]` - Move issue to Done status with a resolution.\n" +
+	"* `/jira digest add [daily|weekdays|mon,wed,...] [HH:MM] [JQL]` - Post the results of a JQL query to this channel on a schedule\n" +
+	"* `/jira digest list` - List the digests of this channel\n" +
+	"* `/jira digest edit [id] schedule [days] [HH:MM]` or `/jira digest edit [id] jql [JQL]` - Change a digest, a new JQL query runs with your Jira account\n" +
+	"* `/jira digest delete [id]` - Delete a digest\n" +
 	"* `/jira help` - Launch the Jira plugin command line help syntax\n" +
 	"* `/jira me` - Display information about the current user\n" +
 	"* `/jira about` - Display build info\n" +
@@ -84,6 +148,10 @@ const commonHelpText = "\n" +
 	"* `/jira instance settings [setting] [value]` - Update your user settings\n" +
 	"  * [setting] can be `notifications`\n" +
 	"  * [value] can be `on` or `off`\n" +
+	"* `/jira settings events [kind] [on|off]` - Choose which kinds of notifications you receive\n" +
+	"* `/jira settings mute|unmute [project-key]` - Stop or resume notifications for the issues of a project\n" +
+	"* `/jira settings quiet_hours [HH:MM-HH:MM|off]` - Hold notifications back during quiet hours, in your timezone\n" +
+	"* `/jira settings digest [days] [HH:MM|off]` - Receive your notifications together at a time of day instead of right away\n" +
 	""
 
 const sysAdminHelpText = "\n###### For System Administrators:\n" +
@@ -97,11 +165,25 @@ const sysAdminHelpText = "\n###### For System Administrators:\n" +
 	"* `/jira instance uninstall cloud [jiraURL]` - Disconnect Mattermost from a Jira Cloud instance located at <jiraURL>\n" +
 	"Manage channel subscriptions:\n" +
 	"* `/jira subscribe ` - Configure the Jira notifications sent\n" +
+	"* `/jira subscribe transfer [id|all] @user [--instance=<jiraURL>]` - Take over a subscription, or all the subscriptions of this channel, system administrators can give them to any user connected to Jira\n" +
+	"* `/jira subscribe delete [id] [--instance=<jiraURL>]` - Delete a subscription\n" +
+	"* `/jira subscribe orphaned` - List the subscriptions that stopped posting because their owner is deactivated or disconnected\n" +
 	"Other:\n" +
 	"* `/jira instance alias [URL] [alias-name]` - assign an alias to an instance\n" +
 	"* `/jira instance unalias [alias-name]` - remve an alias from an instance\n" +
 	"* `/jira instance v2 <jiraURL>` - Set the Jira instance to process \"v2\" webhooks and subscriptions (not prefixed with the instance ID)\n" +
 	"* `/jira webhook [--instance=<jiraURL>]` -  Show the Mattermost webhook to receive JQL queries\n" +
+	"* `/jira webhook failed list` - List the webhook events that failed to process after all retries\n" +
+	"* `/jira webhook failed replay [id|all]` - Process failed webhook events again\n" +
+	"* `/jira webhook failed delete [id|all]` - Discard failed webhook events\n" +
+	"Manage the integration tokens of the backdoor API:\n" +
+	"* `/jira token create [name] [scope,scope,...|all]` - Create a token, scopes are `check-user`, `read-issue`, `get-project`, `create-worklog`, `manage-worklog` and `act-for-user`, which lets the calls act for the `user_id` they pass\n" +
+	"* `/jira token list` - List the integration tokens\n" +
+	"* `/jira token revoke [id|name]` - Revoke an integration token\n" +
+	"* `/jira token audit [id|name] [count]` - Show the most recent backdoor API calls\n" +
+	"Manage the encryption of the stored credentials:\n" +
+	"* `/jira encryption rotate` - Encrypt the stored OAuth tokens and instance secrets with a new key\n" +
+	"* `/jira encryption status` - Show the version of the key the credentials are encrypted with\n" +
 	"* `/jira v2revert ` - Revert to V2 jira plugin data model\n" +
 	""
 
@@ -149,12 +231,22 @@ func (p *Plugin) createJiraCommand(enableAutocomplete, enableOptInstance bool) (
 
 func addSubCommands(jira *model.AutocompleteData, optInstance bool) {
 	// Top-level common commands
+	jira.AddCommand(createCreateIssueCommand(optInstance))
 	jira.AddCommand(createViewCommand(optInstance))
 	jira.AddCommand(createTransitionCommand(optInstance))
 	jira.AddCommand(createAssignCommand(optInstance))
 	jira.AddCommand(createUnassignCommand(optInstance))
 	jira.AddCommand(createWorkLogCommand(optInstance))
 	jira.AddCommand(createResolutionCommand(optInstance))
+	jira.AddCommand(createDigestCommand(optInstance))
+	jira.AddCommand(createTimerCommand(optInstance))
+	jira.AddCommand(createThreadCommand(optInstance))
+	jira.AddCommand(createTemplateCommand(optInstance))
+	jira.AddCommand(createUnfurlCommand())
+	jira.AddCommand(createBulkCommand(optInstance))
+	jira.AddCommand(createWatchCommand(optInstance))
+	jira.AddCommand(createUnwatchCommand(optInstance))
+	jira.AddCommand(createWatchingCommand(optInstance))
 
 	// Generic commands
 	jira.AddCommand(createIssueCommand(optInstance))
@@ -163,6 +255,8 @@ func addSubCommands(jira *model.AutocompleteData, optInstance bool) {
 	// Admin commands
 	jira.AddCommand(createSubscribeCommand(optInstance))
 	jira.AddCommand(createWebhookCommand(optInstance))
+	jira.AddCommand(createTokenCommand())
+	jira.AddCommand(createEncryptionCommand())
 	jira.AddCommand(createSetupCommand())
 
 	// Help and info
@@ -219,12 +313,15 @@ func createInstanceCommand(optInstance bool) *model.AutocompleteData {
 func createIssueCommand(optInstance bool) *model.AutocompleteData {
 	issue := model.NewAutocompleteData(
 		"issue", "[assign|unassign|transition]", "Manage Jira issues")
+	issue.AddCommand(createCreateIssueCommand(optInstance))
 	issue.AddCommand(createViewCommand(optInstance))
 	issue.AddCommand(createTransitionCommand(optInstance))
 	issue.AddCommand(createAssignCommand(optInstance))
 	issue.AddCommand(createUnassignCommand(optInstance))
 	issue.AddCommand(createWorkLogCommand(optInstance))
 	issue.AddCommand(createResolutionCommand(optInstance))
+	issue.AddCommand(createWatchCommand(optInstance))
+	issue.AddCommand(createUnwatchCommand(optInstance))
 	return issue
 }
 
@@ -270,7 +367,7 @@ func createDisconnectCommand() *model.AutocompleteData {
 
 func createSettingsCommand(optInstance bool) *model.AutocompleteData {
 	settings := model.NewAutocompleteData(
-		"settings", "[list|notifications|display_messages]", "View or update your user settings")
+		"settings", "[list|notifications|display_messages|events|mute|unmute|quiet_hours|digest]", "View or update your user settings")
 
 	list := model.NewAutocompleteData(
 		"list", "", "View your current settings")
@@ -293,9 +390,50 @@ func createSettingsCommand(optInstance bool) *model.AutocompleteData {
 	})
 	settings.AddCommand(displayHiddenMessages)
 
+	events := model.NewAutocompleteData(
+		"events", "[kind] [on|off]", "Choose which kinds of notifications you receive")
+	var kinds []model.AutocompleteListItem
+	for _, k := range notificationKinds {
+		kinds = append(kinds, model.AutocompleteListItem{HelpText: "When " + k.Description, Item: k.Kind})
+	}
+	events.AddStaticListArgument("kind", false, kinds)
+	events.AddStaticListArgument("value", false, []model.AutocompleteListItem{
+		{HelpText: "Receive these notifications", Item: "on"},
+		{HelpText: "Stop these notifications", Item: "off"},
+	})
+	settings.AddCommand(events)
+
+	mute := model.NewAutocompleteData(
+		"mute", "[project-key]", "Stop notifications for the issues of a project")
+	mute.AddTextArgument("Project key", "[project-key]", "")
+	settings.AddCommand(mute)
+
+	unmute := model.NewAutocompleteData(
+		"unmute", "[project-key]", "Resume notifications for the issues of a project")
+	unmute.AddTextArgument("Project key", "[project-key]", "")
+	settings.AddCommand(unmute)
+
+	quietHours := model.NewAutocompleteData(
+		"quiet_hours", "[HH:MM-HH:MM|off]", "Hold notifications back during quiet hours, in your timezone")
+	quietHours.AddTextArgument("Quiet hours, such as 22:00-07:00, or off", "[HH:MM-HH:MM|off]", "")
+	settings.AddCommand(quietHours)
+
+	digest := model.NewAutocompleteData(
+		"digest", "[days] [HH:MM|off]", "Receive your notifications together at a time of day instead of right away")
+	digest.AddTextArgument("Days, such as daily or mon,wed,fri, and a time, or off", "[days] [HH:MM|off]", "")
+	settings.AddCommand(digest)
+
 	return settings
 }
 
+func createCreateIssueCommand(optInstance bool) *model.AutocompleteData {
+	create := model.NewAutocompleteData(
+		"create", "[project-key] [issue-type] \"[summary]\"", "Create a Jira issue")
+	create.AddTextArgument("Project key, issue type and summary, then --priority, --assignee, --labels, --component or --description", "[project-key] [issue-type] \"[summary]\"", "")
+	withFlagInstance(create, optInstance, makeAutocompleteRoute(routeAutocompleteInstalledInstanceWithAlias))
+	return create
+}
+
 func createViewCommand(optInstance bool) *model.AutocompleteData {
 	view := model.NewAutocompleteData(
 		"view", "[issue]", "Display a Jira issue")
@@ -317,10 +455,41 @@ func createTransitionCommand(optInstance bool) *model.AutocompleteData {
 
 func createWorkLogCommand(optInstance bool) *model.AutocompleteData {
 	workLog := model.NewAutocompleteData(
-		"worklog", "[Jira issue] [Minutes]", "Record labour costs in minutes per issue")
+		"worklog", "[Jira issue] [duration] [comment]", "Log work on an issue")
 
 	workLog.AddDynamicListArgument("Jira issue", makeAutocompleteRoute(routeParseIssuesInPost), false)
-	workLog.AddTextArgument("Minutes", "", "")
+	workLog.AddTextArgument("Minutes, or Jira time such as 1w 2d 3h 15m", "[duration]", "")
+	workLog.AddTextArgument("Optional comment", "[comment]", "")
+	workLog.AddNamedTextArgument("started", "When the work started: YYYY-MM-DD, HH:MM or YYYY-MM-DDTHH:MM", "", "", false)
+
+	report := model.NewAutocompleteData(
+		"report", "[today|week|YYYY-MM-DD..YYYY-MM-DD]", "Show the work you logged per day and issue")
+	report.AddTextArgument("Period: today, week, or a range of days", "[today|week|YYYY-MM-DD..YYYY-MM-DD]", "")
+	withFlagInstance(report, optInstance, makeAutocompleteRoute(routeAutocompleteUserInstance))
+	workLog.AddCommand(report)
+
+	list := model.NewAutocompleteData(
+		"list", "[Jira issue]", "List the work you logged on an issue")
+	list.AddDynamicListArgument("Jira issue", makeAutocompleteRoute(routeParseIssuesInPost), false)
+	withFlagInstance(list, optInstance, makeAutocompleteRoute(routeAutocompleteUserInstance))
+	workLog.AddCommand(list)
+
+	edit := model.NewAutocompleteData(
+		"edit", "[Jira issue] [worklog ID] [duration] [comment]", "Change one of your worklogs")
+	edit.AddDynamicListArgument("Jira issue", makeAutocompleteRoute(routeParseIssuesInPost), false)
+	edit.AddTextArgument("Worklog ID, see `/jira worklog list`", "[worklog ID]", "")
+	edit.AddTextArgument("Minutes, or Jira time such as 1w 2d 3h 15m", "[duration]", "")
+	edit.AddTextArgument("Optional new comment", "[comment]", "")
+	edit.AddNamedTextArgument("started", "When the work started: YYYY-MM-DD, HH:MM or YYYY-MM-DDTHH:MM", "", "", false)
+	withFlagInstance(edit, optInstance, makeAutocompleteRoute(routeAutocompleteUserInstance))
+	workLog.AddCommand(edit)
+
+	remove := model.NewAutocompleteData(
+		"delete", "[Jira issue] [worklog ID]", "Delete one of your worklogs")
+	remove.AddDynamicListArgument("Jira issue", makeAutocompleteRoute(routeParseIssuesInPost), false)
+	remove.AddTextArgument("Worklog ID, see `/jira worklog list`", "[worklog ID]", "")
+	withFlagInstance(remove, optInstance, makeAutocompleteRoute(routeAutocompleteUserInstance))
+	workLog.AddCommand(remove)
 
 	withFlagInstance(workLog, optInstance, makeAutocompleteRoute(routeAutocompleteInstalledInstanceWithAlias))
 	return workLog
@@ -347,10 +516,28 @@ func createUnassignCommand(optInstance bool) *model.AutocompleteData {
 
 func createSubscribeCommand(optInstance bool) *model.AutocompleteData {
 	subscribe := model.NewAutocompleteData(
-		"subscribe", "[edit]", "Configure the Jira notifications sent")
+		"subscribe", "[edit|transfer|delete|orphaned]", "Configure the Jira notifications sent")
 	subscribe.AddCommand(model.NewAutocompleteData(
 		"edit", "", "Configure the Jira notifications sent"))
 
+	transfer := model.NewAutocompleteData(
+		"transfer", "[id|all] @user", "Take over subscriptions, or give them to another user as a system administrator")
+	transfer.AddTextArgument("Subscription ID, or all for the subscriptions of this channel", "[id|all]", "")
+	transfer.AddTextArgument("User", "@user", "")
+	withFlagInstance(transfer, optInstance, makeAutocompleteRoute(routeAutocompleteInstalledInstanceWithAlias))
+	subscribe.AddCommand(transfer)
+
+	remove := model.NewAutocompleteData(
+		"delete", "[id]", "Delete a subscription")
+	remove.AddTextArgument("Subscription ID", "[id]", "")
+	withFlagInstance(remove, optInstance, makeAutocompleteRoute(routeAutocompleteInstalledInstanceWithAlias))
+	subscribe.AddCommand(remove)
+
+	orphaned := model.NewAutocompleteData(
+		"orphaned", "", "List the subscriptions whose owner is deactivated or disconnected")
+	orphaned.RoleID = model.SystemAdminRoleId
+	subscribe.AddCommand(orphaned)
+
 	return subscribe
 }
 
@@ -359,9 +546,182 @@ func createWebhookCommand(optInstance bool) *model.AutocompleteData {
 		"webhook", "[Jira URL]", "Display the webhook URLs to set up on Jira")
 	webhook.RoleID = model.SystemAdminRoleId
 	withFlagInstance(webhook, optInstance, makeAutocompleteRoute(routeAutocompleteInstalledInstanceWithAlias))
+
+	failed := model.NewAutocompleteData(
+		"failed", "[list|replay|delete]", "Manage the webhook events that failed to process")
+	failed.RoleID = model.SystemAdminRoleId
+	failed.AddCommand(model.NewAutocompleteData("list", "", "List failed webhook events"))
+	failed.AddCommand(model.NewAutocompleteData("replay", "[id|all]", "Process failed webhook events again"))
+	failed.AddCommand(model.NewAutocompleteData("delete", "[id|all]", "Discard failed webhook events"))
+	webhook.AddCommand(failed)
 	return webhook
 }
 
+func createDigestCommand(optInstance bool) *model.AutocompleteData {
+	digest := model.NewAutocompleteData(
+		"digest", "[add|list|edit|delete]", "Post the results of a JQL query to this channel on a schedule")
+
+	add := model.NewAutocompleteData(
+		"add", "[daily|weekdays|mon,wed,...] [HH:MM] [JQL]", "Create a digest for this channel")
+	add.AddTextArgument("Days to post the digest on: daily, weekdays, or days such as mon,wed,fri", "[days]", "")
+	add.AddTextArgument("Time of day, in your timezone", "[HH:MM]", "")
+	add.AddTextArgument("JQL query", "[JQL]", "")
+	withFlagInstance(add, optInstance, makeAutocompleteRoute(routeAutocompleteUserInstance))
+
+	edit := model.NewAutocompleteData(
+		"edit", "[id] [schedule|jql] [value]", "Change the schedule or the query of a digest")
+	edit.AddTextArgument("Digest ID", "[id]", "")
+	edit.AddStaticListArgument("What to change", true, []model.AutocompleteListItem{
+		{HelpText: "New days and time, e.g. `weekdays 09:00`", Item: "schedule"},
+		{HelpText: "New JQL query", Item: "jql"},
+	})
+
+	remove := model.NewAutocompleteData(
+		"delete", "[id]", "Delete a digest")
+	remove.AddTextArgument("Digest ID", "[id]", "")
+
+	digest.AddCommand(add)
+	digest.AddCommand(model.NewAutocompleteData("list", "", "List the digests of this channel"))
+	digest.AddCommand(edit)
+	digest.AddCommand(remove)
+	return digest
+}
+
+func createTimerCommand(optInstance bool) *model.AutocompleteData {
+	timer := model.NewAutocompleteData(
+		"timer", "[start|stop|status]", "Log the time spent on an issue with a timer")
+
+	start := model.NewAutocompleteData(
+		"start", "[Jira issue]", "Start a timer on an issue")
+	start.AddDynamicListArgument("Jira issue", makeAutocompleteRoute(routeParseIssuesInPost), false)
+	withFlagInstance(start, optInstance, makeAutocompleteRoute(routeAutocompleteUserInstance))
+
+	stop := model.NewAutocompleteData(
+		"stop", "[comment]", "Stop your timer and log the elapsed time")
+	stop.AddTextArgument("Optional worklog comment", "[comment]", "")
+
+	timer.AddCommand(start)
+	timer.AddCommand(stop)
+	timer.AddCommand(model.NewAutocompleteData("status", "", "Show your running timer"))
+	return timer
+}
+
+func createThreadCommand(optInstance bool) *model.AutocompleteData {
+	thread := model.NewAutocompleteData(
+		"thread", "[link|unlink]", "Sync the replies of a thread with the comments of an issue")
+
+	link := model.NewAutocompleteData(
+		"link", "[Jira issue]", "Link the current thread to an issue")
+	link.AddDynamicListArgument("Jira issue", makeAutocompleteRoute(routeParseIssuesInPost), false)
+	withFlagInstance(link, optInstance, makeAutocompleteRoute(routeAutocompleteUserInstance))
+
+	thread.AddCommand(link)
+	thread.AddCommand(model.NewAutocompleteData("unlink", "", "Stop syncing the current thread"))
+	return thread
+}
+
+func createTemplateCommand(optInstance bool) *model.AutocompleteData {
+	template := model.NewAutocompleteData(
+		"template", "[add|list|delete]", "Manage the issue templates used with `/jira create --template`")
+
+	add := model.NewAutocompleteData(
+		"add", "[name] [project-key] [issue-type] \"[summary]\"", "Save an issue template for this channel")
+	add.AddTextArgument("Name, project key, issue type and summary, then --description, --priority, --labels, --component, --field or --global", "[name] [project-key] [issue-type] \"[summary]\"", "")
+	withFlagInstance(add, optInstance, makeAutocompleteRoute(routeAutocompleteInstalledInstanceWithAlias))
+	template.AddCommand(add)
+
+	template.AddCommand(model.NewAutocompleteData(
+		"list", "", "List the issue templates of this channel"))
+
+	remove := model.NewAutocompleteData(
+		"delete", "[name]", "Delete an issue template")
+	remove.AddTextArgument("Name of the template, with --global for a global template", "[name]", "")
+	template.AddCommand(remove)
+
+	return template
+}
+
+func createWatchCommand(optInstance bool) *model.AutocompleteData {
+	watch := model.NewAutocompleteData(
+		"watch", "[issue-key]", "Watch an issue and get its changes as direct messages")
+	withParamIssueKey(watch)
+	withFlagInstance(watch, optInstance, makeAutocompleteRoute(routeAutocompleteUserInstance))
+	return watch
+}
+
+func createUnwatchCommand(optInstance bool) *model.AutocompleteData {
+	unwatch := model.NewAutocompleteData(
+		"unwatch", "[issue-key]", "Stop watching an issue")
+	withParamIssueKey(unwatch)
+	withFlagInstance(unwatch, optInstance, makeAutocompleteRoute(routeAutocompleteUserInstance))
+	return unwatch
+}
+
+func createWatchingCommand(optInstance bool) *model.AutocompleteData {
+	watching := model.NewAutocompleteData(
+		"watching", "", "List the issues you watch")
+	withFlagInstance(watching, optInstance, makeAutocompleteRoute(routeAutocompleteUserInstance))
+	return watching
+}
+
+func createBulkCommand(optInstance bool) *model.AutocompleteData {
+	bulk := model.NewAutocompleteData(
+		"bulk", "[JQL] [transition|assign|label] [value]", "Transition, assign or label the issues matching a JQL query")
+	bulk.AddTextArgument("JQL query, then `transition [state]`, `assign [assignee]` or `label +[add] -[remove]`", "[JQL] [transition|assign|label] [value]", "")
+	withFlagInstance(bulk, optInstance, makeAutocompleteRoute(routeAutocompleteUserInstance))
+	return bulk
+}
+
+func createUnfurlCommand() *model.AutocompleteData {
+	unfurl := model.NewAutocompleteData(
+		"unfurl", "[on|off]", "Turn the previews of the Jira issues mentioned in this channel on or off")
+	unfurl.AddStaticListArgument("Previews", true, []model.AutocompleteListItem{
+		{HelpText: "Preview the mentioned issues", Item: "on"},
+		{HelpText: "Do not preview the mentioned issues", Item: "off"},
+	})
+	return unfurl
+}
+
+func createTokenCommand() *model.AutocompleteData {
+	token := model.NewAutocompleteData(
+		"token", "[create|list|revoke|audit]", "Manage the integration tokens of the backdoor API")
+	token.RoleID = model.SystemAdminRoleId
+
+	scopes := []model.AutocompleteListItem{{HelpText: "Every scope", Item: "all"}}
+	for _, scope := range integrationTokenScopes {
+		scopes = append(scopes, model.AutocompleteListItem{Item: scope})
+	}
+
+	create := model.NewAutocompleteData(
+		"create", "[name] [scope,scope,...|all]", "Create an integration token")
+	create.AddTextArgument("Name of the integration", "[name]", "")
+	create.AddStaticListArgument("Comma separated scopes", true, scopes)
+
+	revoke := model.NewAutocompleteData(
+		"revoke", "[id|name]", "Revoke an integration token")
+	revoke.AddTextArgument("Token ID or name", "[id|name]", "")
+
+	audit := model.NewAutocompleteData(
+		"audit", "[id|name] [count]", "Show the most recent backdoor API calls")
+	audit.AddTextArgument("Optional token ID or name, and number of calls", "[id|name] [count]", "")
+
+	token.AddCommand(create)
+	token.AddCommand(model.NewAutocompleteData("list", "", "List the integration tokens"))
+	token.AddCommand(revoke)
+	token.AddCommand(audit)
+	return token
+}
+
+func createEncryptionCommand() *model.AutocompleteData {
+	encryption := model.NewAutocompleteData(
+		"encryption", "[rotate|status]", "Manage the encryption of the stored credentials")
+	encryption.RoleID = model.SystemAdminRoleId
+
+	encryption.AddCommand(model.NewAutocompleteData("rotate", "", "Encrypt the stored credentials with a new key"))
+	encryption.AddCommand(model.NewAutocompleteData("status", "", "Show the version of the key the credentials are encrypted with"))
+	return encryption
+}
+
 func createSetupCommand() *model.AutocompleteData {
 	setup := model.NewAutocompleteData(
 		"setup", "", "Start Jira plugin setup flow")
@@ -469,6 +829,10 @@ func executeConnect(p *Plugin, c *plugin.Context, header *model.CommandArgs, arg
 	if instance != nil {
 		jiraURL = instance.InstanceID.String()
 	}
+	if jiraURL != "" && p.isConnectionBroken(types.ID(jiraURL), types.ID(header.UserId)) {
+		return p.responsef(header, "[Click here to reconnect your Jira account](%s%s)",
+			p.GetPluginURL(), instancePath(routeUserConnect, types.ID(jiraURL)))
+	}
 
 	info, err := p.GetUserInfo(types.ID(header.UserId), nil)
 	if err != nil {
@@ -637,6 +1001,8 @@ func executeSettings(p *Plugin, c *plugin.Context, header *model.CommandArgs, ar
 		return p.settingsNotifications(header, instance.GetID(), user.MattermostUserID, conn, args)
 	case "display_messages":
 		return p.settingsDisplayHiddenMessages(header, instance.GetID(), user.MattermostUserID, conn, args)
+	case "events", "mute", "unmute", "quiet_hours", "digest":
+		return p.settingsNotificationRule(header, instance.GetID(), user.MattermostUserID, conn, args)
 	default:
 		return p.responsef(header, "Unknown setting.")
 	}
@@ -1021,20 +1387,20 @@ func executeWorkLog(p *Plugin, c *plugin.Context, header *model.CommandArgs, arg
 	if err != nil {
 		return p.responsef(header, "Failed to load your connection to Jira. Error: %v.", err)
 	}
+	started, args, err := parseWorklogStarted(args, p.userLocation(header.UserId), time.Now())
+	if err != nil {
+		return p.responsef(header, "%v", err)
+	}
 	if len(args) < 2 {
 		return p.help(header)
 	}
 
 	issueKey := strings.ToUpper(args[0])
-	minutesStr := strings.Join(args[1:], " ")
-	minutes, err := strconv.Atoi(minutesStr)
+	seconds, args, err := parseWorklogDuration(args[1:])
 	if err != nil {
-		return p.responsef(header, "Minutes is not number.")
-	}
-
-	if minutes <= 0 {
-		return p.responsef(header, "Minutes less than or equal to zero.")
+		return p.responsef(header, "%v", err)
 	}
+	comment := strings.Join(args, " ")
 
 	mattermostUserID := types.ID(header.UserId)
 
@@ -1048,16 +1414,157 @@ func executeWorkLog(p *Plugin, c *plugin.Context, header *model.CommandArgs, arg
 		return p.responsef(header, "Failed load client. Error: %v.", err)
 	}
 
-	_, _, err = client.createWorkLog(issueKey, &jira.WorklogRecord{
-		TimeSpentSeconds: minutes * 60, // In seconds
-	})
+	record := &jira.WorklogRecord{
+		TimeSpentSeconds: seconds,
+		Comment:          comment,
+	}
+	if started != nil {
+		jiraStarted := jira.Time(*started)
+		record.Started = &jiraStarted
+	}
+	_, _, err = client.createWorkLog(issueKey, record)
 	if err != nil {
 		return p.responsef(header, "Failed create worklog. Error: %v.", err)
 	}
 
 	issueLink := fmt.Sprintf("[%s](%v/browse/%v)", issueKey, in.GetJiraBaseURL(), issueKey)
 
-	return p.responsef(header, fmt.Sprintf("A %d minute worklog for issue %s has been created.", minutes, issueLink))
+	return p.responsef(header, "A %s worklog for issue %s has been created.", formatWorklogDuration(seconds), issueLink)
+}
+
+func executeWorkLogReport(p *Plugin, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	instanceURL, args, err := p.parseCommandFlagInstanceURL(args)
+	if err != nil {
+		return p.responsef(header, "Failed to load your connection to Jira. Error: %v.", err)
+	}
+	if len(args) > 1 {
+		return p.help(header)
+	}
+	spec := ""
+	if len(args) == 1 {
+		spec = args[0]
+	}
+
+	from, to, err := parseWorklogReportRange(spec, p.userLocation(header.UserId), time.Now())
+	if err != nil {
+		return p.responsef(header, "%v", err)
+	}
+
+	mattermostUserID := types.ID(header.UserId)
+	_, instanceID, err := p.ResolveUserInstanceURL(mattermostUserID, instanceURL)
+	if err != nil {
+		return p.responsef(header, "Failed to identify Jira instance %s. Error: %v.", instanceURL, err)
+	}
+
+	client, instance, connection, err := p.getClient(instanceID, mattermostUserID)
+	if err != nil {
+		return p.responsef(header, "Failed load client. Error: %v.", err)
+	}
+
+	report, err := getWorklogReport(client, connection, from, to)
+	if err != nil {
+		return p.responsef(header, "Failed to load your worklogs. Error: %v.", err)
+	}
+	return p.responsef(header, "%s", report.Markdown(instance.GetJiraBaseURL()))
+}
+
+func executeWorkLogList(p *Plugin, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	instanceURL, args, err := p.parseCommandFlagInstanceURL(args)
+	if err != nil {
+		return p.responsef(header, "Failed to load your connection to Jira. Error: %v.", err)
+	}
+	if len(args) != 1 {
+		return p.help(header)
+	}
+	issueKey := strings.ToUpper(args[0])
+
+	client, _, connection, err := p.getCommandClient(header, instanceURL)
+	if err != nil {
+		return p.responsef(header, "%v", err)
+	}
+
+	records, err := getOwnWorklogs(client, connection, issueKey)
+	if err != nil {
+		return p.responsef(header, "Failed to load the worklogs of %s. Error: %v.", issueKey, err)
+	}
+	return p.responsef(header, "%s", formatWorklogs(issueKey, records, p.userLocation(header.UserId)))
+}
+
+func executeWorkLogEdit(p *Plugin, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	instanceURL, args, err := p.parseCommandFlagInstanceURL(args)
+	if err != nil {
+		return p.responsef(header, "Failed to load your connection to Jira. Error: %v.", err)
+	}
+	started, args, err := parseWorklogStarted(args, p.userLocation(header.UserId), time.Now())
+	if err != nil {
+		return p.responsef(header, "%v", err)
+	}
+	if len(args) < 3 {
+		return p.help(header)
+	}
+
+	issueKey := strings.ToUpper(args[0])
+	worklogID := args[1]
+	seconds, args, err := parseWorklogDuration(args[2:])
+	if err != nil {
+		return p.responsef(header, "%v", err)
+	}
+
+	client, _, connection, err := p.getCommandClient(header, instanceURL)
+	if err != nil {
+		return p.responsef(header, "%v", err)
+	}
+
+	update := &jira.WorklogRecord{
+		TimeSpentSeconds: seconds,
+		Comment:          strings.Join(args, " "),
+	}
+	if started != nil {
+		jiraStarted := jira.Time(*started)
+		update.Started = &jiraStarted
+	}
+	if _, err = updateOwnWorklog(client, connection, issueKey, worklogID, update); err != nil {
+		return p.responsef(header, "Failed to update worklog %s of %s. Error: %v.", worklogID, issueKey, err)
+	}
+	return p.responsef(header, "Worklog %s of %s has been changed to %s.", worklogID, issueKey, formatWorklogDuration(seconds))
+}
+
+func executeWorkLogDelete(p *Plugin, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	instanceURL, args, err := p.parseCommandFlagInstanceURL(args)
+	if err != nil {
+		return p.responsef(header, "Failed to load your connection to Jira. Error: %v.", err)
+	}
+	if len(args) != 2 {
+		return p.help(header)
+	}
+	issueKey := strings.ToUpper(args[0])
+	worklogID := args[1]
+
+	client, _, connection, err := p.getCommandClient(header, instanceURL)
+	if err != nil {
+		return p.responsef(header, "%v", err)
+	}
+
+	if err = deleteOwnWorklog(client, connection, issueKey, worklogID); err != nil {
+		return p.responsef(header, "Failed to delete worklog %s of %s. Error: %v.", worklogID, issueKey, err)
+	}
+	return p.responsef(header, "Worklog %s of %s has been deleted.", worklogID, issueKey)
+}
+
+// getCommandClient returns the Jira client of the user running the command, for the instance
+// given with --instance or the user's default one.
+func (p *Plugin) getCommandClient(header *model.CommandArgs, instanceURL string) (Client, Instance, *Connection, error) {
+	mattermostUserID := types.ID(header.UserId)
+	_, instanceID, err := p.ResolveUserInstanceURL(mattermostUserID, instanceURL)
+	if err != nil {
+		return nil, nil, nil, errors.Errorf("Failed to identify Jira instance %s. Error: %v.", instanceURL, err)
+	}
+
+	client, instance, connection, err := p.getClient(instanceID, mattermostUserID)
+	if err != nil {
+		return nil, nil, nil, errors.Errorf("Failed load client. Error: %v.", err)
+	}
+	return client, instance, connection, nil
 }
 
 func executeMe(p *Plugin, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
@@ -1220,6 +1727,74 @@ func executeWebhookURL(p *Plugin, c *plugin.Context, header *model.CommandArgs,
 		instanceID, instance.GetManageWebhooksURL(), subWebhookURL, subWebhookURL, legacyWebhookURL, legacyWebhookURL)
 }
 
+func executeWebhookFailedList(p *Plugin, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	authorized, err := authorizedSysAdmin(p, header.UserId)
+	if err != nil {
+		return p.responsef(header, "%v", err)
+	}
+	if !authorized {
+		return p.responsef(header, "`/jira webhook failed` can only be run by a system administrator.")
+	}
+	if len(args) != 0 {
+		return p.help(header)
+	}
+
+	deadLetters, err := p.listWebhookDeadLetters()
+	if err != nil {
+		return p.responsef(header, "Failed to load failed webhook events: %v", err)
+	}
+	if len(deadLetters) == 0 {
+		return p.responsef(header, "There are no failed webhook events.")
+	}
+
+	text := "| ID | Received | Event | Issue | Attempts | Last error |\n|--|--|--|--|--|--|\n"
+	for _, dl := range deadLetters {
+		text += fmt.Sprintf("|`%s`|%s|%s|%s|%d|%s|\n",
+			dl.ID, dl.CreatedAt.Format(time.RFC3339), dl.Event, dl.IssueKey, dl.Attempts, strings.ReplaceAll(dl.LastError, "|", "\\|"))
+	}
+	return p.responsef(header, "%s", text)
+}
+
+func executeWebhookFailedReplay(p *Plugin, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	return p.forEachWebhookDeadLetter(header, "replay", "queued for processing", p.replayWebhookDeadLetter, args...)
+}
+
+func executeWebhookFailedDelete(p *Plugin, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	return p.forEachWebhookDeadLetter(header, "delete", "deleted", p.deleteWebhookDeadLetter, args...)
+}
+
+func (p *Plugin) forEachWebhookDeadLetter(header *model.CommandArgs, action, done string, f func(id string) error, args ...string) *model.CommandResponse {
+	authorized, err := authorizedSysAdmin(p, header.UserId)
+	if err != nil {
+		return p.responsef(header, "%v", err)
+	}
+	if !authorized {
+		return p.responsef(header, "`/jira webhook failed %s` can only be run by a system administrator.", action)
+	}
+	if len(args) != 1 {
+		return p.help(header)
+	}
+
+	ids := []string{args[0]}
+	if args[0] == "all" {
+		deadLetters, err := p.listWebhookDeadLetters()
+		if err != nil {
+			return p.responsef(header, "Failed to load failed webhook events: %v", err)
+		}
+		ids = nil
+		for _, dl := range deadLetters {
+			ids = append(ids, dl.ID)
+		}
+	}
+
+	for i, id := range ids {
+		if err = f(id); err != nil {
+			return p.responsef(header, "Failed to %s webhook event `%s`, %d of %d done: %v", action, id, i, len(ids), err)
+		}
+	}
+	return p.responsef(header, "%d failed webhook event(s) %s.", len(ids), done)
+}
+
 func executeSetup(p *Plugin, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
 	authorized, err := authorizedSysAdmin(p, header.UserId)
 	if err != nil {
@@ -1387,12 +1962,12 @@ func executeResolution(p *Plugin, c *plugin.Context, header *model.CommandArgs,
 
 	client, _, _, err := p.getClient(instanceID, mattermostUserID)
 	if err != nil {
-		return p.responsef(header, "Failed load instance client. Error: %v.", instanceURL, err)
+		return p.responsef(header, "Failed load instance client. Error: %v.", err)
 	}
 
 	doneTransition, err := client.getDoneTransition(issueKey)
 	if err != nil {
-		return p.responsef(header, "Failed find done transition. Error: %v.", instanceURL, err)
+		return p.responsef(header, "Failed find done transition. Error: %v.", err)
 	}
 
 	msg, err := p.TransitionIssue(&InTransitionIssue{
@@ -0,0 +1,282 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License for license information.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/pluginapi"
+	"github.com/mattermost/mattermost/server/public/pluginapi/cluster"
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+
+	"github.com/mattermost/mattermost-plugin-jira/server/utils/types"
+)
+
+const (
+	prefixConnectionHealth = "connhealth_" // + hash of the instance and Mattermost user IDs, a broken connection
+
+	connectionHealthJobKey      = "connection_health_check"
+	connectionHealthJobInterval = 6 * time.Hour
+
+	channelMembersPerPage = 200
+)
+
+// connectionHealth records that the Jira token of a connection stopped working. It is only
+// stored while the connection is broken, and removed when the user connects again.
+type connectionHealth struct {
+	BrokenSince time.Time `json:"broken_since"`
+	Reason      string    `json:"reason"`
+}
+
+func keyConnectionHealth(instanceID, mattermostUserID types.ID) string {
+	return prefixConnectionHealth + keyWithInstanceID(instanceID, mattermostUserID)
+}
+
+func (p *Plugin) loadConnectionHealth(instanceID, mattermostUserID types.ID) (*connectionHealth, error) {
+	var health *connectionHealth
+	if err := p.client.KV.Get(keyConnectionHealth(instanceID, mattermostUserID), &health); err != nil {
+		return nil, errors.Wrap(err, "failed to load the connection health")
+	}
+	return health, nil
+}
+
+// isConnectionBroken returns true if the last health check found the token of the connection
+// revoked or expired.
+func (p *Plugin) isConnectionBroken(instanceID, mattermostUserID types.ID) bool {
+	health, err := p.loadConnectionHealth(instanceID, mattermostUserID)
+	return err == nil && health != nil
+}
+
+// markConnectionBroken stores the connection as broken, and returns true if it was not already.
+func (p *Plugin) markConnectionBroken(instanceID, mattermostUserID types.ID, reason string, now time.Time) (bool, error) {
+	health := &connectionHealth{BrokenSince: now, Reason: reason}
+	saved, err := p.client.KV.Set(keyConnectionHealth(instanceID, mattermostUserID), health, pluginapi.SetAtomic(nil))
+	if err != nil {
+		return false, errors.Wrap(err, "failed to store the connection health")
+	}
+	return saved, nil
+}
+
+func (p *Plugin) clearConnectionHealth(instanceID, mattermostUserID types.ID) {
+	if err := p.client.KV.Delete(keyConnectionHealth(instanceID, mattermostUserID)); err != nil {
+		p.errorf("Failed to clear the connection health of user %s: %v", mattermostUserID, err)
+	}
+}
+
+// brokenTokenReason returns why the error means the token of the connection no longer works, or
+// an empty string if it may be a transient error, like Jira being unreachable.
+func brokenTokenReason(err error) string {
+	var retrieveErr *oauth2.RetrieveError
+	if restErr, ok := err.(RESTError); ok {
+		switch restErr.Status {
+		case http.StatusUnauthorized:
+			return "Jira no longer accepts the token"
+		case http.StatusForbidden:
+			return "Jira denied access with the token"
+		}
+		err = restErr.error
+	}
+	if errors.As(err, &retrieveErr) && retrieveErr.Response != nil && retrieveErr.Response.StatusCode < http.StatusInternalServerError {
+		return "the token could not be refreshed"
+	}
+	return ""
+}
+
+// usesUserToken returns true if requests for the connection are made with a token of the user,
+// rather than with the credentials of the app, which the user cannot fix by connecting again.
+func usesUserToken(instance Instance, connection *Connection) bool {
+	switch instance.Common().Type {
+	case ServerInstanceType:
+		return connection.Oauth1AccessToken != ""
+	case CloudOAuthInstanceType:
+		return connection.OAuth2Token != nil
+	}
+	return false
+}
+
+// checkConnection makes a request to Jira with the token of the connection. It returns why the
+// connection is broken, or an error if Jira could not tell.
+func checkConnection(instance Instance, connection *Connection) (string, error) {
+	client, err := instance.GetClient(connection)
+	if err == nil {
+		_, err = client.GetSelf()
+	}
+	if err == nil {
+		return "", nil
+	}
+	if reason := brokenTokenReason(err); reason != "" {
+		return reason, nil
+	}
+	return "", err
+}
+
+// checkConnectionHealth validates the token of every connection, and prompts the users whose
+// token was revoked or could not be refreshed to connect again, before their commands fail and
+// the subscriptions they created stop posting.
+func (p *Plugin) checkConnectionHealth() {
+	now := time.Now()
+	instances := map[types.ID]Instance{}
+	loadInstance := func(instanceID types.ID) Instance {
+		instance, ok := instances[instanceID]
+		if !ok {
+			var err error
+			instance, err = p.instanceStore.LoadInstance(instanceID)
+			if err != nil {
+				p.errorf("Connection health check: failed to load instance %s: %v", instanceID, err)
+			}
+			instances[instanceID] = instance
+		}
+		return instance
+	}
+
+	err := p.userStore.MapUsers(func(user *User) error {
+		for _, instanceID := range user.ConnectedInstances.IDs() {
+			instance := loadInstance(instanceID)
+			if instance == nil {
+				continue
+			}
+			connection, err := p.userStore.LoadConnection(instanceID, user.MattermostUserID)
+			if err != nil || !usesUserToken(instance, connection) {
+				continue
+			}
+
+			reason, err := checkConnection(instance, connection)
+			if err != nil {
+				p.client.Log.Debug("Connection health check: failed to check the connection", "user", user.MattermostUserID, "instance", instanceID, "error", err.Error())
+				continue
+			}
+			if reason == "" {
+				p.clearConnectionHealth(instanceID, user.MattermostUserID)
+				continue
+			}
+
+			broke, err := p.markConnectionBroken(instanceID, user.MattermostUserID, reason, now)
+			if err != nil {
+				p.errorf("Connection health check: %v", err)
+				continue
+			}
+			if broke {
+				p.client.Log.Info("Jira connection is broken", "user", user.MattermostUserID, "instance", instanceID, "reason", reason)
+				p.notifyBrokenConnection(instance, user.MattermostUserID, reason)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		p.errorf("Connection health check: failed to list the users: %v", err)
+	}
+}
+
+// notifyBrokenConnection sends the user a link to connect again, and warns the admins of the
+// channels with subscriptions created by the user that they stopped posting.
+func (p *Plugin) notifyBrokenConnection(instance Instance, mattermostUserID types.ID, reason string) {
+	owned := p.subscriptionsOwnedBy(instance.GetID(), mattermostUserID)
+
+	message := fmt.Sprintf("Your Jira account connection to %s stopped working: %s.", instance.GetID(), reason)
+	if len(owned) > 0 {
+		message += " The channel subscriptions you created will not post until you connect again."
+	}
+	message += fmt.Sprintf("\n[Click here to reconnect your Jira account](%s%s)",
+		p.GetPluginURL(), instancePath(routeUserConnect, instance.GetID()))
+	if _, err := p.CreateBotDMtoMMUserID(mattermostUserID.String(), "%s", message); err != nil {
+		p.errorf("Failed to notify user %s of the broken connection: %v", mattermostUserID, err)
+	}
+
+	if len(owned) == 0 {
+		return
+	}
+	owner := mattermostUserID.String()
+	if user, err := p.client.User.Get(owner); err == nil {
+		owner = "@" + user.Username
+	}
+	for channelID, names := range owned {
+		p.notifyChannelAdmins(channelID, mattermostUserID.String(),
+			"The Jira subscriptions %s in %s stopped posting, because the Jira connection of %s, who created them, is broken. They will post again once %s connects their Jira account again, or you can take them over with `/jira subscribe transfer [id|all] @your-username` in the channel.",
+			strings.Join(names, ", "), p.channelMention(channelID), owner, owner)
+	}
+}
+
+// notifyChannelAdmins sends a direct message to the admins of the channel, except the given user.
+func (p *Plugin) notifyChannelAdmins(channelID, exceptUserID, format string, args ...interface{}) {
+	admins, err := p.listChannelAdmins(channelID)
+	if err != nil {
+		p.errorf("Failed to list the admins of channel %s: %v", channelID, err)
+		return
+	}
+	for _, adminID := range admins {
+		if adminID == exceptUserID {
+			continue
+		}
+		if _, err = p.CreateBotDMtoMMUserID(adminID, format, args...); err != nil {
+			p.errorf("Failed to notify the admin of channel %s: %v", channelID, err)
+		}
+	}
+}
+
+// channelMention returns a link to the channel, or its ID if it could not be loaded.
+func (p *Plugin) channelMention(channelID string) string {
+	channel, err := p.client.Channel.Get(channelID)
+	if err != nil {
+		return channelID
+	}
+	return "~" + channel.Name
+}
+
+// subscriptionsOwnedBy returns the names of the channel subscriptions created by the user, by
+// channel ID.
+func (p *Plugin) subscriptionsOwnedBy(instanceID, mattermostUserID types.ID) map[string][]string {
+	subs, err := p.getSubscriptions(instanceID)
+	if err != nil {
+		p.errorf("Failed to load the subscriptions of %s: %v", instanceID, err)
+		return nil
+	}
+
+	owned := map[string][]string{}
+	for _, sub := range subs.Channel.ByID {
+		if sub.MattermostUserID != mattermostUserID.String() {
+			continue
+		}
+		name := sub.Name
+		if name == "" {
+			name = sub.ID
+		}
+		owned[sub.ChannelID] = append(owned[sub.ChannelID], fmt.Sprintf("%q", name))
+	}
+	for _, names := range owned {
+		sort.Strings(names)
+	}
+	return owned
+}
+
+func (p *Plugin) listChannelAdmins(channelID string) ([]string, error) {
+	var admins []string
+	for page := 0; ; page++ {
+		members, err := p.client.Channel.ListMembers(channelID, page, channelMembersPerPage)
+		if err != nil {
+			return nil, err
+		}
+		for _, member := range members {
+			if member.SchemeAdmin {
+				admins = append(admins, member.UserId)
+			}
+		}
+		if len(members) < channelMembersPerPage {
+			return admins, nil
+		}
+	}
+}
+
+func (p *Plugin) scheduleConnectionHealthJob() error {
+	job, err := cluster.Schedule(p.API, connectionHealthJobKey, cluster.MakeWaitForInterval(connectionHealthJobInterval), p.checkConnectionHealth)
+	if err != nil {
+		return errors.Wrap(err, "failed to schedule connection health job")
+	}
+	p.connectionHealthJob = job
+	return nil
+}
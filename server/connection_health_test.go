@@ -0,0 +1,158 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License for license information.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	jira "github.com/andygrunwald/go-jira"
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+
+	"github.com/mattermost/mattermost-plugin-jira/server/utils/types"
+)
+
+type healthTestClient struct {
+	testClient
+	err error
+}
+
+func (client healthTestClient) GetSelf() (*jira.User, error) {
+	if client.err != nil {
+		return nil, client.err
+	}
+	return &jira.User{}, nil
+}
+
+// healthTestInstance answers the requests of each Jira account with the given error.
+type healthTestInstance struct {
+	testInstance
+	errs map[string]error
+}
+
+func (ti *healthTestInstance) GetClient(connection *Connection) (Client, error) {
+	return healthTestClient{err: ti.errs[connection.AccountID]}, nil
+}
+
+type healthTestInstanceStore struct {
+	mockInstanceStore
+	instance Instance
+}
+
+func (store healthTestInstanceStore) LoadInstance(types.ID) (Instance, error) {
+	return store.instance, nil
+}
+
+func TestBrokenTokenReason(t *testing.T) {
+	refreshErr := func(status int) error {
+		return &oauth2.RetrieveError{Response: &http.Response{StatusCode: status}}
+	}
+	for name, tc := range map[string]struct {
+		err    error
+		broken bool
+	}{
+		"unauthorized":              {err: RESTError{errors.New("unauthorized"), http.StatusUnauthorized}, broken: true},
+		"forbidden":                 {err: RESTError{errors.New("forbidden"), http.StatusForbidden}, broken: true},
+		"Jira error":                {err: RESTError{errors.New("oops"), http.StatusInternalServerError}},
+		"refresh denied":            {err: errors.Wrap(refreshErr(http.StatusBadRequest), "error in getting token from token source"), broken: true},
+		"refresh denied in request": {err: RESTError{&url.Error{Op: "Get", Err: refreshErr(http.StatusBadRequest)}, http.StatusInternalServerError}, broken: true},
+		"refresh unavailable":       {err: errors.Wrap(refreshErr(http.StatusServiceUnavailable), "error in getting token from token source")},
+		"Jira unreachable":          {err: RESTError{&url.Error{Op: "Get", Err: errors.New("connection refused")}, http.StatusInternalServerError}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.broken, brokenTokenReason(tc.err) != "")
+		})
+	}
+}
+
+func TestCheckConnectionHealth(t *testing.T) {
+	p, kv := setupTestCredentialStore(t)
+	p.updateConfig(func(conf *config) {
+		conf.botUserID = "bot"
+		conf.mattermostSiteURL = mattermostSiteURL
+	})
+	p.userStore = NewStore(p)
+
+	instance := &healthTestInstance{
+		testInstance: testInstance{InstanceCommon: InstanceCommon{InstanceID: mockInstance1URL, Type: ServerInstanceType}},
+		errs: map[string]error{
+			"account1": RESTError{errors.New("unauthorized"), http.StatusUnauthorized},
+			"account3": RESTError{errors.New("unavailable"), http.StatusServiceUnavailable},
+		},
+	}
+	p.instanceStore = healthTestInstanceStore{instance: instance}
+	instanceID := instance.GetID()
+
+	for _, id := range []string{"1", "2", "3"} {
+		userID := types.ID("user" + id)
+		require.NoError(t, p.userStore.StoreUser(&User{MattermostUserID: userID, ConnectedInstances: NewInstances(instance.Common())}))
+		require.NoError(t, p.userStore.StoreConnection(instanceID, userID, &Connection{
+			User:               jira.User{AccountID: "account" + id},
+			Oauth1AccessToken:  "token" + id,
+			Oauth1AccessSecret: "secret" + id,
+		}))
+	}
+	// user2 was found broken before, and connected again since.
+	_, err := p.markConnectionBroken(instanceID, "user2", "Jira no longer accepts the token", time.Now())
+	require.NoError(t, err)
+
+	owned := testSubscription("sub1", "channel1", "TES", "10001", eventCreated)
+	owned.MattermostUserID = "user1"
+	data, err := json.Marshal(withExistingChannelSubscriptions([]ChannelSubscription{
+		owned,
+		testSubscription("sub2", "channel2", "TES", "10001", eventCreated),
+	}))
+	require.NoError(t, err)
+	kv[testSubKey] = data
+
+	api := p.API.(*plugintest.API)
+	api.On("LogDebug", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Maybe()
+	api.On("LogInfo", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Maybe()
+	api.On("GetDirectChannel", mock.AnythingOfType("string"), "bot").Return(func(userID, botID string) *model.Channel {
+		return &model.Channel{Id: "dm_" + userID}
+	}, nil)
+	posts := map[string][]string{}
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Run(func(args mock.Arguments) {
+		post := args.Get(0).(*model.Post)
+		posts[post.ChannelId] = append(posts[post.ChannelId], post.Message)
+	}).Return(&model.Post{}, nil)
+	api.On("GetUser", "user1").Return(&model.User{Id: "user1", Username: "owner"}, nil)
+	api.On("GetChannel", "channel1").Return(&model.Channel{Id: "channel1", Name: "town-square"}, nil)
+	api.On("GetChannelMembers", "channel1", 0, channelMembersPerPage).Return(model.ChannelMembers{
+		{UserId: "user1", SchemeAdmin: true},
+		{UserId: "admin1", SchemeAdmin: true},
+		{UserId: "member1"},
+	}, nil)
+
+	p.checkConnectionHealth()
+
+	assert.True(t, p.isConnectionBroken(instanceID, "user1"))
+	assert.False(t, p.isConnectionBroken(instanceID, "user2"))
+	assert.False(t, p.isConnectionBroken(instanceID, "user3"))
+
+	require.Len(t, posts["dm_user1"], 1)
+	assert.Contains(t, posts["dm_user1"][0], p.GetPluginURL()+instancePath(routeUserConnect, instanceID))
+	assert.Contains(t, posts["dm_user1"][0], "The channel subscriptions you created")
+	require.Len(t, posts["dm_admin1"], 1)
+	assert.Contains(t, posts["dm_admin1"][0], `"subscription sub1" in ~town-square`)
+	assert.Contains(t, posts["dm_admin1"][0], "@owner")
+	assert.Len(t, posts, 2)
+
+	// Users are prompted once while their connection is broken.
+	p.checkConnectionHealth()
+	assert.Len(t, posts["dm_user1"], 1)
+	assert.Len(t, posts["dm_admin1"], 1)
+
+	p.clearConnectionHealth(instanceID, "user1")
+	assert.False(t, p.isConnectionBroken(instanceID, "user1"))
+}
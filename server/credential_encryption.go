@@ -0,0 +1,611 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License for license information.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+	"github.com/mattermost/mattermost/server/public/pluginapi/cluster"
+	"github.com/pkg/errors"
+)
+
+const (
+	keyCredentialKeys = "credential_keys"
+
+	// credentialEnvelopePrefix marks an encrypted credential, it is followed by the version of the
+	// key it was encrypted with and the encoded ciphertext: "enc1:<version>:<ciphertext>".
+	credentialEnvelopePrefix = "enc1:"
+
+	credentialMigrationMutexKey = "credential_migration"
+
+	// clusterEventCredentialKeysChanged tells the other servers to reload the encryption keys.
+	clusterEventCredentialKeysChanged = "credential_keys_changed"
+
+	// credentialKeysTTL bounds how long a server may use an old key if the cluster event of a
+	// rotation is lost.
+	credentialKeysTTL = 5 * time.Minute
+
+	// credentialKeyRetireDelay is how long the older keys are kept after a rotation at least, so
+	// that no server still encrypts credentials with a key it cached before the rotation.
+	credentialKeyRetireDelay = 2 * credentialKeysTTL
+
+	credentialKeySize = 32
+)
+
+var errCredentialKeyNotFound = errors.New("credential encryption key not found")
+
+// credentialKeys are the keys the stored credentials are encrypted with, by version. Until the
+// first rotation they are not stored, and the only key, version 1, is the auth token secret.
+type credentialKeys struct {
+	Current   int            `json:"current"`
+	Keys      map[int][]byte `json:"keys"`
+	RotatedAt time.Time      `json:"rotated_at,omitempty"`
+}
+
+func credentialKeyVersion(value string) (int, string, bool) {
+	if !strings.HasPrefix(value, credentialEnvelopePrefix) {
+		return 0, "", false
+	}
+	version, encoded, found := strings.Cut(strings.TrimPrefix(value, credentialEnvelopePrefix), ":")
+	if !found {
+		return 0, "", false
+	}
+	v, err := strconv.Atoi(version)
+	if err != nil {
+		return 0, "", false
+	}
+	return v, encoded, true
+}
+
+// seal encrypts the value with the current key. Empty and already encrypted values are returned
+// as they are.
+func (keys *credentialKeys) seal(value string) (string, error) {
+	if value == "" {
+		return value, nil
+	}
+	if _, _, sealed := credentialKeyVersion(value); sealed {
+		return value, nil
+	}
+	key := keys.Keys[keys.Current]
+	if len(key) != credentialKeySize {
+		return "", errors.Wrapf(errCredentialKeyNotFound, "version %d", keys.Current)
+	}
+	encrypted, err := encrypt([]byte(value), key)
+	if err != nil {
+		return "", errors.WithMessage(err, "failed to encrypt credential")
+	}
+	return fmt.Sprintf("%s%d:%s", credentialEnvelopePrefix, keys.Current, encode(encrypted)), nil
+}
+
+// open decrypts the value. Values stored before credentials were encrypted are returned as they
+// are.
+func (keys *credentialKeys) open(value string) (string, error) {
+	version, encoded, sealed := credentialKeyVersion(value)
+	if !sealed {
+		return value, nil
+	}
+	key := keys.Keys[version]
+	if len(key) != credentialKeySize {
+		return "", errors.Wrapf(errCredentialKeyNotFound, "version %d", version)
+	}
+	decoded, err := decode(encoded)
+	if err != nil {
+		return "", errors.WithMessage(err, "failed to decode credential")
+	}
+	plain, err := decrypt(decoded, key)
+	if err != nil {
+		return "", errors.WithMessage(err, "failed to decrypt credential")
+	}
+	return string(plain), nil
+}
+
+// needReseal returns true if any of the credentials is not encrypted with the current key.
+func (keys *credentialKeys) needReseal(fields []*string) bool {
+	for _, field := range fields {
+		if *field == "" {
+			continue
+		}
+		if version, _, sealed := credentialKeyVersion(*field); !sealed || version != keys.Current {
+			return true
+		}
+	}
+	return false
+}
+
+func (keys *credentialKeys) reseal(fields []*string) error {
+	for _, field := range fields {
+		plain, err := keys.open(*field)
+		if err != nil {
+			return err
+		}
+		if *field, err = keys.seal(plain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// credentialKeyCache holds the encryption keys, so that they are not loaded for every credential.
+type credentialKeyCache struct {
+	lock      sync.Mutex
+	keys      *credentialKeys
+	expiresAt time.Time
+}
+
+func (c *credentialKeyCache) get(now time.Time) (*credentialKeys, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.keys == nil || now.After(c.expiresAt) {
+		return nil, false
+	}
+	return c.keys, true
+}
+
+func (c *credentialKeyCache) set(keys *credentialKeys, now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.keys = keys
+	c.expiresAt = now.Add(credentialKeysTTL)
+}
+
+func (c *credentialKeyCache) invalidate() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.keys = nil
+}
+
+func (store store) loadCredentialKeys(refresh bool) (*credentialKeys, error) {
+	now := time.Now()
+	if !refresh {
+		if keys, ok := store.plugin.credentialKeys.get(now); ok {
+			return keys, nil
+		}
+	}
+
+	keys := &credentialKeys{}
+	if err := store.plugin.client.KV.Get(keyCredentialKeys, keys); err != nil {
+		return nil, errors.WithMessage(err, "failed to load credential encryption keys")
+	}
+	if keys.Current == 0 {
+		secret, err := store.EnsureAuthTokenEncryptSecret()
+		if err != nil {
+			return nil, err
+		}
+		keys = &credentialKeys{Current: 1, Keys: map[int][]byte{1: secret}}
+	}
+	store.plugin.credentialKeys.set(keys, now)
+	return keys, nil
+}
+
+// sealCredentials encrypts the credentials in place with the current key.
+func (store store) sealCredentials(fields []*string) error {
+	empty := true
+	for _, field := range fields {
+		empty = empty && *field == ""
+	}
+	if empty {
+		return nil
+	}
+
+	keys, err := store.loadCredentialKeys(false)
+	if err != nil {
+		return err
+	}
+	for _, field := range fields {
+		if *field, err = keys.seal(*field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openCredentials decrypts the credentials in place, reloading the keys once if one was encrypted
+// with a key this server does not know yet.
+func (store store) openCredentials(fields []*string) error {
+	sealed := false
+	for _, field := range fields {
+		_, _, ok := credentialKeyVersion(*field)
+		sealed = sealed || ok
+	}
+	if !sealed {
+		return nil
+	}
+
+	keys, err := store.loadCredentialKeys(false)
+	if err != nil {
+		return err
+	}
+	refreshed := false
+	for _, field := range fields {
+		plain, err := keys.open(*field)
+		if errors.Is(err, errCredentialKeyNotFound) && !refreshed {
+			refreshed = true
+			if keys, err = store.loadCredentialKeys(true); err != nil {
+				return err
+			}
+			plain, err = keys.open(*field)
+		}
+		if err != nil {
+			return err
+		}
+		*field = plain
+	}
+	return nil
+}
+
+func connectionCredentials(c *Connection) []*string {
+	fields := []*string{&c.Oauth1AccessToken, &c.Oauth1AccessSecret}
+	if c.OAuth2Token != nil {
+		fields = append(fields, &c.OAuth2Token.AccessToken, &c.OAuth2Token.RefreshToken)
+	}
+	return fields
+}
+
+func instanceCredentials(instance Instance) []*string {
+	switch instance := instance.(type) {
+	case *cloudInstance:
+		return []*string{&instance.RawAtlassianSecurityContext}
+	case *cloudOAuthInstance:
+		fields := []*string{&instance.JiraClientSecret, &instance.CodeVerifier}
+		if instance.JWTInstance != nil {
+			fields = append(fields, &instance.JWTInstance.RawAtlassianSecurityContext)
+		}
+		return fields
+	}
+	return nil
+}
+
+// copyConnection copies the connection deep enough to encrypt the copy's credentials.
+func copyConnection(c *Connection) *Connection {
+	copied := *c
+	if c.OAuth2Token != nil {
+		token := *c.OAuth2Token
+		copied.OAuth2Token = &token
+	}
+	return &copied
+}
+
+// copyInstance copies the instance deep enough to encrypt the copy's credentials.
+func copyInstance(instance Instance) Instance {
+	switch instance := instance.(type) {
+	case *cloudInstance:
+		copied := *instance
+		return &copied
+	case *cloudOAuthInstance:
+		copied := *instance
+		if instance.JWTInstance != nil {
+			jwtInstance := *instance.JWTInstance
+			copied.JWTInstance = &jwtInstance
+		}
+		return &copied
+	}
+	return instance
+}
+
+func decodeConnectionCredentials(data []byte) (interface{}, []*string, error) {
+	c := &Connection{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, nil, err
+	}
+	return c, connectionCredentials(c), nil
+}
+
+func decodeInstanceCredentials(data []byte) (interface{}, []*string, error) {
+	si := &serverInstance{}
+	if err := json.Unmarshal(data, si); err != nil {
+		return nil, nil, err
+	}
+
+	var instance Instance
+	switch si.Type {
+	case CloudInstanceType:
+		instance = &cloudInstance{}
+	case CloudOAuthInstanceType:
+		instance = &cloudOAuthInstance{}
+	default:
+		return si, nil, nil
+	}
+	if err := json.Unmarshal(data, instance); err != nil {
+		return nil, nil, err
+	}
+	return instance, instanceCredentials(instance), nil
+}
+
+// resealCredentials encrypts the credentials of the record stored at the key with the current key.
+// The record is changed atomically, so that a change made meanwhile, such as a refreshed OAuth2
+// token, is not lost.
+func (p *Plugin) resealCredentials(key string, keys *credentialKeys, decodeCredentials func(data []byte) (interface{}, []*string, error)) (bool, error) {
+	var data []byte
+	if err := p.client.KV.Get(key, &data); err != nil {
+		return false, err
+	}
+	if len(data) == 0 {
+		return false, nil
+	}
+	_, fields, err := decodeCredentials(data)
+	if err != nil {
+		return false, err
+	}
+	if !keys.needReseal(fields) {
+		return false, nil
+	}
+
+	err = p.client.KV.SetAtomicWithRetries(key, func(initialBytes []byte) (interface{}, error) {
+		if len(initialBytes) == 0 {
+			return nil, nil
+		}
+		record, fields, err := decodeCredentials(initialBytes)
+		if err != nil {
+			return nil, err
+		}
+		if err := keys.reseal(fields); err != nil {
+			return nil, err
+		}
+		return record, nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// forEachCredentialRecord calls f with the key of every stored record holding credentials, and
+// the function to decode it.
+func (p *Plugin) forEachCredentialRecord(s *store, f func(key string, decodeCredentials func(data []byte) (interface{}, []*string, error))) error {
+	instances, err := s.LoadInstances()
+	if err != nil {
+		return err
+	}
+	for _, instanceID := range instances.IDs() {
+		f(hashkey(prefixInstance, instanceID.String()), decodeInstanceCredentials)
+	}
+
+	return s.MapUsers(func(user *User) error {
+		for _, instanceID := range user.ConnectedInstances.IDs() {
+			f(keyWithInstanceID(instanceID, user.MattermostUserID), decodeConnectionCredentials)
+		}
+		return nil
+	})
+}
+
+// migrateCredentials encrypts the credentials stored before they were encrypted, or with an older
+// key than the current one. The older keys are removed once no credentials use them, and long
+// enough after the rotation that no server encrypts with them anymore.
+func (p *Plugin) migrateCredentials() error {
+	mutex, err := cluster.NewMutex(p.API, credentialMigrationMutexKey)
+	if err != nil {
+		return err
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	s := &store{plugin: p}
+	keys, err := s.loadCredentialKeys(true)
+	if err != nil {
+		return err
+	}
+
+	resealed, failed := 0, 0
+	err = p.forEachCredentialRecord(s, func(key string, decodeCredentials func(data []byte) (interface{}, []*string, error)) {
+		ok, resealErr := p.resealCredentials(key, keys, decodeCredentials)
+		if resealErr != nil {
+			failed++
+			p.errorf("Failed to encrypt the credentials stored at %s: %v", key, resealErr)
+			return
+		}
+		if ok {
+			resealed++
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if resealed > 0 {
+		p.client.Log.Info("Encrypted the stored credentials.", "key_version", keys.Current, "count", resealed)
+	}
+	if failed > 0 {
+		return errors.Errorf("failed to encrypt %d of the stored credentials, the older keys are kept", failed)
+	}
+	if len(keys.Keys) <= 1 || time.Since(keys.RotatedAt) < credentialKeyRetireDelay {
+		return nil
+	}
+
+	// A server may have encrypted a credential with an older key while they were encrypted again,
+	// only the keys no credential uses anymore are removed.
+	inUse, err := p.credentialKeyVersionsInUse(s)
+	if err != nil {
+		return err
+	}
+	return p.retireCredentialKeys(keys.Current, inUse)
+}
+
+// credentialKeyVersionsInUse returns the versions of the keys the stored credentials are
+// encrypted with.
+func (p *Plugin) credentialKeyVersionsInUse(s *store) (map[int]bool, error) {
+	inUse := map[int]bool{}
+	var loadErr error
+	err := p.forEachCredentialRecord(s, func(key string, decodeCredentials func(data []byte) (interface{}, []*string, error)) {
+		var data []byte
+		if err := p.client.KV.Get(key, &data); err != nil {
+			loadErr = err
+			return
+		}
+		if len(data) == 0 {
+			return
+		}
+		_, fields, err := decodeCredentials(data)
+		if err != nil {
+			loadErr = err
+			return
+		}
+		for _, field := range fields {
+			if version, _, sealed := credentialKeyVersion(*field); sealed {
+				inUse[version] = true
+			}
+		}
+	})
+	if err == nil {
+		err = loadErr
+	}
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to check the credential encryption keys in use")
+	}
+	return inUse, nil
+}
+
+func (p *Plugin) runCredentialMigration() {
+	if err := p.migrateCredentials(); err != nil {
+		p.errorf("Failed to encrypt the stored credentials: %v", err)
+		return
+	}
+
+	// The older keys are kept for a while after a rotation, run again to remove them then.
+	keys, err := (&store{plugin: p}).loadCredentialKeys(true)
+	if err != nil || len(keys.Keys) <= 1 {
+		return
+	}
+	if wait := time.Until(keys.RotatedAt.Add(credentialKeyRetireDelay)); wait > 0 {
+		time.AfterFunc(wait+time.Second, p.runCredentialMigration)
+	}
+}
+
+// retireCredentialKeys removes the keys older than the given version that are not in use.
+func (p *Plugin) retireCredentialKeys(version int, inUse map[int]bool) error {
+	retired := false
+	err := p.client.KV.SetAtomicWithRetries(keyCredentialKeys, func(initialBytes []byte) (interface{}, error) {
+		retired = false
+		if len(initialBytes) == 0 {
+			return nil, nil
+		}
+		keys := &credentialKeys{}
+		if err := json.Unmarshal(initialBytes, keys); err != nil {
+			return nil, err
+		}
+		for v := range keys.Keys {
+			if v < version && !inUse[v] {
+				delete(keys.Keys, v)
+				retired = true
+			}
+		}
+		if !retired {
+			return initialBytes, nil
+		}
+		return keys, nil
+	})
+	if err != nil {
+		return errors.WithMessage(err, "failed to remove the older credential encryption keys")
+	}
+	if retired {
+		p.invalidateCredentialKeys()
+	}
+	return nil
+}
+
+// rotateCredentialKey makes a new key the one credentials are encrypted with. The stored
+// credentials must then be encrypted again with migrateCredentials.
+func (p *Plugin) rotateCredentialKey() (*credentialKeys, error) {
+	s := &store{plugin: p}
+	initial, err := s.loadCredentialKeys(true)
+	if err != nil {
+		return nil, err
+	}
+
+	var rotated *credentialKeys
+	err = p.client.KV.SetAtomicWithRetries(keyCredentialKeys, func(initialBytes []byte) (interface{}, error) {
+		keys := &credentialKeys{Current: initial.Current, Keys: map[int][]byte{}}
+		for v, key := range initial.Keys {
+			keys.Keys[v] = key
+		}
+		if len(initialBytes) != 0 {
+			keys = &credentialKeys{}
+			if err := json.Unmarshal(initialBytes, keys); err != nil {
+				return nil, err
+			}
+		}
+
+		key := make([]byte, credentialKeySize)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		keys.Current++
+		keys.Keys[keys.Current] = key
+		keys.RotatedAt = time.Now()
+		rotated = keys
+		return keys, nil
+	})
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to rotate the credential encryption key")
+	}
+	p.invalidateCredentialKeys()
+	return rotated, nil
+}
+
+// invalidateCredentialKeys makes every server reload the encryption keys.
+func (p *Plugin) invalidateCredentialKeys() {
+	p.credentialKeys.invalidate()
+
+	err := p.client.Cluster.PublishPluginEvent(
+		model.PluginClusterEvent{Id: clusterEventCredentialKeysChanged},
+		model.PluginClusterEventSendOptions{SendType: model.PluginClusterEventSendTypeReliable},
+	)
+	if err != nil {
+		p.errorf("Failed to publish the change of credential encryption keys: %v", err)
+	}
+}
+
+func executeEncryptionRotate(p *Plugin, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	if resp := p.checkSysAdminCommand(header, "/jira encryption"); resp != nil {
+		return resp
+	}
+	if len(args) != 0 {
+		return p.help(header)
+	}
+
+	keys, err := p.rotateCredentialKey()
+	if err != nil {
+		return p.responsef(header, "%v", err)
+	}
+	go p.runCredentialMigration()
+
+	return p.responsef(header, "Credentials are now encrypted with key version %d. The stored credentials are being encrypted again in the background, the older keys are removed once no credentials use them anymore.", keys.Current)
+}
+
+func executeEncryptionStatus(p *Plugin, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	if resp := p.checkSysAdminCommand(header, "/jira encryption"); resp != nil {
+		return resp
+	}
+	if len(args) != 0 {
+		return p.help(header)
+	}
+
+	keys, err := (&store{plugin: p}).loadCredentialKeys(true)
+	if err != nil {
+		return p.responsef(header, "%v", err)
+	}
+	if keys.RotatedAt.IsZero() {
+		return p.responsef(header, "Credentials are encrypted with the auth token secret, the key has never been rotated.")
+	}
+
+	older := []int{}
+	for v := range keys.Keys {
+		if v != keys.Current {
+			older = append(older, v)
+		}
+	}
+	sort.Ints(older)
+	text := fmt.Sprintf("Credentials are encrypted with key version %d, rotated on %s.", keys.Current, keys.RotatedAt.Format(time.RFC3339))
+	if len(older) > 0 {
+		text += fmt.Sprintf(" Older key versions still used by some credentials: %v.", older)
+	}
+	return p.responsef(header, text)
+}
@@ -0,0 +1,227 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License for license information.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	jira "github.com/andygrunwald/go-jira"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+
+	"github.com/mattermost/mattermost-plugin-jira/server/utils/types"
+)
+
+func testCredentialKey(version int) []byte {
+	return bytes.Repeat([]byte{byte(version)}, credentialKeySize)
+}
+
+func setupTestCredentialStore(t *testing.T) (*Plugin, testKVStore) {
+	p, kv := setupTestWebhookQueue(t)
+	api := p.API.(*plugintest.API)
+	api.On("LogInfo", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Maybe()
+	api.On("PublishPluginClusterEvent", mock.AnythingOfType("model.PluginClusterEvent"), mock.AnythingOfType("model.PluginClusterEventSendOptions")).Maybe().Return(nil)
+	kv[keyTokenSecret] = testCredentialKey(1)
+	return p, kv
+}
+
+// openTestInstancePayload decrypts the secrets of a stored instance, to compare it with the
+// expected plain payload.
+func openTestInstancePayload(t *testing.T, p *Plugin, payload []byte) []byte {
+	record, fields, err := decodeInstanceCredentials(payload)
+	require.NoError(t, err)
+	if len(fields) == 0 {
+		return payload
+	}
+	for _, field := range fields {
+		if *field != "" {
+			assert.True(t, strings.HasPrefix(*field, credentialEnvelopePrefix), "expected %q to be encrypted", *field)
+		}
+	}
+	require.NoError(t, (&store{plugin: p}).openCredentials(fields))
+	data, err := json.Marshal(record)
+	require.NoError(t, err)
+	return data
+}
+
+func TestCredentialKeys(t *testing.T) {
+	keys := &credentialKeys{Current: 2, Keys: map[int][]byte{1: testCredentialKey(1), 2: testCredentialKey(2)}}
+
+	sealed, err := keys.seal("secret")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(sealed, "enc1:2:"))
+	assert.NotContains(t, sealed, "secret")
+
+	resealed, err := keys.seal(sealed)
+	require.NoError(t, err)
+	assert.Equal(t, sealed, resealed)
+
+	opened, err := keys.open(sealed)
+	require.NoError(t, err)
+	assert.Equal(t, "secret", opened)
+
+	for _, value := range []string{"", "plain", "enc1:not-a-version"} {
+		opened, err = keys.open(value)
+		require.NoError(t, err)
+		assert.Equal(t, value, opened)
+	}
+	empty, err := keys.seal("")
+	require.NoError(t, err)
+	assert.Empty(t, empty)
+
+	_, err = keys.open("enc1:3:AAAA")
+	assert.ErrorIs(t, err, errCredentialKeyNotFound)
+
+	old := &credentialKeys{Current: 1, Keys: map[int][]byte{1: testCredentialKey(1)}}
+	oldSealed, err := old.seal("secret")
+	require.NoError(t, err)
+	plain := "plain"
+	empty = ""
+	assert.False(t, keys.needReseal([]*string{&sealed, &empty}))
+	assert.True(t, keys.needReseal([]*string{&sealed, &oldSealed}))
+	assert.True(t, keys.needReseal([]*string{&plain}))
+
+	require.NoError(t, keys.reseal([]*string{&oldSealed, &plain}))
+	assert.True(t, strings.HasPrefix(oldSealed, "enc1:2:"))
+	assert.True(t, strings.HasPrefix(plain, "enc1:2:"))
+}
+
+func TestStoreConnectionEncryptsCredentials(t *testing.T) {
+	p, kv := setupTestCredentialStore(t)
+	s := NewStore(p)
+	instanceID := types.ID("https://jira.example.com")
+
+	connection := &Connection{
+		User:               jira.User{AccountID: "jira-account"},
+		Oauth1AccessToken:  "oauth1-access-token",
+		Oauth1AccessSecret: "oauth1-access-secret",
+		OAuth2Token:        &oauth2.Token{AccessToken: "oauth2-access-token", RefreshToken: "oauth2-refresh-token"},
+	}
+	require.NoError(t, s.StoreConnection(instanceID, "user1", connection))
+	assert.Equal(t, "oauth1-access-token", connection.Oauth1AccessToken)
+	assert.Equal(t, "oauth2-refresh-token", connection.OAuth2Token.RefreshToken)
+
+	stored := string(kv[keyWithInstanceID(instanceID, "user1")])
+	for _, secret := range []string{"oauth1-access-token", "oauth1-access-secret", "oauth2-access-token", "oauth2-refresh-token"} {
+		assert.NotContains(t, stored, secret)
+	}
+
+	loaded, err := s.LoadConnection(instanceID, "user1")
+	require.NoError(t, err)
+	assert.Equal(t, "oauth1-access-token", loaded.Oauth1AccessToken)
+	assert.Equal(t, "oauth1-access-secret", loaded.Oauth1AccessSecret)
+	assert.Equal(t, "oauth2-access-token", loaded.OAuth2Token.AccessToken)
+	assert.Equal(t, "oauth2-refresh-token", loaded.OAuth2Token.RefreshToken)
+
+	// Connections stored before credentials were encrypted are still loaded.
+	kv[keyWithInstanceID(instanceID, "user2")] = []byte(`{"Oauth1AccessToken":"plain-token"}`)
+	loaded, err = s.LoadConnection(instanceID, "user2")
+	require.NoError(t, err)
+	assert.Equal(t, "plain-token", loaded.Oauth1AccessToken)
+}
+
+func TestStoreInstanceEncryptsSecrets(t *testing.T) {
+	p, kv := setupTestCredentialStore(t)
+	s := NewStore(p)
+
+	rawASC := `{"key":"mattermost","sharedSecret":"shared-secret","baseUrl":"https://mmtest.atlassian.net"}`
+	ci := newCloudInstance(p, "https://mmtest.atlassian.net", true, rawASC,
+		&AtlassianSecurityContext{SharedSecret: "shared-secret", BaseURL: "https://mmtest.atlassian.net"})
+	require.NoError(t, s.StoreInstance(ci))
+	assert.Equal(t, rawASC, ci.RawAtlassianSecurityContext)
+	assert.NotContains(t, string(kv[hashkey(prefixInstance, "https://mmtest.atlassian.net")]), "shared-secret")
+
+	loaded, err := s.LoadInstance("https://mmtest.atlassian.net")
+	require.NoError(t, err)
+	require.IsType(t, &cloudInstance{}, loaded)
+	assert.Equal(t, "shared-secret", loaded.(*cloudInstance).AtlassianSecurityContext.SharedSecret)
+}
+
+func TestRotateCredentialKey(t *testing.T) {
+	p, kv := setupTestCredentialStore(t)
+	s := NewStore(p)
+	instanceID := types.ID("https://mmtest.atlassian.net")
+
+	rawASC := `{"sharedSecret":"shared-secret","baseUrl":"https://mmtest.atlassian.net"}`
+	ci := newCloudInstance(p, instanceID, true, rawASC, &AtlassianSecurityContext{SharedSecret: "shared-secret"})
+	require.NoError(t, s.StoreInstance(ci))
+	require.NoError(t, s.StoreInstances(NewInstances(ci.Common())))
+
+	for _, userID := range []types.ID{"user1", "user2"} {
+		require.NoError(t, s.StoreUser(&User{MattermostUserID: userID, ConnectedInstances: NewInstances(ci.Common())}))
+	}
+	require.NoError(t, s.StoreConnection(instanceID, "user1", &Connection{
+		User:        jira.User{AccountID: "account1"},
+		OAuth2Token: &oauth2.Token{AccessToken: "access1", RefreshToken: "refresh1"},
+	}))
+	// Stored before credentials were encrypted.
+	kv[keyWithInstanceID(instanceID, "user2")] = []byte(`{"Oauth1AccessToken":"plain-token"}`)
+
+	keys, err := p.rotateCredentialKey()
+	require.NoError(t, err)
+	assert.Equal(t, 2, keys.Current)
+	assert.Len(t, keys.Keys, 2)
+
+	require.NoError(t, p.migrateCredentials())
+
+	// The older key is kept while servers may still encrypt with it.
+	stored := &credentialKeys{}
+	require.NoError(t, json.Unmarshal(kv[keyCredentialKeys], stored))
+	assert.Equal(t, 2, stored.Current)
+	assert.Len(t, stored.Keys, 2)
+
+	stored.RotatedAt = time.Now().Add(-credentialKeyRetireDelay)
+	kv[keyCredentialKeys], err = json.Marshal(stored)
+	require.NoError(t, err)
+
+	// A server encrypted a credential with the older key meanwhile.
+	old := &credentialKeys{Current: 1, Keys: map[int][]byte{1: stored.Keys[1]}}
+	user1Key := keyWithInstanceID(instanceID, "user1")
+	user1Data := kv[user1Key]
+	sealedWithOld, err := old.seal("access1")
+	require.NoError(t, err)
+	kv[user1Key] = []byte(`{"Oauth1AccessToken":"` + sealedWithOld + `"}`)
+	inUse, err := p.credentialKeyVersionsInUse(&store{plugin: p})
+	require.NoError(t, err)
+	assert.Equal(t, map[int]bool{1: true, 2: true}, inUse)
+	require.NoError(t, p.retireCredentialKeys(2, inUse))
+	stored = &credentialKeys{}
+	require.NoError(t, json.Unmarshal(kv[keyCredentialKeys], stored))
+	assert.Len(t, stored.Keys, 2, "keys in use are kept")
+	kv[user1Key] = user1Data
+
+	require.NoError(t, p.migrateCredentials())
+	stored = &credentialKeys{}
+	require.NoError(t, json.Unmarshal(kv[keyCredentialKeys], stored))
+	assert.Equal(t, 2, stored.Current)
+	assert.Len(t, stored.Keys, 1)
+	assert.Contains(t, stored.Keys, 2)
+
+	for key, decodeCredentials := range map[string]func([]byte) (interface{}, []*string, error){
+		keyWithInstanceID(instanceID, "user1"):       decodeConnectionCredentials,
+		keyWithInstanceID(instanceID, "user2"):       decodeConnectionCredentials,
+		hashkey(prefixInstance, instanceID.String()): decodeInstanceCredentials,
+	} {
+		_, fields, err := decodeCredentials(kv[key])
+		require.NoError(t, err)
+		assert.False(t, stored.needReseal(fields), "expected %s to be encrypted with the new key", key)
+	}
+
+	connection, err := s.LoadConnection(instanceID, "user1")
+	require.NoError(t, err)
+	assert.Equal(t, "refresh1", connection.OAuth2Token.RefreshToken)
+	connection, err = s.LoadConnection(instanceID, "user2")
+	require.NoError(t, err)
+	assert.Equal(t, "plain-token", connection.Oauth1AccessToken)
+	instance, err := s.LoadInstance(instanceID)
+	require.NoError(t, err)
+	assert.Equal(t, "shared-secret", instance.(*cloudInstance).AtlassianSecurityContext.SharedSecret)
+}
@@ -0,0 +1,473 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License for license information.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	jira "github.com/andygrunwald/go-jira"
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+	"github.com/mattermost/mattermost/server/public/pluginapi/cluster"
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-plugin-jira/server/utils/types"
+)
+
+const (
+	JiraDigestsKey = "jiradigests"
+
+	digestJobKey      = "jira_digests"
+	digestJobInterval = time.Minute
+
+	// DigestMaxIssues is the number of issues listed in a digest post.
+	DigestMaxIssues = 50
+)
+
+var digestWeekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// DigestSchedule is a set of days of the week and a time of day, in the given timezone.
+type DigestSchedule struct {
+	Weekdays []time.Weekday `json:"weekdays"`
+	Hour     int            `json:"hour"`
+	Minute   int            `json:"minute"`
+	Timezone string         `json:"timezone"`
+}
+
+// Digest is a JQL query whose results are posted to a channel on a schedule.
+type Digest struct {
+	ID               string         `json:"id"`
+	ChannelID        string         `json:"channel_id"`
+	MattermostUserID string         `json:"mattermost_user_id"`
+	InstanceID       types.ID       `json:"instance_id"`
+	JQL              string         `json:"jql"`
+	Schedule         DigestSchedule `json:"schedule"`
+	NextRunAt        time.Time      `json:"next_run_at"`
+}
+
+type Digests struct {
+	ByID map[string]Digest `json:"by_id"`
+}
+
+// parseDigestSchedule parses the days ("daily", "weekdays" or a comma separated list
+// such as "mon,wed,fri") and the time of day ("09:00") of a schedule.
+func parseDigestSchedule(days, at, timezone string) (DigestSchedule, error) {
+	schedule := DigestSchedule{Timezone: timezone}
+
+	switch strings.ToLower(days) {
+	case "daily":
+		schedule.Weekdays = []time.Weekday{time.Sunday, time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday}
+	case "weekdays":
+		schedule.Weekdays = []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}
+	default:
+		seen := map[time.Weekday]bool{}
+		for _, day := range strings.Split(strings.ToLower(days), ",") {
+			weekday, ok := digestWeekdays[strings.TrimSpace(day)]
+			if !ok {
+				return schedule, errors.Errorf("unknown day %q, use `daily`, `weekdays` or days such as `mon,wed,fri`", day)
+			}
+			if !seen[weekday] {
+				seen[weekday] = true
+				schedule.Weekdays = append(schedule.Weekdays, weekday)
+			}
+		}
+		sort.Slice(schedule.Weekdays, func(i, j int) bool { return schedule.Weekdays[i] < schedule.Weekdays[j] })
+	}
+
+	t, err := time.Parse("15:04", at)
+	if err != nil {
+		return schedule, errors.Errorf("invalid time %q, use the 24-hour `HH:MM` format", at)
+	}
+	schedule.Hour = t.Hour()
+	schedule.Minute = t.Minute()
+
+	if _, err = schedule.location(); err != nil {
+		return schedule, err
+	}
+	return schedule, nil
+}
+
+func (s DigestSchedule) location() (*time.Location, error) {
+	if s.Timezone == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unknown timezone %q", s.Timezone)
+	}
+	return loc, nil
+}
+
+// Next returns the first scheduled time strictly after the given time.
+func (s DigestSchedule) Next(after time.Time) time.Time {
+	loc, err := s.location()
+	if err != nil {
+		loc = time.UTC
+	}
+	local := after.In(loc)
+
+	for i := 0; i <= 7; i++ {
+		day := local.AddDate(0, 0, i)
+		candidate := time.Date(day.Year(), day.Month(), day.Day(), s.Hour, s.Minute, 0, 0, loc)
+		if !candidate.After(after) {
+			continue
+		}
+		for _, weekday := range s.Weekdays {
+			if candidate.Weekday() == weekday {
+				return candidate
+			}
+		}
+	}
+	return time.Time{}
+}
+
+func (s DigestSchedule) String() string {
+	days := []string{}
+	for _, weekday := range s.Weekdays {
+		days = append(days, weekday.String()[:3])
+	}
+
+	text := strings.Join(days, ", ")
+	switch len(s.Weekdays) {
+	case 7:
+		text = "Every day"
+	case 5:
+		if strings.Join(days, ",") == "Mon,Tue,Wed,Thu,Fri" {
+			text = "Weekdays"
+		}
+	}
+
+	tz := s.Timezone
+	if tz == "" {
+		tz = "UTC"
+	}
+	return fmt.Sprintf("%s at %02d:%02d (%s)", text, s.Hour, s.Minute, tz)
+}
+
+func (p *Plugin) getDigests() (*Digests, error) {
+	var data []byte
+	if err := p.client.KV.Get(JiraDigestsKey, &data); err != nil {
+		return nil, err
+	}
+	return digestsFromJSON(data)
+}
+
+func digestsFromJSON(data []byte) (*Digests, error) {
+	digests := &Digests{ByID: map[string]Digest{}}
+	if len(data) == 0 {
+		return digests, nil
+	}
+	if err := json.Unmarshal(data, digests); err != nil {
+		return nil, err
+	}
+	if digests.ByID == nil {
+		digests.ByID = map[string]Digest{}
+	}
+	return digests, nil
+}
+
+func (p *Plugin) updateDigests(f func(digests *Digests) error) error {
+	return p.client.KV.SetAtomicWithRetries(JiraDigestsKey, func(initialBytes []byte) (interface{}, error) {
+		digests, err := digestsFromJSON(initialBytes)
+		if err != nil {
+			return nil, err
+		}
+		if err = f(digests); err != nil {
+			return nil, err
+		}
+		return digests, nil
+	})
+}
+
+func (p *Plugin) getDigest(id string) (*Digest, error) {
+	digests, err := p.getDigests()
+	if err != nil {
+		return nil, err
+	}
+	digest, ok := digests.ByID[id]
+	if !ok {
+		return nil, errors.Errorf("digest %q not found", id)
+	}
+	return &digest, nil
+}
+
+func (p *Plugin) getDigestsForChannel(channelID string) ([]Digest, error) {
+	digests, err := p.getDigests()
+	if err != nil {
+		return nil, err
+	}
+
+	result := []Digest{}
+	for _, digest := range digests.ByID {
+		if digest.ChannelID == channelID {
+			result = append(result, digest)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].NextRunAt.Before(result[j].NextRunAt)
+	})
+	return result, nil
+}
+
+func (p *Plugin) saveDigest(digest *Digest) error {
+	digest.NextRunAt = digest.Schedule.Next(time.Now())
+	return p.updateDigests(func(digests *Digests) error {
+		digests.ByID[digest.ID] = *digest
+		return nil
+	})
+}
+
+func (p *Plugin) removeDigest(id string) error {
+	return p.updateDigests(func(digests *Digests) error {
+		if _, ok := digests.ByID[id]; !ok {
+			return errors.Errorf("digest %q not found", id)
+		}
+		delete(digests.ByID, id)
+		return nil
+	})
+}
+
+// runDueDigests posts every digest whose scheduled time has come, and schedules its next run.
+func (p *Plugin) runDueDigests() {
+	digests, err := p.getDigests()
+	if err != nil {
+		p.errorf("Failed to load digests: %v", err)
+		return
+	}
+
+	now := time.Now()
+	for id, digest := range digests.ByID {
+		if digest.NextRunAt.After(now) {
+			continue
+		}
+
+		// Move the schedule forward first, so that a failing digest is not retried every minute.
+		err = p.updateDigests(func(digests *Digests) error {
+			stored, ok := digests.ByID[id]
+			if !ok || stored.NextRunAt.After(now) {
+				return errors.New("digest was changed")
+			}
+			stored.NextRunAt = stored.Schedule.Next(now)
+			digests.ByID[id] = stored
+			return nil
+		})
+		if err != nil {
+			continue
+		}
+
+		if err = p.postDigest(&digest); err != nil {
+			p.errorf("Failed to post digest %s to channel %s: %v", digest.ID, digest.ChannelID, err)
+		}
+	}
+}
+
+func (p *Plugin) postDigest(digest *Digest) error {
+	client, instance, _, err := p.getClient(digest.InstanceID, types.ID(digest.MattermostUserID))
+	if err != nil {
+		return err
+	}
+
+	issues, err := client.SearchIssues(digest.JQL, &jira.SearchOptions{
+		MaxResults: DigestMaxIssues,
+		Fields:     []string{"summary", "status", "assignee", "priority"},
+	})
+	if err != nil {
+		return err
+	}
+
+	return p.client.Post.CreatePost(&model.Post{
+		UserId:    p.getUserID(),
+		ChannelId: digest.ChannelID,
+		Message:   formatDigest(digest, instance.GetJiraBaseURL(), issues),
+	})
+}
+
+func formatDigest(digest *Digest, jiraBaseURL string, issues []jira.Issue) string {
+	text := fmt.Sprintf("#### Jira digest\n`%s`\n", digest.JQL)
+	if len(issues) == 0 {
+		return text + "No issues found."
+	}
+
+	text += "\n|Issue|Summary|Status|Assignee|\n|--|--|--|--|\n"
+	for _, issue := range issues {
+		status, assignee := "", "_unassigned_"
+		if issue.Fields != nil {
+			if issue.Fields.Status != nil {
+				status = issue.Fields.Status.Name
+			}
+			if issue.Fields.Assignee != nil {
+				assignee = issue.Fields.Assignee.DisplayName
+			}
+		}
+		summary := ""
+		if issue.Fields != nil {
+			summary = strings.ReplaceAll(issue.Fields.Summary, "|", "\\|")
+		}
+		text += fmt.Sprintf("|[%s](%s/browse/%s)|%s|%s|%s|\n", issue.Key, jiraBaseURL, issue.Key, summary, status, assignee)
+	}
+
+	if len(issues) == DigestMaxIssues {
+		text += fmt.Sprintf("\nOnly the first %d issues are shown.", DigestMaxIssues)
+	}
+	return text
+}
+
+func (p *Plugin) scheduleDigestJob() error {
+	job, err := cluster.Schedule(p.API, digestJobKey, cluster.MakeWaitForInterval(digestJobInterval), p.runDueDigests)
+	if err != nil {
+		return errors.Wrap(err, "failed to schedule digest job")
+	}
+	p.digestJob = job
+	return nil
+}
+
+func executeDigestAdd(p *Plugin, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	instanceURL, args, err := p.parseCommandFlagInstanceURL(args)
+	if err != nil {
+		return p.responsef(header, "Failed to load your connection to Jira. Error: %v.", err)
+	}
+	if len(args) < 3 {
+		return p.help(header)
+	}
+
+	mattermostUserID := types.ID(header.UserId)
+	_, instanceID, err := p.ResolveUserInstanceURL(mattermostUserID, instanceURL)
+	if err != nil {
+		return p.responsef(header, "Failed to identify Jira instance %s. Error: %v.", instanceURL, err)
+	}
+	if err = p.hasPermissionToManageSubscription(instanceID, header.UserId, header.ChannelId); err != nil {
+		return p.responsef(header, "You don't have permission to manage digests in this channel: %v.", err)
+	}
+
+	timezone := ""
+	if user, userErr := p.client.User.Get(header.UserId); userErr == nil {
+		timezone = user.GetPreferredTimezone()
+	}
+	schedule, err := parseDigestSchedule(args[0], args[1], timezone)
+	if err != nil {
+		return p.responsef(header, "%v", err)
+	}
+
+	digest := &Digest{
+		ID:               model.NewId(),
+		ChannelID:        header.ChannelId,
+		MattermostUserID: header.UserId,
+		InstanceID:       instanceID,
+		JQL:              strings.Join(args[2:], " "),
+		Schedule:         schedule,
+	}
+	if err = p.validateDigestJQL(digest); err != nil {
+		return p.responsef(header, "Failed to run the JQL query. Error: %v.", err)
+	}
+	if err = p.saveDigest(digest); err != nil {
+		return p.responsef(header, "Failed to save the digest. Error: %v.", err)
+	}
+
+	return p.responsef(header, "Digest `%s` created: %s. The first one is due %s.",
+		digest.ID, schedule, digest.NextRunAt.Format(time.RFC1123))
+}
+
+func (p *Plugin) validateDigestJQL(digest *Digest) error {
+	client, _, _, err := p.getClient(digest.InstanceID, types.ID(digest.MattermostUserID))
+	if err != nil {
+		return err
+	}
+	_, err = client.SearchIssues(digest.JQL, &jira.SearchOptions{MaxResults: 1, Fields: []string{"summary"}})
+	return err
+}
+
+func executeDigestList(p *Plugin, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	if len(args) != 0 {
+		return p.help(header)
+	}
+
+	digests, err := p.getDigestsForChannel(header.ChannelId)
+	if err != nil {
+		return p.responsef(header, "Failed to load digests. Error: %v.", err)
+	}
+	if len(digests) == 0 {
+		return p.responsef(header, "There are no digests in this channel. Use `/jira digest add` to create one.")
+	}
+
+	text := "| ID | Schedule | JQL | Next run |\n|--|--|--|--|\n"
+	for _, digest := range digests {
+		text += fmt.Sprintf("|`%s`|%s|`%s`|%s|\n", digest.ID, digest.Schedule, digest.JQL, digest.NextRunAt.Format(time.RFC1123))
+	}
+	return p.responsef(header, "%s", text)
+}
+
+func executeDigestEdit(p *Plugin, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	if len(args) < 3 {
+		return p.help(header)
+	}
+
+	digest, err := p.loadDigestForEdit(header, args[0])
+	if err != nil {
+		return p.responsef(header, "%v", err)
+	}
+
+	switch args[1] {
+	case "schedule":
+		if len(args) != 4 {
+			return p.help(header)
+		}
+		digest.Schedule, err = parseDigestSchedule(args[2], args[3], digest.Schedule.Timezone)
+		if err != nil {
+			return p.responsef(header, "%v", err)
+		}
+	case "jql":
+		// The digest runs the new query with the Jira account of the user who wrote it.
+		digest.JQL = strings.Join(args[2:], " ")
+		digest.MattermostUserID = header.UserId
+		if err = p.validateDigestJQL(digest); err != nil {
+			return p.responsef(header, "Failed to run the JQL query. Error: %v.", err)
+		}
+	default:
+		return p.help(header)
+	}
+
+	if err = p.saveDigest(digest); err != nil {
+		return p.responsef(header, "Failed to save the digest. Error: %v.", err)
+	}
+	return p.responsef(header, "Digest `%s` updated. The next one is due %s.", digest.ID, digest.NextRunAt.Format(time.RFC1123))
+}
+
+func executeDigestDelete(p *Plugin, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	if len(args) != 1 {
+		return p.help(header)
+	}
+
+	digest, err := p.loadDigestForEdit(header, args[0])
+	if err != nil {
+		return p.responsef(header, "%v", err)
+	}
+	if err = p.removeDigest(digest.ID); err != nil {
+		return p.responsef(header, "Failed to delete the digest. Error: %v.", err)
+	}
+	return p.responsef(header, "Digest `%s` deleted.", digest.ID)
+}
+
+// loadDigestForEdit loads a digest the user may change, with the same rules as channel subscriptions.
+func (p *Plugin) loadDigestForEdit(header *model.CommandArgs, id string) (*Digest, error) {
+	digest, err := p.getDigest(id)
+	if err != nil {
+		return nil, err
+	}
+	if err = p.hasPermissionToManageSubscription(digest.InstanceID, header.UserId, digest.ChannelID); err != nil {
+		return nil, errors.Errorf("You don't have permission to manage this digest: %v.", err)
+	}
+	return digest, nil
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License for license information.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	jira "github.com/andygrunwald/go-jira"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDigestSchedule(t *testing.T) {
+	for name, tc := range map[string]struct {
+		days, at, timezone string
+		expected           string
+		expectedErr        bool
+	}{
+		"daily":           {days: "daily", at: "09:00", expected: "Every day at 09:00 (UTC)"},
+		"weekdays":        {days: "weekdays", at: "9:30", timezone: "Europe/Moscow", expected: "Weekdays at 09:30 (Europe/Moscow)"},
+		"some days":       {days: "fri,Mon,mon", at: "17:05", expected: "Mon, Fri at 17:05 (UTC)"},
+		"unknown day":     {days: "monday", at: "09:00", expectedErr: true},
+		"invalid time":    {days: "daily", at: "25:00", expectedErr: true},
+		"unknown zone":    {days: "daily", at: "09:00", timezone: "Mars/Olympus", expectedErr: true},
+		"missing minutes": {days: "daily", at: "9", expectedErr: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			schedule, err := parseDigestSchedule(tc.days, tc.at, tc.timezone)
+			if tc.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, schedule.String())
+		})
+	}
+}
+
+func TestDigestScheduleNext(t *testing.T) {
+	schedule, err := parseDigestSchedule("weekdays", "09:00", "Europe/Moscow")
+	require.NoError(t, err)
+	loc, err := time.LoadLocation("Europe/Moscow")
+	require.NoError(t, err)
+
+	// Friday 2024-03-01
+	friday := time.Date(2024, 3, 1, 8, 0, 0, 0, loc)
+	assert.Equal(t, time.Date(2024, 3, 1, 9, 0, 0, 0, loc), schedule.Next(friday))
+	assert.Equal(t, time.Date(2024, 3, 4, 9, 0, 0, 0, loc), schedule.Next(friday.Add(time.Hour)))
+	assert.Equal(t, time.Date(2024, 3, 4, 9, 0, 0, 0, loc), schedule.Next(friday.Add(2*time.Hour)))
+}
+
+func TestFormatDigest(t *testing.T) {
+	digest := &Digest{JQL: "project = TEST"}
+	assert.Equal(t, "#### Jira digest\n`project = TEST`\nNo issues found.", formatDigest(digest, "https://jira.example.com", nil))
+
+	text := formatDigest(digest, "https://jira.example.com", []jira.Issue{{
+		Key: "TEST-1",
+		Fields: &jira.IssueFields{
+			Summary: "A | B",
+			Status:  &jira.Status{Name: "Open"},
+		},
+	}})
+	assert.Contains(t, text, "|[TEST-1](https://jira.example.com/browse/TEST-1)|A \\| B|Open|_unassigned_|")
+}
@@ -9,7 +9,6 @@ import (
 	"github.com/andygrunwald/go-jira"
 	"github.com/mattermost/mattermost/server/public/model"
 	htmlTemplate "html/template"
-	"regexp"
 	textTemplate "text/template"
 
 	"net/http"
@@ -20,6 +19,7 @@ import (
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
@@ -38,6 +38,9 @@ const (
 	routeAPI                                    = "/api/v2"
 	routeInstancePath                           = "/instance/{id}"
 	routeAPICreateIssue                         = "/create-issue"
+	routeAPICreateIssueDialog                   = "/create-issue-dialog"
+	routeAPIIssueTemplates                      = "/issue-templates"
+	routeAPIBulkConfirm                         = "/bulk-confirm"
 	routeAPIGetCreateIssueMetadata              = "/get-create-issue-metadata-for-project"
 	routeAPIGetJiraProjectMetadata              = "/get-jira-project-metadata"
 	routeAPIGetSearchIssues                     = "/get-search-issues"
@@ -46,10 +49,24 @@ const (
 	routeAPIAttachCommentToIssue                = "/attach-comment-to-issue"
 	routeAPIUserInfo                            = "/userinfo"
 	routeAPISubscribeWebhook                    = "/webhook"
+	routeAPIWebhookDeadLetters                  = "/webhook/dead-letters"
+	routeAPIWebhookDeadLetterWithID             = routeAPIWebhookDeadLetters + "/{id:[A-Za-z0-9]+}"
+	routeAPIWebhookDeadLetterReplay             = routeAPIWebhookDeadLetterWithID + "/replay"
+	routeAPIIntegrationAuditLog                 = "/integration-tokens/audit"
 	routeAPISubscriptionsChannel                = "/subscriptions/channel"
 	routeAPISubscriptionsChannelWithID          = routeAPISubscriptionsChannel + "/{id:[A-Za-z0-9]+}"
 	routeAPISettingsInfo                        = "/settingsinfo"
+	routeAPINotificationSettings                = "/settings/notifications"
 	routeIssueTransition                        = "/transition"
+	routeIssueAssignToMe                        = "/issue-assign-to-me"
+	routeIssueChangePriority                    = "/issue-change-priority"
+	routeIssueWatch                             = "/issue-watch"
+	routeIssueCommentDialog                     = "/issue-comment-dialog"
+	routeIssueComment                           = "/issue-comment"
+	routeIssueLabelsDialog                      = "/issue-labels-dialog"
+	routeIssueLabels                            = "/issue-labels"
+	routeIssueWorklogDialog                     = "/issue-worklog-dialog"
+	routeIssueWorklog                           = "/issue-worklog"
 	routeAPIUserDisconnect                      = "/api/v3/disconnect"
 	routeACInstalled                            = "/ac/installed"
 	routeACJSON                                 = "/ac/atlassian-connect.json"
@@ -75,6 +92,7 @@ const (
 	routeUpdateIssue             = "/update-issue"
 	routeIssueTransitions        = "/issue-transitions"
 	routeIssueAvailableAssignees = "/issue-available-assignees"
+	routeWorklogReport           = "/worklog-report"
 
 	routeBackdoor              = "/backdoor"
 	routeBackdoorCheckUser     = "/check-user"
@@ -82,6 +100,9 @@ const (
 	routeBackdoorGetIssue      = "/get-issue"
 	routeBackdoorCheckWorklog  = "/check-worklog"
 	routeBackdoorGetProject    = "/get-project"
+	routeBackdoorListWorkLogs  = "/list-worklogs"
+	routeBackdoorUpdateWorkLog = "/update-worklog"
+	routeBackdoorDeleteWorkLog = "/delete-worklog"
 )
 
 const routePrefixInstance = "instance"
@@ -117,17 +138,35 @@ func (p *Plugin) initializeRouter() {
 	autocompleteRouter.HandleFunc(routeAutocompleteInstalledInstance, p.checkAuth(p.handleResponse(p.httpAutocompleteInstalledInstance))).Methods(http.MethodGet)
 	autocompleteRouter.HandleFunc(routeAutocompleteInstalledInstanceWithAlias, p.checkAuth(p.handleResponse(p.httpAutocompleteInstalledInstanceWithAlias))).Methods(http.MethodGet)
 
+	// The disconnect route predates the v3 API, and is registered first as its subrouter
+	// answers every other path under its prefix.
+	p.router.HandleFunc(routeAPIUserDisconnect, p.checkAuth(p.handleResponse(p.httpUserDisconnect))).Methods(http.MethodPost)
+
+	p.initializeAPIv3Router()
+
 	apiRouter := p.router.PathPrefix(routeAPI).Subrouter()
 
 	// Issue APIs
 	apiRouter.HandleFunc(routeAPIGetAutoCompleteFields, p.checkAuth(p.handleResponse(p.httpGetAutoCompleteFields))).Methods(http.MethodGet)
 	apiRouter.HandleFunc(routeAPICreateIssue, p.checkAuth(p.handleResponse(p.httpCreateIssue))).Methods(http.MethodPost)
+	apiRouter.HandleFunc(routeAPICreateIssueDialog, p.checkAuth(p.handleResponse(p.httpSubmitCreateIssueDialog))).Methods(http.MethodPost)
+	apiRouter.HandleFunc(routeAPIIssueTemplates, p.checkAuth(p.handleResponse(p.httpGetIssueTemplates))).Methods(http.MethodGet)
 	apiRouter.HandleFunc(routeAPIGetCreateIssueMetadata, p.checkAuth(p.handleResponse(p.httpGetCreateIssueMetadataForProjects))).Methods(http.MethodGet)
 	apiRouter.HandleFunc(routeAPIGetJiraProjectMetadata, p.checkAuth(p.handleResponse(p.httpGetJiraProjectMetadata))).Methods(http.MethodGet)
 	apiRouter.HandleFunc(routeAPIGetSearchIssues, p.checkAuth(p.handleResponse(p.httpGetSearchIssues))).Methods(http.MethodGet)
 	apiRouter.HandleFunc(routeAPIGetSearchUsers, p.checkAuth(p.handleResponse(p.httpGetSearchUsers))).Methods(http.MethodGet)
 	apiRouter.HandleFunc(routeAPIAttachCommentToIssue, p.checkAuth(p.handleResponse(p.httpAttachCommentToIssue))).Methods(http.MethodPost)
 	apiRouter.HandleFunc(routeIssueTransition, p.handleResponse(p.httpTransitionIssuePostAction)).Methods(http.MethodPost)
+	apiRouter.HandleFunc(routeAPIBulkConfirm, p.checkAuth(p.handleResponse(p.httpBulkConfirm))).Methods(http.MethodPost)
+	apiRouter.HandleFunc(routeIssueAssignToMe, p.checkAuth(p.handleResponse(p.httpIssueAssignToMe))).Methods(http.MethodPost)
+	apiRouter.HandleFunc(routeIssueChangePriority, p.checkAuth(p.handleResponse(p.httpIssueChangePriority))).Methods(http.MethodPost)
+	apiRouter.HandleFunc(routeIssueWatch, p.checkAuth(p.handleResponse(p.httpIssueWatch))).Methods(http.MethodPost)
+	apiRouter.HandleFunc(routeIssueCommentDialog, p.checkAuth(p.handleResponse(p.httpIssueCommentDialog))).Methods(http.MethodPost)
+	apiRouter.HandleFunc(routeIssueComment, p.checkAuth(p.handleResponse(p.httpIssueComment))).Methods(http.MethodPost)
+	apiRouter.HandleFunc(routeIssueLabelsDialog, p.checkAuth(p.handleResponse(p.httpIssueLabelsDialog))).Methods(http.MethodPost)
+	apiRouter.HandleFunc(routeIssueLabels, p.checkAuth(p.handleResponse(p.httpIssueLabels))).Methods(http.MethodPost)
+	apiRouter.HandleFunc(routeIssueWorklogDialog, p.checkAuth(p.handleResponse(p.httpIssueWorklogDialog))).Methods(http.MethodPost)
+	apiRouter.HandleFunc(routeIssueWorklog, p.checkAuth(p.handleResponse(p.httpIssueWorklog))).Methods(http.MethodPost)
 	apiRouter.HandleFunc(routeSharePublicly, p.handleResponse(p.httpShareIssuePublicly)).Methods(http.MethodPost)
 	apiRouter.HandleFunc(routeGetIssueByKey, p.handleResponse(p.httpGetIssueByKey)).Methods(http.MethodGet)
 
@@ -136,6 +175,7 @@ func (p *Plugin) initializeRouter() {
 	// User APIs
 	apiRouter.HandleFunc(routeAPIUserInfo, p.checkAuth(p.handleResponse(p.httpGetUserInfo))).Methods(http.MethodGet)
 	apiRouter.HandleFunc(routeAPISettingsInfo, p.checkAuth(p.handleResponse(p.httpGetSettingsInfo))).Methods(http.MethodGet)
+	apiRouter.HandleFunc(routeAPINotificationSettings, p.checkAuth(p.handleResponse(p.httpNotificationSettings))).Methods(http.MethodGet, http.MethodPut)
 
 	// Atlassian Connect application
 	instanceRouter.HandleFunc(routeACJSON, p.handleResponseWithCallbackInstance(p.httpACJSON)).Methods(http.MethodGet)
@@ -158,7 +198,6 @@ func (p *Plugin) initializeRouter() {
 	// User connect/disconnect links
 	instanceRouter.HandleFunc(routeUserConnect, p.checkAuth(p.handleResponseWithCallbackInstance(p.httpUserConnect))).Methods(http.MethodGet)
 	p.router.HandleFunc(routeUserStart, p.checkAuth(p.handleResponseWithCallbackInstance(p.httpUserStart))).Methods(http.MethodGet)
-	p.router.HandleFunc(routeAPIUserDisconnect, p.checkAuth(p.handleResponse(p.httpUserDisconnect))).Methods(http.MethodPost)
 
 	// Firehose webhook setup for channel subscriptions
 	instanceRouter.HandleFunc(makeAPIRoute(routeAPISubscribeWebhook), p.handleResponseWithCallbackInstance(p.httpSubscribeWebhook)).Methods(http.MethodPost)
@@ -167,6 +206,12 @@ func (p *Plugin) initializeRouter() {
 	apiRouter.HandleFunc(routeAPISubscribeWebhook, p.handleResponseWithCallbackInstance(p.httpSubscribeWebhook)).Methods(http.MethodPost)
 	instanceRouter.HandleFunc(routeIncomingWebhook, p.handleResponseWithCallbackInstance(p.httpWebhook)).Methods(http.MethodPost)
 
+	// Webhook events that failed to process after all retries
+	apiRouter.HandleFunc(routeAPIWebhookDeadLetters, p.checkAuth(p.checkIsAdmin(p.handleResponse(p.httpGetWebhookDeadLetters)))).Methods(http.MethodGet)
+	apiRouter.HandleFunc(routeAPIWebhookDeadLetterReplay, p.checkAuth(p.checkIsAdmin(p.handleResponse(p.httpReplayWebhookDeadLetter)))).Methods(http.MethodPost)
+	apiRouter.HandleFunc(routeAPIWebhookDeadLetterWithID, p.checkAuth(p.checkIsAdmin(p.handleResponse(p.httpDeleteWebhookDeadLetter)))).Methods(http.MethodDelete)
+	apiRouter.HandleFunc(routeAPIIntegrationAuditLog, p.checkAuth(p.checkIsAdmin(p.handleResponse(p.httpGetIntegrationAuditLog)))).Methods(http.MethodGet)
+
 	// Channel Subscriptions
 	apiRouter.HandleFunc(routeAPISubscriptionsChannelWithID, p.checkAuth(p.handleResponse(p.httpChannelGetSubscriptions))).Methods(http.MethodGet)
 	apiRouter.HandleFunc(routeAPISubscriptionsChannel, p.checkAuth(p.handleResponse(p.httpChannelCreateSubscription))).Methods(http.MethodPost)
@@ -180,13 +225,17 @@ func (p *Plugin) initializeRouter() {
 
 	apiRouter.HandleFunc(routeIssueTransitions, p.checkAuth(p.handleResponse(p.httpGetIssueTransitions))).Methods(http.MethodGet)
 	apiRouter.HandleFunc(routeIssueAvailableAssignees, p.checkAuth(p.handleResponse(p.httpGetIssueAvailableAssignees))).Methods(http.MethodGet)
+	apiRouter.HandleFunc(routeWorklogReport, p.checkAuth(p.handleResponse(p.httpGetWorklogReport))).Methods(http.MethodGet)
 
 	backdoorRouter := p.router.PathPrefix(routeBackdoor).Subrouter()
-	backdoorRouter.HandleFunc(routeBackdoorCheckUser, p.checkAuth(p.checkIsAuthBackdoors(p.handleResponse(p.httpBackdoorCheckUserAuth)))).Methods(http.MethodGet)
-	backdoorRouter.HandleFunc(routeBackdoorGetIssue, p.checkAuth(p.checkIsAuthBackdoors(p.handleResponse(p.httpBackdoorGetIssue)))).Methods(http.MethodGet)
-	backdoorRouter.HandleFunc(routeBackdoorCheckWorklog, p.checkAuth(p.checkIsAuthBackdoors(p.handleResponse(p.httpBackdoorCheckCreateWorklogIssue)))).Methods(http.MethodGet)
-	backdoorRouter.HandleFunc(routeBackdoorGetProject, p.checkAuth(p.checkIsAuthBackdoors(p.handleResponse(p.httpBackdoorGetProject)))).Methods(http.MethodGet)
-	backdoorRouter.HandleFunc(routeBackdoorCreateWorkLog, p.checkAuth(p.checkIsAuthBackdoors(p.handleResponse(p.httpBackdoorCreateWorkLog)))).Methods(http.MethodPost)
+	backdoorRouter.HandleFunc(routeBackdoorCheckUser, p.checkAuth(p.checkIntegrationToken(ScopeCheckUser, p.handleResponse(p.httpBackdoorCheckUserAuth)))).Methods(http.MethodGet)
+	backdoorRouter.HandleFunc(routeBackdoorGetIssue, p.checkAuth(p.checkIntegrationToken(ScopeReadIssue, p.handleResponse(p.httpBackdoorGetIssue)))).Methods(http.MethodGet)
+	backdoorRouter.HandleFunc(routeBackdoorCheckWorklog, p.checkAuth(p.checkIntegrationToken(ScopeReadIssue, p.handleResponse(p.httpBackdoorCheckCreateWorklogIssue)))).Methods(http.MethodGet)
+	backdoorRouter.HandleFunc(routeBackdoorGetProject, p.checkAuth(p.checkIntegrationToken(ScopeGetProject, p.handleResponse(p.httpBackdoorGetProject)))).Methods(http.MethodGet)
+	backdoorRouter.HandleFunc(routeBackdoorCreateWorkLog, p.checkAuth(p.checkIntegrationToken(ScopeCreateWorklog, p.handleResponse(p.httpBackdoorCreateWorkLog)))).Methods(http.MethodPost)
+	backdoorRouter.HandleFunc(routeBackdoorListWorkLogs, p.checkAuth(p.checkIntegrationToken(ScopeManageWorklog, p.handleResponse(p.httpBackdoorListWorkLogs)))).Methods(http.MethodGet)
+	backdoorRouter.HandleFunc(routeBackdoorUpdateWorkLog, p.checkAuth(p.checkIntegrationToken(ScopeManageWorklog, p.handleResponse(p.httpBackdoorUpdateWorkLog)))).Methods(http.MethodPut)
+	backdoorRouter.HandleFunc(routeBackdoorDeleteWorkLog, p.checkAuth(p.checkIntegrationToken(ScopeManageWorklog, p.handleResponse(p.httpBackdoorDeleteWorkLog)))).Methods(http.MethodDelete)
 }
 
 func (p *Plugin) ServeHTTP(c *plugin.Context, w http.ResponseWriter, r *http.Request) {
@@ -479,20 +528,11 @@ func (p *Plugin) httpParseIssuesInPost(w http.ResponseWriter, r *http.Request) (
 		return respondErr(w, http.StatusInternalServerError, errPost)
 	}
 
-	lprojects, err := client.ListProjects("", -1, false)
-	if errPost != nil {
-		return respondErr(w, http.StatusInternalServerError, errPost)
-	}
-
-	var projectKyes []string
-	for _, project := range lprojects {
-		pkey := project.Key
-		projectKyes = append(projectKyes, pkey)
+	re := p.projectKeyRegexp(instanceID, mattermostUserID, client, projectKeyListTimeout)
+	if re == nil {
+		return respondJSON(w, keys)
 	}
 
-	pattern := fmt.Sprintf(`(?i)\b(?:%s)-\d+\b`, join(projectKyes, "|"))
-	re := regexp.MustCompile(pattern)
-
 	matches := re.FindAllString(post.Message, -1)
 	uniqueMatches := make(map[string]bool)
 	for _, match := range matches {
@@ -623,3 +663,29 @@ func (p *Plugin) httpGetIssueAvailableAssignees(w http.ResponseWriter, r *http.R
 
 	return respondJSON(w, jiraUsers)
 }
+
+func (p *Plugin) httpGetWorklogReport(w http.ResponseWriter, r *http.Request) (int, error) {
+	mattermostUserID := r.Header.Get("Mattermost-User-Id")
+
+	instanceID, err := validateQueryKey(r, "instance_id")
+	if err != nil {
+		return respondErr(w, http.StatusBadRequest, err)
+	}
+
+	from, to, err := parseWorklogReportRange(r.URL.Query().Get("range"), p.userLocation(mattermostUserID), time.Now())
+	if err != nil {
+		return respondErr(w, http.StatusBadRequest, err)
+	}
+
+	client, _, connection, err := p.getClient(types.ID(instanceID), types.ID(mattermostUserID))
+	if err != nil {
+		return respondErr(w, http.StatusInternalServerError, err)
+	}
+
+	report, err := getWorklogReport(client, connection, from, to)
+	if err != nil {
+		return respondErr(w, http.StatusInternalServerError, err)
+	}
+
+	return respondJSON(w, report)
+}
@@ -1,12 +1,12 @@
 package main
 
 import (
-	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"strings"
+	"time"
 
 	jira "github.com/andygrunwald/go-jira"
 	"github.com/mattermost/mattermost/server/public/model"
@@ -40,7 +40,8 @@ type CloudOAuthConfigure struct {
 }
 
 type JiraAccessibleResources []struct {
-	ID string
+	ID  string
+	URL string
 }
 
 type PKCEParams struct {
@@ -129,9 +130,6 @@ func (ci *cloudOAuthInstance) GetClient(connection *Connection) (Client, error)
 }
 
 func (ci *cloudOAuthInstance) getClientForConnection(connection *Connection) (*jira.Client, *http.Client, error) {
-	oauth2Conf := ci.GetOAuthConfig()
-	ctx := context.Background()
-
 	// Checking if this user's connection is for a JWT instance
 	if connection.OAuth2Token == nil {
 		if ci.JWTInstance != nil {
@@ -142,32 +140,23 @@ func (ci *cloudOAuthInstance) getClientForConnection(connection *Connection) (*j
 		return nil, nil, errors.New("failed to create client for OAuth instance: no JWT instance found, and connection's OAuth token is missing")
 	}
 
-	tokenSource := oauth2Conf.TokenSource(ctx, connection.OAuth2Token)
-	client := oauth2.NewClient(ctx, tokenSource)
+	pooled := ci.Plugin.oauth2Clients.get(ci, connection, time.Now())
+	client := pooled.client
 
-	// Get a new token, if Access Token has expired
-	currentToken := connection.OAuth2Token
-	updatedToken, err := tokenSource.Token()
+	// Get a new token, if Access Token has expired. The token source stores the new access token
+	// & refresh token to get a new access token in future when it has expired.
+	token, err := pooled.source.Token()
 	if err != nil {
 		return nil, nil, errors.Wrap(err, "error in getting token from token source")
 	}
+	connection.OAuth2Token = token
 
-	if updatedToken.RefreshToken != currentToken.RefreshToken {
-		connection.OAuth2Token = updatedToken
-
-		// Store this new access token & refresh token to get a new access token in future when it has expired
-		if err = ci.Plugin.userStore.StoreConnection(ci.Common().InstanceID, connection.MattermostUserID, connection); err != nil {
+	if ci.JiraResourceID == "" {
+		if err = ci.storeJiraCloudResourceID(client); err != nil {
 			return nil, nil, err
 		}
 	}
 
-	// TODO: Get resource ID if not in the KV Store?
-	jiraID, err := ci.getJiraCloudResourceID(*client)
-	ci.JiraResourceID = jiraID
-	if err != nil {
-		return nil, nil, err
-	}
-
 	jiraClient, err := jira.NewClient(client, ci.GetURL())
 	return jiraClient, client, err
 }
@@ -255,10 +244,31 @@ func (ci *cloudOAuthInstance) getJiraCloudResourceID(client http.Client) (string
 		return "", errors.Wrap(err, "failed to unmarshal JiraAccessibleResources")
 	}
 
-	// We return the first resource ID only
 	if len(resources) < 1 {
 		return "", errors.New("No resources are available for this Jira Cloud Account.")
 	}
 
+	// The account may have access to several sites, prefer the one of the instance, or else
+	// return the first resource ID
+	for _, resource := range resources {
+		if resource.URL != "" && strings.EqualFold(strings.TrimSuffix(resource.URL, "/"), strings.TrimSuffix(ci.GetJiraBaseURL(), "/")) {
+			return resource.ID, nil
+		}
+	}
 	return resources[0].ID, nil
 }
+
+// storeJiraCloudResourceID gets the resource ID of the Jira site once, and stores it with the
+// instance so that it is not requested again for every client.
+func (ci *cloudOAuthInstance) storeJiraCloudResourceID(client *http.Client) error {
+	jiraID, err := ci.getJiraCloudResourceID(*client)
+	if err != nil {
+		return err
+	}
+	ci.JiraResourceID = jiraID
+
+	if err = ci.Plugin.instanceStore.StoreInstance(ci); err != nil {
+		ci.Plugin.errorf("Failed to store the Jira Cloud resource ID of %s: %v", ci.InstanceID, err)
+	}
+	return nil
+}
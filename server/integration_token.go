@@ -0,0 +1,514 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License for license information.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+	"github.com/mattermost/mattermost/server/public/pluginapi"
+	"github.com/pkg/errors"
+)
+
+const (
+	prefixIntegrationToken    = "itok_"      // + token ID, the integration tokens of the backdoor API
+	prefixIntegrationAuditLog = "itokaudit_" // + day and shard, the backdoor API calls of the day
+
+	// IntegrationTokenHeader is the request header the integrations pass their token in.
+	IntegrationTokenHeader = "X-Integration-Token"
+
+	// IntegrationAuditLogSize is the number of backdoor API calls kept in each shard of a day of
+	// the audit log, and returned by default.
+	IntegrationAuditLogSize = 1000
+
+	// IntegrationAuditLogDays is the number of days the backdoor API calls are kept.
+	IntegrationAuditLogDays = 30
+
+	integrationAuditLogShards  = 8
+	integrationAuditLogRetries = 5
+
+	integrationTokenSecretLength = 32
+
+	// legacyBackdoorBotName is the token name recorded for the calls of the bots allowed by the
+	// deprecated ListBackdoorsBots setting.
+	legacyBackdoorBotName = "ListBackdoorsBots"
+)
+
+// Scopes of the integration tokens, one per group of backdoor routes. ScopeActForUser lets the
+// calls act for the Mattermost user they pass in user_id instead of the caller.
+const (
+	ScopeCheckUser     = "check-user"
+	ScopeReadIssue     = "read-issue"
+	ScopeGetProject    = "get-project"
+	ScopeCreateWorklog = "create-worklog"
+	ScopeManageWorklog = "manage-worklog"
+	ScopeActForUser    = "act-for-user"
+)
+
+var integrationTokenScopes = []string{
+	ScopeCheckUser,
+	ScopeReadIssue,
+	ScopeGetProject,
+	ScopeCreateWorklog,
+	ScopeManageWorklog,
+	ScopeActForUser,
+}
+
+type integrationTokenContextKey struct{}
+
+// integrationTokenFromRequest returns the token checkIntegrationToken authorized the call with,
+// nil for the bots of the deprecated ListBackdoorsBots setting.
+func integrationTokenFromRequest(r *http.Request) *IntegrationToken {
+	token, _ := r.Context().Value(integrationTokenContextKey{}).(*IntegrationToken)
+	return token
+}
+
+// IntegrationToken authorizes an integration to call the backdoor API routes of its scopes.
+// Only the hash of the secret is stored, the token itself is shown once when it is created.
+type IntegrationToken struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	Scopes     []string  `json:"scopes"`
+	SecretHash string    `json:"secret_hash"`
+	CreatedBy  string    `json:"created_by"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// IntegrationAuditEntry records one call to the backdoor API.
+type IntegrationAuditEntry struct {
+	Time       time.Time `json:"time"`
+	TokenID    string    `json:"token_id,omitempty"`
+	TokenName  string    `json:"token_name,omitempty"`
+	UserID     string    `json:"user_id,omitempty"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Status     int       `json:"status"`
+	RemoteAddr string    `json:"remote_addr"`
+}
+
+func keyIntegrationToken(id string) string {
+	return prefixIntegrationToken + id
+}
+
+func keyIntegrationAuditLog(day time.Time, shard int) string {
+	return fmt.Sprintf("%s%s_%d", prefixIntegrationAuditLog, day.UTC().Format("20060102"), shard)
+}
+
+func hashIntegrationTokenSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func (t *IntegrationToken) hasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// parseIntegrationTokenScopes parses a comma separated list of scopes, "all" grants every scope.
+func parseIntegrationTokenScopes(in string) ([]string, error) {
+	if in == "all" {
+		return append([]string{}, integrationTokenScopes...), nil
+	}
+
+	requested := NewStringSet()
+	for _, scope := range strings.Split(in, ",") {
+		scope = strings.TrimSpace(scope)
+		if scope == "" {
+			continue
+		}
+		if !NewStringSet(integrationTokenScopes...).ContainsAny(scope) {
+			return nil, errors.Errorf("unknown scope %q, valid scopes are %s", scope, strings.Join(integrationTokenScopes, ", "))
+		}
+		requested[scope] = true
+	}
+
+	scopes := []string{}
+	for _, scope := range integrationTokenScopes {
+		if requested.ContainsAny(scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	if len(scopes) == 0 {
+		return nil, errors.New("at least one scope is required")
+	}
+	return scopes, nil
+}
+
+// createIntegrationToken stores a new token and returns it along with the value to give to
+// the integration, "<token ID>.<secret>".
+func (p *Plugin) createIntegrationToken(name string, scopes []string, createdBy string) (*IntegrationToken, string, error) {
+	tokens, err := p.listIntegrationTokens()
+	if err != nil {
+		return nil, "", err
+	}
+	for _, t := range tokens {
+		if t.Name == name {
+			return nil, "", errors.Errorf("a token named %q already exists", name)
+		}
+	}
+
+	b := make([]byte, integrationTokenSecretLength)
+	if _, err = rand.Read(b); err != nil {
+		return nil, "", err
+	}
+	secret := base64.RawURLEncoding.EncodeToString(b)
+
+	token := &IntegrationToken{
+		ID:         model.NewId(),
+		Name:       name,
+		Scopes:     scopes,
+		SecretHash: hashIntegrationTokenSecret(secret),
+		CreatedBy:  createdBy,
+		CreatedAt:  time.Now(),
+	}
+	if _, err = p.client.KV.Set(keyIntegrationToken(token.ID), token); err != nil {
+		return nil, "", errors.Wrap(err, "failed to store integration token")
+	}
+	return token, token.ID + "." + secret, nil
+}
+
+func (p *Plugin) loadIntegrationToken(id string) (*IntegrationToken, error) {
+	var token *IntegrationToken
+	if err := p.client.KV.Get(keyIntegrationToken(id), &token); err != nil {
+		return nil, errors.Wrap(err, "failed to load integration token")
+	}
+	if token == nil {
+		return nil, errors.Errorf("integration token %s not found", id)
+	}
+	return token, nil
+}
+
+func (p *Plugin) listIntegrationTokens() ([]*IntegrationToken, error) {
+	keys, err := p.listKeysWithPrefix(prefixIntegrationToken)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list integration tokens")
+	}
+
+	tokens := []*IntegrationToken{}
+	for _, key := range keys {
+		token, err := p.loadIntegrationToken(strings.TrimPrefix(key, prefixIntegrationToken))
+		if err != nil {
+			continue
+		}
+		tokens = append(tokens, token)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt.Before(tokens[j].CreatedAt)
+	})
+	return tokens, nil
+}
+
+// findIntegrationToken finds a token by its ID or its name.
+func (p *Plugin) findIntegrationToken(idOrName string) (*IntegrationToken, error) {
+	tokens, err := p.listIntegrationTokens()
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range tokens {
+		if t.ID == idOrName || t.Name == idOrName {
+			return t, nil
+		}
+	}
+	return nil, errors.Errorf("integration token %q not found", idOrName)
+}
+
+func (p *Plugin) revokeIntegrationToken(id string) error {
+	return p.client.KV.Delete(keyIntegrationToken(id))
+}
+
+// authenticateIntegrationToken returns the token matching the value passed by an integration.
+func (p *Plugin) authenticateIntegrationToken(value string) (*IntegrationToken, error) {
+	id, secret, ok := strings.Cut(value, ".")
+	if !ok || id == "" || secret == "" {
+		return nil, errors.New("malformed integration token")
+	}
+
+	token, err := p.loadIntegrationToken(id)
+	if err != nil {
+		return nil, errors.New("invalid integration token")
+	}
+	if subtle.ConstantTimeCompare([]byte(token.SecretHash), []byte(hashIntegrationTokenSecret(secret))) != 1 {
+		return nil, errors.New("invalid integration token")
+	}
+	return token, nil
+}
+
+// appendIntegrationAuditEntry stores the entry in one of the shards of its day, picked from the
+// time of the call, so that concurrent calls rarely update the same key. The shards expire once they are older than the retention.
+func (p *Plugin) appendIntegrationAuditEntry(entry IntegrationAuditEntry) error {
+	key := keyIntegrationAuditLog(entry.Time, int(entry.Time.UnixNano()%integrationAuditLogShards))
+	for i := 0; i < integrationAuditLogRetries; i++ {
+		var data []byte
+		if err := p.client.KV.Get(key, &data); err != nil {
+			return err
+		}
+		var entries []IntegrationAuditEntry
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &entries); err != nil {
+				return err
+			}
+		}
+		entries = append(entries, entry)
+		if len(entries) > IntegrationAuditLogSize {
+			entries = entries[len(entries)-IntegrationAuditLogSize:]
+		}
+
+		saved, err := p.client.KV.Set(key, entries, pluginapi.SetAtomic(data),
+			pluginapi.SetExpiry((IntegrationAuditLogDays+1)*24*time.Hour))
+		if err != nil {
+			return err
+		}
+		if saved {
+			return nil
+		}
+	}
+	return errors.Errorf("failed to update %s after %d attempts", key, integrationAuditLogRetries)
+}
+
+// getIntegrationAuditLog returns up to limit of the most recent audit entries, newest first,
+// optionally only those of one token.
+func (p *Plugin) getIntegrationAuditLog(tokenID string, limit int) ([]IntegrationAuditEntry, error) {
+	result := []IntegrationAuditEntry{}
+	day := time.Now()
+	for d := 0; d < IntegrationAuditLogDays && len(result) < limit; d++ {
+		var entries []IntegrationAuditEntry
+		for shard := 0; shard < integrationAuditLogShards; shard++ {
+			var shardEntries []IntegrationAuditEntry
+			if err := p.client.KV.Get(keyIntegrationAuditLog(day, shard), &shardEntries); err != nil {
+				return nil, errors.Wrap(err, "failed to load the integration audit log")
+			}
+			for _, e := range shardEntries {
+				if tokenID == "" || e.TokenID == tokenID {
+					entries = append(entries, e)
+				}
+			}
+		}
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].Time.After(entries[j].Time)
+		})
+		for _, e := range entries {
+			if len(result) == limit {
+				break
+			}
+			result = append(result, e)
+		}
+		day = day.AddDate(0, 0, -1)
+	}
+	return result, nil
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// isLegacyBackdoorBot returns true if the user is one of the bots allowed to call the backdoor
+// API without a token by the deprecated ListBackdoorsBots setting.
+func (p *Plugin) isLegacyBackdoorBot(mattermostUserID string) bool {
+	for _, id := range strings.Split(p.getConfig().ListBackdoorsBots, ",") {
+		if id = strings.TrimSpace(id); id != "" && id == mattermostUserID {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Plugin) recordIntegrationCall(entry IntegrationAuditEntry) {
+	if err := p.appendIntegrationAuditEntry(entry); err != nil {
+		p.errorf("Failed to record backdoor API call to the audit log: %v", err)
+	}
+}
+
+// checkIntegrationToken authorizes backdoor API calls with an integration token that has the
+// given scope, and records the authorized calls to the audit log. Until they are given a token,
+// the bots of the deprecated ListBackdoorsBots setting may still call every route without one.
+// It must be wrapped in checkAuth, the calls act for the Mattermost user making them unless the
+// token has ScopeActForUser.
+func (p *Plugin) checkIntegrationToken(scope string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		entry := IntegrationAuditEntry{
+			Time:       time.Now(),
+			UserID:     r.Header.Get("Mattermost-User-ID"),
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			RemoteAddr: r.RemoteAddr,
+		}
+
+		value := r.Header.Get(IntegrationTokenHeader)
+		if value == "" && p.isLegacyBackdoorBot(entry.UserID) {
+			entry.TokenName = legacyBackdoorBotName
+		} else {
+			token, err := p.authenticateIntegrationToken(value)
+			if err != nil {
+				http.Error(w, "Not authorized", http.StatusUnauthorized)
+				return
+			}
+			entry.TokenID = token.ID
+			entry.TokenName = token.Name
+
+			if !token.hasScope(scope) {
+				http.Error(w, fmt.Sprintf("Token is missing the %s scope", scope), http.StatusForbidden)
+				entry.Status = http.StatusForbidden
+				p.recordIntegrationCall(entry)
+				return
+			}
+			r = r.WithContext(context.WithValue(r.Context(), integrationTokenContextKey{}, token))
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler(recorder, r)
+		entry.Status = recorder.status
+		p.recordIntegrationCall(entry)
+	}
+}
+
+func (p *Plugin) httpGetIntegrationAuditLog(w http.ResponseWriter, r *http.Request) (int, error) {
+	limit := IntegrationAuditLogSize
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			return respondErr(w, http.StatusBadRequest, errors.New("limit must be a positive number"))
+		}
+		limit = n
+	}
+
+	entries, err := p.getIntegrationAuditLog(r.URL.Query().Get("token_id"), limit)
+	if err != nil {
+		return respondErr(w, http.StatusInternalServerError, err)
+	}
+	return respondJSON(w, entries)
+}
+
+func (p *Plugin) checkSysAdminCommand(header *model.CommandArgs, command string) *model.CommandResponse {
+	authorized, err := authorizedSysAdmin(p, header.UserId)
+	if err != nil {
+		return p.responsef(header, "%v", err)
+	}
+	if !authorized {
+		return p.responsef(header, "`%s` can only be run by a system administrator.", command)
+	}
+	return nil
+}
+
+func executeTokenCreate(p *Plugin, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	if resp := p.checkSysAdminCommand(header, "/jira token"); resp != nil {
+		return resp
+	}
+	if len(args) != 2 {
+		return p.help(header)
+	}
+
+	scopes, err := parseIntegrationTokenScopes(args[1])
+	if err != nil {
+		return p.responsef(header, "%v", err)
+	}
+	token, value, err := p.createIntegrationToken(args[0], scopes, header.UserId)
+	if err != nil {
+		return p.responsef(header, "Failed to create the token: %v", err)
+	}
+
+	return p.responsef(header, "Token %q (`%s`) created with scopes %s. Pass it in the `%s` header of the backdoor API calls, "+
+		"which act for the Mattermost user making them, or with the `%s` scope for the `user_id` they pass. "+
+		"It will not be shown again:\n```\n%s\n```", token.Name, token.ID, strings.Join(token.Scopes, ", "), IntegrationTokenHeader, ScopeActForUser, value)
+}
+
+func executeTokenList(p *Plugin, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	if resp := p.checkSysAdminCommand(header, "/jira token"); resp != nil {
+		return resp
+	}
+	if len(args) != 0 {
+		return p.help(header)
+	}
+
+	tokens, err := p.listIntegrationTokens()
+	if err != nil {
+		return p.responsef(header, "%v", err)
+	}
+	if len(tokens) == 0 {
+		return p.responsef(header, "There are no integration tokens.")
+	}
+
+	text := "| ID | Name | Scopes | Created |\n|--|--|--|--|\n"
+	for _, t := range tokens {
+		text += fmt.Sprintf("|`%s`|%s|%s|%s|\n", t.ID, t.Name, strings.Join(t.Scopes, ", "), t.CreatedAt.Format(time.RFC3339))
+	}
+	return p.responsef(header, "%s", text)
+}
+
+func executeTokenRevoke(p *Plugin, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	if resp := p.checkSysAdminCommand(header, "/jira token"); resp != nil {
+		return resp
+	}
+	if len(args) != 1 {
+		return p.help(header)
+	}
+
+	token, err := p.findIntegrationToken(args[0])
+	if err != nil {
+		return p.responsef(header, "%v", err)
+	}
+	if err = p.revokeIntegrationToken(token.ID); err != nil {
+		return p.responsef(header, "Failed to revoke token %q: %v", token.Name, err)
+	}
+	return p.responsef(header, "Token %q has been revoked.", token.Name)
+}
+
+func executeTokenAudit(p *Plugin, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	if resp := p.checkSysAdminCommand(header, "/jira token"); resp != nil {
+		return resp
+	}
+	if len(args) > 2 {
+		return p.help(header)
+	}
+
+	limit := 20
+	tokenID := ""
+	for _, arg := range args {
+		if n, err := strconv.Atoi(arg); err == nil && n > 0 {
+			limit = n
+			continue
+		}
+		token, err := p.findIntegrationToken(arg)
+		if err != nil {
+			return p.responsef(header, "%v", err)
+		}
+		tokenID = token.ID
+	}
+
+	entries, err := p.getIntegrationAuditLog(tokenID, limit)
+	if err != nil {
+		return p.responsef(header, "%v", err)
+	}
+	if len(entries) == 0 {
+		return p.responsef(header, "No backdoor API calls were recorded.")
+	}
+
+	text := "| Time | Token | User | Call | Status | From |\n|--|--|--|--|--|--|\n"
+	for _, e := range entries {
+		text += fmt.Sprintf("|%s|%s|`%s`|`%s %s`|%d|%s|\n", e.Time.Format(time.RFC3339), e.TokenName, e.UserID, e.Method, e.Path, e.Status, e.RemoteAddr)
+	}
+	return p.responsef(header, "%s", text)
+}
@@ -0,0 +1,133 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License for license information.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseIntegrationTokenScopes(t *testing.T) {
+	scopes, err := parseIntegrationTokenScopes("create-worklog, read-issue,read-issue")
+	require.NoError(t, err)
+	assert.Equal(t, []string{ScopeReadIssue, ScopeCreateWorklog}, scopes)
+
+	scopes, err = parseIntegrationTokenScopes("all")
+	require.NoError(t, err)
+	assert.Equal(t, integrationTokenScopes, scopes)
+
+	_, err = parseIntegrationTokenScopes("read-issue,admin")
+	assert.Error(t, err)
+	_, err = parseIntegrationTokenScopes(",")
+	assert.Error(t, err)
+}
+
+func TestCheckIntegrationToken(t *testing.T) {
+	p, _ := setupTestWebhookQueue(t)
+
+	token, value, err := p.createIntegrationToken("timesheets", []string{ScopeReadIssue}, "admin1")
+	require.NoError(t, err)
+	assert.NotContains(t, token.SecretHash, value)
+
+	_, _, err = p.createIntegrationToken("timesheets", []string{ScopeReadIssue}, "admin1")
+	assert.Error(t, err, "token names are unique")
+
+	handler := p.checkIntegrationToken(ScopeReadIssue, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	call := func(tokenValue string) int {
+		r := httptest.NewRequest(http.MethodGet, "/backdoor/get-issue", nil)
+		r.Header.Set("Mattermost-User-ID", "bot1")
+		if tokenValue != "" {
+			r.Header.Set(IntegrationTokenHeader, tokenValue)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusNoContent, call(value))
+	assert.Equal(t, http.StatusUnauthorized, call(""))
+	assert.Equal(t, http.StatusUnauthorized, call(token.ID+".wrong"))
+
+	other, otherValue, err := p.createIntegrationToken("reports", []string{ScopeGetProject}, "admin1")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, call(otherValue))
+
+	// Only the calls with a valid token are recorded.
+	entries, err := p.getIntegrationAuditLog("", IntegrationAuditLogSize)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, other.ID, entries[0].TokenID)
+	assert.Equal(t, http.StatusForbidden, entries[0].Status)
+	assert.Equal(t, http.StatusNoContent, entries[1].Status)
+	assert.Equal(t, "/backdoor/get-issue", entries[1].Path)
+	assert.Equal(t, "bot1", entries[1].UserID)
+
+	entries, err = p.getIntegrationAuditLog(token.ID, 1)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, http.StatusNoContent, entries[0].Status)
+
+	require.NoError(t, p.revokeIntegrationToken(token.ID))
+	assert.Equal(t, http.StatusUnauthorized, call(value))
+
+	// The bots of the deprecated setting are still allowed without a token.
+	p.updateConfig(func(conf *config) {
+		conf.ListBackdoorsBots = "bot0, bot1"
+	})
+	assert.Equal(t, http.StatusNoContent, call(""))
+	entries, err = p.getIntegrationAuditLog("", 1)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, legacyBackdoorBotName, entries[0].TokenName)
+}
+
+func TestBackdoorUserID(t *testing.T) {
+	p, _ := setupTestWebhookQueue(t)
+	p.updateConfig(func(conf *config) {
+		conf.ListBackdoorsBots = "bot1"
+	})
+	request := func(callerID string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/backdoor/get-issue", nil)
+		r.Header.Set("Mattermost-User-ID", callerID)
+		return r
+	}
+
+	userID, err := p.backdoorUserID(request("user1"), "")
+	require.NoError(t, err)
+	assert.Equal(t, "user1", userID.String())
+	userID, err = p.backdoorUserID(request("user1"), "user1")
+	require.NoError(t, err)
+	assert.Equal(t, "user1", userID.String())
+	_, err = p.backdoorUserID(request("user1"), "user2")
+	assert.Error(t, err, "calls act for the caller")
+
+	userID, err = p.backdoorUserID(request("bot1"), "user2")
+	require.NoError(t, err)
+	assert.Equal(t, "user2", userID.String())
+
+	withToken := func(scopes ...string) *http.Request {
+		r := request("bot2")
+		token := &IntegrationToken{ID: "token1", Scopes: scopes}
+		return r.WithContext(context.WithValue(r.Context(), integrationTokenContextKey{}, token))
+	}
+	_, err = p.backdoorUserID(withToken(ScopeManageWorklog), "user2")
+	assert.Error(t, err, "tokens act for the caller without the act-for-user scope")
+	userID, err = p.backdoorUserID(withToken(ScopeManageWorklog, ScopeActForUser), "user2")
+	require.NoError(t, err)
+	assert.Equal(t, "user2", userID.String())
+
+	_, _, err = p.getBackdoorClientConnection(request("user1"))
+	assert.Equal(t, http.StatusBadRequest, StatusCode(err), "instance_id is required")
+	r := httptest.NewRequest(http.MethodGet, "/backdoor/get-issue?instance_id=jiraurl1&user_id=user2", nil)
+	r.Header.Set("Mattermost-User-ID", "user1")
+	_, _, err = p.getBackdoorClientConnection(r)
+	assert.Equal(t, http.StatusForbidden, StatusCode(err))
+}
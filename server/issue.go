@@ -13,6 +13,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/mattermost/mattermost-plugin-jira/server/utils"
 	"github.com/mattermost/mattermost-plugin-jira/server/utils/types"
@@ -179,6 +180,7 @@ type InCreateIssue struct {
 	PostID                   string           `json:"post_id"`
 	CurrentTeam              string           `json:"current_team"`
 	ChannelID                string           `json:"channel_id"`
+	Template                 string           `json:"template,omitempty"`
 	Fields                   jira.IssueFields `json:"fields"`
 }
 
@@ -206,8 +208,6 @@ func (p *Plugin) CreateIssue(in *InCreateIssue) (*jira.Issue, error) {
 	}
 
 	var post *model.Post
-
-	// If this issue is attached to a post, lets add a permalink to the post in the Jira Description
 	if in.PostID != "" {
 		post, err = p.client.Post.GetPost(in.PostID)
 		if err != nil {
@@ -216,6 +216,20 @@ func (p *Plugin) CreateIssue(in *InCreateIssue) (*jira.Issue, error) {
 		if post == nil {
 			return nil, errors.New("failed to load post " + in.PostID + ": not found")
 		}
+	}
+
+	if in.Template != "" {
+		templateChannelID := in.ChannelID
+		if post != nil {
+			templateChannelID = post.ChannelId
+		}
+		if err = p.applyIssueTemplateToFields(client, instance, in, post, templateChannelID); err != nil {
+			return nil, err
+		}
+	}
+
+	// If this issue is attached to a post, lets add a permalink to the post in the Jira Description
+	if post != nil {
 		permalink := getPermaLink(instance, in.PostID, in.CurrentTeam)
 
 		if len(in.Fields.Description) > 0 {
@@ -815,7 +829,7 @@ func (p *Plugin) getIssueAsSlackAttachment(instance Instance, connection *Connec
 		return nil, err
 	}
 
-	issue, err := client.GetIssue(issueKey, nil)
+	issue, err := p.getIssueCached(client, instance.GetID(), connection.MattermostUserID, issueKey)
 	if err != nil {
 		switch StatusCode(err) {
 		case http.StatusNotFound:
@@ -829,7 +843,11 @@ func (p *Plugin) getIssueAsSlackAttachment(instance Instance, connection *Connec
 		}
 	}
 
-	return asSlackAttachment(instance, client, issue, showActions, otherInfo...)
+	var priorities []jira.Priority
+	if showActions {
+		priorities = p.issuePriorities.get(instance.GetID(), time.Now(), client.GetPriorities)
+	}
+	return asSlackAttachment(instance, client, issue, priorities, showActions, otherInfo...)
 }
 
 func (p *Plugin) UnassignIssue(instance Instance, mattermostUserID types.ID, issueKey string) (string, error) {
@@ -854,6 +872,7 @@ func (p *Plugin) UnassignIssue(instance Instance, mattermostUserID types.ID, iss
 		}
 		return "", err
 	}
+	p.issueCache.invalidate(instance.GetID(), issueKey)
 
 	permalink := fmt.Sprintf("%v/browse/%v", instance.GetJiraBaseURL(), issueKey)
 
@@ -939,6 +958,7 @@ func (p *Plugin) AssignIssue(instance Instance, mattermostUserID types.ID, issue
 	if err := client.UpdateAssignee(issueKey, &user); err != nil {
 		return "", err
 	}
+	p.issueCache.invalidate(instance.GetID(), issueKey)
 
 	permalink := fmt.Sprintf("%v/browse/%v", instance.GetJiraBaseURL(), issueKey)
 
@@ -1013,6 +1033,7 @@ func (p *Plugin) TransitionIssue(in *InTransitionIssue) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	p.issueCache.invalidate(instance.GetID(), in.IssueKey)
 
 	msg := fmt.Sprintf("[%s](%v/browse/%v) transitioned to `%s`",
 		in.IssueKey, instance.GetJiraBaseURL(), in.IssueKey, transition.To.Name)
@@ -1136,12 +1157,12 @@ func (p *Plugin) httpGetIssueByKey(w http.ResponseWriter, r *http.Request) (int,
 }
 
 func (p *Plugin) GetIssueByKey(instanceID, mattermostUserID types.ID, issueKey string) (*jira.Issue, error) {
-	client, _, _, err := p.getClient(instanceID, mattermostUserID)
+	client, instance, _, err := p.getClient(instanceID, mattermostUserID)
 	if err != nil {
 		return nil, err
 	}
 
-	issue, err := client.GetIssue(issueKey, nil)
+	issue, err := p.getIssueCached(client, instance.GetID(), mattermostUserID, issueKey)
 	if err != nil {
 		switch StatusCode(err) {
 		case http.StatusNotFound:
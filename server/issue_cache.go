@@ -0,0 +1,168 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License for license information.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	jira "github.com/andygrunwald/go-jira"
+
+	"github.com/mattermost/mattermost-plugin-jira/server/utils/types"
+)
+
+const (
+	// issueCacheTTL is how long an issue loaded by a user is reused for them, webhooks for the
+	// issue drop it sooner.
+	issueCacheTTL = time.Minute
+
+	// issueDeniedCacheTTL is how long an issue a user can not see is not loaded again for them.
+	issueDeniedCacheTTL = 5 * time.Minute
+
+	issueCacheMaxSize = 2000
+)
+
+// issueCacheEntry is an issue as loaded by a user, kept as JSON so that every caller gets its
+// own copy, or the error when the issue is not visible to the user.
+type issueCacheEntry struct {
+	data      []byte
+	err       error
+	expiresAt time.Time
+}
+
+// issueCache holds the issues recently loaded from Jira, keyed by instance and issue ID or key,
+// then by the user who loaded them. An issue is only served to the user who loaded it, as the
+// comments, worklogs and fields Jira returns depend on what the user can see.
+type issueCache struct {
+	lock   sync.Mutex
+	issues map[string]map[types.ID]issueCacheEntry
+	size   int
+}
+
+func issueCacheKey(instanceID types.ID, issueIDOrKey string) string {
+	return instanceID.String() + "/" + strings.ToUpper(issueIDOrKey)
+}
+
+func (c *issueCache) get(instanceID, mattermostUserID types.ID, issueIDOrKey string, now time.Time) (issue *jira.Issue, ok bool, err error) {
+	c.lock.Lock()
+	entry, ok := c.issues[issueCacheKey(instanceID, issueIDOrKey)][mattermostUserID]
+	c.lock.Unlock()
+	if !ok || now.After(entry.expiresAt) {
+		return nil, false, nil
+	}
+	if entry.err != nil {
+		return nil, true, entry.err
+	}
+
+	issue = &jira.Issue{}
+	if err = json.Unmarshal(entry.data, issue); err != nil {
+		return nil, false, nil
+	}
+	return issue, true, nil
+}
+
+// set caches the issue as loaded by the user, under both its ID and its key.
+func (c *issueCache) set(instanceID, mattermostUserID types.ID, issue *jira.Issue, now time.Time) {
+	data, err := json.Marshal(issue)
+	if err != nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.makeRoom(now)
+	for _, idOrKey := range []string{issue.ID, issue.Key} {
+		if idOrKey == "" {
+			continue
+		}
+		c.setEntry(issueCacheKey(instanceID, idOrKey), mattermostUserID, issueCacheEntry{data: data, expiresAt: now.Add(issueCacheTTL)})
+	}
+}
+
+// setDenied caches that the issue is not visible to the user.
+func (c *issueCache) setDenied(instanceID, mattermostUserID types.ID, issueIDOrKey string, err error, now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.makeRoom(now)
+	c.setEntry(issueCacheKey(instanceID, issueIDOrKey), mattermostUserID, issueCacheEntry{err: err, expiresAt: now.Add(issueDeniedCacheTTL)})
+}
+
+// invalidate drops the issue as loaded by every user, when the issue changed.
+func (c *issueCache) invalidate(instanceID types.ID, issueIDsOrKeys ...string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, idOrKey := range issueIDsOrKeys {
+		if idOrKey == "" {
+			continue
+		}
+		key := issueCacheKey(instanceID, idOrKey)
+		c.size -= len(c.issues[key])
+		delete(c.issues, key)
+	}
+}
+
+func (c *issueCache) setEntry(key string, mattermostUserID types.ID, entry issueCacheEntry) {
+	if c.issues[key] == nil {
+		c.issues[key] = map[types.ID]issueCacheEntry{}
+	}
+	if _, ok := c.issues[key][mattermostUserID]; !ok {
+		c.size++
+	}
+	c.issues[key][mattermostUserID] = entry
+}
+
+// makeRoom initializes the map, and drops the expired entries when the cache is full. Must be
+// called with the lock held.
+func (c *issueCache) makeRoom(now time.Time) {
+	if c.issues == nil {
+		c.issues = map[string]map[types.ID]issueCacheEntry{}
+	}
+	if c.size < issueCacheMaxSize {
+		return
+	}
+
+	for key, users := range c.issues {
+		for userID, entry := range users {
+			if now.After(entry.expiresAt) {
+				delete(users, userID)
+				c.size--
+			}
+		}
+		if len(users) == 0 {
+			delete(c.issues, key)
+		}
+	}
+	if c.size >= issueCacheMaxSize {
+		c.issues = map[string]map[types.ID]issueCacheEntry{}
+		c.size = 0
+	}
+}
+
+func isWatchingIssue(issue *jira.Issue) bool {
+	return issue.Fields != nil && issue.Fields.Watches != nil && issue.Fields.Watches.IsWatching
+}
+
+// getIssueCached loads the issue as the user of the client, reusing the issue when the user
+// loaded it recently. Only the errors that tell the user can not see
+// the issue, which Jira reports as not found, are cached.
+func (p *Plugin) getIssueCached(client Client, instanceID, mattermostUserID types.ID, issueIDOrKey string) (*jira.Issue, error) {
+	now := time.Now()
+	if issue, ok, err := p.issueCache.get(instanceID, mattermostUserID, issueIDOrKey, now); ok {
+		return issue, err
+	}
+
+	issue, err := client.GetIssue(issueIDOrKey, nil)
+	if err != nil {
+		if StatusCode(err) == http.StatusNotFound {
+			p.issueCache.setDenied(instanceID, mattermostUserID, issueIDOrKey, err, now)
+		}
+		return nil, err
+	}
+
+	p.issueCache.set(instanceID, mattermostUserID, issue, now)
+	return issue, nil
+}
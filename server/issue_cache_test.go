@@ -0,0 +1,104 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License for license information.
+
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	jira "github.com/andygrunwald/go-jira"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mattermost/mattermost-plugin-jira/server/utils/types"
+)
+
+func TestIssueCache(t *testing.T) {
+	instanceID := types.ID("https://jira.example.com")
+	now := time.Now()
+	issue := &jira.Issue{
+		ID:  "10001",
+		Key: "API-1",
+		Fields: &jira.IssueFields{
+			Summary:  "Crash",
+			Watches:  &jira.Watches{IsWatching: true},
+			Comments: &jira.Comments{Comments: []*jira.Comment{{ID: "1", Body: "Restricted"}}},
+		},
+	}
+
+	t.Run("served to the users that could see it", func(t *testing.T) {
+		c := issueCache{}
+		c.set(instanceID, "user1", issue, now)
+
+		cached, ok, err := c.get(instanceID, "user1", "api-1", now.Add(time.Second))
+		require.True(t, ok)
+		require.NoError(t, err)
+		assert.Equal(t, "Crash", cached.Fields.Summary)
+		assert.True(t, cached.Fields.Watches.IsWatching)
+
+		_, ok, _ = c.get(instanceID, "user1", "10001", now.Add(time.Second))
+		assert.True(t, ok)
+
+		_, ok, _ = c.get(instanceID, "user2", "API-1", now.Add(time.Second))
+		assert.False(t, ok)
+	})
+
+	t.Run("as loaded by the user", func(t *testing.T) {
+		c := issueCache{}
+		c.set(instanceID, "user1", issue, now)
+		c.set(instanceID, "user2", &jira.Issue{ID: "10001", Key: "API-1", Fields: &jira.IssueFields{Summary: "Crash", Watches: &jira.Watches{}}}, now)
+		c.set(instanceID, "user1", issue, now)
+
+		cached, ok, _ := c.get(instanceID, "user2", "API-1", now.Add(time.Second))
+		require.True(t, ok)
+		assert.False(t, cached.Fields.Watches.IsWatching)
+		assert.Nil(t, cached.Fields.Comments)
+	})
+
+	t.Run("copied for every caller", func(t *testing.T) {
+		c := issueCache{}
+		c.set(instanceID, "user1", issue, now)
+
+		cached, ok, _ := c.get(instanceID, "user1", "API-1", now.Add(time.Second))
+		require.True(t, ok)
+		cached.Fields.Summary = "Changed"
+		cached.Fields.Watches.IsWatching = false
+
+		cached, ok, _ = c.get(instanceID, "user1", "API-1", now.Add(time.Second))
+		require.True(t, ok)
+		assert.Equal(t, "Crash", cached.Fields.Summary)
+		assert.True(t, cached.Fields.Watches.IsWatching)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		c := issueCache{}
+		c.set(instanceID, "user1", issue, now)
+		_, ok, _ := c.get(instanceID, "user1", "API-1", now.Add(issueCacheTTL+time.Second))
+		assert.False(t, ok)
+	})
+
+	t.Run("denied", func(t *testing.T) {
+		c := issueCache{}
+		c.setDenied(instanceID, "user1", "API-1", RESTError{errors.New("not found"), http.StatusNotFound}, now)
+		_, ok, err := c.get(instanceID, "user1", "API-1", now.Add(issueCacheTTL+time.Second))
+		assert.True(t, ok)
+		assert.Equal(t, http.StatusNotFound, StatusCode(err))
+	})
+
+	t.Run("invalidated", func(t *testing.T) {
+		c := issueCache{}
+		c.set(instanceID, "user1", issue, now)
+		c.setDenied(instanceID, "user2", "API-1", RESTError{errors.New("not found"), http.StatusNotFound}, now)
+		c.invalidate(instanceID, "10001", "API-1")
+
+		_, ok, _ := c.get(instanceID, "user1", "10001", now)
+		assert.False(t, ok)
+		_, ok, _ = c.get(instanceID, "user1", "API-1", now)
+		assert.False(t, ok)
+		_, ok, _ = c.get(instanceID, "user2", "API-1", now)
+		assert.False(t, ok)
+	})
+}
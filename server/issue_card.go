@@ -0,0 +1,465 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License for license information.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	jira "github.com/andygrunwald/go-jira"
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-plugin-jira/server/utils/types"
+)
+
+// issueCardState identifies an issue card, the ephemeral post showing an issue with actions.
+// It is the context of the card actions and the state of the dialogs they open.
+type issueCardState struct {
+	InstanceID types.ID `json:"instance_id"`
+	IssueID    string   `json:"issue_id"`
+	IssueKey   string   `json:"issue_key"`
+	ChannelID  string   `json:"channel_id"`
+	RootID     string   `json:"root_id"`
+	PostID     string   `json:"post_id"`
+}
+
+func makeIssueCardActionIntegration(route string, ctx map[string]interface{}) *model.PostActionIntegration {
+	return &model.PostActionIntegration{
+		URL:     fmt.Sprintf("/plugins/%s%s%s", manifest.Id, routeAPI, route),
+		Context: ctx,
+	}
+}
+
+// issuePriorityTTL is how long the priorities of an instance are reused for the issue cards.
+const issuePriorityTTL = 15 * time.Minute
+
+type issuePriorities struct {
+	priorities []jira.Priority
+	expiresAt  time.Time
+}
+
+// issuePriorityCache holds the issue priorities of each instance, so that rendering an issue card
+// does not load them from Jira every time. Failures to load them are not cached.
+type issuePriorityCache struct {
+	lock      sync.Mutex
+	instances map[types.ID]*issuePriorities
+}
+
+func (c *issuePriorityCache) get(instanceID types.ID, now time.Time, load func() ([]jira.Priority, error)) []jira.Priority {
+	c.lock.Lock()
+	cached := c.instances[instanceID]
+	c.lock.Unlock()
+	if cached != nil && now.Before(cached.expiresAt) {
+		return cached.priorities
+	}
+
+	priorities, err := load()
+	if err != nil {
+		return nil
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.instances == nil {
+		c.instances = map[types.ID]*issuePriorities{}
+	}
+	c.instances[instanceID] = &issuePriorities{priorities: priorities, expiresAt: now.Add(issuePriorityTTL)}
+	return priorities
+}
+
+// getIssueCardActions returns the edit actions of an issue card. The priority select is left
+// out when there are no priorities, as when they can not be loaded, rather than failing the
+// whole card. The sprint is not editable from the card, its field is a Jira Software custom
+// field with a different ID on each instance, and its values come from the boards.
+func getIssueCardActions(instanceID types.ID, issue *jira.Issue, priorities []jira.Priority, rootID string) []*model.PostAction {
+	ctx := map[string]interface{}{
+		"instance_id": instanceID.String(),
+		"issue_id":    issue.ID,
+		"issue_key":   issue.Key,
+		"root_id":     rootID,
+	}
+	withCtx := func(key string, value interface{}) map[string]interface{} {
+		c := map[string]interface{}{key: value}
+		for k, v := range ctx {
+			c[k] = v
+		}
+		return c
+	}
+
+	actions := []*model.PostAction{{
+		Name:        "Assign to me",
+		Type:        model.PostActionTypeButton,
+		Integration: makeIssueCardActionIntegration(routeIssueAssignToMe, ctx),
+	}}
+
+	if len(priorities) > 0 {
+		var options []*model.PostActionOptions
+		for _, priority := range priorities {
+			if issue.Fields != nil && issue.Fields.Priority != nil && issue.Fields.Priority.ID == priority.ID {
+				continue
+			}
+			options = append(options, &model.PostActionOptions{Text: priority.Name, Value: priority.ID})
+		}
+		actions = append(actions, &model.PostAction{
+			Name:        "Change priority",
+			Type:        model.PostActionTypeSelect,
+			Options:     options,
+			Integration: makeIssueCardActionIntegration(routeIssueChangePriority, ctx),
+		})
+	}
+
+	watchName := "Watch"
+	if isWatchingIssue(issue) {
+		watchName = "Unwatch"
+	}
+
+	return append(actions,
+		&model.PostAction{
+			Name:        "Comment",
+			Type:        model.PostActionTypeButton,
+			Integration: makeIssueCardActionIntegration(routeIssueCommentDialog, ctx),
+		},
+		&model.PostAction{
+			Name:        "Labels",
+			Type:        model.PostActionTypeButton,
+			Integration: makeIssueCardActionIntegration(routeIssueLabelsDialog, ctx),
+		},
+		&model.PostAction{
+			Name:        "Log work",
+			Type:        model.PostActionTypeButton,
+			Integration: makeIssueCardActionIntegration(routeIssueWorklogDialog, ctx),
+		},
+		&model.PostAction{
+			Name:        watchName,
+			Type:        model.PostActionTypeButton,
+			Integration: makeIssueCardActionIntegration(routeIssueWatch, withCtx("watch", !isWatchingIssue(issue))),
+		},
+	)
+}
+
+func issueCardStateFromAction(request *model.PostActionIntegrationRequest) (*issueCardState, error) {
+	instanceID, _ := request.Context["instance_id"].(string)
+	issueID, _ := request.Context["issue_id"].(string)
+	issueKey, _ := request.Context["issue_key"].(string)
+	rootID, _ := request.Context["root_id"].(string)
+	if instanceID == "" || issueKey == "" {
+		return nil, errors.New("no issue was found in context data")
+	}
+
+	return &issueCardState{
+		InstanceID: types.ID(instanceID),
+		IssueID:    issueID,
+		IssueKey:   issueKey,
+		ChannelID:  request.ChannelId,
+		RootID:     rootID,
+		PostID:     request.PostId,
+	}, nil
+}
+
+func decodeIssueCardAction(r *http.Request) (*model.PostActionIntegrationRequest, *issueCardState, error) {
+	request := &model.PostActionIntegrationRequest{}
+	if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+		return nil, nil, errors.WithMessage(err, "failed to decode the post action")
+	}
+	state, err := issueCardStateFromAction(request)
+	if err != nil {
+		return nil, nil, err
+	}
+	return request, state, nil
+}
+
+func decodeIssueCardDialog(r *http.Request) (*model.SubmitDialogRequest, *issueCardState, error) {
+	request := &model.SubmitDialogRequest{}
+	if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+		return nil, nil, errors.WithMessage(err, "failed to decode the dialog submission")
+	}
+	state := &issueCardState{}
+	if !request.Cancelled {
+		if err := json.Unmarshal([]byte(request.State), state); err != nil {
+			return nil, nil, errors.WithMessage(err, "failed to decode the dialog state")
+		}
+	}
+	return request, state, nil
+}
+
+// updateIssueCard drops the cached issue, and replaces the card with a fresh one showing msg.
+func (p *Plugin) updateIssueCard(mattermostUserID types.ID, state *issueCardState, instance Instance, connection *Connection, msg string) {
+	p.issueCache.invalidate(state.InstanceID, state.IssueID, state.IssueKey)
+
+	post := makePost(p.getUserID(), state.ChannelID, msg)
+	post.Id = state.PostID
+	post.RootId = state.RootID
+	attachment, err := p.getIssueAsSlackAttachment(instance, connection, state.IssueKey, true, state.RootID)
+	if err != nil {
+		p.client.Log.Warn("Failed to refresh the issue card", "issue", state.IssueKey, "error", err.Error())
+	} else {
+		post.AddProp("attachments", attachment)
+	}
+	p.client.Post.UpdateEphemeralPost(mattermostUserID.String(), post)
+}
+
+func respondIssueCardAction(w http.ResponseWriter, format string, args ...interface{}) (int, error) {
+	return respondJSON(w, &model.PostActionIntegrationResponse{EphemeralText: fmt.Sprintf(format, args...)})
+}
+
+func (p *Plugin) openIssueCardDialog(triggerID, route string, state *issueCardState, dialog model.Dialog) error {
+	stateJSON, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	dialog.CallbackId = state.IssueKey
+	dialog.State = string(stateJSON)
+	dialog.SubmitLabel = "Save"
+	return p.client.Frontend.OpenInteractiveDialog(model.OpenDialogRequest{
+		TriggerId: triggerID,
+		URL:       p.GetPluginURL() + makeAPIRoute(route),
+		Dialog:    dialog,
+	})
+}
+
+func (p *Plugin) httpIssueAssignToMe(w http.ResponseWriter, r *http.Request) (int, error) {
+	mattermostUserID := types.ID(r.Header.Get("Mattermost-User-ID"))
+	_, state, err := decodeIssueCardAction(r)
+	if err != nil {
+		return respondErr(w, http.StatusBadRequest, err)
+	}
+	client, instance, connection, err := p.getClient(state.InstanceID, mattermostUserID)
+	if err != nil {
+		return respondIssueCardAction(w, "Failed to load your connection to Jira. Error: %v.", err)
+	}
+
+	// Jira accepts either the account ID or the name of the assignee, not both.
+	user := connection.User
+	if user.AccountID != "" {
+		user.Name = ""
+	}
+	if err = client.UpdateAssignee(state.IssueKey, &user); err != nil {
+		return respondIssueCardAction(w, "Failed to assign %s. Error: %v.", state.IssueKey, err)
+	}
+
+	p.updateIssueCard(mattermostUserID, state, instance, connection, fmt.Sprintf("%s was assigned to you.", state.IssueKey))
+	return respondJSON(w, &model.PostActionIntegrationResponse{})
+}
+
+func (p *Plugin) httpIssueChangePriority(w http.ResponseWriter, r *http.Request) (int, error) {
+	mattermostUserID := types.ID(r.Header.Get("Mattermost-User-ID"))
+	request, state, err := decodeIssueCardAction(r)
+	if err != nil {
+		return respondErr(w, http.StatusBadRequest, err)
+	}
+	priorityID, _ := request.Context["selected_option"].(string)
+	if priorityID == "" {
+		return respondErr(w, http.StatusBadRequest, errors.New("no priority was selected"))
+	}
+	client, instance, connection, err := p.getClient(state.InstanceID, mattermostUserID)
+	if err != nil {
+		return respondIssueCardAction(w, "Failed to load your connection to Jira. Error: %v.", err)
+	}
+
+	err = client.UpdateIssue(state.IssueKey, map[string]interface{}{
+		"fields": map[string]interface{}{
+			"priority": map[string]string{"id": priorityID},
+		},
+	})
+	if err != nil {
+		return respondIssueCardAction(w, "Failed to change the priority of %s. Error: %v.", state.IssueKey, err)
+	}
+
+	p.updateIssueCard(mattermostUserID, state, instance, connection, fmt.Sprintf("The priority of %s was changed.", state.IssueKey))
+	return respondJSON(w, &model.PostActionIntegrationResponse{})
+}
+
+func (p *Plugin) httpIssueWatch(w http.ResponseWriter, r *http.Request) (int, error) {
+	mattermostUserID := types.ID(r.Header.Get("Mattermost-User-ID"))
+	request, state, err := decodeIssueCardAction(r)
+	if err != nil {
+		return respondErr(w, http.StatusBadRequest, err)
+	}
+	watch, _ := request.Context["watch"].(bool)
+	client, instance, connection, err := p.getClient(state.InstanceID, mattermostUserID)
+	if err != nil {
+		return respondIssueCardAction(w, "Failed to load your connection to Jira. Error: %v.", err)
+	}
+
+	msg := fmt.Sprintf("You are now watching %s.", state.IssueKey)
+	if !watch {
+		msg = fmt.Sprintf("You stopped watching %s.", state.IssueKey)
+	}
+	if err = p.WatchIssue(client, state.InstanceID, connection, &jira.Issue{ID: state.IssueID, Key: state.IssueKey}, watch); err != nil {
+		return respondIssueCardAction(w, "Failed to change watching %s. Error: %v.", state.IssueKey, err)
+	}
+
+	p.updateIssueCard(mattermostUserID, state, instance, connection, msg)
+	return respondJSON(w, &model.PostActionIntegrationResponse{})
+}
+
+func (p *Plugin) httpIssueCommentDialog(w http.ResponseWriter, r *http.Request) (int, error) {
+	request, state, err := decodeIssueCardAction(r)
+	if err != nil {
+		return respondErr(w, http.StatusBadRequest, err)
+	}
+
+	err = p.openIssueCardDialog(request.TriggerId, routeIssueComment, state, model.Dialog{
+		Title: "Comment on " + state.IssueKey,
+		Elements: []model.DialogElement{{
+			DisplayName: "Comment",
+			Name:        "comment",
+			Type:        "textarea",
+		}},
+	})
+	if err != nil {
+		return respondIssueCardAction(w, "Failed to open the comment dialog. Error: %v.", err)
+	}
+	return respondJSON(w, &model.PostActionIntegrationResponse{})
+}
+
+func (p *Plugin) httpIssueComment(w http.ResponseWriter, r *http.Request) (int, error) {
+	mattermostUserID := types.ID(r.Header.Get("Mattermost-User-ID"))
+	request, state, err := decodeIssueCardDialog(r)
+	if err != nil {
+		return respondErr(w, http.StatusBadRequest, err)
+	}
+	if request.Cancelled {
+		return http.StatusOK, nil
+	}
+	comment, _ := request.Submission["comment"].(string)
+	if strings.TrimSpace(comment) == "" {
+		return respondJSON(w, model.SubmitDialogResponse{Errors: map[string]string{"comment": "This field is required."}})
+	}
+
+	client, instance, connection, err := p.getClient(state.InstanceID, mattermostUserID)
+	if err != nil {
+		return respondJSON(w, model.SubmitDialogResponse{Error: err.Error()})
+	}
+	if _, err = client.AddComment(state.IssueKey, &jira.Comment{Body: comment}); err != nil {
+		return respondJSON(w, model.SubmitDialogResponse{Error: err.Error()})
+	}
+
+	p.updateIssueCard(mattermostUserID, state, instance, connection, fmt.Sprintf("Your comment was added to %s.", state.IssueKey))
+	return respondJSON(w, model.SubmitDialogResponse{})
+}
+
+func (p *Plugin) httpIssueLabelsDialog(w http.ResponseWriter, r *http.Request) (int, error) {
+	mattermostUserID := types.ID(r.Header.Get("Mattermost-User-ID"))
+	request, state, err := decodeIssueCardAction(r)
+	if err != nil {
+		return respondErr(w, http.StatusBadRequest, err)
+	}
+
+	helpText := "The issue has no labels."
+	client, _, connection, err := p.getClient(state.InstanceID, mattermostUserID)
+	if err == nil {
+		issue, issueErr := p.getIssueCached(client, state.InstanceID, connection.MattermostUserID, state.IssueKey)
+		if issueErr == nil && issue.Fields != nil && len(issue.Fields.Labels) > 0 {
+			helpText = "The labels of the issue are: " + strings.Join(issue.Fields.Labels, ", ")
+		}
+	}
+
+	err = p.openIssueCardDialog(request.TriggerId, routeIssueLabels, state, model.Dialog{
+		Title: "Labels of " + state.IssueKey,
+		Elements: []model.DialogElement{
+			{DisplayName: "Add", Name: "add", Type: "text", Optional: true, Placeholder: "label1, label2", HelpText: helpText},
+			{DisplayName: "Remove", Name: "remove", Type: "text", Optional: true, Placeholder: "label1, label2"},
+		},
+	})
+	if err != nil {
+		return respondIssueCardAction(w, "Failed to open the labels dialog. Error: %v.", err)
+	}
+	return respondJSON(w, &model.PostActionIntegrationResponse{})
+}
+
+// splitLabels splits labels separated by commas or spaces, since labels can not have spaces.
+func splitLabels(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	})
+}
+
+func (p *Plugin) httpIssueLabels(w http.ResponseWriter, r *http.Request) (int, error) {
+	mattermostUserID := types.ID(r.Header.Get("Mattermost-User-ID"))
+	request, state, err := decodeIssueCardDialog(r)
+	if err != nil {
+		return respondErr(w, http.StatusBadRequest, err)
+	}
+	if request.Cancelled {
+		return http.StatusOK, nil
+	}
+	add, _ := request.Submission["add"].(string)
+	remove, _ := request.Submission["remove"].(string)
+	addLabels, removeLabels := splitLabels(add), splitLabels(remove)
+	if len(addLabels) == 0 && len(removeLabels) == 0 {
+		return respondJSON(w, model.SubmitDialogResponse{Error: "Please enter the labels to add or remove."})
+	}
+
+	client, instance, connection, err := p.getClient(state.InstanceID, mattermostUserID)
+	if err != nil {
+		return respondJSON(w, model.SubmitDialogResponse{Error: err.Error()})
+	}
+	if err = client.UpdateIssue(state.IssueKey, makeBulkLabelsUpdate(addLabels, removeLabels)); err != nil {
+		return respondJSON(w, model.SubmitDialogResponse{Error: err.Error()})
+	}
+
+	p.updateIssueCard(mattermostUserID, state, instance, connection, fmt.Sprintf("The labels of %s were changed.", state.IssueKey))
+	return respondJSON(w, model.SubmitDialogResponse{})
+}
+
+func (p *Plugin) httpIssueWorklogDialog(w http.ResponseWriter, r *http.Request) (int, error) {
+	request, state, err := decodeIssueCardAction(r)
+	if err != nil {
+		return respondErr(w, http.StatusBadRequest, err)
+	}
+
+	err = p.openIssueCardDialog(request.TriggerId, routeIssueWorklog, state, model.Dialog{
+		Title: "Log work on " + state.IssueKey,
+		Elements: []model.DialogElement{
+			{DisplayName: "Time spent", Name: "duration", Type: "text", Placeholder: "1h 30m", HelpText: "Minutes, or Jira time like `1h 30m` or `2d`"},
+			{DisplayName: "Comment", Name: "comment", Type: "textarea", Optional: true},
+		},
+	})
+	if err != nil {
+		return respondIssueCardAction(w, "Failed to open the worklog dialog. Error: %v.", err)
+	}
+	return respondJSON(w, &model.PostActionIntegrationResponse{})
+}
+
+func (p *Plugin) httpIssueWorklog(w http.ResponseWriter, r *http.Request) (int, error) {
+	mattermostUserID := types.ID(r.Header.Get("Mattermost-User-ID"))
+	request, state, err := decodeIssueCardDialog(r)
+	if err != nil {
+		return respondErr(w, http.StatusBadRequest, err)
+	}
+	if request.Cancelled {
+		return http.StatusOK, nil
+	}
+	duration, _ := request.Submission["duration"].(string)
+	comment, _ := request.Submission["comment"].(string)
+	seconds, rest, err := parseWorklogDuration(strings.Fields(duration))
+	if err == nil && len(rest) > 0 {
+		err = errors.Errorf("%q is not a duration", duration)
+	}
+	if err != nil {
+		return respondJSON(w, model.SubmitDialogResponse{Errors: map[string]string{"duration": err.Error()}})
+	}
+
+	client, instance, connection, err := p.getClient(state.InstanceID, mattermostUserID)
+	if err != nil {
+		return respondJSON(w, model.SubmitDialogResponse{Error: err.Error()})
+	}
+	_, _, err = client.createWorkLog(state.IssueKey, &jira.WorklogRecord{
+		TimeSpentSeconds: seconds,
+		Comment:          comment,
+	})
+	if err != nil {
+		return respondJSON(w, model.SubmitDialogResponse{Error: err.Error()})
+	}
+
+	p.updateIssueCard(mattermostUserID, state, instance, connection,
+		fmt.Sprintf("A %s worklog for %s was created.", formatWorklogDuration(seconds), state.IssueKey))
+	return respondJSON(w, model.SubmitDialogResponse{})
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License for license information.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	jira "github.com/andygrunwald/go-jira"
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type issueCardTestClient struct {
+	testClient
+	priorities []jira.Priority
+}
+
+func (client issueCardTestClient) GetPriorities() ([]jira.Priority, error) {
+	if client.priorities == nil {
+		return nil, errors.New("not found")
+	}
+	return client.priorities, nil
+}
+
+func TestGetIssueCardActions(t *testing.T) {
+	issue := &jira.Issue{
+		ID:  "10001",
+		Key: "PROJ-1",
+		Fields: &jira.IssueFields{
+			Priority: &jira.Priority{ID: "2", Name: "High"},
+			Watches:  &jira.Watches{IsWatching: true},
+		},
+	}
+	actionNames := func(actions []*model.PostAction) []string {
+		var names []string
+		for _, action := range actions {
+			names = append(names, action.Name)
+		}
+		return names
+	}
+
+	t.Run("all actions", func(t *testing.T) {
+		priorities := []jira.Priority{{ID: "1", Name: "Highest"}, {ID: "2", Name: "High"}}
+		actions := getIssueCardActions("instance", issue, priorities, "root")
+
+		assert.Equal(t, []string{"Assign to me", "Change priority", "Comment", "Labels", "Log work", "Unwatch"}, actionNames(actions))
+		require.Len(t, actions[1].Options, 1)
+		assert.Equal(t, "1", actions[1].Options[0].Value)
+		assert.Equal(t, false, actions[5].Integration.Context["watch"])
+
+		request := &model.PostActionIntegrationRequest{ChannelId: "channel", PostId: "post", Context: actions[0].Integration.Context}
+		state, err := issueCardStateFromAction(request)
+		require.NoError(t, err)
+		assert.Equal(t, &issueCardState{
+			InstanceID: "instance",
+			IssueID:    "10001",
+			IssueKey:   "PROJ-1",
+			ChannelID:  "channel",
+			RootID:     "root",
+			PostID:     "post",
+		}, state)
+	})
+
+	t.Run("without priorities", func(t *testing.T) {
+		actions := getIssueCardActions("instance", issue, nil, "")
+		assert.Equal(t, []string{"Assign to me", "Comment", "Labels", "Log work", "Unwatch"}, actionNames(actions))
+	})
+
+	t.Run("missing context", func(t *testing.T) {
+		_, err := issueCardStateFromAction(&model.PostActionIntegrationRequest{Context: map[string]interface{}{"issue_key": "PROJ-1"}})
+		assert.EqualError(t, err, "no issue was found in context data")
+	})
+}
+
+func TestIssuePriorityCache(t *testing.T) {
+	var c issuePriorityCache
+	now := time.Now()
+	loads := 0
+	client := issueCardTestClient{priorities: []jira.Priority{{ID: "1", Name: "Highest"}}}
+	load := func() ([]jira.Priority, error) {
+		loads++
+		return client.GetPriorities()
+	}
+
+	assert.Nil(t, c.get("instance", now, issueCardTestClient{}.GetPriorities))
+	assert.Equal(t, client.priorities, c.get("instance", now, load))
+	assert.Equal(t, client.priorities, c.get("instance", now.Add(time.Minute), load))
+	assert.Equal(t, 1, loads)
+
+	assert.Equal(t, client.priorities, c.get("other", now, load))
+	assert.Equal(t, 2, loads)
+
+	c.get("instance", now.Add(issuePriorityTTL), load)
+	assert.Equal(t, 3, loads)
+}
+
+func TestSplitLabels(t *testing.T) {
+	assert.Equal(t, []string{"a", "b", "c"}, splitLabels("a, b c,,"))
+	assert.Empty(t, splitLabels(" , "))
+}
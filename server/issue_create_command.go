@@ -0,0 +1,626 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License for license information.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	jira "github.com/andygrunwald/go-jira"
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+	"github.com/pkg/errors"
+	"github.com/trivago/tgo/tcontainer"
+
+	"github.com/mattermost/mattermost-plugin-jira/server/utils/types"
+)
+
+const createIssueUsage = "`/jira create [project-key] [issue-type] \"[summary]\" [--priority P] [--assignee @user] [--labels a,b] [--component C] [--description \"text\"] [--field name=value]` or `/jira create --template [name] [text]`"
+
+// dialogDisplayNameMaxLength is the longest display name Mattermost accepts for a dialog element.
+const dialogDisplayNameMaxLength = 24
+
+// createIssueArgs is an issue described with `/jira create`.
+type createIssueArgs struct {
+	ProjectKey  string
+	IssueType   string
+	Summary     string
+	Description string
+	Priority    string
+	Assignee    string
+	Labels      []string
+	Components  []string
+	// Fields are the values of other fields, by field key or name
+	Fields map[string]string
+	// Template is the name of the issue template the issue is created from
+	Template string
+}
+
+// createMetaField is the create metadata Jira returns for a field of an issue type.
+type createMetaField struct {
+	Name            string `json:"name"`
+	Required        bool   `json:"required"`
+	HasDefaultValue bool   `json:"hasDefaultValue"`
+	Schema          struct {
+		Type   string `json:"type"`
+		Items  string `json:"items"`
+		System string `json:"system"`
+	} `json:"schema"`
+	AllowedValues []struct {
+		ID    string `json:"id"`
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	} `json:"allowedValues"`
+}
+
+// allowedValueID returns the ID of the allowed value with the name, ignoring case, or with the ID.
+func (f createMetaField) allowedValueID(name string) (string, bool) {
+	for _, v := range f.AllowedValues {
+		if strings.EqualFold(v.Name, name) || strings.EqualFold(v.Value, name) || v.ID == name {
+			return v.ID, true
+		}
+	}
+	return "", false
+}
+
+func (f createMetaField) allowedValueNames() []string {
+	var names []string
+	for _, v := range f.AllowedValues {
+		if v.Name != "" {
+			names = append(names, v.Name)
+		} else {
+			names = append(names, v.Value)
+		}
+	}
+	return names
+}
+
+// createIssueDialogState is the issue being created, kept in the dialog that asks for its
+// missing required fields.
+type createIssueDialogState struct {
+	InstanceID types.ID         `json:"instance_id"`
+	ChannelID  string           `json:"channel_id"`
+	Fields     jira.IssueFields `json:"fields"`
+}
+
+// splitQuotedArgs splits s into words, keeping the text in double quotes as one word.
+func splitQuotedArgs(s string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord, inQuotes := false, false
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '“' || r == '”':
+			inQuotes = !inQuotes
+			inWord = true
+		case r == ' ' && !inQuotes:
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if inQuotes {
+		return nil, errors.New("a quote is not closed")
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+func splitCommaList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// parseCreateIssueFlags returns the flags of an issue description, and the other words.
+func parseCreateIssueFlags(args []string) (*createIssueArgs, []string, error) {
+	words, err := splitQuotedArgs(strings.Join(args, " "))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cmd := &createIssueArgs{}
+	var positional []string
+	for i := 0; i < len(words); i++ {
+		word := words[i]
+		if !strings.HasPrefix(word, "--") {
+			positional = append(positional, word)
+			continue
+		}
+
+		name, value, hasValue := strings.Cut(word[2:], "=")
+		if !hasValue {
+			if i+1 >= len(words) {
+				return nil, nil, errors.Errorf("--%s needs a value", name)
+			}
+			i++
+			value = words[i]
+		}
+		switch strings.ToLower(name) {
+		case "priority":
+			cmd.Priority = value
+		case "assignee":
+			cmd.Assignee = value
+		case "description":
+			cmd.Description = value
+		case "label", "labels":
+			cmd.Labels = append(cmd.Labels, splitCommaList(value)...)
+		case "component", "components":
+			cmd.Components = append(cmd.Components, splitCommaList(value)...)
+		case "field":
+			key, fieldValue, ok := strings.Cut(value, "=")
+			if !ok || strings.TrimSpace(key) == "" {
+				return nil, nil, errors.Errorf("the field %q has no value, use `--field name=value`", value)
+			}
+			if cmd.Fields == nil {
+				cmd.Fields = map[string]string{}
+			}
+			cmd.Fields[strings.TrimSpace(key)] = strings.TrimSpace(fieldValue)
+		case "template":
+			cmd.Template = value
+		default:
+			return nil, nil, errors.Errorf("--%s is not a known flag", name)
+		}
+	}
+
+	for _, label := range cmd.Labels {
+		if strings.ContainsAny(label, " \t") {
+			return nil, nil, errors.Errorf("the label %q has a space, labels can not have spaces", label)
+		}
+	}
+	return cmd, positional, nil
+}
+
+// parseCreateIssueArgs parses `/jira create`. With a template, the words are the text of the
+// template, otherwise they are the project, the issue type and the summary.
+func parseCreateIssueArgs(args []string) (*createIssueArgs, error) {
+	cmd, positional, err := parseCreateIssueFlags(args)
+	if err != nil {
+		return nil, err
+	}
+	if cmd.Template != "" {
+		cmd.Summary = strings.Join(positional, " ")
+		return cmd, nil
+	}
+
+	if len(positional) < 3 {
+		return nil, errors.New("a project, an issue type and a summary are required")
+	}
+	cmd.ProjectKey = strings.ToUpper(positional[0])
+	cmd.IssueType = positional[1]
+	cmd.Summary = strings.Join(positional[2:], " ")
+	return cmd, nil
+}
+
+// getCreateMetaIssueType returns the create metadata of an issue type of the project, found by
+// name or ID.
+func (p *Plugin) getCreateMetaIssueType(client Client, projectKey, issueType string) (*jira.MetaIssueType, error) {
+	metaInfo, err := client.GetCreateMetaInfo(p.API, &jira.GetQueryOptions{
+		Expand:      "projects.issuetypes.fields",
+		ProjectKeys: projectKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	project := metaInfo.GetProjectWithKey(projectKey)
+	if project == nil {
+		return nil, errors.Errorf("project %s was not found, or you can not create issues in it", projectKey)
+	}
+	var names []string
+	for _, t := range project.IssueTypes {
+		if strings.EqualFold(t.Name, issueType) || t.Id == issueType {
+			return t, nil
+		}
+		names = append(names, t.Name)
+	}
+	return nil, errors.Errorf("%s is not an issue type of project %s, the issue types are: %s", issueType, projectKey, strings.Join(names, ", "))
+}
+
+func createMetaFields(issueType *jira.MetaIssueType) (map[string]createMetaField, error) {
+	data, err := json.Marshal(issueType.Fields)
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]createMetaField{}
+	if err = json.Unmarshal(data, &fields); err != nil {
+		return nil, errors.WithMessage(err, "failed to read the fields of the issue type")
+	}
+	return fields, nil
+}
+
+// makeCreateIssueFields returns the fields of the issue described by the command, checked
+// against the create metadata of its issue type.
+func (p *Plugin) makeCreateIssueFields(instanceID types.ID, mentions model.UserMentionMap, cmd *createIssueArgs, issueType *jira.MetaIssueType, metaFields map[string]createMetaField) (*jira.IssueFields, error) {
+	fields := &jira.IssueFields{
+		Project:     jira.Project{Key: cmd.ProjectKey},
+		Type:        jira.IssueType{ID: issueType.Id},
+		Summary:     cmd.Summary,
+		Description: cmd.Description,
+	}
+	if len(cmd.Labels) > 0 {
+		fields.Labels = cmd.Labels
+	}
+
+	field := func(key string) (createMetaField, error) {
+		f, ok := metaFields[key]
+		if !ok {
+			return f, errors.Errorf("the %s of %s issues in project %s can not be set", key, issueType.Name, cmd.ProjectKey)
+		}
+		return f, nil
+	}
+
+	if cmd.Description != "" {
+		if _, err := field("description"); err != nil {
+			return nil, err
+		}
+	}
+	if len(cmd.Labels) > 0 {
+		if _, err := field("labels"); err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Priority != "" {
+		f, err := field("priority")
+		if err != nil {
+			return nil, err
+		}
+		id, ok := f.allowedValueID(cmd.Priority)
+		if !ok {
+			return nil, errors.Errorf("%s is not a priority, the priorities are: %s", cmd.Priority, strings.Join(f.allowedValueNames(), ", "))
+		}
+		fields.Priority = &jira.Priority{ID: id}
+	}
+
+	for _, name := range cmd.Components {
+		f, err := field("components")
+		if err != nil {
+			return nil, err
+		}
+		id, ok := f.allowedValueID(name)
+		if !ok {
+			return nil, errors.Errorf("%s is not a component of project %s, the components are: %s", name, cmd.ProjectKey, strings.Join(f.allowedValueNames(), ", "))
+		}
+		fields.Components = append(fields.Components, &jira.Component{ID: id})
+	}
+
+	if cmd.Assignee != "" {
+		if _, err := field("assignee"); err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(cmd.Assignee, "@") {
+			return nil, errors.New("mention the assignee, like `--assignee @user`")
+		}
+		assignee, err := p.GetJiraUserFromMentions(instanceID, mentions, cmd.Assignee)
+		if err != nil {
+			return nil, err
+		}
+		fields.Assignee = jiraUserReference(assignee)
+	}
+
+	for name, value := range cmd.Fields {
+		key, f, ok := findCreateMetaField(metaFields, name)
+		if !ok {
+			return nil, errors.Errorf("%s is not a field of %s issues in project %s", name, issueType.Name, cmd.ProjectKey)
+		}
+		if f.Schema.Type == "user" {
+			return nil, errors.Errorf("the user field %s can not be set with --field", f.Name)
+		}
+		if len(f.AllowedValues) > 0 {
+			id, found := f.allowedValueID(value)
+			if !found {
+				return nil, errors.Errorf("%s is not a value of %s, the values are: %s", value, f.Name, strings.Join(f.allowedValueNames(), ", "))
+			}
+			value = id
+		}
+		jiraValue, err := p.createIssueFieldValue(instanceID, f, value)
+		if err != nil {
+			return nil, errors.Errorf("invalid value of %s: %v", f.Name, err)
+		}
+		if fields.Unknowns == nil {
+			fields.Unknowns = tcontainer.NewMarshalMap()
+		}
+		fields.Unknowns[key] = jiraValue
+	}
+
+	return fields, nil
+}
+
+// findCreateMetaField finds a field by key, or by name ignoring case.
+func findCreateMetaField(metaFields map[string]createMetaField, name string) (string, createMetaField, bool) {
+	if f, ok := metaFields[name]; ok {
+		return name, f, true
+	}
+	for key, f := range metaFields {
+		if strings.EqualFold(f.Name, name) {
+			return key, f, true
+		}
+	}
+	return "", createMetaField{}, false
+}
+
+// jiraUserReference returns the user as a field value. Jira takes either the account ID, on
+// Jira Cloud, or the name.
+func jiraUserReference(user *jira.User) *jira.User {
+	if user.AccountID != "" {
+		return &jira.User{AccountID: user.AccountID}
+	}
+	return &jira.User{Name: user.Name}
+}
+
+// missingRequiredFields returns the keys of the required fields that are not set and have no
+// default value, sorted. The reporter is left to CreateIssue.
+func missingRequiredFields(fields *jira.IssueFields, metaFields map[string]createMetaField) []string {
+	set := map[string]bool{
+		"project":   true,
+		"issuetype": true,
+		"summary":   fields.Summary != "",
+		"reporter":  true,
+	}
+	set["description"] = fields.Description != ""
+	set["priority"] = fields.Priority != nil
+	set["assignee"] = fields.Assignee != nil
+	set["labels"] = len(fields.Labels) > 0
+	set["components"] = len(fields.Components) > 0
+	for key := range fields.Unknowns {
+		set[key] = true
+	}
+
+	var missing []string
+	for key, f := range metaFields {
+		if f.Required && !f.HasDefaultValue && !set[key] {
+			missing = append(missing, key)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// makeCreateIssueDialogElement returns the dialog element asking for the value of a field, or
+// false when the field can not be set from a dialog.
+func makeCreateIssueDialogElement(key string, f createMetaField) (model.DialogElement, bool) {
+	element := model.DialogElement{
+		DisplayName: f.Name,
+		Name:        key,
+		Type:        "text",
+	}
+	if name := []rune(f.Name); len(name) > dialogDisplayNameMaxLength {
+		element.DisplayName = string(name[:dialogDisplayNameMaxLength-3]) + "..."
+		element.HelpText = f.Name
+	}
+
+	switch {
+	case len(f.AllowedValues) > 0 && (f.Schema.Type != "array" || f.Schema.Items != "string"):
+		element.Type = "select"
+		for _, v := range f.AllowedValues {
+			text := v.Name
+			if text == "" {
+				text = v.Value
+			}
+			element.Options = append(element.Options, &model.PostActionOptions{Text: text, Value: v.ID})
+		}
+	case f.Schema.Type == "user":
+		element.Type = "select"
+		element.DataSource = "users"
+	case f.Schema.Type == "string":
+		if key == "description" || key == "environment" {
+			element.Type = "textarea"
+		}
+	case f.Schema.Type == "number":
+		element.SubType = "number"
+	case f.Schema.Type == "date":
+		element.Placeholder = "YYYY-MM-DD"
+	case f.Schema.Type == "datetime":
+		element.Placeholder = "YYYY-MM-DDTHH:MM:SS.000+0000"
+	case f.Schema.Type == "array" && f.Schema.Items == "string":
+		element.HelpText = strings.TrimSpace(element.HelpText + " Separate the values with commas.")
+	default:
+		return element, false
+	}
+	return element, true
+}
+
+// openCreateIssueDialog asks for the required fields missing from the issue. The fields a
+// dialog can not ask for are left to CreateIssue, which links to Jira to create the issue there.
+func (p *Plugin) openCreateIssueDialog(header *model.CommandArgs, in *InCreateIssue, issueType *jira.MetaIssueType, missing []string, metaFields map[string]createMetaField) (bool, error) {
+	var elements []model.DialogElement
+	for _, key := range missing {
+		element, ok := makeCreateIssueDialogElement(key, metaFields[key])
+		if !ok {
+			in.RequiredFieldsNotCovered = append(in.RequiredFieldsNotCovered, []string{key, metaFields[key].Name})
+			continue
+		}
+		elements = append(elements, element)
+	}
+	if len(in.RequiredFieldsNotCovered) > 0 {
+		return false, nil
+	}
+
+	state, err := json.Marshal(createIssueDialogState{
+		InstanceID: in.InstanceID,
+		ChannelID:  in.ChannelID,
+		Fields:     in.Fields,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	err = p.client.Frontend.OpenInteractiveDialog(model.OpenDialogRequest{
+		TriggerId: header.TriggerId,
+		URL:       p.GetPluginURL() + makeAPIRoute(routeAPICreateIssueDialog),
+		Dialog: model.Dialog{
+			CallbackId:       "create_issue",
+			Title:            "Create a Jira issue",
+			IntroductionText: fmt.Sprintf("%s %s issues need more fields: **%s**", in.Fields.Project.Key, issueType.Name, in.Fields.Summary),
+			Elements:         elements,
+			SubmitLabel:      "Create",
+			State:            string(state),
+		},
+	})
+	return err == nil, err
+}
+
+// createIssueFieldValue converts the value of a field, as submitted in a dialog, to its Jira
+// value. Fields with allowed values take the ID of a value, and user fields a Mattermost user ID.
+func (p *Plugin) createIssueFieldValue(instanceID types.ID, f createMetaField, value string) (interface{}, error) {
+	switch {
+	case f.Schema.Type == "user":
+		connection, err := p.userStore.LoadConnection(instanceID, types.ID(value))
+		if err != nil {
+			return nil, errors.New("the user is not connected to Jira")
+		}
+		return jiraUserReference(&connection.User), nil
+	case len(f.AllowedValues) > 0 && f.Schema.Type == "array" && f.Schema.Items != "string":
+		return []map[string]string{{"id": value}}, nil
+	case len(f.AllowedValues) > 0 && f.Schema.Type != "array":
+		return map[string]string{"id": value}, nil
+	case f.Schema.Type == "number":
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, errors.New("not a number")
+		}
+		return number, nil
+	case f.Schema.Type == "array":
+		return splitCommaList(value), nil
+	default:
+		return value, nil
+	}
+}
+
+func (p *Plugin) httpSubmitCreateIssueDialog(w http.ResponseWriter, r *http.Request) (int, error) {
+	mattermostUserID := r.Header.Get("Mattermost-User-ID")
+	request := model.SubmitDialogRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		return respondErr(w, http.StatusBadRequest, errors.WithMessage(err, "failed to decode the dialog submission"))
+	}
+	if request.Cancelled {
+		return http.StatusOK, nil
+	}
+
+	state := createIssueDialogState{}
+	if err := json.Unmarshal([]byte(request.State), &state); err != nil {
+		return respondErr(w, http.StatusBadRequest, errors.WithMessage(err, "failed to decode the dialog state"))
+	}
+
+	fail := func(err error) (int, error) {
+		return respondJSON(w, model.SubmitDialogResponse{Error: err.Error()})
+	}
+	client, _, _, err := p.getClient(state.InstanceID, types.ID(mattermostUserID))
+	if err != nil {
+		return fail(err)
+	}
+	issueType, err := p.getCreateMetaIssueType(client, state.Fields.Project.Key, state.Fields.Type.ID)
+	if err != nil {
+		return fail(err)
+	}
+	metaFields, err := createMetaFields(issueType)
+	if err != nil {
+		return fail(err)
+	}
+
+	fields := state.Fields
+	if fields.Unknowns == nil {
+		fields.Unknowns = tcontainer.NewMarshalMap()
+	}
+	fieldErrors := map[string]string{}
+	for _, key := range missingRequiredFields(&fields, metaFields) {
+		submitted, _ := request.Submission[key].(string)
+		if strings.TrimSpace(submitted) == "" {
+			fieldErrors[key] = "This field is required."
+			continue
+		}
+		value, err := p.createIssueFieldValue(state.InstanceID, metaFields[key], strings.TrimSpace(submitted))
+		if err != nil {
+			fieldErrors[key] = err.Error()
+			continue
+		}
+		fields.Unknowns[key] = value
+	}
+	if len(fieldErrors) > 0 {
+		return respondJSON(w, model.SubmitDialogResponse{Errors: fieldErrors})
+	}
+
+	_, err = p.CreateIssue(&InCreateIssue{
+		mattermostUserID: types.ID(mattermostUserID),
+		InstanceID:       state.InstanceID,
+		ChannelID:        state.ChannelID,
+		Fields:           fields,
+	})
+	if err != nil {
+		return fail(err)
+	}
+	return respondJSON(w, model.SubmitDialogResponse{})
+}
+
+func executeCreate(p *Plugin, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	user, instance, args, err := p.loadFlagUserInstance(header.UserId, args)
+	if err != nil {
+		return p.responsef(header, "Failed to load your connection to Jira. Error: %v.", err)
+	}
+	cmd, err := parseCreateIssueArgs(args)
+	if err != nil {
+		return p.responsef(header, "Failed to read the command: %v. Please use %s.", err, createIssueUsage)
+	}
+	if cmd.Template != "" {
+		if err = p.applyIssueTemplateToCommand(instance, header, cmd); err != nil {
+			return p.responsef(header, "Failed to use the issue template: %v.", err)
+		}
+	}
+
+	client, _, _, err := p.getClient(instance.GetID(), user.MattermostUserID)
+	if err != nil {
+		return p.responsef(header, "%v", err)
+	}
+	issueType, err := p.getCreateMetaIssueType(client, cmd.ProjectKey, cmd.IssueType)
+	if err != nil {
+		return p.responsef(header, "Failed to create the issue: %v.", err)
+	}
+	metaFields, err := createMetaFields(issueType)
+	if err != nil {
+		return p.responsef(header, "Failed to create the issue: %v.", err)
+	}
+	fields, err := p.makeCreateIssueFields(instance.GetID(), header.UserMentions, cmd, issueType, metaFields)
+	if err != nil {
+		return p.responsef(header, "Failed to create the issue: %v.", err)
+	}
+
+	in := &InCreateIssue{
+		mattermostUserID: user.MattermostUserID,
+		InstanceID:       instance.GetID(),
+		ChannelID:        header.ChannelId,
+		Fields:           *fields,
+	}
+	if missing := missingRequiredFields(fields, metaFields); len(missing) > 0 {
+		opened, err := p.openCreateIssueDialog(header, in, issueType, missing, metaFields)
+		if err != nil {
+			return p.responsef(header, "Failed to ask for the required fields of the issue: %v.", err)
+		}
+		if opened {
+			return &model.CommandResponse{}
+		}
+	}
+
+	// CreateIssue posts the created issue, or the link to create it in Jira when it has
+	// required fields that can not be set here.
+	if _, err = p.CreateIssue(in); err != nil && len(in.RequiredFieldsNotCovered) == 0 {
+		return p.responsef(header, "Failed to create the issue: %v.", err)
+	}
+	return &model.CommandResponse{}
+}
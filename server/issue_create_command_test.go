@@ -0,0 +1,150 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License for license information.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	jira "github.com/andygrunwald/go-jira"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/trivago/tgo/tcontainer"
+)
+
+func TestParseCreateIssueArgs(t *testing.T) {
+	for name, tc := range map[string]struct {
+		command     string
+		expected    *createIssueArgs
+		expectedErr string
+	}{
+		"quoted summary and flags": {
+			command: `proj Bug "The app crashes" --priority High --assignee @user --labels a,b --component API`,
+			expected: &createIssueArgs{
+				ProjectKey: "PROJ",
+				IssueType:  "Bug",
+				Summary:    "The app crashes",
+				Priority:   "High",
+				Assignee:   "@user",
+				Labels:     []string{"a", "b"},
+				Components: []string{"API"},
+			},
+		},
+		"unquoted summary and flag values": {
+			command: `PROJ Task Write the docs --description="Start with the API" --component=API,Web`,
+			expected: &createIssueArgs{
+				ProjectKey:  "PROJ",
+				IssueType:   "Task",
+				Summary:     "Write the docs",
+				Description: "Start with the API",
+				Components:  []string{"API", "Web"},
+			},
+		},
+		"quoted issue type": {
+			command: `PROJ "Service Request" “Reset my password”`,
+			expected: &createIssueArgs{
+				ProjectKey: "PROJ",
+				IssueType:  "Service Request",
+				Summary:    "Reset my password",
+			},
+		},
+		"missing summary":  {command: `PROJ Bug`, expectedErr: "a project, an issue type and a summary are required"},
+		"unclosed quote":   {command: `PROJ Bug "crash`, expectedErr: "a quote is not closed"},
+		"unknown flag":     {command: `PROJ Bug crash --severity 1`, expectedErr: "--severity is not a known flag"},
+		"missing value":    {command: `PROJ Bug crash --priority`, expectedErr: "--priority needs a value"},
+		"label with space": {command: `PROJ Bug crash --labels "a b"`, expectedErr: `the label "a b" has a space, labels can not have spaces`},
+	} {
+		t.Run(name, func(t *testing.T) {
+			cmd, err := parseCreateIssueArgs(strings.Fields(tc.command))
+			if tc.expectedErr != "" {
+				require.EqualError(t, err, tc.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, cmd)
+		})
+	}
+}
+
+func testCreateMetaIssueType() *jira.MetaIssueType {
+	return &jira.MetaIssueType{
+		Id:   "10004",
+		Name: "Bug",
+		Fields: tcontainer.MarshalMap{
+			"summary":   map[string]interface{}{"name": "Summary", "required": true, "schema": map[string]interface{}{"type": "string"}},
+			"issuetype": map[string]interface{}{"name": "Issue Type", "required": true, "schema": map[string]interface{}{"type": "issuetype"}},
+			"reporter":  map[string]interface{}{"name": "Reporter", "required": true, "schema": map[string]interface{}{"type": "user"}},
+			"priority": map[string]interface{}{
+				"name": "Priority", "required": true, "hasDefaultValue": true, "schema": map[string]interface{}{"type": "priority"},
+				"allowedValues": []interface{}{map[string]interface{}{"id": "1", "name": "Highest"}, map[string]interface{}{"id": "2", "name": "High"}},
+			},
+			"components": map[string]interface{}{
+				"name": "Components", "required": false, "schema": map[string]interface{}{"type": "array", "items": "component"},
+				"allowedValues": []interface{}{map[string]interface{}{"id": "100", "name": "API"}},
+			},
+			"labels": map[string]interface{}{"name": "Labels", "required": false, "schema": map[string]interface{}{"type": "array", "items": "string"}},
+			"customfield_10100": map[string]interface{}{
+				"name": "Environment of the customer", "required": true, "schema": map[string]interface{}{"type": "option"},
+				"allowedValues": []interface{}{map[string]interface{}{"id": "5", "value": "Production"}},
+			},
+			"customfield_10200": map[string]interface{}{"name": "Story Points", "required": true, "schema": map[string]interface{}{"type": "number"}},
+		},
+	}
+}
+
+func TestMakeCreateIssueFields(t *testing.T) {
+	p := &Plugin{}
+	issueType := testCreateMetaIssueType()
+	metaFields, err := createMetaFields(issueType)
+	require.NoError(t, err)
+
+	fields, err := p.makeCreateIssueFields("", nil, &createIssueArgs{
+		ProjectKey: "PROJ",
+		IssueType:  "bug",
+		Summary:    "Crash",
+		Priority:   "high",
+		Labels:     []string{"a"},
+		Components: []string{"api"},
+	}, issueType, metaFields)
+	require.NoError(t, err)
+	assert.Equal(t, "10004", fields.Type.ID)
+	assert.Equal(t, "2", fields.Priority.ID)
+	assert.Equal(t, "100", fields.Components[0].ID)
+	assert.Equal(t, []string{"customfield_10100", "customfield_10200"}, missingRequiredFields(fields, metaFields))
+
+	_, err = p.makeCreateIssueFields("", nil, &createIssueArgs{ProjectKey: "PROJ", Summary: "Crash", Priority: "Low"}, issueType, metaFields)
+	assert.EqualError(t, err, "Low is not a priority, the priorities are: Highest, High")
+
+	_, err = p.makeCreateIssueFields("", nil, &createIssueArgs{ProjectKey: "PROJ", Summary: "Crash", Description: "text"}, issueType, metaFields)
+	assert.EqualError(t, err, "the description of Bug issues in project PROJ can not be set")
+}
+
+func TestMakeCreateIssueDialogElement(t *testing.T) {
+	metaFields, err := createMetaFields(testCreateMetaIssueType())
+	require.NoError(t, err)
+
+	element, ok := makeCreateIssueDialogElement("customfield_10100", metaFields["customfield_10100"])
+	require.True(t, ok)
+	assert.Equal(t, "select", element.Type)
+	assert.Equal(t, "Environment of the cu...", element.DisplayName)
+	assert.Equal(t, "5", element.Options[0].Value)
+	assert.Equal(t, "Production", element.Options[0].Text)
+
+	element, ok = makeCreateIssueDialogElement("customfield_10200", metaFields["customfield_10200"])
+	require.True(t, ok)
+	assert.Equal(t, "number", element.SubType)
+
+	p := &Plugin{}
+	value, err := p.createIssueFieldValue("", metaFields["customfield_10100"], "5")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"id": "5"}, value)
+	value, err = p.createIssueFieldValue("", metaFields["customfield_10200"], "3")
+	require.NoError(t, err)
+	assert.Equal(t, 3.0, value)
+	_, err = p.createIssueFieldValue("", metaFields["customfield_10200"], "three")
+	assert.Error(t, err)
+	value, err = p.createIssueFieldValue("", metaFields["components"], "100")
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]string{{"id": "100"}}, value)
+}
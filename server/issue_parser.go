@@ -30,7 +30,7 @@ func reporterSummary(issue *jira.Issue) string {
 	return reporterSummary
 }
 
-func getActions(instanceID types.ID, client Client, issue *jira.Issue, otherInfo ...string) ([]*model.PostAction, error) {
+func getActions(instanceID types.ID, client Client, issue *jira.Issue, priorities []jira.Priority, otherInfo ...string) ([]*model.PostAction, error) {
 	var actions []*model.PostAction
 
 	ctx := map[string]interface{}{
@@ -72,6 +72,12 @@ func getActions(instanceID types.ID, client Client, issue *jira.Issue, otherInfo
 		Integration: integration,
 	})
 
+	rootID := ""
+	if len(otherInfo) == 1 {
+		rootID = otherInfo[0]
+	}
+	actions = append(actions, getIssueCardActions(instanceID, issue, priorities, rootID)...)
+
 	actions = append(actions, &model.PostAction{
 		Name: "Share publicly",
 		Type: "button",
@@ -84,7 +90,7 @@ func getActions(instanceID types.ID, client Client, issue *jira.Issue, otherInfo
 	return actions, nil
 }
 
-func asSlackAttachment(instance Instance, client Client, issue *jira.Issue, showActions bool, otherInfo ...string) ([]*model.SlackAttachment, error) {
+func asSlackAttachment(instance Instance, client Client, issue *jira.Issue, priorities []jira.Priority, showActions bool, otherInfo ...string) ([]*model.SlackAttachment, error) {
 	text := mdKeySummaryLink(issue, instance)
 	desc := truncate(issue.Fields.Description, 3000)
 	desc = parseJiraLinksToMarkdown(desc)
@@ -117,7 +123,7 @@ func asSlackAttachment(instance Instance, client Client, issue *jira.Issue, show
 	var actions []*model.PostAction
 	var err error
 	if showActions {
-		actions, err = getActions(instance.GetID(), client, issue, otherInfo...)
+		actions, err = getActions(instance.GetID(), client, issue, priorities, otherInfo...)
 		if err != nil {
 			return []*model.SlackAttachment{}, err
 		}
@@ -139,3 +145,37 @@ func asSlackAttachment(instance Instance, client Client, issue *jira.Issue, show
 		},
 	}, nil
 }
+
+// asIssueKeySlackAttachment is a preview of an issue without its details, for the issues not
+// everyone who reads the post may see.
+func asIssueKeySlackAttachment(instance Instance, issueKey string) *model.SlackAttachment {
+	return &model.SlackAttachment{
+		Color:     "#95b7d0",
+		Title:     issueKey,
+		TitleLink: instance.GetJiraBaseURL() + "/browse/" + issueKey,
+		Text:      "Open the issue in Jira to see its details.",
+	}
+}
+
+// asCompactSlackAttachment is a short preview of an issue, with its summary, status, assignee and priority.
+func asCompactSlackAttachment(instance Instance, issue *jira.Issue) *model.SlackAttachment {
+	var fields []*model.SlackAttachmentField
+	if issue.Fields.Status != nil {
+		fields = append(fields, &model.SlackAttachmentField{Title: "Status", Value: issue.Fields.Status.Name, Short: true})
+	}
+	assignee := "Unassigned"
+	if issue.Fields.Assignee != nil {
+		assignee = issue.Fields.Assignee.DisplayName
+	}
+	fields = append(fields, &model.SlackAttachmentField{Title: "Assignee", Value: assignee, Short: true})
+	if issue.Fields.Priority != nil {
+		fields = append(fields, &model.SlackAttachmentField{Title: "Priority", Value: issue.Fields.Priority.Name, Short: true})
+	}
+
+	return &model.SlackAttachment{
+		Color:     "#95b7d0",
+		Title:     issue.Key + ": " + issue.Fields.Summary,
+		TitleLink: instance.GetJiraBaseURL() + "/browse/" + issue.Key,
+		Fields:    fields,
+	}
+}
@@ -0,0 +1,467 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License for license information.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+	"github.com/pkg/errors"
+)
+
+const JiraIssueTemplatesKey = "jiraissuetemplates"
+
+var issueTemplateNameRegexp = regexp.MustCompile(`^[[:alnum:]_-]{1,64}$`)
+
+var issueTemplatePlaceholderRegexp = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+// IssueTemplate describes an issue that is created over and over. Its summary, description
+// and field values can have placeholders such as {channel}, filled when the issue is created.
+type IssueTemplate struct {
+	Name string `json:"name"`
+	// ChannelID is the channel the template belongs to, empty for the global templates of admins
+	ChannelID        string            `json:"channel_id,omitempty"`
+	MattermostUserID string            `json:"mattermost_user_id"`
+	ProjectKey       string            `json:"project_key"`
+	IssueType        string            `json:"issue_type"`
+	Summary          string            `json:"summary,omitempty"`
+	Description      string            `json:"description,omitempty"`
+	Priority         string            `json:"priority,omitempty"`
+	Labels           []string          `json:"labels,omitempty"`
+	Components       []string          `json:"components,omitempty"`
+	Fields           map[string]string `json:"fields,omitempty"`
+}
+
+type IssueTemplates struct {
+	ByKey map[string]IssueTemplate `json:"by_key"`
+}
+
+func issueTemplateKey(channelID, name string) string {
+	return channelID + "/" + strings.ToLower(name)
+}
+
+// apply fills the parts of the issue that were not given with the template, and the
+// placeholders of the template with the values. The text given with the template is the
+// {text} placeholder, or the summary when the template has none.
+func (t *IssueTemplate) apply(cmd *createIssueArgs, values map[string]string) {
+	values["text"] = cmd.Summary
+	fill := func(s string) string {
+		return fillIssueTemplatePlaceholders(s, values)
+	}
+
+	if cmd.ProjectKey == "" {
+		cmd.ProjectKey = t.ProjectKey
+	}
+	if cmd.IssueType == "" {
+		cmd.IssueType = t.IssueType
+	}
+	if t.Summary != "" {
+		cmd.Summary = fill(t.Summary)
+	}
+	if cmd.Description == "" {
+		cmd.Description = fill(t.Description)
+	}
+	if cmd.Priority == "" {
+		cmd.Priority = t.Priority
+	}
+	cmd.Labels = appendUnique(t.Labels, cmd.Labels...)
+	cmd.Components = appendUnique(t.Components, cmd.Components...)
+	for name, value := range t.Fields {
+		if _, ok := cmd.Fields[name]; ok {
+			continue
+		}
+		if cmd.Fields == nil {
+			cmd.Fields = map[string]string{}
+		}
+		cmd.Fields[name] = fill(value)
+	}
+}
+
+// appendUnique returns a new list with the elements of list, then the other elements not in it.
+func appendUnique(list []string, elems ...string) []string {
+	result := append([]string{}, list...)
+	seen := NewStringSet(list...)
+	for _, elem := range elems {
+		if !seen.ContainsAny(elem) {
+			seen = seen.Add(elem)
+			result = append(result, elem)
+		}
+	}
+	return result
+}
+
+// fillIssueTemplatePlaceholders replaces the known placeholders, the others are kept as they
+// may be Jira markup such as {code}.
+func fillIssueTemplatePlaceholders(s string, values map[string]string) string {
+	return issueTemplatePlaceholderRegexp.ReplaceAllStringFunc(s, func(placeholder string) string {
+		if value, ok := values[placeholder[1:len(placeholder)-1]]; ok {
+			return value
+		}
+		return placeholder
+	})
+}
+
+// issueTemplateValues returns the values of the placeholders of templates: the channel, the
+// user, the date and the source post, when there is one.
+func (p *Plugin) issueTemplateValues(instance Instance, mattermostUserID, channelID string, post *model.Post) map[string]string {
+	values := map[string]string{
+		"date": time.Now().Format("2006-01-02"),
+	}
+	if user, err := p.client.User.Get(mattermostUserID); err == nil {
+		values["user"] = "@" + user.Username
+		values["user_name"] = strings.TrimSpace(user.GetFullName())
+		if values["user_name"] == "" {
+			values["user_name"] = user.Username
+		}
+	}
+
+	teamName := ""
+	if channel, err := p.client.Channel.Get(channelID); err == nil {
+		values["channel"] = channel.DisplayName
+		values["channel_name"] = channel.Name
+		if team, teamErr := p.client.Team.Get(channel.TeamId); teamErr == nil {
+			teamName = team.Name
+			values["team"] = team.DisplayName
+		}
+	}
+
+	if post != nil {
+		values["post"] = post.Message
+		if teamName != "" {
+			values["post_link"] = getPermaLink(instance, post.Id, teamName)
+		}
+	}
+	return values
+}
+
+func (p *Plugin) getIssueTemplates() (*IssueTemplates, error) {
+	var data []byte
+	if err := p.client.KV.Get(JiraIssueTemplatesKey, &data); err != nil {
+		return nil, err
+	}
+	return issueTemplatesFromJSON(data)
+}
+
+func issueTemplatesFromJSON(data []byte) (*IssueTemplates, error) {
+	templates := &IssueTemplates{ByKey: map[string]IssueTemplate{}}
+	if len(data) == 0 {
+		return templates, nil
+	}
+	if err := json.Unmarshal(data, templates); err != nil {
+		return nil, err
+	}
+	if templates.ByKey == nil {
+		templates.ByKey = map[string]IssueTemplate{}
+	}
+	return templates, nil
+}
+
+func (p *Plugin) updateIssueTemplates(f func(templates *IssueTemplates) error) error {
+	return p.client.KV.SetAtomicWithRetries(JiraIssueTemplatesKey, func(initialBytes []byte) (interface{}, error) {
+		templates, err := issueTemplatesFromJSON(initialBytes)
+		if err != nil {
+			return nil, err
+		}
+		if err = f(templates); err != nil {
+			return nil, err
+		}
+		return templates, nil
+	})
+}
+
+// getIssueTemplate returns the template of the channel with the name, or else the global one.
+func (p *Plugin) getIssueTemplate(channelID, name string) (*IssueTemplate, error) {
+	templates, err := p.getIssueTemplates()
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range []string{issueTemplateKey(channelID, name), issueTemplateKey("", name)} {
+		if template, ok := templates.ByKey[key]; ok {
+			return &template, nil
+		}
+	}
+	return nil, errors.Errorf("there is no issue template %q in this channel", name)
+}
+
+// getIssueTemplatesForChannel returns the templates of the channel and the global ones, sorted
+// by name.
+func (p *Plugin) getIssueTemplatesForChannel(channelID string) ([]IssueTemplate, error) {
+	templates, err := p.getIssueTemplates()
+	if err != nil {
+		return nil, err
+	}
+
+	result := []IssueTemplate{}
+	for _, template := range templates.ByKey {
+		if template.ChannelID == channelID || template.ChannelID == "" {
+			result = append(result, template)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if !strings.EqualFold(result[i].Name, result[j].Name) {
+			return strings.ToLower(result[i].Name) < strings.ToLower(result[j].Name)
+		}
+		return result[i].ChannelID > result[j].ChannelID
+	})
+	return result, nil
+}
+
+func (p *Plugin) saveIssueTemplate(template *IssueTemplate) error {
+	return p.updateIssueTemplates(func(templates *IssueTemplates) error {
+		templates.ByKey[issueTemplateKey(template.ChannelID, template.Name)] = *template
+		return nil
+	})
+}
+
+func (p *Plugin) removeIssueTemplate(channelID, name string) error {
+	return p.updateIssueTemplates(func(templates *IssueTemplates) error {
+		key := issueTemplateKey(channelID, name)
+		if _, ok := templates.ByKey[key]; !ok {
+			return errors.Errorf("issue template %q not found", name)
+		}
+		delete(templates.ByKey, key)
+		return nil
+	})
+}
+
+// applyIssueTemplateToFields fills the fields of an issue created with the API that were not
+// given with the template.
+func (p *Plugin) applyIssueTemplateToFields(client Client, instance Instance, in *InCreateIssue, post *model.Post, channelID string) error {
+	template, err := p.getIssueTemplate(channelID, in.Template)
+	if err != nil {
+		return err
+	}
+	if template.ChannelID != "" && !p.client.User.HasPermissionToChannel(in.mattermostUserID.String(), template.ChannelID, model.PermissionReadChannel) {
+		return errors.Errorf("issue template %q belongs to a channel you are not a member of", template.Name)
+	}
+
+	cmd := &createIssueArgs{
+		ProjectKey:  in.Fields.Project.Key,
+		IssueType:   in.Fields.Type.ID,
+		Summary:     in.Fields.Summary,
+		Description: in.Fields.Description,
+	}
+	if cmd.IssueType == "" {
+		cmd.IssueType = in.Fields.Type.Name
+	}
+	template.apply(cmd, p.issueTemplateValues(instance, in.mattermostUserID.String(), channelID, post))
+
+	issueType, err := p.getCreateMetaIssueType(client, cmd.ProjectKey, cmd.IssueType)
+	if err != nil {
+		return err
+	}
+	metaFields, err := createMetaFields(issueType)
+	if err != nil {
+		return err
+	}
+	fields, err := p.makeCreateIssueFields(instance.GetID(), nil, cmd, issueType, metaFields)
+	if err != nil {
+		return errors.WithMessagef(err, "failed to apply issue template %q", template.Name)
+	}
+
+	if in.Fields.Priority == nil {
+		in.Fields.Priority = fields.Priority
+	}
+	in.Fields.Project = fields.Project
+	in.Fields.Type = fields.Type
+	in.Fields.Summary = fields.Summary
+	in.Fields.Description = fields.Description
+	in.Fields.Labels = appendUnique(in.Fields.Labels, fields.Labels...)
+	if len(in.Fields.Components) == 0 {
+		in.Fields.Components = fields.Components
+	}
+	for key, value := range fields.Unknowns {
+		if in.Fields.Unknowns == nil {
+			in.Fields.Unknowns = fields.Unknowns
+			break
+		}
+		if _, ok := in.Fields.Unknowns[key]; !ok {
+			in.Fields.Unknowns[key] = value
+		}
+	}
+	return nil
+}
+
+// removeBoolFlag removes the flag from the args, and tells whether it was there.
+func removeBoolFlag(args []string, flag string) ([]string, bool) {
+	remaining := []string{}
+	found := false
+	for _, arg := range args {
+		if arg == flag {
+			found = true
+			continue
+		}
+		remaining = append(remaining, arg)
+	}
+	return remaining, found
+}
+
+// canManageIssueTemplate checks that the user may add or remove a template: admins manage the
+// global templates, and the members of a channel its templates.
+func (p *Plugin) canManageIssueTemplate(userID, channelID string) error {
+	if channelID == "" {
+		if authorized, _ := authorizedSysAdmin(p, userID); !authorized {
+			return errors.New("only system administrators may manage the global issue templates")
+		}
+		return nil
+	}
+	if !p.client.User.HasPermissionToChannel(userID, channelID, model.PermissionReadChannel) {
+		return errors.New("only the members of the channel may manage its issue templates")
+	}
+	return nil
+}
+
+func executeTemplateAdd(p *Plugin, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	user, instance, args, err := p.loadFlagUserInstance(header.UserId, args)
+	if err != nil {
+		return p.responsef(header, "Failed to load your connection to Jira. Error: %v.", err)
+	}
+	args, global := removeBoolFlag(args, "--global")
+	if len(args) < 3 {
+		return p.help(header)
+	}
+
+	name := args[0]
+	if !issueTemplateNameRegexp.MatchString(name) {
+		return p.responsef(header, "The name of a template may only have letters, digits, `-` and `_`.")
+	}
+	cmd, positional, err := parseCreateIssueFlags(args[1:])
+	if err != nil {
+		return p.responsef(header, "Failed to read the template: %v.", err)
+	}
+	if len(positional) < 2 {
+		return p.responsef(header, "Please specify the project and the issue type of the template.")
+	}
+	if cmd.Assignee != "" || cmd.Template != "" {
+		return p.responsef(header, "A template can not have an assignee or a template.")
+	}
+
+	template := &IssueTemplate{
+		Name:             name,
+		MattermostUserID: header.UserId,
+		ProjectKey:       strings.ToUpper(positional[0]),
+		IssueType:        positional[1],
+		Summary:          strings.Join(positional[2:], " "),
+		Description:      cmd.Description,
+		Priority:         cmd.Priority,
+		Labels:           cmd.Labels,
+		Components:       cmd.Components,
+		Fields:           cmd.Fields,
+	}
+	if !global {
+		template.ChannelID = header.ChannelId
+	}
+	if err = p.canManageIssueTemplate(header.UserId, template.ChannelID); err != nil {
+		return p.responsef(header, "%v.", err)
+	}
+
+	// The names of the template are checked with Jira.
+	client, _, _, err := p.getClient(instance.GetID(), user.MattermostUserID)
+	if err != nil {
+		return p.responsef(header, "%v", err)
+	}
+	issueType, err := p.getCreateMetaIssueType(client, template.ProjectKey, template.IssueType)
+	if err != nil {
+		return p.responsef(header, "Failed to check the template: %v.", err)
+	}
+	metaFields, err := createMetaFields(issueType)
+	if err != nil {
+		return p.responsef(header, "Failed to check the template: %v.", err)
+	}
+	check := &createIssueArgs{Summary: "check"}
+	template.apply(check, map[string]string{})
+	if _, err = p.makeCreateIssueFields(instance.GetID(), nil, check, issueType, metaFields); err != nil {
+		return p.responsef(header, "Failed to check the template: %v.", err)
+	}
+
+	if err = p.saveIssueTemplate(template); err != nil {
+		return p.responsef(header, "Failed to save the template. Error: %v.", err)
+	}
+	return p.responsef(header, "Issue template `%s` saved. Use it with `/jira create --template %s [text]`.", template.Name, template.Name)
+}
+
+func executeTemplateList(p *Plugin, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	if len(args) != 0 {
+		return p.help(header)
+	}
+
+	templates, err := p.getIssueTemplatesForChannel(header.ChannelId)
+	if err != nil {
+		return p.responsef(header, "Failed to load the issue templates. Error: %v.", err)
+	}
+	if len(templates) == 0 {
+		return p.responsef(header, "There are no issue templates in this channel. Use `/jira template add` to create one.")
+	}
+
+	text := "| Name | Scope | Issue | Summary |\n|--|--|--|--|\n"
+	for _, template := range templates {
+		scope := "Channel"
+		if template.ChannelID == "" {
+			scope = "Global"
+		}
+		text += fmt.Sprintf("|`%s`|%s|%s %s|%s|\n", template.Name, scope, template.ProjectKey, template.IssueType, template.Summary)
+	}
+	return p.responsef(header, "%s", text)
+}
+
+func executeTemplateDelete(p *Plugin, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	args, global := removeBoolFlag(args, "--global")
+	if len(args) != 1 {
+		return p.help(header)
+	}
+
+	channelID := header.ChannelId
+	if global {
+		channelID = ""
+	}
+	if err := p.canManageIssueTemplate(header.UserId, channelID); err != nil {
+		return p.responsef(header, "%v.", err)
+	}
+	if err := p.removeIssueTemplate(channelID, args[0]); err != nil {
+		return p.responsef(header, "Failed to delete the template. Error: %v.", err)
+	}
+	return p.responsef(header, "Issue template `%s` deleted.", args[0])
+}
+
+func (p *Plugin) httpGetIssueTemplates(w http.ResponseWriter, r *http.Request) (int, error) {
+	mattermostUserID := r.Header.Get("Mattermost-User-ID")
+	channelID := r.FormValue("channel_id")
+	if channelID == "" {
+		return respondErr(w, http.StatusBadRequest, errors.New("channel_id must not be empty"))
+	}
+	if !p.client.User.HasPermissionToChannel(mattermostUserID, channelID, model.PermissionReadChannel) {
+		return respondErr(w, http.StatusForbidden, errors.New("not a member of the channel"))
+	}
+
+	templates, err := p.getIssueTemplatesForChannel(channelID)
+	if err != nil {
+		return respondErr(w, http.StatusInternalServerError, err)
+	}
+	return respondJSON(w, templates)
+}
+
+// applyIssueTemplateToCommand fills the issue of `/jira create --template` with the template.
+func (p *Plugin) applyIssueTemplateToCommand(instance Instance, header *model.CommandArgs, cmd *createIssueArgs) error {
+	template, err := p.getIssueTemplate(header.ChannelId, cmd.Template)
+	if err != nil {
+		return err
+	}
+
+	var post *model.Post
+	if header.RootId != "" {
+		post, _ = p.client.Post.GetPost(header.RootId)
+	}
+	template.apply(cmd, p.issueTemplateValues(instance, header.UserId, header.ChannelId, post))
+	if cmd.Summary == "" {
+		return errors.Errorf("template %q has no summary, give one after the name of the template", template.Name)
+	}
+	return nil
+}
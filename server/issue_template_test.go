@@ -0,0 +1,88 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License for license information.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFillIssueTemplatePlaceholders(t *testing.T) {
+	values := map[string]string{"channel": "Town Square", "user": "@user", "text": ""}
+
+	assert.Equal(t, "Incident in Town Square reported by @user", fillIssueTemplatePlaceholders("Incident in {channel} reported by {user}", values))
+	assert.Equal(t, "{code}x{code} {unknown}", fillIssueTemplatePlaceholders("{code}x{code} {unknown}", values))
+	assert.Equal(t, "Incident: ", fillIssueTemplatePlaceholders("Incident: {text}", values))
+}
+
+func TestIssueTemplateApply(t *testing.T) {
+	template := &IssueTemplate{
+		Name:        "incident",
+		ProjectKey:  "OPS",
+		IssueType:   "Incident",
+		Summary:     "[{channel}] {text}",
+		Description: "Reported by {user}\n\n{post}",
+		Priority:    "High",
+		Labels:      []string{"incident"},
+		Components:  []string{"API"},
+		Fields:      map[string]string{"Environment": "Production", "Customer": "{channel}"},
+	}
+	values := map[string]string{"channel": "support", "user": "@user", "post": "the API is down"}
+
+	t.Run("template values", func(t *testing.T) {
+		cmd, err := parseCreateIssueArgs(strings.Fields(`--template incident API is down`))
+		require.NoError(t, err)
+		template.apply(cmd, values)
+
+		assert.Equal(t, &createIssueArgs{
+			ProjectKey:  "OPS",
+			IssueType:   "Incident",
+			Summary:     "[support] API is down",
+			Description: "Reported by @user\n\nthe API is down",
+			Priority:    "High",
+			Labels:      []string{"incident"},
+			Components:  []string{"API"},
+			Fields:      map[string]string{"Environment": "Production", "Customer": "support"},
+			Template:    "incident",
+		}, cmd)
+	})
+
+	t.Run("given values win", func(t *testing.T) {
+		cmd, err := parseCreateIssueArgs(strings.Fields(`--template incident Down --priority Highest --labels customer,incident --field Environment=Staging --description "It is down"`))
+		require.NoError(t, err)
+		template.apply(cmd, values)
+
+		assert.Equal(t, "Highest", cmd.Priority)
+		assert.Equal(t, "It is down", cmd.Description)
+		assert.Equal(t, []string{"incident", "customer"}, cmd.Labels)
+		assert.Equal(t, "Staging", cmd.Fields["Environment"])
+	})
+
+	t.Run("text is the summary of a template without one", func(t *testing.T) {
+		cmd := &createIssueArgs{Summary: "Give access to the VPN"}
+		(&IssueTemplate{ProjectKey: "IT", IssueType: "Access"}).apply(cmd, map[string]string{})
+		assert.Equal(t, "Give access to the VPN", cmd.Summary)
+		assert.Equal(t, "IT", cmd.ProjectKey)
+	})
+}
+
+func TestIssueTemplatesFromJSON(t *testing.T) {
+	templates, err := issueTemplatesFromJSON(nil)
+	require.NoError(t, err)
+	assert.Empty(t, templates.ByKey)
+
+	templates, err = issueTemplatesFromJSON([]byte(`{"by_key": {"/incident": {"name": "incident", "project_key": "OPS"}}}`))
+	require.NoError(t, err)
+	assert.Equal(t, "OPS", templates.ByKey[issueTemplateKey("", "Incident")].ProjectKey)
+}
+
+func TestAppendUnique(t *testing.T) {
+	list := []string{"a", "b"}
+	assert.Equal(t, []string{"a", "b", "c"}, appendUnique(list, "b", "c", "c"))
+	assert.Equal(t, []string{"a", "b"}, list)
+	assert.Equal(t, []string{}, appendUnique(nil))
+}
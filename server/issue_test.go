@@ -60,7 +60,7 @@ func (client testClient) GetTransitions(issueKey string) ([]jira.Transition, err
 	}, nil
 }
 
-func (client testClient) DoTransition(issueKey string, transitionID string) error {
+func (client testClient) DoTransition(issueKey, transitionID, resolution string) error {
 	return nil
 }
 
@@ -86,6 +86,13 @@ func (client testClient) AddComment(issueKey string, comment *jira.Comment) (*ji
 	return nil, nil
 }
 
+func (client testClient) GetWatchers(issueKey string) ([]jira.User, error) {
+	if issueKey == "TEST-1" {
+		return []jira.User{{AccountID: "jiraWatcher"}}, nil
+	}
+	return nil, nil
+}
+
 func (client testClient) GetCreateMetaInfo(api plugin.API, options *jira.GetQueryOptions) (*jira.CreateMetaInfo, error) {
 	return &jira.CreateMetaInfo{
 		Projects: []*jira.MetaProject{
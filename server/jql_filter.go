@@ -0,0 +1,527 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License for license information.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	jira "github.com/andygrunwald/go-jira"
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-plugin-jira/server/utils/types"
+)
+
+const (
+	// jqlMatchCacheTTL is how long the result of a JQL check with Jira is reused. The issue's
+	// update time is part of the cache key, so a change of the issue is always checked again.
+	jqlMatchCacheTTL     = 5 * time.Minute
+	jqlMatchCacheMaxSize = 1000
+)
+
+var jqlOrderByRegexp = regexp.MustCompile(`(?i)\border\s+by\b`)
+
+// jqlResult is the result of evaluating JQL against a webhook payload, in three-valued logic:
+// clauses that can not be evaluated locally are unknown, and decided by Jira.
+type jqlResult int
+
+const (
+	jqlUnknown jqlResult = iota
+	jqlFalse
+	jqlTrue
+)
+
+func jqlBool(b bool) jqlResult {
+	if b {
+		return jqlTrue
+	}
+	return jqlFalse
+}
+
+type jqlExpr interface {
+	eval(issue *jira.Issue) jqlResult
+}
+
+type jqlAnd struct{ left, right jqlExpr }
+type jqlOr struct{ left, right jqlExpr }
+type jqlNot struct{ expr jqlExpr }
+
+// jqlClause is a "field operator value(s)" clause. A clause whose value is a function call,
+// such as currentUser(), has no values and is always unknown.
+type jqlClause struct {
+	field    string
+	operator string
+	values   []string
+	function bool
+}
+
+func (e jqlAnd) eval(issue *jira.Issue) jqlResult {
+	l, r := e.left.eval(issue), e.right.eval(issue)
+	switch {
+	case l == jqlFalse || r == jqlFalse:
+		return jqlFalse
+	case l == jqlTrue && r == jqlTrue:
+		return jqlTrue
+	}
+	return jqlUnknown
+}
+
+func (e jqlOr) eval(issue *jira.Issue) jqlResult {
+	l, r := e.left.eval(issue), e.right.eval(issue)
+	switch {
+	case l == jqlTrue || r == jqlTrue:
+		return jqlTrue
+	case l == jqlFalse && r == jqlFalse:
+		return jqlFalse
+	}
+	return jqlUnknown
+}
+
+func (e jqlNot) eval(issue *jira.Issue) jqlResult {
+	switch e.expr.eval(issue) {
+	case jqlTrue:
+		return jqlFalse
+	case jqlFalse:
+		return jqlTrue
+	}
+	return jqlUnknown
+}
+
+func (c jqlClause) eval(issue *jira.Issue) jqlResult {
+	if c.function || issue == nil || issue.Fields == nil {
+		return jqlUnknown
+	}
+	values, ok := jqlFieldValues(issue, c.field)
+	if !ok {
+		return jqlUnknown
+	}
+
+	matchesAny := func() bool {
+		for _, want := range c.values {
+			for _, have := range values {
+				if strings.EqualFold(want, have) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	isEmpty := len(values) == 0
+	compareEmpty := len(c.values) == 1 && (strings.EqualFold(c.values[0], "empty") || strings.EqualFold(c.values[0], "null"))
+
+	// As in Jira, negative operators do not match issues where the field is empty.
+	switch c.operator {
+	case "=", "in":
+		if compareEmpty {
+			return jqlBool(isEmpty)
+		}
+		return jqlBool(matchesAny())
+	case "!=", "not in":
+		if compareEmpty {
+			return jqlBool(!isEmpty)
+		}
+		return jqlBool(!isEmpty && !matchesAny())
+	case "is":
+		if !compareEmpty {
+			return jqlUnknown
+		}
+		return jqlBool(isEmpty)
+	case "is not":
+		if !compareEmpty {
+			return jqlUnknown
+		}
+		return jqlBool(!isEmpty)
+	}
+	return jqlUnknown
+}
+
+// jqlFieldValues returns the names and IDs of the issue's values of the field, for the fields
+// that can be evaluated from a webhook payload.
+func jqlFieldValues(issue *jira.Issue, field string) ([]string, bool) {
+	f := issue.Fields
+	switch strings.ToLower(field) {
+	case "key", "issuekey", "id":
+		return []string{issue.Key, issue.ID}, true
+	case "project":
+		return []string{f.Project.Key, f.Project.Name, f.Project.ID}, true
+	case "issuetype", "type":
+		return []string{f.Type.Name, f.Type.ID}, true
+	case "status":
+		if f.Status == nil {
+			return nil, true
+		}
+		return []string{f.Status.Name, f.Status.ID}, true
+	case "priority":
+		if f.Priority == nil {
+			return nil, true
+		}
+		return []string{f.Priority.Name, f.Priority.ID}, true
+	case "resolution":
+		if f.Resolution == nil {
+			return nil, true
+		}
+		return []string{f.Resolution.Name, f.Resolution.ID}, true
+	case "labels", "label":
+		return f.Labels, true
+	case "component", "components":
+		var values []string
+		for _, c := range f.Components {
+			values = append(values, c.Name, c.ID)
+		}
+		return values, true
+	case "fixversion", "fixversions":
+		var values []string
+		for _, v := range f.FixVersions {
+			values = append(values, v.Name, v.ID)
+		}
+		return values, true
+	case "assignee":
+		return jqlUserValues(f.Assignee), true
+	case "reporter":
+		return jqlUserValues(f.Reporter), true
+	}
+	return nil, false
+}
+
+func jqlUserValues(user *jira.User) []string {
+	if user == nil {
+		return nil
+	}
+	var values []string
+	for _, v := range []string{user.AccountID, user.Name, user.Key, user.DisplayName, user.EmailAddress} {
+		if v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+type jqlToken struct {
+	text   string
+	quoted bool
+}
+
+func tokenizeJQL(jql string) ([]jqlToken, error) {
+	var tokens []jqlToken
+	for i := 0; i < len(jql); {
+		c := jql[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"' || c == '\'':
+			end := i + 1
+			var b strings.Builder
+			for ; end < len(jql) && jql[end] != c; end++ {
+				if jql[end] == '\\' && end+1 < len(jql) {
+					end++
+				}
+				b.WriteByte(jql[end])
+			}
+			if end >= len(jql) {
+				return nil, errors.New("unterminated string")
+			}
+			tokens = append(tokens, jqlToken{text: b.String(), quoted: true})
+			i = end + 1
+		case c == '(' || c == ')' || c == ',':
+			tokens = append(tokens, jqlToken{text: string(c)})
+			i++
+		case c == '!' || c == '<' || c == '>' || c == '=' || c == '~':
+			if i+1 < len(jql) && (jql[i+1] == '=' || jql[i+1] == '~') && c != '=' && c != '~' {
+				tokens = append(tokens, jqlToken{text: jql[i : i+2]})
+				i += 2
+			} else {
+				tokens = append(tokens, jqlToken{text: string(c)})
+				i++
+			}
+		default:
+			end := i
+			for end < len(jql) && !strings.ContainsRune(" \t\n\r\"'(),!<>=~", rune(jql[end])) {
+				end++
+			}
+			tokens = append(tokens, jqlToken{text: jql[i:end]})
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+type jqlParser struct {
+	tokens []jqlToken
+	pos    int
+}
+
+// parseJQL parses the boolean structure of a JQL query, without ORDER BY.
+func parseJQL(jql string) (jqlExpr, error) {
+	tokens, err := tokenizeJQL(jql)
+	if err != nil {
+		return nil, err
+	}
+	p := &jqlParser{tokens: tokens}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, errors.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	return expr, nil
+}
+
+func (p *jqlParser) peek() (jqlToken, bool) {
+	if p.pos >= len(p.tokens) {
+		return jqlToken{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+func (p *jqlParser) next() (jqlToken, error) {
+	t, ok := p.peek()
+	if !ok {
+		return t, errors.New("unexpected end of query")
+	}
+	p.pos++
+	return t, nil
+}
+
+// keyword reports whether the next token is the given unquoted keyword, and consumes it.
+func (p *jqlParser) keyword(k string) bool {
+	t, ok := p.peek()
+	if ok && !t.quoted && strings.EqualFold(t.text, k) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *jqlParser) parseOr() (jqlExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("or") || p.keyword("||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = jqlOr{left, right}
+	}
+	return left, nil
+}
+
+func (p *jqlParser) parseAnd() (jqlExpr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("and") || p.keyword("&&") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = jqlAnd{left, right}
+	}
+	return left, nil
+}
+
+func (p *jqlParser) parseNot() (jqlExpr, error) {
+	if p.keyword("not") || p.keyword("!") {
+		expr, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return jqlNot{expr}, nil
+	}
+	if p.keyword("(") {
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.keyword(")") {
+			return nil, errors.New("missing )")
+		}
+		return expr, nil
+	}
+	return p.parseClause()
+}
+
+func (p *jqlParser) parseClause() (jqlExpr, error) {
+	field, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	clause := jqlClause{field: field.text}
+	switch {
+	case p.keyword("not"):
+		if !p.keyword("in") {
+			return nil, errors.New("expected IN after NOT")
+		}
+		clause.operator = "not in"
+	case p.keyword("in"):
+		clause.operator = "in"
+	case p.keyword("is"):
+		clause.operator = "is"
+		if p.keyword("not") {
+			clause.operator = "is not"
+		}
+	default:
+		op, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		switch op.text {
+		case "=", "!=", "~", "!~", "<", "<=", ">", ">=":
+			if op.quoted {
+				return nil, errors.Errorf("unexpected %q", op.text)
+			}
+			clause.operator = op.text
+		default:
+			// WAS, CHANGED and other history operators are left to Jira.
+			return nil, errors.Errorf("unsupported operator %q", op.text)
+		}
+	}
+
+	if p.keyword("(") {
+		for {
+			value, err := p.parseValue(&clause)
+			if err != nil {
+				return nil, err
+			}
+			clause.values = append(clause.values, value)
+			if p.keyword(")") {
+				break
+			}
+			if !p.keyword(",") {
+				return nil, errors.New("expected , or )")
+			}
+		}
+		return clause, nil
+	}
+
+	value, err := p.parseValue(&clause)
+	if err != nil {
+		return nil, err
+	}
+	clause.values = append(clause.values, value)
+	return clause, nil
+}
+
+// parseValue parses a value, or a function call which marks the clause as not evaluable.
+func (p *jqlParser) parseValue(clause *jqlClause) (string, error) {
+	value, err := p.next()
+	if err != nil {
+		return "", err
+	}
+	if !value.quoted && strings.ContainsAny(value.text, "(),") {
+		return "", errors.Errorf("unexpected %q", value.text)
+	}
+	if !value.quoted && p.keyword("(") {
+		clause.function = true
+		for depth := 1; depth > 0; {
+			t, err := p.next()
+			if err != nil {
+				return "", err
+			}
+			if !t.quoted && t.text == "(" {
+				depth++
+			} else if !t.quoted && t.text == ")" {
+				depth--
+			}
+		}
+	}
+	return value.text, nil
+}
+
+// validateSubscriptionJQL checks the JQL filter of a subscription with Jira.
+func validateSubscriptionJQL(client Client, jql string) error {
+	if jqlOrderByRegexp.MatchString(jql) {
+		return errors.New("the JQL filter can not have an ORDER BY clause")
+	}
+	if _, err := client.SearchIssues(jql, &jira.SearchOptions{MaxResults: 1, Fields: []string{"key"}}); err != nil {
+		return errors.WithMessage(err, "invalid JQL filter")
+	}
+	return nil
+}
+
+type jqlMatchCacheEntry struct {
+	matches   bool
+	expiresAt time.Time
+}
+
+// jqlMatchCache remembers whether an issue, as of its last update, matched a JQL query.
+type jqlMatchCache struct {
+	lock    sync.Mutex
+	entries map[string]jqlMatchCacheEntry
+}
+
+func (c *jqlMatchCache) get(key string, now time.Time) (matches, ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || now.After(entry.expiresAt) {
+		return false, false
+	}
+	return entry.matches, true
+}
+
+func (c *jqlMatchCache) set(key string, matches bool, now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.entries == nil {
+		c.entries = map[string]jqlMatchCacheEntry{}
+	}
+	if len(c.entries) >= jqlMatchCacheMaxSize {
+		for k, entry := range c.entries {
+			if now.After(entry.expiresAt) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= jqlMatchCacheMaxSize {
+			c.entries = map[string]jqlMatchCacheEntry{}
+		}
+	}
+	c.entries[key] = jqlMatchCacheEntry{matches: matches, expiresAt: now.Add(jqlMatchCacheTTL)}
+}
+
+// matchesSubscriptionJQL evaluates the JQL filter of a subscription against the webhook issue.
+// When the query can not be decided from the payload, Jira is asked whether the issue matches,
+// as the user who created the subscription.
+func (p *Plugin) matchesSubscriptionJQL(issue *jira.Issue, jql string, instanceID types.ID, mattermostUserID string) bool {
+	if expr, err := parseJQL(jql); err == nil {
+		switch expr.eval(issue) {
+		case jqlTrue:
+			return true
+		case jqlFalse:
+			return false
+		}
+	}
+
+	updated := ""
+	if issue.Fields != nil {
+		updated = time.Time(issue.Fields.Updated).String()
+	}
+	cacheKey := strings.Join([]string{instanceID.String(), mattermostUserID, issue.Key, updated, jql}, "\x00")
+	now := time.Now()
+	if matches, ok := p.jqlMatches.get(cacheKey, now); ok {
+		return matches
+	}
+
+	client, _, _, err := p.getClient(instanceID, types.ID(mattermostUserID))
+	if err != nil {
+		p.errorf("Failed to check the JQL filter of a subscription of user %s: %v", mattermostUserID, err)
+		return false
+	}
+	found, err := client.SearchIssues(fmt.Sprintf("key = %s AND (%s)", issue.Key, jql), &jira.SearchOptions{MaxResults: 1, Fields: []string{"key"}})
+	if err != nil {
+		p.errorf("Failed to check the JQL filter of a subscription of user %s: %v", mattermostUserID, err)
+		return false
+	}
+
+	matches := len(found) > 0
+	p.jqlMatches.set(cacheKey, matches, now)
+	return matches
+}
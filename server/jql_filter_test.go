@@ -0,0 +1,128 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License for license information.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	jira "github.com/andygrunwald/go-jira"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mattermost/mattermost-plugin-jira/server/utils/types"
+)
+
+func testJQLIssue() *jira.Issue {
+	return &jira.Issue{
+		Key: "API-7",
+		Fields: &jira.IssueFields{
+			Project:    jira.Project{Key: "API", Name: "Public API"},
+			Type:       jira.IssueType{Name: "Bug", ID: "10004"},
+			Status:     &jira.Status{Name: "In Progress"},
+			Priority:   &jira.Priority{Name: "High", ID: "2"},
+			Labels:     []string{"backend", "customer"},
+			Components: []*jira.Component{{Name: "API", ID: "100"}},
+			Assignee:   &jira.User{AccountID: "abc", DisplayName: "Some User"},
+		},
+	}
+}
+
+func TestEvalJQL(t *testing.T) {
+	issue := testJQLIssue()
+
+	for jql, expected := range map[string]jqlResult{
+		`priority = High AND component in (API) AND labels != wontfix`: jqlTrue,
+		`project = API and issuetype = bug`:                            jqlTrue,
+		`project = OTHER AND priority >= High`:                         jqlFalse,
+		`priority >= High`:                                             jqlUnknown,
+		`priority >= High OR labels = customer`:                        jqlTrue,
+		`labels not in (customer, vip)`:                                jqlFalse,
+		`NOT (status = "In Progress")`:                                 jqlFalse,
+		`resolution is EMPTY and assignee is not empty`:                jqlTrue,
+		`resolution != Fixed`:                                          jqlFalse,
+		`resolution = EMPTY`:                                           jqlTrue,
+		`assignee = currentUser()`:                                     jqlUnknown,
+		`assignee = currentUser() AND project = OTHER`:                 jqlFalse,
+		`"Story Points" > 3`:                                           jqlUnknown,
+		`summary ~ "crash"`:                                            jqlUnknown,
+		`key = api-7 || labels = frontend`:                             jqlTrue,
+	} {
+		t.Run(jql, func(t *testing.T) {
+			expr, err := parseJQL(jql)
+			require.NoError(t, err)
+			assert.Equal(t, expected, expr.eval(issue))
+		})
+	}
+}
+
+func TestParseJQLErrors(t *testing.T) {
+	for _, jql := range []string{
+		`project = `,
+		`project in (API`,
+		`(project = API`,
+		`status was Open`,
+		`summary ~ "unterminated`,
+		`project = API ORDER BY created`,
+	} {
+		_, err := parseJQL(jql)
+		assert.Error(t, err, jql)
+	}
+}
+
+type jqlTestClient struct {
+	testClient
+	searches *[]string
+	found    bool
+}
+
+func (client jqlTestClient) SearchIssues(jql string, options *jira.SearchOptions) ([]jira.Issue, error) {
+	*client.searches = append(*client.searches, jql)
+	if client.found {
+		return []jira.Issue{{Key: "API-7"}}, nil
+	}
+	return nil, nil
+}
+
+type jqlTestInstance struct {
+	testInstance
+	client Client
+}
+
+func (ti jqlTestInstance) GetClient(*Connection) (Client, error) {
+	return ti.client, nil
+}
+
+type jqlTestInstanceStore struct {
+	mockInstanceStore
+	instance Instance
+}
+
+func (store jqlTestInstanceStore) LoadInstance(types.ID) (Instance, error) {
+	return store.instance, nil
+}
+
+func TestMatchesSubscriptionJQL(t *testing.T) {
+	searches := []string{}
+	p := &Plugin{}
+	p.userStore = mockUserStore{}
+	p.instanceStore = jqlTestInstanceStore{instance: &jqlTestInstance{
+		testInstance: *testInstance1,
+		client:       jqlTestClient{searches: &searches, found: true},
+	}}
+	issue := testJQLIssue()
+
+	assert.True(t, p.matchesSubscriptionJQL(issue, "labels = customer", testInstance1.GetID(), "user1"))
+	assert.False(t, p.matchesSubscriptionJQL(issue, "labels = frontend", testInstance1.GetID(), "user1"))
+	assert.Empty(t, searches)
+
+	assert.True(t, p.matchesSubscriptionJQL(issue, "priority >= High", testInstance1.GetID(), "user1"))
+	assert.True(t, p.matchesSubscriptionJQL(issue, "priority >= High", testInstance1.GetID(), "user1"))
+	assert.Equal(t, []string{"key = API-7 AND (priority >= High)"}, searches)
+
+	// A change of the issue is checked again
+	issue.Fields.Updated = jira.Time(time.Time(issue.Fields.Updated).Add(time.Second))
+	assert.True(t, p.matchesSubscriptionJQL(issue, "priority >= High", testInstance1.GetID(), "user1"))
+	assert.Len(t, searches, 2)
+}
@@ -140,7 +140,14 @@ func (store store) StoreConnection(instanceID, mattermostUserID types.ID, connec
 	connection.PluginVersion = manifest.Version
 	connection.MattermostUserID = mattermostUserID
 
-	err := store.set(keyWithInstanceID(instanceID, mattermostUserID), connection)
+	// The credentials are encrypted in a copy, the caller keeps using the connection.
+	sealed := copyConnection(connection)
+	err := store.sealCredentials(connectionCredentials(sealed))
+	if err != nil {
+		return err
+	}
+
+	err = store.set(keyWithInstanceID(instanceID, mattermostUserID), sealed)
 	if err != nil {
 		return err
 	}
@@ -171,6 +178,11 @@ func (store store) LoadConnection(instanceID, mattermostUserID types.ID) (*Conne
 		return nil, errors.Wrapf(err,
 			"failed to load connection for Mattermost user ID:%q, Jira:%q", mattermostUserID, instanceID)
 	}
+	err = store.openCredentials(connectionCredentials(c))
+	if err != nil {
+		return nil, errors.Wrapf(err,
+			"failed to decrypt connection for Mattermost user ID:%q, Jira:%q", mattermostUserID, instanceID)
+	}
 	c.PluginVersion = manifest.Version
 	return c, nil
 }
@@ -487,6 +499,9 @@ func (store *store) LoadInstanceFullKey(fullkey string) (Instance, error) {
 		if err := json.Unmarshal(data, &ci); err != nil {
 			return nil, errors.WithMessage(err, fmt.Sprintf("failed to unmarshal stored instance %s", fullkey))
 		}
+		if err := store.openCredentials(instanceCredentials(&ci)); err != nil {
+			return nil, errors.WithMessage(err, fmt.Sprintf("failed to decrypt stored instance %s", fullkey))
+		}
 		if len(ci.RawAtlassianSecurityContext) > 0 {
 			if err := json.Unmarshal([]byte(ci.RawAtlassianSecurityContext), &ci.AtlassianSecurityContext); err != nil {
 				return nil, errors.WithMessage(err, fmt.Sprintf("failed to unmarshal stored instance %s", fullkey))
@@ -500,6 +515,9 @@ func (store *store) LoadInstanceFullKey(fullkey string) (Instance, error) {
 		if err := json.Unmarshal(data, &ci); err != nil {
 			return nil, errors.WithMessage(err, fmt.Sprintf("failed to unmarshal stored instance %s", fullkey))
 		}
+		if err := store.openCredentials(instanceCredentials(&ci)); err != nil {
+			return nil, errors.WithMessage(err, fmt.Sprintf("failed to decrypt stored instance %s", fullkey))
+		}
 		if ci.JWTInstance != nil {
 			if err := json.Unmarshal([]byte(ci.JWTInstance.RawAtlassianSecurityContext), &ci.JWTInstance.AtlassianSecurityContext); err != nil {
 				return nil, errors.WithMessage(err, fmt.Sprintf("failed to unmarshal stored instance %s", fullkey))
@@ -521,7 +539,13 @@ func (store *store) LoadInstanceFullKey(fullkey string) (Instance, error) {
 func (store *store) StoreInstance(instance Instance) error {
 	kv := kvstore.NewStore(kvstore.NewPluginStore(store.plugin.client))
 	instance.Common().PluginVersion = manifest.Version
-	return kv.Entity(prefixInstance).Store(instance.GetID(), instance)
+
+	// The secrets are encrypted in a copy, the caller keeps using the instance.
+	sealed := copyInstance(instance)
+	if err := store.sealCredentials(instanceCredentials(sealed)); err != nil {
+		return errors.WithMessagef(err, "failed to store Jira instance %s", instance.GetID())
+	}
+	return kv.Entity(prefixInstance).Store(instance.GetID(), sealed)
 }
 
 func (store *store) DeleteInstance(id types.ID) error {
@@ -58,6 +58,8 @@ func TestMigrateV2Instances(t *testing.T) {
 			api.On("LogDebug", mock.AnythingOfTypeArgument("string")).Return(nil)
 
 			api.On("KVGet", keyInstances).Return(nil, nil)
+			api.On("KVGet", keyCredentialKeys).Return(nil, nil)
+			api.On("KVGet", keyTokenSecret).Return(testCredentialKey(1), nil)
 			api.On("KVGet", v2keyKnownJiraInstances).Return([]byte(tc.known), nil)
 			if tc.current != "" {
 				api.On("KVGet", v2keyCurrentJIRAInstance).Return([]byte(tc.current), nil)
@@ -94,7 +96,7 @@ func TestMigrateV2Instances(t *testing.T) {
 			require.Equal(t, tc.numExpectedInstances, instances.Len())
 			if instances.Len() > 0 {
 				id := instances.IDs()[0]
-				require.Equal(t, tc.expectInstance, string(storedInstancePayload))
+				require.Equal(t, tc.expectInstance, string(openTestInstancePayload(t, p, storedInstancePayload)))
 				require.Equal(t, tc.expectInstances, string(storedInstancesPayload))
 				require.Equal(t, id, instances.Get(id).GetID())
 			}
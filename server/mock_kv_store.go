@@ -1,6 +1,10 @@
 package main
 
 import (
+	"bytes"
+	"sort"
+
+	"github.com/mattermost/mattermost/server/public/model"
 	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
 	"github.com/stretchr/testify/mock"
 )
@@ -30,11 +34,33 @@ func makeTestKVStore(api *plugintest.API, initialValues testKVStore) testKVStore
 		testStore[key] = value
 	})
 
-	api.On("KVSetWithOptions", mock.AnythingOfType("string"), mock.Anything, mock.AnythingOfType("model.PluginKVSetOptions")).Return(true, nil).Run(func(args mock.Arguments) {
-		key := args.Get(0).(string)
-		value := args.Get(1).([]byte)
-		testStore[key] = value
-	})
+	api.On("KVSetWithOptions", mock.AnythingOfType("string"), mock.Anything, mock.AnythingOfType("model.PluginKVSetOptions")).Return(
+		func(key string, value []byte, options model.PluginKVSetOptions) bool {
+			if options.Atomic && !bytes.Equal(testStore[key], options.OldValue) {
+				return false
+			}
+			testStore[key] = value
+			return true
+		}, nil)
+
+	api.On("KVList", mock.AnythingOfType("int"), mock.AnythingOfType("int")).Maybe().Return(
+		func(page, perPage int) []string {
+			keys := []string{}
+			for key, value := range testStore {
+				if value != nil {
+					keys = append(keys, key)
+				}
+			}
+			sort.Strings(keys)
+			if page*perPage >= len(keys) {
+				return []string{}
+			}
+			keys = keys[page*perPage:]
+			if len(keys) > perPage {
+				keys = keys[:perPage]
+			}
+			return keys
+		}, nil)
 
 	return testStore
 }
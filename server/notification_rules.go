@@ -0,0 +1,493 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License for license information.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/pluginapi"
+	"github.com/mattermost/mattermost/server/public/pluginapi/cluster"
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-plugin-jira/server/utils/types"
+)
+
+const (
+	notificationKindMention    = "mention"
+	notificationKindAssignment = "assignment"
+	notificationKindComment    = "comment"
+	notificationKindStatus     = "status"
+	notificationKindWatching   = "watching"
+
+	prefixDeferredNotifications = "dnq_" // + hash of instance ID and user ID, notifications held back by quiet hours or a digest
+
+	// keyDeferredNotificationsIndex holds when the notifications held back for each user are due,
+	// by key, so that the job reads only the ones that are.
+	keyDeferredNotificationsIndex = "deferred_notifications_index"
+
+	deferredNotificationsJobKey      = "deferred_notifications_flush"
+	deferredNotificationsJobInterval = time.Minute
+)
+
+// notificationKinds are the kinds of notifications users can turn off, with their descriptions,
+// from the one that concerns a user most.
+var notificationKinds = []struct{ Kind, Description string }{
+	{notificationKindMention, "you are mentioned in a comment"},
+	{notificationKindAssignment, "you are assigned to an issue"},
+	{notificationKindComment, "an issue assigned to you is commented on"},
+	{notificationKindStatus, "the status of an issue you reported changes"},
+	{notificationKindWatching, "an issue you watch changes"},
+}
+
+// sortNotificationsByKind orders the notifications as notificationKinds, so that a user notified
+// several times of a change keeps the notification that concerns them most.
+func sortNotificationsByKind(notifications []webhookUserNotification) {
+	rank := func(kind string) int {
+		for i, k := range notificationKinds {
+			if k.Kind == kind {
+				return i
+			}
+		}
+		return len(notificationKinds)
+	}
+	sort.SliceStable(notifications, func(i, j int) bool {
+		return rank(notifications[i].kind) < rank(notifications[j].kind)
+	})
+}
+
+func isNotificationKind(kind string) bool {
+	for _, k := range notificationKinds {
+		if k.Kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// QuietHours is a daily period, in the given timezone, during which notifications are held back
+// and sent when it ends. From may be later than To for a period spanning midnight.
+type QuietHours struct {
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Timezone string `json:"timezone"`
+}
+
+// parseQuietHours parses a period such as "22:00-07:30".
+func parseQuietHours(period, timezone string) (*QuietHours, error) {
+	from, to, ok := strings.Cut(period, "-")
+	if !ok {
+		return nil, errors.Errorf("invalid quiet hours %q, use the 24-hour `HH:MM-HH:MM` format", period)
+	}
+	q := &QuietHours{From: strings.TrimSpace(from), To: strings.TrimSpace(to), Timezone: timezone}
+	fromMinutes, err := minuteOfDay(q.From)
+	if err != nil {
+		return nil, err
+	}
+	toMinutes, err := minuteOfDay(q.To)
+	if err != nil {
+		return nil, err
+	}
+	if fromMinutes == toMinutes {
+		return nil, errors.New("quiet hours must not start and end at the same time")
+	}
+	if _, err = (DigestSchedule{Timezone: timezone}).location(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func minuteOfDay(clock string) (int, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, errors.Errorf("invalid time %q, use the 24-hour `HH:MM` format", clock)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Until returns the end of the quiet hours if the given time is within them.
+func (q *QuietHours) Until(now time.Time) (time.Time, bool) {
+	fromMinutes, err := minuteOfDay(q.From)
+	if err != nil {
+		return time.Time{}, false
+	}
+	toMinutes, err := minuteOfDay(q.To)
+	if err != nil {
+		return time.Time{}, false
+	}
+	loc, err := (DigestSchedule{Timezone: q.Timezone}).location()
+	if err != nil {
+		loc = time.UTC
+	}
+
+	local := now.In(loc)
+	minutes := local.Hour()*60 + local.Minute()
+	end := time.Date(local.Year(), local.Month(), local.Day(), toMinutes/60, toMinutes%60, 0, 0, loc)
+	switch {
+	case fromMinutes < toMinutes:
+		return end, minutes >= fromMinutes && minutes < toMinutes
+	case minutes >= fromMinutes:
+		return end.AddDate(0, 0, 1), true
+	default:
+		return end, minutes < toMinutes
+	}
+}
+
+func (q *QuietHours) String() string {
+	return fmt.Sprintf("%s-%s %s", q.From, q.To, q.Timezone)
+}
+
+// AllowsNotification tells whether a notification of the kind, for an issue of the project, is sent.
+func (s *ConnectionSettings) AllowsNotification(kind, projectKey string) bool {
+	if s == nil || !s.Notifications {
+		return false
+	}
+	for _, muted := range s.MutedEvents {
+		if muted == kind {
+			return false
+		}
+	}
+	for _, muted := range s.MutedProjects {
+		if strings.EqualFold(muted, projectKey) {
+			return false
+		}
+	}
+	return true
+}
+
+// DeliverAt returns when a notification created now is sent, if it is not sent right away.
+func (s *ConnectionSettings) DeliverAt(now time.Time) (time.Time, bool) {
+	if s == nil {
+		return time.Time{}, false
+	}
+	if s.NotificationDigest != nil {
+		return s.NotificationDigest.Next(now), true
+	}
+	if s.QuietHours != nil {
+		return s.QuietHours.Until(now)
+	}
+	return time.Time{}, false
+}
+
+// projectKey returns the key of the project of the issue of the webhook.
+func (wh *webhook) projectKey() string {
+	if wh.Issue.Fields != nil && wh.Issue.Fields.Project.Key != "" {
+		return wh.Issue.Fields.Project.Key
+	}
+	projectKey, _, _ := strings.Cut(wh.Issue.Key, "-")
+	return projectKey
+}
+
+// deferredNotifications are the notifications of a user held back until DeliverAt.
+type deferredNotifications struct {
+	InstanceID       types.ID  `json:"instance_id"`
+	MattermostUserID types.ID  `json:"mattermost_user_id"`
+	DeliverAt        time.Time `json:"deliver_at"`
+	Messages         []string  `json:"messages"`
+}
+
+func keyDeferredNotifications(instanceID, mattermostUserID types.ID) string {
+	return hashkey(prefixDeferredNotifications, instanceID.String()+"/"+mattermostUserID.String())
+}
+
+// deferNotification adds the message to the notifications held back for the user. The first
+// notification held back decides when they are all sent.
+func (p *Plugin) deferNotification(instanceID, mattermostUserID types.ID, deliverAt time.Time, message string) error {
+	key := keyDeferredNotifications(instanceID, mattermostUserID)
+	var due time.Time
+	err := p.client.KV.SetAtomicWithRetries(key, func(initialBytes []byte) (interface{}, error) {
+		deferred := &deferredNotifications{
+			InstanceID:       instanceID,
+			MattermostUserID: mattermostUserID,
+			DeliverAt:        deliverAt,
+		}
+		if len(initialBytes) != 0 {
+			if err := json.Unmarshal(initialBytes, deferred); err != nil {
+				return nil, err
+			}
+		}
+		deferred.Messages = append(deferred.Messages, message)
+		due = deferred.DeliverAt
+		return deferred, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return p.updateDeferredNotificationsIndex(func(index map[string]time.Time) {
+		index[key] = due
+	})
+}
+
+func (p *Plugin) updateDeferredNotificationsIndex(update func(index map[string]time.Time)) error {
+	err := p.client.KV.SetAtomicWithRetries(keyDeferredNotificationsIndex, func(initialBytes []byte) (interface{}, error) {
+		index := map[string]time.Time{}
+		if len(initialBytes) != 0 {
+			if err := json.Unmarshal(initialBytes, &index); err != nil {
+				return nil, err
+			}
+		}
+		update(index)
+		if len(index) == 0 {
+			return nil, nil
+		}
+		return index, nil
+	})
+	return errors.Wrap(err, "failed to update the deferred notifications index")
+}
+
+// flushDeferredNotifications sends the notifications held back whose time has come, as one
+// direct message per user.
+func (p *Plugin) flushDeferredNotifications() {
+	var index map[string]time.Time
+	if err := p.client.KV.Get(keyDeferredNotificationsIndex, &index); err != nil {
+		p.errorf("Failed to load the deferred notifications index: %v", err)
+		return
+	}
+
+	now := time.Now()
+	flushed := map[string]time.Time{}
+	for key, due := range index {
+		if due.After(now) {
+			continue
+		}
+		if p.flushDeferredNotificationsKey(key, now) {
+			flushed[key] = due
+		}
+	}
+	if len(flushed) == 0 {
+		return
+	}
+
+	// Notifications held back again while these were sent have a later time in the index.
+	err := p.updateDeferredNotificationsIndex(func(index map[string]time.Time) {
+		for key, due := range flushed {
+			if current, ok := index[key]; ok && current.Equal(due) {
+				delete(index, key)
+			}
+		}
+	})
+	if err != nil {
+		p.errorf("Failed to remove flushed deferred notifications from the index: %v", err)
+	}
+}
+
+// flushDeferredNotificationsKey sends the notifications held back under the key if they are due,
+// and returns whether none are left to send.
+func (p *Plugin) flushDeferredNotificationsKey(key string, now time.Time) bool {
+	var data []byte
+	if err := p.client.KV.Get(key, &data); err != nil {
+		p.errorf("Failed to load deferred notifications %s: %v", key, err)
+		return false
+	}
+	if len(data) == 0 {
+		return true
+	}
+
+	deferred := &deferredNotifications{}
+	if err := json.Unmarshal(data, deferred); err != nil {
+		p.errorf("Failed to unmarshal deferred notifications %s, discarding them: %v", key, err)
+		_ = p.client.KV.Delete(key)
+		return true
+	}
+	if deferred.DeliverAt.After(now) {
+		return false
+	}
+
+	// Take the notifications out of the store first, so that the ones arriving while they
+	// are being sent are held back for the next delivery instead of being lost.
+	deleted, err := p.client.KV.Set(key, nil, pluginapi.SetAtomic(data))
+	if err != nil {
+		p.errorf("Failed to remove deferred notifications %s: %v", key, err)
+		return false
+	}
+	if !deleted {
+		return false
+	}
+
+	if _, err = p.CreateBotDMPost(deferred.InstanceID, deferred.MattermostUserID, formatDeferredNotifications(deferred), ""); err != nil {
+		p.errorf("Failed to send deferred notifications to %s: %v", deferred.MattermostUserID, err)
+	}
+	return true
+}
+
+func formatDeferredNotifications(deferred *deferredNotifications) string {
+	return fmt.Sprintf("#### Jira notifications\n%d updates since your last notification:\n\n%s",
+		len(deferred.Messages), strings.Join(deferred.Messages, "\n\n---\n"))
+}
+
+func (p *Plugin) scheduleDeferredNotificationsJob() error {
+	job, err := cluster.Schedule(p.API, deferredNotificationsJobKey, cluster.MakeWaitForInterval(deferredNotificationsJobInterval), p.flushDeferredNotifications)
+	if err != nil {
+		return errors.Wrap(err, "failed to schedule deferred notifications job")
+	}
+	p.deferredNotificationsJob = job
+	return nil
+}
+
+// NotificationSettings are the notification preferences of a user, as exposed by the API.
+type NotificationSettings struct {
+	Notifications      bool            `json:"notifications"`
+	MutedEvents        []string        `json:"muted_events"`
+	MutedProjects      []string        `json:"muted_projects"`
+	QuietHours         *QuietHours     `json:"quiet_hours"`
+	NotificationDigest *DigestSchedule `json:"notification_digest"`
+}
+
+func (s *NotificationSettings) validate() error {
+	for _, kind := range s.MutedEvents {
+		if !isNotificationKind(kind) {
+			return errors.Errorf("%q is not a kind of notification", kind)
+		}
+	}
+	if s.QuietHours != nil {
+		if _, err := parseQuietHours(s.QuietHours.From+"-"+s.QuietHours.To, s.QuietHours.Timezone); err != nil {
+			return err
+		}
+	}
+	if s.NotificationDigest != nil {
+		if len(s.NotificationDigest.Weekdays) == 0 {
+			return errors.New("the notification digest needs at least one day")
+		}
+		if _, err := s.NotificationDigest.location(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Plugin) httpNotificationSettings(w http.ResponseWriter, r *http.Request) (int, error) {
+	mattermostUserID := types.ID(r.Header.Get("Mattermost-User-ID"))
+	_, instanceID, err := p.ResolveUserInstanceURL(mattermostUserID, r.FormValue("instance_id"))
+	if err != nil {
+		return respondErr(w, http.StatusBadRequest, err)
+	}
+	connection, err := p.userStore.LoadConnection(instanceID, mattermostUserID)
+	if err != nil {
+		return respondErr(w, http.StatusNotFound, err)
+	}
+	if connection.Settings == nil {
+		connection.Settings = &ConnectionSettings{}
+	}
+
+	if r.Method == http.MethodPut {
+		in := NotificationSettings{}
+		if err = json.NewDecoder(r.Body).Decode(&in); err != nil {
+			return respondErr(w, http.StatusBadRequest, errors.WithMessage(err, "failed to decode the notification settings"))
+		}
+		if err = in.validate(); err != nil {
+			return respondErr(w, http.StatusBadRequest, err)
+		}
+		connection.Settings.Notifications = in.Notifications
+		connection.Settings.MutedEvents = in.MutedEvents
+		connection.Settings.MutedProjects = in.MutedProjects
+		connection.Settings.QuietHours = in.QuietHours
+		connection.Settings.NotificationDigest = in.NotificationDigest
+		if err = p.userStore.StoreConnection(instanceID, mattermostUserID, connection); err != nil {
+			return respondErr(w, http.StatusInternalServerError, err)
+		}
+	}
+
+	return respondJSON(w, NotificationSettings{
+		Notifications:      connection.Settings.Notifications,
+		MutedEvents:        connection.Settings.MutedEvents,
+		MutedProjects:      connection.Settings.MutedProjects,
+		QuietHours:         connection.Settings.QuietHours,
+		NotificationDigest: connection.Settings.NotificationDigest,
+	})
+}
+
+// settingsNotificationRule updates one of the notification rules, with args such as
+// ["events", "status", "off"] or ["quiet_hours", "22:00-07:00"].
+func (p *Plugin) settingsNotificationRule(header *model.CommandArgs, instanceID, mattermostUserID types.ID, connection *Connection, args []string) *model.CommandResponse {
+	if connection.Settings == nil {
+		connection.Settings = &ConnectionSettings{}
+	}
+	settings := connection.Settings
+	timezone := ""
+	if user, err := p.client.User.Get(mattermostUserID.String()); err == nil {
+		timezone = user.GetPreferredTimezone()
+	}
+
+	switch {
+	case args[0] == "events" && len(args) == 1:
+		text := "Notifications are sent when:\n"
+		for _, k := range notificationKinds {
+			state := "on"
+			for _, kind := range settings.MutedEvents {
+				if kind == k.Kind {
+					state = "off"
+				}
+			}
+			text += fmt.Sprintf("* `%s`: %s, %s\n", k.Kind, k.Description, state)
+		}
+		return p.responsef(header, text)
+
+	case args[0] == "events" && len(args) == 3 && isNotificationKind(args[1]) && (args[2] == "on" || args[2] == "off"):
+		var muted []string
+		for _, kind := range settings.MutedEvents {
+			if kind != args[1] {
+				muted = append(muted, kind)
+			}
+		}
+		if args[2] == "off" {
+			muted = append(muted, args[1])
+		}
+		settings.MutedEvents = muted
+
+	case (args[0] == "mute" || args[0] == "unmute") && len(args) == 2:
+		projectKey := strings.ToUpper(args[1])
+		var muted []string
+		for _, key := range settings.MutedProjects {
+			if key != projectKey {
+				muted = append(muted, key)
+			}
+		}
+		if args[0] == "mute" {
+			muted = append(muted, projectKey)
+		}
+		settings.MutedProjects = muted
+
+	case args[0] == "quiet_hours" && len(args) == 2:
+		if args[1] == "off" {
+			settings.QuietHours = nil
+			break
+		}
+		quietHours, err := parseQuietHours(args[1], timezone)
+		if err != nil {
+			return p.responsef(header, "%v", err)
+		}
+		settings.QuietHours = quietHours
+
+	case args[0] == "digest" && (len(args) == 2 || len(args) == 3):
+		if args[1] == "off" {
+			settings.NotificationDigest = nil
+			break
+		}
+		days, at := "daily", args[1]
+		if len(args) == 3 {
+			days, at = args[1], args[2]
+		}
+		schedule, err := parseDigestSchedule(days, at, timezone)
+		if err != nil {
+			return p.responsef(header, "%v", err)
+		}
+		settings.NotificationDigest = &schedule
+
+	default:
+		return p.responsef(header, "`/jira settings events [kind] [on|off]`, `/jira settings mute|unmute [project-key]`, "+
+			"`/jira settings quiet_hours [HH:MM-HH:MM|off]` or `/jira settings digest [days] [HH:MM|off]`\n* Invalid value.")
+	}
+
+	if err := p.userStore.StoreConnection(instanceID, mattermostUserID, connection); err != nil {
+		p.errorf("settingsNotificationRule, err: %v", err)
+		return p.responsef(header, "Could not store new settings. Please contact your system administrator. error: %v", err)
+	}
+	return p.responsef(header, "Settings updated.\n%s", settings.String())
+}
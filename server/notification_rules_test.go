@@ -0,0 +1,122 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License for license information.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	jira "github.com/andygrunwald/go-jira"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuietHours(t *testing.T) {
+	_, err := parseQuietHours("22:00", "")
+	assert.Error(t, err)
+	_, err = parseQuietHours("22:00-22:00", "")
+	assert.Error(t, err)
+	_, err = parseQuietHours("22:00-07:00", "Not/A_Zone")
+	assert.Error(t, err)
+
+	overnight, err := parseQuietHours("22:00-07:30", "")
+	require.NoError(t, err)
+	daytime, err := parseQuietHours("12:00-13:00", "")
+	require.NoError(t, err)
+
+	for name, tc := range map[string]struct {
+		quietHours *QuietHours
+		now        time.Time
+		until      time.Time
+		quiet      bool
+	}{
+		"overnight before start": {overnight, time.Date(2024, 3, 4, 21, 59, 0, 0, time.UTC), time.Time{}, false},
+		"overnight evening":      {overnight, time.Date(2024, 3, 4, 23, 0, 0, 0, time.UTC), time.Date(2024, 3, 5, 7, 30, 0, 0, time.UTC), true},
+		"overnight morning":      {overnight, time.Date(2024, 3, 5, 6, 0, 0, 0, time.UTC), time.Date(2024, 3, 5, 7, 30, 0, 0, time.UTC), true},
+		"overnight at end":       {overnight, time.Date(2024, 3, 5, 7, 30, 0, 0, time.UTC), time.Time{}, false},
+		"daytime within":         {daytime, time.Date(2024, 3, 4, 12, 15, 0, 0, time.UTC), time.Date(2024, 3, 4, 13, 0, 0, 0, time.UTC), true},
+		"daytime after":          {daytime, time.Date(2024, 3, 4, 14, 0, 0, 0, time.UTC), time.Time{}, false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			until, quiet := tc.quietHours.Until(tc.now)
+			assert.Equal(t, tc.quiet, quiet)
+			if tc.quiet {
+				assert.True(t, tc.until.Equal(until), "expected %v, got %v", tc.until, until)
+			}
+		})
+	}
+}
+
+func TestConnectionSettingsNotificationRules(t *testing.T) {
+	var settings *ConnectionSettings
+	assert.False(t, settings.AllowsNotification(notificationKindMention, "PROJ"))
+
+	settings = &ConnectionSettings{
+		Notifications: true,
+		MutedEvents:   []string{notificationKindStatus},
+		MutedProjects: []string{"NOISY"},
+	}
+	assert.True(t, settings.AllowsNotification(notificationKindMention, "PROJ"))
+	assert.False(t, settings.AllowsNotification(notificationKindStatus, "PROJ"))
+	assert.False(t, settings.AllowsNotification(notificationKindMention, "noisy"))
+
+	now := time.Date(2024, 3, 4, 23, 0, 0, 0, time.UTC)
+	_, deferred := settings.DeliverAt(now)
+	assert.False(t, deferred)
+
+	settings.QuietHours = &QuietHours{From: "22:00", To: "07:00"}
+	deliverAt, deferred := settings.DeliverAt(now)
+	assert.True(t, deferred)
+	assert.Equal(t, time.Date(2024, 3, 5, 7, 0, 0, 0, time.UTC), deliverAt)
+
+	schedule, err := parseDigestSchedule("daily", "18:00", "")
+	require.NoError(t, err)
+	settings.NotificationDigest = &schedule
+	deliverAt, deferred = settings.DeliverAt(now)
+	assert.True(t, deferred)
+	assert.Equal(t, time.Date(2024, 3, 5, 18, 0, 0, 0, time.UTC), deliverAt)
+}
+
+func TestWebhookProjectKey(t *testing.T) {
+	wh := &webhook{JiraWebhook: &JiraWebhook{Issue: jira.Issue{Key: "PROJ-12"}}}
+	assert.Equal(t, "PROJ", wh.projectKey())
+
+	wh.Issue.Fields = &jira.IssueFields{Project: jira.Project{Key: "OTHER"}}
+	assert.Equal(t, "OTHER", wh.projectKey())
+}
+
+func TestDeferNotification(t *testing.T) {
+	p, _ := setupTestWebhookQueue(t)
+	first := time.Date(2024, 3, 5, 7, 0, 0, 0, time.UTC)
+
+	require.NoError(t, p.deferNotification("jiraurl1", "user1", first, "first"))
+	require.NoError(t, p.deferNotification("jiraurl1", "user1", first.Add(time.Hour), "second"))
+
+	deferred := &deferredNotifications{}
+	require.NoError(t, p.client.KV.Get(keyDeferredNotifications("jiraurl1", "user1"), deferred))
+	assert.True(t, first.Equal(deferred.DeliverAt))
+	assert.Equal(t, []string{"first", "second"}, deferred.Messages)
+	assert.Equal(t, "#### Jira notifications\n2 updates since your last notification:\n\nfirst\n\n---\nsecond",
+		formatDeferredNotifications(deferred))
+}
+
+func TestFlushDeferredNotifications(t *testing.T) {
+	p, _ := setupTestWebhookQueue(t)
+	later := time.Now().Add(time.Hour)
+	require.NoError(t, p.deferNotification("jiraurl1", "user1", later, "later"))
+	require.NoError(t, p.updateDeferredNotificationsIndex(func(index map[string]time.Time) {
+		index[keyDeferredNotifications("jiraurl1", "user2")] = time.Now().Add(-time.Minute)
+	}))
+
+	p.flushDeferredNotifications()
+
+	index := map[string]time.Time{}
+	require.NoError(t, p.client.KV.Get(keyDeferredNotificationsIndex, &index))
+	require.Len(t, index, 1)
+	assert.True(t, later.Equal(index[keyDeferredNotifications("jiraurl1", "user1")]))
+
+	deferred := &deferredNotifications{}
+	require.NoError(t, p.client.KV.Get(keyDeferredNotifications("jiraurl1", "user1"), deferred))
+	assert.Equal(t, []string{"later"}, deferred.Messages)
+}
@@ -0,0 +1,176 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License for license information.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/mattermost/mattermost-plugin-jira/server/utils/types"
+)
+
+const (
+	oauth2ClientPoolMaxSize = 1000
+	oauth2ClientIdleTTL     = 30 * time.Minute
+)
+
+// connectionTokenSource is the token source of a connection to a Jira Cloud OAuth 2.0 instance.
+// It refreshes the token at most once at a time, and stores the refreshed token with the
+// connection, so that concurrent requests do not each refresh it and race to store it.
+type connectionTokenSource struct {
+	plugin           *Plugin
+	instanceID       types.ID
+	mattermostUserID types.ID
+	base             oauth2.TokenSource
+
+	lock sync.Mutex
+	// initialRefreshToken is the refresh token the source was created with, connections loaded
+	// before the token was refreshed still have it.
+	initialRefreshToken string
+	token               *oauth2.Token
+}
+
+func newConnectionTokenSource(p *Plugin, instanceID, mattermostUserID types.ID, token *oauth2.Token, base oauth2.TokenSource) *connectionTokenSource {
+	return &connectionTokenSource{
+		plugin:              p,
+		instanceID:          instanceID,
+		mattermostUserID:    mattermostUserID,
+		base:                base,
+		initialRefreshToken: token.RefreshToken,
+		token:               token,
+	}
+}
+
+func (s *connectionTokenSource) Token() (*oauth2.Token, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	token, err := s.base.Token()
+	if err != nil {
+		return nil, err
+	}
+	if token.AccessToken == s.token.AccessToken && token.RefreshToken == s.token.RefreshToken {
+		return token, nil
+	}
+	s.token = token
+
+	// The request goes on with the new token even if it could not be stored.
+	if err = s.storeToken(token); err != nil {
+		s.plugin.errorf("Failed to store the refreshed OAuth2 token of user %s: %v", s.mattermostUserID, err)
+	}
+	return token, nil
+}
+
+// storeToken stores the token with the latest version of the connection, rather than with the
+// one the source was created from, to not undo the changes made to it since.
+func (s *connectionTokenSource) storeToken(token *oauth2.Token) error {
+	connection, err := s.plugin.userStore.LoadConnection(s.instanceID, s.mattermostUserID)
+	if err != nil {
+		return err
+	}
+	if connection.OAuth2Token == nil {
+		// The user disconnected meanwhile.
+		return nil
+	}
+	connection.OAuth2Token = token
+	return s.plugin.userStore.StoreConnection(s.instanceID, s.mattermostUserID, connection)
+}
+
+// matches returns true if the token is the one of the source, or the one it was created with.
+func (s *connectionTokenSource) matches(token *oauth2.Token) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return token.RefreshToken == s.initialRefreshToken || token.RefreshToken == s.token.RefreshToken
+}
+
+// oauth2ConnectionClient is the HTTP client of a connection, shared by the requests made for the
+// user.
+type oauth2ConnectionClient struct {
+	client   *http.Client
+	source   *connectionTokenSource
+	clientID string
+	lastUsed time.Time
+}
+
+// oauth2ClientPool holds the HTTP clients of the connections to Jira Cloud OAuth 2.0 instances,
+// by instance and user.
+type oauth2ClientPool struct {
+	lock    sync.Mutex
+	clients map[string]*oauth2ConnectionClient
+}
+
+func oauth2ClientKey(instanceID, mattermostUserID types.ID) string {
+	return instanceID.String() + "/" + mattermostUserID.String()
+}
+
+func newOAuth2ConnectionClient(ci *cloudOAuthInstance, connection *Connection, now time.Time) *oauth2ConnectionClient {
+	ctx := context.Background()
+	source := newConnectionTokenSource(ci.Plugin, ci.InstanceID, connection.MattermostUserID, connection.OAuth2Token,
+		ci.GetOAuthConfig().TokenSource(ctx, connection.OAuth2Token))
+	return &oauth2ConnectionClient{
+		client:   oauth2.NewClient(ctx, source),
+		source:   source,
+		clientID: ci.JiraClientID,
+		lastUsed: now,
+	}
+}
+
+// get returns the client of the connection, or a new one if the user connected again, its token
+// was refreshed by another server, or the instance was installed again with another OAuth app.
+// Connections not stored yet, while the user connects, get a client of their own.
+func (pool *oauth2ClientPool) get(ci *cloudOAuthInstance, connection *Connection, now time.Time) *oauth2ConnectionClient {
+	if connection.MattermostUserID == "" {
+		return newOAuth2ConnectionClient(ci, connection, now)
+	}
+	key := oauth2ClientKey(ci.InstanceID, connection.MattermostUserID)
+
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	pooled, ok := pool.clients[key]
+	if ok && pooled.clientID == ci.JiraClientID && pooled.source.matches(connection.OAuth2Token) {
+		pooled.lastUsed = now
+		return pooled
+	}
+
+	pooled = newOAuth2ConnectionClient(ci, connection, now)
+	pool.makeRoom(now)
+	pool.clients[key] = pooled
+	return pooled
+}
+
+// remove drops the client of a connection, when the user disconnects.
+func (pool *oauth2ClientPool) remove(instanceID, mattermostUserID types.ID) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	delete(pool.clients, oauth2ClientKey(instanceID, mattermostUserID))
+}
+
+// makeRoom initializes the map, and drops the idle clients when the pool is full, or else the
+// least recently used one. Must be called with the lock held.
+func (pool *oauth2ClientPool) makeRoom(now time.Time) {
+	if pool.clients == nil {
+		pool.clients = map[string]*oauth2ConnectionClient{}
+	}
+	if len(pool.clients) < oauth2ClientPoolMaxSize {
+		return
+	}
+
+	oldestKey := ""
+	for key, pooled := range pool.clients {
+		if now.Sub(pooled.lastUsed) > oauth2ClientIdleTTL {
+			delete(pool.clients, key)
+			continue
+		}
+		if oldestKey == "" || pooled.lastUsed.Before(pool.clients[oldestKey].lastUsed) {
+			oldestKey = key
+		}
+	}
+	if len(pool.clients) >= oauth2ClientPoolMaxSize {
+		delete(pool.clients, oldestKey)
+	}
+}
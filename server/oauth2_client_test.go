@@ -0,0 +1,160 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License for license information.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	jira "github.com/andygrunwald/go-jira"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+
+	"github.com/mattermost/mattermost-plugin-jira/server/utils/types"
+)
+
+type testTokenSource struct {
+	lock  sync.Mutex
+	token *oauth2.Token
+	calls int
+}
+
+func (s *testTokenSource) Token() (*oauth2.Token, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.calls++
+	return s.token, nil
+}
+
+func testOAuthInstance(p *Plugin) *cloudOAuthInstance {
+	return &cloudOAuthInstance{
+		InstanceCommon: newInstanceCommon(p, CloudOAuthInstanceType, "https://mmtest.atlassian.net"),
+		JiraClientID:   "client1",
+		JiraBaseURL:    "https://mmtest.atlassian.net",
+	}
+}
+
+func TestOAuth2ClientPool(t *testing.T) {
+	p := &Plugin{}
+	ci := testOAuthInstance(p)
+	now := time.Now()
+	connection := &Connection{MattermostUserID: "user1", OAuth2Token: &oauth2.Token{AccessToken: "access1", RefreshToken: "refresh1"}}
+
+	pool := oauth2ClientPool{}
+	pooled := pool.get(ci, connection, now)
+	assert.Same(t, pooled, pool.get(ci, connection, now))
+
+	// Connections loaded before the token was refreshed keep using the client.
+	pooled.source.token = &oauth2.Token{AccessToken: "access2", RefreshToken: "refresh2"}
+	assert.Same(t, pooled, pool.get(ci, connection, now))
+	assert.Same(t, pooled, pool.get(ci, &Connection{MattermostUserID: "user1", OAuth2Token: pooled.source.token}, now))
+
+	reconnected := &Connection{MattermostUserID: "user1", OAuth2Token: &oauth2.Token{AccessToken: "access3", RefreshToken: "refresh3"}}
+	replaced := pool.get(ci, reconnected, now)
+	assert.NotSame(t, pooled, replaced)
+
+	ci.JiraClientID = "client2"
+	assert.NotSame(t, replaced, pool.get(ci, reconnected, now))
+
+	assert.NotSame(t, pool.get(ci, &Connection{OAuth2Token: reconnected.OAuth2Token}, now), pool.get(ci, &Connection{OAuth2Token: reconnected.OAuth2Token}, now))
+
+	pool.remove(ci.InstanceID, "user1")
+	assert.Empty(t, pool.clients)
+}
+
+func TestOAuth2ClientPoolMakeRoom(t *testing.T) {
+	now := time.Now()
+	pool := oauth2ClientPool{clients: map[string]*oauth2ConnectionClient{}}
+	for i := 0; i < oauth2ClientPoolMaxSize-1; i++ {
+		pool.clients[fmt.Sprintf("instance/user%d", i)] = &oauth2ConnectionClient{lastUsed: now.Add(time.Duration(i) * time.Second)}
+	}
+	pool.clients["oldest"] = &oauth2ConnectionClient{lastUsed: now.Add(-time.Second)}
+	require.Len(t, pool.clients, oauth2ClientPoolMaxSize)
+
+	pool.makeRoom(now)
+	assert.Len(t, pool.clients, oauth2ClientPoolMaxSize-1)
+	assert.NotContains(t, pool.clients, "oldest")
+
+	pool.clients["idle"] = &oauth2ConnectionClient{lastUsed: now.Add(-time.Hour)}
+	pool.makeRoom(now)
+	assert.Len(t, pool.clients, oauth2ClientPoolMaxSize-1)
+	assert.NotContains(t, pool.clients, "idle")
+}
+
+func TestConnectionTokenSourceStoresRefreshedToken(t *testing.T) {
+	p, _ := setupTestCredentialStore(t)
+	p.userStore = NewStore(p)
+	instanceID := types.ID("https://mmtest.atlassian.net")
+
+	initial := &oauth2.Token{AccessToken: "access1", RefreshToken: "refresh1"}
+	require.NoError(t, p.userStore.StoreConnection(instanceID, "user1", &Connection{
+		User:        jira.User{AccountID: "account1"},
+		OAuth2Token: initial,
+	}))
+
+	// The connection changed since the token source was created.
+	stored, err := p.userStore.LoadConnection(instanceID, "user1")
+	require.NoError(t, err)
+	stored.DefaultProjectKey = "TES"
+	require.NoError(t, p.userStore.StoreConnection(instanceID, "user1", stored))
+
+	base := &testTokenSource{token: &oauth2.Token{AccessToken: "access2", RefreshToken: "refresh2"}}
+	source := newConnectionTokenSource(p, instanceID, "user1", initial, base)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			token, err := source.Token()
+			assert.NoError(t, err)
+			assert.Equal(t, "refresh2", token.RefreshToken)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 5, base.calls)
+
+	loaded, err := p.userStore.LoadConnection(instanceID, "user1")
+	require.NoError(t, err)
+	assert.Equal(t, "refresh2", loaded.OAuth2Token.RefreshToken)
+	assert.Equal(t, "access2", loaded.OAuth2Token.AccessToken)
+	assert.Equal(t, "TES", loaded.DefaultProjectKey)
+}
+
+func TestStoreJiraCloudResourceID(t *testing.T) {
+	p, _ := setupTestCredentialStore(t)
+	p.instanceStore = NewStore(p)
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		_ = json.NewEncoder(w).Encode(JiraAccessibleResources{
+			{ID: "other", URL: "https://other.atlassian.net"},
+			{ID: "site", URL: "https://mmtest.atlassian.net/"},
+		})
+	}))
+	defer server.Close()
+	oldResourcesURL := jiraOAuthAccessibleResourcesURL
+	defer func() {
+		jiraOAuthAccessibleResourcesURL = oldResourcesURL
+	}()
+	jiraOAuthAccessibleResourcesURL = server.URL
+
+	ci := testOAuthInstance(p)
+	require.NoError(t, p.instanceStore.StoreInstance(ci))
+	require.NoError(t, ci.storeJiraCloudResourceID(http.DefaultClient))
+	assert.Equal(t, "site", ci.JiraResourceID)
+	assert.Equal(t, 1, requests)
+
+	loaded, err := p.instanceStore.LoadInstance(ci.InstanceID)
+	require.NoError(t, err)
+	assert.Equal(t, "site", loaded.(*cloudOAuthInstance).JiraResourceID)
+	assert.Equal(t, "https://api.atlassian.com/ex/jira/site", loaded.GetURL())
+}
@@ -24,6 +24,7 @@ import (
 	"github.com/mattermost/mattermost/server/public/model"
 	"github.com/mattermost/mattermost/server/public/plugin"
 	"github.com/mattermost/mattermost/server/public/pluginapi"
+	"github.com/mattermost/mattermost/server/public/pluginapi/cluster"
 	"github.com/mattermost/mattermost/server/public/pluginapi/experimental/flow"
 
 	"github.com/mattermost/mattermost-plugin-autolink/server/autolink"
@@ -32,6 +33,7 @@ import (
 	"github.com/mattermost/mattermost-plugin-jira/server/enterprise"
 	"github.com/mattermost/mattermost-plugin-jira/server/telemetry"
 	"github.com/mattermost/mattermost-plugin-jira/server/utils"
+	"github.com/mattermost/mattermost-plugin-jira/server/utils/types"
 )
 
 const (
@@ -82,7 +84,21 @@ type externalConfig struct {
 	// Display subscription name in notifications
 	DisplaySubscriptionNameInNotifications bool
 
+	// Deprecated: comma separated IDs of the bots allowed to call the backdoor API without an
+	// integration token, for any user. Kept until the bots are given integration tokens.
 	ListBackdoorsBots string
+
+	// Minutes the time of a stopped work timer is rounded to
+	WorkTimerRoundingMinutes int
+
+	// Hours after which users are reminded of a running work timer, 0 disables the reminder
+	WorkTimerReminderHours int
+
+	// Attach a preview of the Jira issues mentioned in posts
+	EnableIssueUnfurl bool
+
+	// Maximum number of issue previews attached to one post
+	IssueUnfurlMaxPerPost int
 }
 
 const defaultMaxAttachmentSize = utils.ByteSize(10 * 1024 * 1024) // 10Mb
@@ -129,6 +145,48 @@ type Plugin struct {
 	// channel to distribute work to the webhook processors
 	webhookQueue chan *webhookMessage
 
+	// job that re-dispatches failed and stranded webhook events
+	webhookRetryJob *cluster.Job
+
+	// job that posts the summaries of batching subscriptions
+	webhookBatchJob *cluster.Job
+
+	// job that posts the scheduled JQL digests
+	digestJob *cluster.Job
+
+	// job that reminds users of long running work timers
+	workTimerReminderJob *cluster.Job
+
+	// job that sends the notifications held back by quiet hours or notification digests
+	deferredNotificationsJob *cluster.Job
+
+	// job that checks the Jira tokens of the connections and prompts users to reconnect
+	connectionHealthJob *cluster.Job
+
+	// job that warns channel admins of the subscriptions whose owner left or disconnected
+	orphanedSubscriptionsJob *cluster.Job
+
+	// results of the JQL filters of subscriptions checked with Jira
+	jqlMatches jqlMatchCache
+
+	// issues recently loaded from Jira, and whether each user could see them
+	issueCache issueCache
+
+	// channel subscriptions of each instance, indexed for matching webhooks
+	subscriptionIndex subscriptionIndex
+
+	// keys the stored credentials are encrypted with
+	credentialKeys credentialKeyCache
+
+	// HTTP clients of the connections to Jira Cloud OAuth 2.0 instances
+	oauth2Clients oauth2ClientPool
+
+	// patterns matching the issue keys of the projects of each instance
+	projectKeyPatterns projectKeyPatternCache
+
+	// issue priorities of each instance, for the issue cards
+	issuePriorities issuePriorityCache
+
 	// service that determines if this Mattermost instance has access to
 	// enterprise features
 	enterpriseChecker enterprise.Checker
@@ -184,6 +242,10 @@ func (p *Plugin) OnConfigurationChange() error {
 		conf.maxAttachmentSize = maxAttachmentSize
 	})
 
+	if ec.ListBackdoorsBots != "" && prev.ListBackdoorsBots != ec.ListBackdoorsBots {
+		p.client.Log.Warn("The ListBackdoorsBots setting is deprecated. Create an integration token for each of its bots with `/jira token create`, with the act-for-user scope for the bots acting for other users, and clear the setting.")
+	}
+
 	// OnConfigurationChanged is first called before the plugin is activated,
 	// in this case don't register the command, let Activate do it, it has the instanceStore.
 	// TODO: consider moving (some? stores? all?) initialization into the first OnConfig instead of OnActivate.
@@ -206,7 +268,25 @@ func (p *Plugin) OnConfigurationChange() error {
 	return nil
 }
 
+func (p *Plugin) OnPluginClusterEvent(c *plugin.Context, ev model.PluginClusterEvent) {
+	switch ev.Id {
+	case clusterEventSubscriptionsChanged:
+		p.subscriptionIndex.invalidate(types.ID(ev.Data))
+	case clusterEventCredentialKeysChanged:
+		p.credentialKeys.invalidate()
+	}
+}
+
 func (p *Plugin) OnDeactivate() error {
+	for _, job := range []*cluster.Job{p.webhookRetryJob, p.webhookBatchJob, p.digestJob, p.workTimerReminderJob, p.deferredNotificationsJob, p.connectionHealthJob, p.orphanedSubscriptionsJob} {
+		if job == nil {
+			continue
+		}
+		if err := job.Close(); err != nil {
+			p.errorf("OnDeactivate: failed to close a scheduled job: %v", err)
+		}
+	}
+
 	// close the tracker on plugin deactivation
 	if p.telemetryClient != nil {
 		err := p.telemetryClient.Close()
@@ -296,8 +376,33 @@ func (p *Plugin) OnActivate() error {
 		go webhookWorker{i, p, p.webhookQueue}.work()
 	}
 
+	if err = p.scheduleWebhookRetryJob(); err != nil {
+		return errors.WithMessage(err, "OnActivate")
+	}
+	if err = p.scheduleWebhookBatchJob(); err != nil {
+		return errors.WithMessage(err, "OnActivate")
+	}
+	if err = p.scheduleDigestJob(); err != nil {
+		return errors.WithMessage(err, "OnActivate")
+	}
+	if err = p.scheduleWorkTimerReminderJob(); err != nil {
+		return errors.WithMessage(err, "OnActivate")
+	}
+	if err = p.scheduleDeferredNotificationsJob(); err != nil {
+		return errors.WithMessage(err, "OnActivate")
+	}
+	if err = p.scheduleConnectionHealthJob(); err != nil {
+		return errors.WithMessage(err, "OnActivate")
+	}
+	if err = p.scheduleOrphanedSubscriptionsJob(); err != nil {
+		return errors.WithMessage(err, "OnActivate")
+	}
+
 	p.enterpriseChecker = enterprise.NewEnterpriseChecker(p.API)
 
+	// Encrypt the credentials stored before they were, or with a rotated key.
+	go p.runCredentialMigration()
+
 	go func() {
 		for _, url := range instances.IDs() {
 			var instance Instance
@@ -11,6 +11,7 @@ import (
 	"reflect"
 	"sort"
 	"strings"
+	"time"
 
 	jira "github.com/andygrunwald/go-jira"
 	"github.com/gorilla/mux"
@@ -33,6 +34,9 @@ const (
 	FilterEmpty      = "empty"
 
 	MaxSubscriptionNameLength = 100
+
+	// MaxSubscriptionBatchMinutes is the longest batching window a subscription may use.
+	MaxSubscriptionBatchMinutes = 24 * 60
 )
 
 type FieldFilter struct {
@@ -47,6 +51,7 @@ type SubscriptionFilters struct {
 	IssueTypes StringSet     `json:"issue_types"`
 	Fields     []FieldFilter `json:"fields"`
 	Self       []string      `json:"self"`
+	JQL        string        `json:"jql,omitempty"`
 }
 
 type ChannelSubscription struct {
@@ -56,20 +61,41 @@ type ChannelSubscription struct {
 	Filters          SubscriptionFilters `json:"filters"`
 	Name             string              `json:"name"`
 	InstanceID       types.ID            `json:"instance_id"`
+
+	// BatchMinutes, if set, collects the events of the subscription for that many
+	// minutes and posts a single summary per issue instead of a post per event.
+	BatchMinutes int `json:"batch_minutes,omitempty"`
 }
 
 type ChannelSubscriptions struct {
 	ByID          map[string]ChannelSubscription `json:"by_id"`
 	IDByChannelID map[string]StringSet           `json:"id_by_channel_id"`
 	IDByEvent     map[string]StringSet           `json:"id_by_event"`
+
+	// IDByProject and IDByIssueType index the subscriptions by their filters, with the
+	// subscriptions that do not filter on projects or issue types under anyFilterValue.
+	IDByProject   map[string]StringSet `json:"-"`
+	IDByIssueType map[string]StringSet `json:"-"`
 }
 
+// anyFilterValue indexes the subscriptions that do not filter on a value.
+const anyFilterValue = ""
+
 func NewChannelSubscriptions() *ChannelSubscriptions {
 	return &ChannelSubscriptions{
 		ByID:          map[string]ChannelSubscription{},
 		IDByChannelID: map[string]StringSet{},
 		IDByEvent:     map[string]StringSet{},
+		IDByProject:   map[string]StringSet{},
+		IDByIssueType: map[string]StringSet{},
+	}
+}
+
+func filterValuesOrAny(values StringSet) []string {
+	if values.Len() == 0 {
+		return []string{anyFilterValue}
 	}
+	return values.Elems()
 }
 
 func (s *ChannelSubscriptions) remove(sub *ChannelSubscription) {
@@ -80,6 +106,16 @@ func (s *ChannelSubscriptions) remove(sub *ChannelSubscription) {
 	for _, event := range sub.Filters.Events.Elems() {
 		s.IDByEvent[event] = s.IDByEvent[event].Subtract(sub.ID)
 	}
+	if s.IDByProject != nil {
+		for _, project := range filterValuesOrAny(sub.Filters.Projects) {
+			s.IDByProject[project] = s.IDByProject[project].Subtract(sub.ID)
+		}
+	}
+	if s.IDByIssueType != nil {
+		for _, issueType := range filterValuesOrAny(sub.Filters.IssueTypes) {
+			s.IDByIssueType[issueType] = s.IDByIssueType[issueType].Subtract(sub.ID)
+		}
+	}
 }
 
 func (s *ChannelSubscriptions) add(newSubscription *ChannelSubscription) {
@@ -88,6 +124,40 @@ func (s *ChannelSubscriptions) add(newSubscription *ChannelSubscription) {
 	for _, event := range newSubscription.Filters.Events.Elems() {
 		s.IDByEvent[event] = s.IDByEvent[event].Add(newSubscription.ID)
 	}
+	if s.IDByProject != nil {
+		for _, project := range filterValuesOrAny(newSubscription.Filters.Projects) {
+			s.IDByProject[project] = s.IDByProject[project].Add(newSubscription.ID)
+		}
+	}
+	if s.IDByIssueType != nil {
+		for _, issueType := range filterValuesOrAny(newSubscription.Filters.IssueTypes) {
+			s.IDByIssueType[issueType] = s.IDByIssueType[issueType].Add(newSubscription.ID)
+		}
+	}
+}
+
+// candidates returns the subscriptions that may match the webhook: those subscribed to one of
+// its events, for its project and issue type. matchesSubsciptionFilters checks the rest of
+// their filters.
+func (s *ChannelSubscriptions) candidates(wh *webhook) []ChannelSubscription {
+	ids := NewStringSet()
+	for _, eventType := range wh.Events().Elems() {
+		ids = ids.Union(s.IDByEvent[eventType])
+		if strings.HasPrefix(eventType, "event_updated") || strings.HasSuffix(eventType, "comment") {
+			ids = ids.Union(s.IDByEvent[eventUpdatedAny])
+		}
+	}
+
+	if fields := wh.Issue.Fields; fields != nil && s.IDByProject != nil && s.IDByIssueType != nil {
+		ids = ids.Intersection(s.IDByProject[fields.Project.Key].Union(s.IDByProject[anyFilterValue]))
+		ids = ids.Intersection(s.IDByIssueType[fields.Type.ID].Union(s.IDByIssueType[anyFilterValue]))
+	}
+
+	candidates := make([]ChannelSubscription, 0, ids.Len())
+	for _, id := range ids.Elems() {
+		candidates = append(candidates, s.ByID[id])
+	}
+	return candidates
 }
 
 type Subscriptions struct {
@@ -191,6 +261,10 @@ func (p *Plugin) matchesSubsciptionFilters(wh *webhook, filters SubscriptionFilt
 		}
 	}
 
+	if filters.JQL != "" && !p.matchesSubscriptionJQL(issue, filters.JQL, instanceID, MattermostUserID) {
+		return false
+	}
+
 	if len(filters.Self) > 0 {
 		c, err := p.userStore.LoadConnection(instanceID, types.ID(MattermostUserID))
 		if err == nil {
@@ -211,7 +285,7 @@ func (p *Plugin) matchesSubsciptionFilters(wh *webhook, filters SubscriptionFilt
 					if errI == nil {
 						client, errC := instance.GetClient(c)
 						if errC == nil {
-							meIssue, errIs := client.GetIssue(issue.Key, nil)
+							meIssue, errIs := p.getIssueCached(client, instanceID, types.ID(MattermostUserID), issue.Key)
 							if errIs == nil {
 								if meIssue.Fields.Watches.IsWatching {
 									return true
@@ -250,8 +324,7 @@ func (p *Plugin) getChannelsSubscribed(wh *webhook, instanceID types.ID) ([]Chan
 	}
 
 	var channelSubscriptions []ChannelSubscription
-	subIds := subs.Channel.ByID
-	for _, sub := range subIds {
+	for _, sub := range subs.Channel.candidates(wh) {
 		if p.matchesSubsciptionFilters(wh, sub.Filters, instanceID, sub.MattermostUserID) {
 			channelSubscriptions = append(channelSubscriptions, sub)
 		}
@@ -260,14 +333,21 @@ func (p *Plugin) getChannelsSubscribed(wh *webhook, instanceID types.ID) ([]Chan
 	return channelSubscriptions, nil
 }
 
+// getSubscriptions returns the channel subscriptions of the instance, from the index when it has
+// them. They must not be modified.
 func (p *Plugin) getSubscriptions(instanceID types.ID) (*Subscriptions, error) {
-	subKey := keyWithInstanceID(instanceID, JiraSubscriptionsKey)
-	var data []byte
-	err := p.client.KV.Get(subKey, &data)
+	now := time.Now()
+	subs, generation, ok := p.subscriptionIndex.get(instanceID, now)
+	if ok {
+		return subs, nil
+	}
+
+	subs, err := p.loadSubscriptions(instanceID)
 	if err != nil {
 		return nil, err
 	}
-	return SubscriptionsFromJSON(data, instanceID)
+	p.subscriptionIndex.set(instanceID, subs, generation, now)
+	return subs, nil
 }
 
 func (p *Plugin) getSubscriptionsForChannel(instanceID types.ID, channelID string) ([]ChannelSubscription, error) {
@@ -299,52 +379,47 @@ func (p *Plugin) getChannelSubscription(instanceID types.ID, subscriptionID stri
 }
 
 func (p *Plugin) removeChannelSubscription(instanceID types.ID, subscriptionID string) error {
-	subKey := keyWithInstanceID(instanceID, JiraSubscriptionsKey)
-	return p.client.KV.SetAtomicWithRetries(subKey, func(initialBytes []byte) (interface{}, error) {
-		subs, err := SubscriptionsFromJSON(initialBytes, instanceID)
-		if err != nil {
-			return nil, err
-		}
-
-		subscription, ok := subs.Channel.ByID[subscriptionID]
-		if !ok {
-			return nil, errors.New("could not find subscription")
-		}
-
-		subs.Channel.remove(&subscription)
+	subscription, err := p.getChannelSubscription(instanceID, subscriptionID)
+	if err != nil {
+		return err
+	}
 
-		modifiedBytes, marshalErr := json.Marshal(&subs)
-		if marshalErr != nil {
-			return nil, marshalErr
+	err = p.updateChannelSubscriptions(instanceID, subscription.ChannelID, func(byID map[string]ChannelSubscription) error {
+		if _, ok := byID[subscriptionID]; !ok {
+			return errors.New("could not find subscription")
 		}
-
-		return modifiedBytes, nil
+		delete(byID, subscriptionID)
+		return nil
 	})
+	if err != nil {
+		return err
+	}
+
+	p.invalidateSubscriptions(instanceID)
+	return nil
 }
 
 func (p *Plugin) addChannelSubscription(instanceID types.ID, newSubscription *ChannelSubscription, client Client) error {
-	subKey := keyWithInstanceID(instanceID, JiraSubscriptionsKey)
-	return p.client.KV.SetAtomicWithRetries(subKey, func(initialBytes []byte) (interface{}, error) {
-		subs, err := SubscriptionsFromJSON(initialBytes, instanceID)
-		if err != nil {
-			return nil, err
-		}
-
-		err = p.validateSubscription(instanceID, newSubscription, client)
-		if err != nil {
-			return nil, err
-		}
-
-		newSubscription.ID = model.NewId()
-		subs.Channel.add(newSubscription)
-
-		modifiedBytes, marshalErr := json.Marshal(&subs)
-		if marshalErr != nil {
-			return nil, marshalErr
-		}
+	err := p.validateSubscription(instanceID, newSubscription, client)
+	if err != nil {
+		return err
+	}
+	newSubscription.ID = model.NewId()
 
-		return modifiedBytes, nil
+	err = p.addSubscribedChannel(instanceID, newSubscription.ChannelID)
+	if err != nil {
+		return err
+	}
+	err = p.updateChannelSubscriptions(instanceID, newSubscription.ChannelID, func(byID map[string]ChannelSubscription) error {
+		byID[newSubscription.ID] = *newSubscription
+		return nil
 	})
+	if err != nil {
+		return err
+	}
+
+	p.invalidateSubscriptions(instanceID)
+	return nil
 }
 
 func (p *Plugin) validateSubscription(instanceID types.ID, subscription *ChannelSubscription, client Client) error {
@@ -368,6 +443,10 @@ func (p *Plugin) validateSubscription(instanceID types.ID, subscription *Channel
 		return errors.New("please provide a issue role")
 	}
 
+	if subscription.BatchMinutes < 0 || subscription.BatchMinutes > MaxSubscriptionBatchMinutes {
+		return errors.Errorf("please provide a batching window between 0 and %d minutes", MaxSubscriptionBatchMinutes)
+	}
+
 	projectKey := subscription.Filters.Projects.Elems()[0]
 
 	var securityLevels StringSet
@@ -416,6 +495,13 @@ func (p *Plugin) validateSubscription(instanceID types.ID, subscription *Channel
 		return errors.WithMessagef(err, "failed to get project %q", projectKey)
 	}
 
+	subscription.Filters.JQL = strings.TrimSpace(subscription.Filters.JQL)
+	if subscription.Filters.JQL != "" {
+		if err = validateSubscriptionJQL(client, subscription.Filters.JQL); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -461,33 +547,47 @@ func (p *Plugin) getSecurityLevelsForProject(client Client, projectKey string) (
 }
 
 func (p *Plugin) editChannelSubscription(instanceID types.ID, modifiedSubscription *ChannelSubscription, client Client) error {
-	subKey := keyWithInstanceID(instanceID, JiraSubscriptionsKey)
-	return p.client.KV.SetAtomicWithRetries(subKey, func(initialBytes []byte) (interface{}, error) {
-		subs, err := SubscriptionsFromJSON(initialBytes, instanceID)
-		if err != nil {
-			return nil, err
-		}
+	subs, err := p.getSubscriptions(instanceID)
+	if err != nil {
+		return err
+	}
+	oldSub, ok := subs.Channel.ByID[modifiedSubscription.ID]
+	if !ok {
+		return errors.New("existing subscription does not exist")
+	}
 
-		oldSub, ok := subs.Channel.ByID[modifiedSubscription.ID]
-		if !ok {
-			return nil, errors.New("existing subscription does not exist")
-		}
+	err = p.validateSubscription(instanceID, modifiedSubscription, client)
+	if err != nil {
+		return err
+	}
 
-		err = p.validateSubscription(instanceID, modifiedSubscription, client)
+	if oldSub.ChannelID != modifiedSubscription.ChannelID {
+		err = p.updateChannelSubscriptions(instanceID, oldSub.ChannelID, func(byID map[string]ChannelSubscription) error {
+			delete(byID, oldSub.ID)
+			return nil
+		})
 		if err != nil {
-			return nil, err
+			return err
 		}
-
-		subs.Channel.remove(&oldSub)
-		subs.Channel.add(modifiedSubscription)
-
-		modifiedBytes, marshalErr := json.Marshal(&subs)
-		if marshalErr != nil {
-			return nil, marshalErr
+		err = p.addSubscribedChannel(instanceID, modifiedSubscription.ChannelID)
+		if err != nil {
+			return err
 		}
+	}
 
-		return modifiedBytes, nil
+	err = p.updateChannelSubscriptions(instanceID, modifiedSubscription.ChannelID, func(byID map[string]ChannelSubscription) error {
+		if _, ok := byID[modifiedSubscription.ID]; !ok && oldSub.ChannelID == modifiedSubscription.ChannelID {
+			return errors.New("existing subscription does not exist")
+		}
+		byID[modifiedSubscription.ID] = *modifiedSubscription
+		return nil
 	})
+	if err != nil {
+		return err
+	}
+
+	p.invalidateSubscriptions(instanceID)
+	return nil
 }
 
 type InstanceSubMap map[types.ID][]string
@@ -809,17 +909,12 @@ func (p *Plugin) httpSubscribeWebhook(w http.ResponseWriter, r *http.Request, in
 		p.client.Log.Debug("Webhook Event Log", "event", string(bb))
 	}
 
-	// If there is space in the queue, immediately return a 200; we will process the webhook event async.
-	// If the queue is full, return a 503; we will not process that webhook event.
-	select {
-	case p.webhookQueue <- &webhookMessage{
-		InstanceID: instanceID,
-		Data:       bb,
-	}:
-		return http.StatusOK, nil
-	default:
-		return respondErr(w, http.StatusServiceUnavailable, nil)
+	// Once the webhook event is stored, immediately return a 200; we will process it async,
+	// retrying on failure. If it could not be stored, return a 503 so that Jira may resend it.
+	if err = p.dispatchWebhookMessage(newWebhookMessage(instanceID, bb)); err != nil {
+		return respondErr(w, http.StatusServiceUnavailable, err)
 	}
+	return http.StatusOK, nil
 }
 
 func (p *Plugin) httpChannelCreateSubscription(w http.ResponseWriter, r *http.Request) (int, error) {
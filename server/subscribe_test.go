@@ -194,7 +194,8 @@ func TestValidateSubscription(t *testing.T) {
 			p.SetAPI(api)
 			p.client = pluginapi.NewClient(p.API, p.Driver)
 
-			api.On("KVGet", testSubKey).Return(nil, nil)
+			makeTestKVStore(api, nil)
+			p.subscriptionIndex.invalidate(testInstance1.InstanceID)
 
 			p.updateConfig(func(conf *config) {
 				conf.SecurityLevelEmptyForJiraSubscriptions = !tc.disableSecurityConfig
@@ -399,7 +400,10 @@ func TestListChannelSubscriptions(t *testing.T) {
 			subscriptionBytes, err := json.Marshal(tc.Subs)
 			assert.Nil(t, err)
 
-			api.On("KVGet", testSubKey).Return(subscriptionBytes, nil)
+			// The subscriptions are stored as before they had a key per channel, and migrated when loaded.
+			makeTestKVStore(api, testKVStore{testSubKey: subscriptionBytes})
+			api.On("LogInfo", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Maybe()
+			p.subscriptionIndex.invalidate(testInstance1.InstanceID)
 
 			channel1 := &model.Channel{
 				Id:          "channel1",
@@ -1644,7 +1648,10 @@ func TestGetChannelsSubscribed(t *testing.T) {
 			subscriptionBytes, err := json.Marshal(tc.Subs)
 			assert.Nil(t, err)
 
-			api.On("KVGet", testSubKey).Return(subscriptionBytes, nil)
+			// The subscriptions are stored as before they had a key per channel, and migrated when loaded.
+			makeTestKVStore(api, testKVStore{testSubKey: subscriptionBytes})
+			api.On("LogInfo", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Maybe()
+			p.subscriptionIndex.invalidate(testInstance1.InstanceID)
 
 			api.On("KVCompareAndSet", testSubKey, subscriptionBytes, mock.MatchedBy(func(data []byte) bool {
 				return true
@@ -0,0 +1,349 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License for license information.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+	"github.com/mattermost/mattermost/server/public/pluginapi"
+	"github.com/mattermost/mattermost/server/public/pluginapi/cluster"
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-plugin-jira/server/utils/types"
+)
+
+const (
+	prefixOrphanedSubscriptions = "orphansubs_" // + hash of the instance ID, the orphaned subscriptions channel admins were warned of
+
+	orphanedSubscriptionsJobKey      = "orphaned_subscriptions_check"
+	orphanedSubscriptionsJobInterval = 6 * time.Hour
+)
+
+// orphanedSubscription is a channel subscription that does not post, because its owner cannot be
+// used to check the permissions of the events.
+type orphanedSubscription struct {
+	Subscription ChannelSubscription
+	Problem      string
+
+	// BrokenConnection is true if the owner can fix it by connecting again. They are prompted
+	// to by the connection health check.
+	BrokenConnection bool
+}
+
+// orphanedSubscriptionWarnings are the IDs of the orphaned subscriptions of an instance whose
+// channel admins were warned, so that they are warned once.
+type orphanedSubscriptionWarnings struct {
+	SubscriptionIDs StringSet `json:"subscription_ids"`
+}
+
+func keyOrphanedSubscriptions(instanceID types.ID) string {
+	return hashkey(prefixOrphanedSubscriptions, instanceID.String())
+}
+
+// subscriptionOwnerProblem returns why the subscriptions of the user to the instance do not post,
+// or an empty string if they do.
+func (p *Plugin) subscriptionOwnerProblem(instanceID types.ID, mattermostUserID string) (problem string, brokenConnection bool, err error) {
+	if mattermostUserID == "" {
+		return "it has no owner", false, nil
+	}
+	user, err := p.client.User.Get(mattermostUserID)
+	if errors.Is(err, pluginapi.ErrNotFound) {
+		return "its owner no longer exists", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	if user.DeleteAt != 0 {
+		return fmt.Sprintf("@%s is deactivated", user.Username), false, nil
+	}
+
+	connection, err := p.userStore.LoadConnection(instanceID, types.ID(mattermostUserID))
+	if err != nil {
+		return "", false, err
+	}
+	if connection.JiraAccountID() == "" {
+		return fmt.Sprintf("@%s is not connected to Jira", user.Username), false, nil
+	}
+	if p.isConnectionBroken(instanceID, types.ID(mattermostUserID)) {
+		return fmt.Sprintf("the Jira connection of @%s is broken", user.Username), true, nil
+	}
+	return "", false, nil
+}
+
+// findOrphanedSubscriptions returns the channel subscriptions of the instance whose owner is
+// missing, deactivated or not connected to Jira, sorted by channel and name.
+func (p *Plugin) findOrphanedSubscriptions(instanceID types.ID) ([]orphanedSubscription, error) {
+	subs, err := p.getSubscriptions(instanceID)
+	if err != nil {
+		return nil, err
+	}
+
+	type ownerProblem struct {
+		problem          string
+		brokenConnection bool
+	}
+	owners := map[string]*ownerProblem{}
+	orphaned := []orphanedSubscription{}
+	for _, sub := range subs.Channel.ByID {
+		owner, ok := owners[sub.MattermostUserID]
+		if !ok {
+			problem, brokenConnection, checkErr := p.subscriptionOwnerProblem(instanceID, sub.MattermostUserID)
+			if checkErr != nil {
+				p.errorf("Failed to check the owner %s of subscriptions to %s: %v", sub.MattermostUserID, instanceID, checkErr)
+			} else {
+				owner = &ownerProblem{problem: problem, brokenConnection: brokenConnection}
+			}
+			owners[sub.MattermostUserID] = owner
+		}
+		if owner == nil || owner.problem == "" {
+			continue
+		}
+		orphaned = append(orphaned, orphanedSubscription{
+			Subscription:     sub,
+			Problem:          owner.problem,
+			BrokenConnection: owner.brokenConnection,
+		})
+	}
+
+	sort.Slice(orphaned, func(i, j int) bool {
+		a, b := orphaned[i].Subscription, orphaned[j].Subscription
+		if a.ChannelID != b.ChannelID {
+			return a.ChannelID < b.ChannelID
+		}
+		return a.Name < b.Name
+	})
+	return orphaned, nil
+}
+
+// checkOrphanedSubscriptions warns the admins of the channels with subscriptions that stopped
+// posting because their owner left or disconnected, once per subscription.
+func (p *Plugin) checkOrphanedSubscriptions() {
+	instances, err := p.instanceStore.LoadInstances()
+	if err != nil {
+		p.errorf("Orphaned subscriptions check: failed to load instances: %v", err)
+		return
+	}
+	for _, instanceID := range instances.IDs() {
+		if err = p.warnOrphanedSubscriptions(instanceID); err != nil {
+			p.errorf("Orphaned subscriptions check: %s: %v", instanceID, err)
+		}
+	}
+}
+
+func (p *Plugin) warnOrphanedSubscriptions(instanceID types.ID) error {
+	orphaned, err := p.findOrphanedSubscriptions(instanceID)
+	if err != nil {
+		return err
+	}
+
+	var warned orphanedSubscriptionWarnings
+	if err = p.client.KV.Get(keyOrphanedSubscriptions(instanceID), &warned); err != nil {
+		return errors.Wrap(err, "failed to load the orphaned subscription warnings")
+	}
+
+	current := NewStringSet()
+	byChannel := map[string][]orphanedSubscription{}
+	for _, o := range orphaned {
+		if o.BrokenConnection {
+			continue
+		}
+		current = current.Add(o.Subscription.ID)
+		if !warned.SubscriptionIDs.ContainsAny(o.Subscription.ID) {
+			byChannel[o.Subscription.ChannelID] = append(byChannel[o.Subscription.ChannelID], o)
+		}
+	}
+
+	for channelID, subs := range byChannel {
+		lines := []string{}
+		for _, o := range subs {
+			lines = append(lines, fmt.Sprintf("* %q (`%s`): %s", o.Subscription.Name, o.Subscription.ID, o.Problem))
+		}
+		p.notifyChannelAdmins(channelID, "",
+			"These Jira subscriptions in %s stopped posting:\n%s\n\nUse `/jira subscribe transfer [id|all] @your-username` in the channel to take them over with your Jira connection, or `/jira subscribe delete [id]` to delete them.",
+			p.channelMention(channelID), strings.Join(lines, "\n"))
+	}
+
+	// Subscriptions that are fixed or deleted are forgotten, to warn again if they stop posting later.
+	if current.Len() == 0 {
+		if warned.SubscriptionIDs.Len() == 0 {
+			return nil
+		}
+		return p.client.KV.Delete(keyOrphanedSubscriptions(instanceID))
+	}
+	_, err = p.client.KV.Set(keyOrphanedSubscriptions(instanceID), &orphanedSubscriptionWarnings{SubscriptionIDs: current})
+	return errors.Wrap(err, "failed to store the orphaned subscription warnings")
+}
+
+func (p *Plugin) scheduleOrphanedSubscriptionsJob() error {
+	job, err := cluster.Schedule(p.API, orphanedSubscriptionsJobKey, cluster.MakeWaitForInterval(orphanedSubscriptionsJobInterval), p.checkOrphanedSubscriptions)
+	if err != nil {
+		return errors.Wrap(err, "failed to schedule orphaned subscriptions job")
+	}
+	p.orphanedSubscriptionsJob = job
+	return nil
+}
+
+// checkNewSubscriptionOwner returns the user to give subscriptions of the channel to, if they are
+// active, connected to the instance and a member of the channel. The subscriptions then post what
+// the owner can see in Jira, so users may only take them over, and only system administrators
+// may give them to another user.
+func (p *Plugin) checkNewSubscriptionOwner(instanceID types.ID, channelID, username, callerID string) (*model.User, error) {
+	user, err := p.client.User.GetByUsername(strings.TrimPrefix(username, "@"))
+	if err != nil {
+		return nil, errors.Errorf("could not find user %s", username)
+	}
+	if user.Id != callerID {
+		authorized, authErr := authorizedSysAdmin(p, callerID)
+		if authErr != nil {
+			return nil, authErr
+		}
+		if !authorized {
+			return nil, errors.New("only a system administrator can give subscriptions to another user, you can take them over with your own username")
+		}
+	}
+	problem, _, err := p.subscriptionOwnerProblem(instanceID, user.Id)
+	if err != nil {
+		return nil, err
+	}
+	if problem != "" {
+		return nil, errors.New(problem)
+	}
+	if !p.client.User.HasPermissionToChannel(user.Id, channelID, model.PermissionReadChannel) {
+		return nil, errors.Errorf("@%s is not a member of %s", user.Username, p.channelMention(channelID))
+	}
+	return user, nil
+}
+
+// transferChannelSubscriptions gives the subscriptions of the channel with the IDs, or all of them
+// if ids is empty, to the user. It returns the names of the subscriptions transferred.
+func (p *Plugin) transferChannelSubscriptions(instanceID types.ID, channelID string, ids []string, mattermostUserID string) ([]string, error) {
+	selected := NewStringSet(ids...)
+	var names []string
+	err := p.updateChannelSubscriptions(instanceID, channelID, func(byID map[string]ChannelSubscription) error {
+		names = nil
+		for id, sub := range byID {
+			if len(ids) > 0 && !selected.ContainsAny(id) {
+				continue
+			}
+			sub.MattermostUserID = mattermostUserID
+			byID[id] = sub
+			names = append(names, fmt.Sprintf("%q", sub.Name))
+		}
+		if len(ids) > 0 && len(names) < len(ids) {
+			return errors.New("could not find subscription")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	p.invalidateSubscriptions(instanceID)
+	sort.Strings(names)
+	return names, nil
+}
+
+func executeSubscribeTransfer(p *Plugin, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	instanceURL, args, err := p.parseCommandFlagInstanceURL(args)
+	if err != nil {
+		return p.responsef(header, "Failed to load your connection to Jira. Error: %v.", err)
+	}
+	if len(args) != 2 {
+		return p.help(header)
+	}
+	_, instanceID, err := p.ResolveUserInstanceURL(types.ID(header.UserId), instanceURL)
+	if err != nil {
+		return p.responsef(header, "Failed to identify Jira instance %s. Error: %v.", instanceURL, err)
+	}
+
+	channelID := header.ChannelId
+	var ids []string
+	if !strings.EqualFold(args[0], "all") {
+		sub, loadErr := p.getChannelSubscription(instanceID, args[0])
+		if loadErr != nil {
+			return p.responsef(header, "Failed to load subscription %s. Error: %v.", args[0], loadErr)
+		}
+		channelID = sub.ChannelID
+		ids = []string{sub.ID}
+	}
+	if err = p.hasPermissionToManageSubscription(instanceID, header.UserId, channelID); err != nil {
+		return p.responsef(header, "You don't have permission to manage the subscriptions of %s: %v.", p.channelMention(channelID), err)
+	}
+
+	owner, err := p.checkNewSubscriptionOwner(instanceID, channelID, args[1], header.UserId)
+	if err != nil {
+		return p.responsef(header, "Subscriptions cannot be given to %s: %v.", args[1], err)
+	}
+	names, err := p.transferChannelSubscriptions(instanceID, channelID, ids, owner.Id)
+	if err != nil {
+		return p.responsef(header, "Failed to transfer the subscriptions. Error: %v.", err)
+	}
+	if len(names) == 0 {
+		return p.responsef(header, "There are no subscriptions in this channel.")
+	}
+	return p.responsef(header, "Subscriptions %s of %s now belong to @%s.", strings.Join(names, ", "), p.channelMention(channelID), owner.Username)
+}
+
+func executeSubscribeDelete(p *Plugin, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	instanceURL, args, err := p.parseCommandFlagInstanceURL(args)
+	if err != nil {
+		return p.responsef(header, "Failed to load your connection to Jira. Error: %v.", err)
+	}
+	if len(args) != 1 {
+		return p.help(header)
+	}
+	_, instanceID, err := p.ResolveUserInstanceURL(types.ID(header.UserId), instanceURL)
+	if err != nil {
+		return p.responsef(header, "Failed to identify Jira instance %s. Error: %v.", instanceURL, err)
+	}
+
+	sub, err := p.getChannelSubscription(instanceID, args[0])
+	if err != nil {
+		return p.responsef(header, "Failed to load subscription %s. Error: %v.", args[0], err)
+	}
+	if err = p.hasPermissionToManageSubscription(instanceID, header.UserId, sub.ChannelID); err != nil {
+		return p.responsef(header, "You don't have permission to manage the subscriptions of %s: %v.", p.channelMention(sub.ChannelID), err)
+	}
+	if err = p.removeChannelSubscription(instanceID, sub.ID); err != nil {
+		return p.responsef(header, "Failed to delete the subscription. Error: %v.", err)
+	}
+	return p.responsef(header, "Subscription %q of %s deleted.", sub.Name, p.channelMention(sub.ChannelID))
+}
+
+func executeSubscribeOrphaned(p *Plugin, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	if resp := p.checkSysAdminCommand(header, "/jira subscribe orphaned"); resp != nil {
+		return resp
+	}
+	if len(args) != 0 {
+		return p.help(header)
+	}
+
+	instances, err := p.instanceStore.LoadInstances()
+	if err != nil {
+		return p.responsef(header, "Failed to load instances. Error: %v.", err)
+	}
+	text := "| Instance | ID | Name | Channel | Problem |\n|--|--|--|--|--|\n"
+	count := 0
+	for _, instanceID := range instances.IDs() {
+		orphaned, findErr := p.findOrphanedSubscriptions(instanceID)
+		if findErr != nil {
+			return p.responsef(header, "Failed to load the subscriptions of %s. Error: %v.", instanceID, findErr)
+		}
+		for _, o := range orphaned {
+			text += fmt.Sprintf("|%s|`%s`|%s|%s|%s|\n", instanceID, o.Subscription.ID,
+				strings.ReplaceAll(o.Subscription.Name, "|", "\\|"), p.channelMention(o.Subscription.ChannelID), o.Problem)
+		}
+		count += len(orphaned)
+	}
+	if count == 0 {
+		return p.responsef(header, "There are no orphaned subscriptions.")
+	}
+	text += "\nUse `/jira subscribe transfer [id] @user [--instance=<jiraURL>]` to give a subscription to a user connected to Jira, or `/jira subscribe delete [id] [--instance=<jiraURL>]` to delete it."
+	return p.responsef(header, "%s", text)
+}
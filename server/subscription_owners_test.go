@@ -0,0 +1,149 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License for license information.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	jira "github.com/andygrunwald/go-jira"
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mattermost/mattermost-plugin-jira/server/utils/types"
+)
+
+func setupTestSubscriptionOwners(t *testing.T, owners ...string) (*Plugin, testKVStore) {
+	p, kv := setupTestCredentialStore(t)
+	p.updateConfig(func(conf *config) {
+		conf.botUserID = "bot"
+	})
+	p.userStore = NewStore(p)
+
+	var subs []ChannelSubscription
+	for i, owner := range owners {
+		sub := testSubscription(owner+"-sub", "channel1", "TES", "10001", eventCreated)
+		sub.MattermostUserID = owner
+		if i%2 == 1 {
+			sub.ChannelID = "channel2"
+		}
+		subs = append(subs, sub)
+	}
+	data, err := json.Marshal(withExistingChannelSubscriptions(subs))
+	require.NoError(t, err)
+	kv[testSubKey] = data
+
+	for _, userID := range []types.ID{"active", "broken"} {
+		require.NoError(t, p.userStore.StoreConnection(mockInstance1URL, userID, &Connection{User: jira.User{AccountID: "account-" + userID.String()}}))
+	}
+	_, err = p.markConnectionBroken(mockInstance1URL, "broken", "Jira no longer accepts the token", time.Now())
+	require.NoError(t, err)
+
+	api := p.API.(*plugintest.API)
+	api.On("GetUser", "gone").Return(nil, model.NewAppError("GetUser", "app.user.missing_account.const", nil, "", http.StatusNotFound))
+	api.On("GetUser", "deactivated").Return(&model.User{Id: "deactivated", Username: "deactivated", DeleteAt: 1}, nil)
+	for _, userID := range []string{"disconnected", "active", "broken"} {
+		api.On("GetUser", userID).Return(&model.User{Id: userID, Username: userID}, nil)
+		api.On("GetUserByUsername", userID).Return(&model.User{Id: userID, Username: userID}, nil)
+	}
+	api.On("GetChannel", mock.AnythingOfType("string")).Return(func(channelID string) *model.Channel {
+		return &model.Channel{Id: channelID, Name: channelID}
+	}, nil)
+	return p, kv
+}
+
+func TestFindOrphanedSubscriptions(t *testing.T) {
+	p, kv := setupTestSubscriptionOwners(t, "", "gone", "deactivated", "disconnected", "active", "broken")
+
+	orphaned, err := p.findOrphanedSubscriptions(mockInstance1URL)
+	require.NoError(t, err)
+	problems := map[string]string{}
+	for _, o := range orphaned {
+		problems[o.Subscription.MattermostUserID] = o.Problem
+	}
+	assert.Equal(t, map[string]string{
+		"":             "it has no owner",
+		"gone":         "its owner no longer exists",
+		"deactivated":  "@deactivated is deactivated",
+		"disconnected": "@disconnected is not connected to Jira",
+		"broken":       "the Jira connection of @broken is broken",
+	}, problems)
+
+	api := p.API.(*plugintest.API)
+	api.On("GetChannelMembers", "channel1", 0, channelMembersPerPage).Return(model.ChannelMembers{{UserId: "admin1", SchemeAdmin: true}}, nil)
+	api.On("GetChannelMembers", "channel2", 0, channelMembersPerPage).Return(model.ChannelMembers{{UserId: "admin2", SchemeAdmin: true}}, nil)
+	api.On("GetDirectChannel", mock.AnythingOfType("string"), "bot").Return(func(userID, botID string) *model.Channel {
+		return &model.Channel{Id: "dm_" + userID}
+	}, nil)
+	posts := map[string][]string{}
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Run(func(args mock.Arguments) {
+		post := args.Get(0).(*model.Post)
+		posts[post.ChannelId] = append(posts[post.ChannelId], post.Message)
+	}).Return(&model.Post{}, nil)
+
+	require.NoError(t, p.warnOrphanedSubscriptions(mockInstance1URL))
+	require.Len(t, posts["dm_admin1"], 1)
+	assert.Contains(t, posts["dm_admin1"][0], "~channel1")
+	assert.Contains(t, posts["dm_admin1"][0], "@deactivated is deactivated")
+	assert.NotContains(t, posts["dm_admin1"][0], "broken")
+	require.Len(t, posts["dm_admin2"], 1)
+	assert.Contains(t, posts["dm_admin2"][0], "@disconnected is not connected to Jira")
+
+	warned := orphanedSubscriptionWarnings{}
+	require.NoError(t, json.Unmarshal(kv[keyOrphanedSubscriptions(mockInstance1URL)], &warned))
+	assert.Equal(t, NewStringSet("-sub", "gone-sub", "deactivated-sub", "disconnected-sub"), warned.SubscriptionIDs)
+
+	// Channel admins are warned once.
+	require.NoError(t, p.warnOrphanedSubscriptions(mockInstance1URL))
+	assert.Len(t, posts["dm_admin1"], 1)
+	assert.Len(t, posts["dm_admin2"], 1)
+}
+
+func TestTransferChannelSubscriptions(t *testing.T) {
+	p, _ := setupTestSubscriptionOwners(t, "deactivated", "gone", "disconnected")
+	// Loading the subscriptions moves them to a key per channel.
+	_, err := p.getSubscriptions(mockInstance1URL)
+	require.NoError(t, err)
+	api := p.API.(*plugintest.API)
+	api.On("HasPermissionToChannel", "active", "channel1", model.PermissionReadChannel).Return(true)
+	api.On("HasPermissionToChannel", "active", "channel2", model.PermissionReadChannel).Return(false)
+
+	api.On("GetUser", "admin").Return(&model.User{Id: "admin", Username: "admin", Roles: "system_admin system_user"}, nil)
+	api.On("GetUser", "member").Return(&model.User{Id: "member", Username: "member", Roles: "system_user"}, nil)
+
+	_, err = p.checkNewSubscriptionOwner(mockInstance1URL, "channel1", "@disconnected", "admin")
+	assert.EqualError(t, err, "@disconnected is not connected to Jira")
+	_, err = p.checkNewSubscriptionOwner(mockInstance1URL, "channel1", "@broken", "admin")
+	assert.EqualError(t, err, "the Jira connection of @broken is broken")
+	_, err = p.checkNewSubscriptionOwner(mockInstance1URL, "channel2", "@active", "admin")
+	assert.EqualError(t, err, "@active is not a member of ~channel2")
+	_, err = p.checkNewSubscriptionOwner(mockInstance1URL, "channel1", "@active", "member")
+	assert.Error(t, err, "only system administrators give subscriptions to another user")
+	_, err = p.checkNewSubscriptionOwner(mockInstance1URL, "channel1", "@active", "admin")
+	require.NoError(t, err)
+	owner, err := p.checkNewSubscriptionOwner(mockInstance1URL, "channel1", "@active", "active")
+	require.NoError(t, err)
+
+	names, err := p.transferChannelSubscriptions(mockInstance1URL, "channel1", []string{"deactivated-sub"}, owner.Id)
+	require.NoError(t, err)
+	assert.Equal(t, []string{`"subscription deactivated-sub"`}, names)
+
+	_, err = p.transferChannelSubscriptions(mockInstance1URL, "channel1", []string{"gone-sub"}, owner.Id)
+	assert.Error(t, err, "subscriptions of other channels are not transferred")
+
+	names, err = p.transferChannelSubscriptions(mockInstance1URL, "channel1", nil, owner.Id)
+	require.NoError(t, err)
+	assert.Len(t, names, 2)
+
+	subs, err := p.loadSubscriptions(mockInstance1URL)
+	require.NoError(t, err)
+	assert.Equal(t, "active", subs.Channel.ByID["deactivated-sub"].MattermostUserID)
+	assert.Equal(t, "active", subs.Channel.ByID["disconnected-sub"].MattermostUserID)
+	assert.Equal(t, "gone", subs.Channel.ByID["gone-sub"].MattermostUserID)
+}
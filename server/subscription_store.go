@@ -0,0 +1,264 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License for license information.
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/pluginapi"
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-plugin-jira/server/utils/types"
+)
+
+const (
+	// JiraSubscriptionChannelsKey holds the channels that have subscriptions to an instance.
+	JiraSubscriptionChannelsKey = "jirasubchannels"
+
+	prefixChannelSubscriptions = "jirasubch_" // + hash of instance ID and channel ID, the subscriptions of the channel
+
+	// clusterEventSubscriptionsChanged tells the other servers to reload the subscriptions of the
+	// instance in its data.
+	clusterEventSubscriptionsChanged = "subscriptions_changed"
+
+	// subscriptionIndexTTL bounds how long a server may miss a change of subscriptions if the
+	// cluster event for it is lost.
+	subscriptionIndexTTL = 10 * time.Minute
+
+	// subscriptionMigrationAttempts bounds how many times the migration starts over when a server
+	// of an older version changes the subscriptions during a rolling upgrade.
+	subscriptionMigrationAttempts = 5
+)
+
+// channelSubscriptionsShard holds the subscriptions of a channel to an instance, by ID.
+type channelSubscriptionsShard struct {
+	ChannelID string                         `json:"channel_id"`
+	ByID      map[string]ChannelSubscription `json:"by_id"`
+}
+
+// subscribedChannels are the channels with subscriptions to an instance, so that they can be
+// loaded without listing the keys of the KV store.
+type subscribedChannels struct {
+	ChannelIDs StringSet `json:"channel_ids"`
+}
+
+func keyChannelSubscriptions(instanceID types.ID, channelID string) string {
+	return hashkey(prefixChannelSubscriptions, instanceID.String()+"/"+channelID)
+}
+
+func keySubscribedChannels(instanceID types.ID) string {
+	return keyWithInstanceID(instanceID, JiraSubscriptionChannelsKey)
+}
+
+// addSubscribedChannel records that the channel has subscriptions to the instance. Channels are
+// not removed when their last subscription is, to not race with a new subscription: loading the
+// subscriptions skips the channels without any.
+func (p *Plugin) addSubscribedChannel(instanceID types.ID, channelID string) error {
+	return p.client.KV.SetAtomicWithRetries(keySubscribedChannels(instanceID), func(initialBytes []byte) (interface{}, error) {
+		channels := &subscribedChannels{}
+		if len(initialBytes) != 0 {
+			if err := json.Unmarshal(initialBytes, channels); err != nil {
+				return nil, err
+			}
+		}
+		if channels.ChannelIDs.ContainsAny(channelID) {
+			return initialBytes, nil
+		}
+		channels.ChannelIDs = channels.ChannelIDs.Add(channelID)
+		return channels, nil
+	})
+}
+
+// updateChannelSubscriptions changes the subscriptions of a channel, by ID, atomically.
+func (p *Plugin) updateChannelSubscriptions(instanceID types.ID, channelID string, update func(byID map[string]ChannelSubscription) error) error {
+	return p.client.KV.SetAtomicWithRetries(keyChannelSubscriptions(instanceID, channelID), func(initialBytes []byte) (interface{}, error) {
+		shard := &channelSubscriptionsShard{}
+		if len(initialBytes) != 0 {
+			if err := json.Unmarshal(initialBytes, shard); err != nil {
+				return nil, err
+			}
+		}
+		if shard.ByID == nil {
+			shard.ByID = map[string]ChannelSubscription{}
+		}
+		shard.ChannelID = channelID
+
+		if err := update(shard.ByID); err != nil {
+			return nil, err
+		}
+		if len(shard.ByID) == 0 {
+			return nil, nil
+		}
+		return shard, nil
+	})
+}
+
+// migrateSubscriptions moves the subscriptions of an instance from the single key they were all
+// stored in to a key per channel. Subscriptions already migrated are kept, so that servers
+// migrating at the same time do not lose any. The single key is only removed if it did not change
+// meanwhile, otherwise the changes made by the servers of an older version are migrated too.
+func (p *Plugin) migrateSubscriptions(instanceID types.ID) error {
+	legacyKey := keyWithInstanceID(instanceID, JiraSubscriptionsKey)
+	var migrated map[string]ChannelSubscription
+	for attempt := 0; attempt < subscriptionMigrationAttempts; attempt++ {
+		var data []byte
+		if err := p.client.KV.Get(legacyKey, &data); err != nil {
+			return errors.WithMessage(err, "failed to load subscriptions to migrate")
+		}
+		if len(data) == 0 {
+			return nil
+		}
+		legacy, err := SubscriptionsFromJSON(data, instanceID)
+		if err != nil {
+			return errors.WithMessage(err, "failed to unmarshal subscriptions to migrate")
+		}
+
+		if err = p.copyLegacySubscriptions(instanceID, legacy.Channel.ByID, migrated); err != nil {
+			return errors.WithMessage(err, "failed to migrate subscriptions")
+		}
+
+		deleted, err := p.client.KV.Set(legacyKey, nil, pluginapi.SetAtomic(data))
+		if err != nil {
+			return errors.WithMessage(err, "failed to remove migrated subscriptions")
+		}
+		if deleted {
+			p.client.Log.Info("Migrated channel subscriptions to a key per channel.", "instance", instanceID.String(), "count", len(legacy.Channel.ByID))
+			return nil
+		}
+		migrated = legacy.Channel.ByID
+	}
+	return errors.Errorf("failed to migrate subscriptions, they changed during %d attempts", subscriptionMigrationAttempts)
+}
+
+// copyLegacySubscriptions copies the subscriptions to the keys of their channels. The ones already
+// there are kept, unless they changed since the previous attempt copied them, and the ones the
+// previous attempt copied that are gone since are removed.
+func (p *Plugin) copyLegacySubscriptions(instanceID types.ID, legacy, previous map[string]ChannelSubscription) error {
+	channelIDs := NewStringSet()
+	for _, sub := range legacy {
+		channelIDs = channelIDs.Add(sub.ChannelID)
+	}
+	for _, sub := range previous {
+		channelIDs = channelIDs.Add(sub.ChannelID)
+	}
+
+	for _, channelID := range channelIDs.Elems() {
+		if err := p.addSubscribedChannel(instanceID, channelID); err != nil {
+			return err
+		}
+		err := p.updateChannelSubscriptions(instanceID, channelID, func(byID map[string]ChannelSubscription) error {
+			for id, sub := range legacy {
+				if sub.ChannelID != channelID {
+					continue
+				}
+				_, exists := byID[id]
+				copied, wasCopied := previous[id]
+				if !exists || (wasCopied && !reflect.DeepEqual(copied, sub)) {
+					byID[id] = sub
+				}
+			}
+			for id, sub := range previous {
+				if _, ok := legacy[id]; !ok && sub.ChannelID == channelID {
+					delete(byID, id)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadSubscriptions loads all the channel subscriptions of an instance from the KV store.
+func (p *Plugin) loadSubscriptions(instanceID types.ID) (*Subscriptions, error) {
+	if err := p.migrateSubscriptions(instanceID); err != nil {
+		return nil, err
+	}
+
+	channels := &subscribedChannels{}
+	if err := p.client.KV.Get(keySubscribedChannels(instanceID), channels); err != nil {
+		return nil, errors.WithMessage(err, "failed to load subscribed channels")
+	}
+
+	subs := NewSubscriptions()
+	for _, channelID := range channels.ChannelIDs.Elems() {
+		shard := &channelSubscriptionsShard{}
+		if err := p.client.KV.Get(keyChannelSubscriptions(instanceID, channelID), shard); err != nil {
+			return nil, errors.WithMessagef(err, "failed to load the subscriptions of channel %s", channelID)
+		}
+		for _, sub := range shard.ByID {
+			sub := sub
+			sub.InstanceID = instanceID
+			subs.Channel.add(&sub)
+		}
+	}
+	return subs, nil
+}
+
+type subscriptionIndexEntry struct {
+	subs      *Subscriptions
+	expiresAt time.Time
+}
+
+// subscriptionIndex holds the channel subscriptions of each instance, indexed for matching
+// webhooks, so that they are not loaded from the KV store for every webhook. The subscriptions
+// it returns are shared and must not be modified.
+type subscriptionIndex struct {
+	lock       sync.Mutex
+	generation int
+	entries    map[types.ID]subscriptionIndexEntry
+}
+
+// get returns the subscriptions of the instance, and the generation of the index to set them
+// with if they were not found.
+func (c *subscriptionIndex) get(instanceID types.ID, now time.Time) (*Subscriptions, int, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry, ok := c.entries[instanceID]
+	if !ok || now.After(entry.expiresAt) {
+		return nil, c.generation, false
+	}
+	return entry.subs, c.generation, true
+}
+
+// set stores the subscriptions of the instance, unless the index was invalidated since the
+// given generation, while they were being loaded.
+func (c *subscriptionIndex) set(instanceID types.ID, subs *Subscriptions, generation int, now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if generation != c.generation {
+		return
+	}
+	if c.entries == nil {
+		c.entries = map[types.ID]subscriptionIndexEntry{}
+	}
+	c.entries[instanceID] = subscriptionIndexEntry{subs: subs, expiresAt: now.Add(subscriptionIndexTTL)}
+}
+
+func (c *subscriptionIndex) invalidate(instanceID types.ID) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.generation++
+	delete(c.entries, instanceID)
+}
+
+// invalidateSubscriptions drops the subscriptions of the instance from the index of every
+// server, after they changed.
+func (p *Plugin) invalidateSubscriptions(instanceID types.ID) {
+	p.subscriptionIndex.invalidate(instanceID)
+
+	err := p.client.Cluster.PublishPluginEvent(
+		model.PluginClusterEvent{Id: clusterEventSubscriptionsChanged, Data: []byte(instanceID)},
+		model.PluginClusterEventSendOptions{SendType: model.PluginClusterEventSendTypeReliable},
+	)
+	if err != nil {
+		p.errorf("Failed to publish the change of subscriptions of %s: %v", instanceID, err)
+	}
+}
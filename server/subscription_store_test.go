@@ -0,0 +1,201 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License for license information.
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	jira "github.com/andygrunwald/go-jira"
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func setupTestSubscriptionStore(t *testing.T) (*Plugin, testKVStore) {
+	p, kv := setupTestWebhookQueue(t)
+	api := p.API.(*plugintest.API)
+	api.On("LogInfo", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Maybe()
+	api.On("PublishPluginClusterEvent", mock.AnythingOfType("model.PluginClusterEvent"), mock.AnythingOfType("model.PluginClusterEventSendOptions")).Maybe().Return(nil)
+	return p, kv
+}
+
+func testSubscription(id, channelID, project, issueType string, events ...string) ChannelSubscription {
+	return ChannelSubscription{
+		ID:        id,
+		ChannelID: channelID,
+		Name:      "subscription " + id,
+		Filters: SubscriptionFilters{
+			Events:     NewStringSet(events...),
+			Projects:   NewStringSet(project),
+			IssueTypes: NewStringSet(issueType),
+			Self:       []string{"any"},
+		},
+	}
+}
+
+func TestMigrateSubscriptions(t *testing.T) {
+	p, kv := setupTestSubscriptionStore(t)
+	legacy := withExistingChannelSubscriptions([]ChannelSubscription{
+		testSubscription("sub1", "channel1", "TES", "10001", eventCreated),
+		testSubscription("sub2", "channel1", "TES", "10002", eventCreated),
+		testSubscription("sub3", "channel2", "OTHER", "10001", eventUpdatedAny),
+	})
+	data, err := json.Marshal(legacy)
+	require.NoError(t, err)
+	kv[testSubKey] = data
+
+	subs, err := p.getSubscriptions(testInstance1.InstanceID)
+	require.NoError(t, err)
+	assert.Len(t, subs.Channel.ByID, 3)
+	assert.Equal(t, NewStringSet("sub1", "sub2"), subs.Channel.IDByChannelID["channel1"])
+	assert.Equal(t, testInstance1.InstanceID, subs.Channel.ByID["sub3"].InstanceID)
+	assert.Nil(t, kv[testSubKey])
+
+	shard := &channelSubscriptionsShard{}
+	require.NoError(t, json.Unmarshal(kv[keyChannelSubscriptions(testInstance1.InstanceID, "channel2")], shard))
+	assert.Len(t, shard.ByID, 1)
+	assert.Contains(t, shard.ByID, "sub3")
+
+	// Loading again, from the KV store, finds the migrated subscriptions.
+	p.subscriptionIndex.invalidate(testInstance1.InstanceID)
+	subs, err = p.getSubscriptions(testInstance1.InstanceID)
+	require.NoError(t, err)
+	assert.Len(t, subs.Channel.ByID, 3)
+}
+
+func TestCopyLegacySubscriptions(t *testing.T) {
+	p, _ := setupTestSubscriptionStore(t)
+	instanceID := testInstance1.InstanceID
+	first := map[string]ChannelSubscription{}
+	for _, sub := range []ChannelSubscription{
+		testSubscription("sub1", "channel1", "TES", "10001", eventCreated),
+		testSubscription("sub2", "channel1", "TES", "10002", eventCreated),
+		testSubscription("sub3", "channel2", "OTHER", "10001", eventUpdatedAny),
+	} {
+		first[sub.ID] = sub
+	}
+	require.NoError(t, p.copyLegacySubscriptions(instanceID, first, nil))
+
+	// sub1 was edited after the migration copied it.
+	edited := first["sub1"]
+	edited.Name = "edited"
+	require.NoError(t, p.updateChannelSubscriptions(instanceID, "channel1", func(byID map[string]ChannelSubscription) error {
+		byID["sub1"] = edited
+		return nil
+	}))
+
+	// A server of an older version changed sub2 and deleted sub3 meanwhile.
+	second := map[string]ChannelSubscription{"sub1": first["sub1"], "sub2": first["sub2"]}
+	changed := second["sub2"]
+	changed.Name = "changed by an older server"
+	second["sub2"] = changed
+	require.NoError(t, p.copyLegacySubscriptions(instanceID, second, first))
+
+	subs, err := p.loadSubscriptions(instanceID)
+	require.NoError(t, err)
+	assert.Len(t, subs.Channel.ByID, 2)
+	assert.Equal(t, "edited", subs.Channel.ByID["sub1"].Name)
+	assert.Equal(t, "changed by an older server", subs.Channel.ByID["sub2"].Name)
+}
+
+func TestChannelSubscriptionStore(t *testing.T) {
+	p, _ := setupTestSubscriptionStore(t)
+	instanceID := testInstance1.InstanceID
+
+	sub := testSubscription("", "channel1", "TES", "10001", eventCreated)
+	require.NoError(t, p.addChannelSubscription(instanceID, &sub, testClient{}))
+	require.NotEmpty(t, sub.ID)
+
+	duplicate := testSubscription("", "channel1", "TES", "10001", eventCreated)
+	duplicate.Name = sub.Name
+	assert.Error(t, p.addChannelSubscription(instanceID, &duplicate, testClient{}))
+
+	subs, err := p.getSubscriptionsForChannel(instanceID, "channel1")
+	require.NoError(t, err)
+	require.Len(t, subs, 1)
+	assert.Equal(t, sub.ID, subs[0].ID)
+
+	edited := sub
+	edited.ChannelID = "channel2"
+	edited.Name = "edited"
+	require.NoError(t, p.editChannelSubscription(instanceID, &edited, testClient{}))
+	subs, err = p.getSubscriptionsForChannel(instanceID, "channel1")
+	require.NoError(t, err)
+	assert.Empty(t, subs)
+	found, err := p.getChannelSubscription(instanceID, sub.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "edited", found.Name)
+	assert.Equal(t, "channel2", found.ChannelID)
+
+	require.NoError(t, p.removeChannelSubscription(instanceID, sub.ID))
+	_, err = p.getChannelSubscription(instanceID, sub.ID)
+	assert.EqualError(t, err, "could not find subscription")
+	assert.Error(t, p.removeChannelSubscription(instanceID, sub.ID))
+}
+
+func TestSubscriptionIndexInvalidation(t *testing.T) {
+	p, kv := setupTestSubscriptionStore(t)
+	instanceID := testInstance1.InstanceID
+
+	sub := testSubscription("sub1", "channel1", "TES", "10001", eventCreated)
+	require.NoError(t, p.addSubscribedChannel(instanceID, "channel1"))
+	require.NoError(t, p.updateChannelSubscriptions(instanceID, "channel1", func(byID map[string]ChannelSubscription) error {
+		byID[sub.ID] = sub
+		return nil
+	}))
+
+	subs, err := p.getSubscriptions(instanceID)
+	require.NoError(t, err)
+	assert.Len(t, subs.Channel.ByID, 1)
+
+	// Another server removes the subscription, this one keeps its index until told.
+	delete(kv, keyChannelSubscriptions(instanceID, "channel1"))
+	subs, err = p.getSubscriptions(instanceID)
+	require.NoError(t, err)
+	assert.Len(t, subs.Channel.ByID, 1)
+
+	p.OnPluginClusterEvent(nil, model.PluginClusterEvent{Id: clusterEventSubscriptionsChanged, Data: []byte(instanceID)})
+	subs, err = p.getSubscriptions(instanceID)
+	require.NoError(t, err)
+	assert.Empty(t, subs.Channel.ByID)
+}
+
+func TestChannelSubscriptionsCandidates(t *testing.T) {
+	subs := NewChannelSubscriptions()
+	for _, sub := range []ChannelSubscription{
+		testSubscription("created", "channel1", "TES", "10001", eventCreated),
+		testSubscription("other-project", "channel1", "OTHER", "10001", eventCreated),
+		testSubscription("other-type", "channel1", "TES", "10002", eventCreated),
+		testSubscription("updated-any", "channel2", "TES", "10001", eventUpdatedAny),
+		{ID: "any-project", ChannelID: "channel3", Filters: SubscriptionFilters{Events: NewStringSet(eventCreated)}},
+	} {
+		sub := sub
+		subs.add(&sub)
+	}
+
+	ids := func(candidates []ChannelSubscription) StringSet {
+		set := NewStringSet()
+		for _, sub := range candidates {
+			set = set.Add(sub.ID)
+		}
+		return set
+	}
+	issue := jira.Issue{Fields: &jira.IssueFields{
+		Project: jira.Project{Key: "TES"},
+		Type:    jira.IssueType{ID: "10001"},
+	}}
+
+	created := &webhook{JiraWebhook: &JiraWebhook{Issue: issue}, eventTypes: NewStringSet(eventCreated)}
+	assert.Equal(t, NewStringSet("created", "any-project"), ids(subs.candidates(created)))
+
+	updated := &webhook{JiraWebhook: &JiraWebhook{Issue: issue}, eventTypes: NewStringSet(eventUpdatedStatus)}
+	assert.Equal(t, NewStringSet("updated-any"), ids(subs.candidates(updated)))
+
+	removed := subs.ByID["created"]
+	subs.remove(&removed)
+	assert.Equal(t, NewStringSet("any-project"), ids(subs.candidates(created)))
+}
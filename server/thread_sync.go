@@ -0,0 +1,520 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License for license information.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	jira "github.com/andygrunwald/go-jira"
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+	"github.com/mattermost/mattermost/server/public/pluginapi"
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-plugin-jira/server/utils/types"
+)
+
+const (
+	prefixThreadLink     = "threadlink_"     // + root post ID, the issue the thread is linked to
+	prefixThreadIssue    = "threadissue_"    // + hash of instance ID and issue key, the root post ID of the linked thread
+	prefixThreadPost     = "threadpost_"     // + post ID, the comment the reply is synced with
+	prefixThreadComment  = "threadcomment_"  // + hash of instance ID and comment ID, the reply the comment is synced with
+	prefixThreadComments = "threadcomments_" // + root post ID, the post IDs of the thread by synced comment ID
+	prefixThreadPending  = "threadpending_"  // + hash of instance ID and issue key, the replies being added as comments
+
+	// threadPendingTTL bounds how long a reply is considered being added as a comment, in case
+	// the server adding it stopped.
+	threadPendingTTL = 5 * time.Minute
+)
+
+// errThreadRepliesPending is returned for the comments created while replies of the linked
+// thread are being added to the issue, the comment may be one of them.
+var errThreadRepliesPending = errors.New("replies of the linked thread are being added to the issue")
+
+// ThreadLink links a Mattermost thread to a Jira issue. Replies in the thread become comments
+// of the issue, and comments of the issue are posted as replies in the thread.
+type ThreadLink struct {
+	RootPostID       string    `json:"root_post_id"`
+	ChannelID        string    `json:"channel_id"`
+	InstanceID       types.ID  `json:"instance_id"`
+	IssueKey         string    `json:"issue_key"`
+	MattermostUserID string    `json:"mattermost_user_id"`
+	LinkedAt         time.Time `json:"linked_at"`
+}
+
+// ThreadComment maps a reply of a linked thread to a Jira comment. Edits and deletes are only
+// mirrored from the side the comment was written on, which keeps the sync from looping.
+type ThreadComment struct {
+	InstanceID     types.ID `json:"instance_id"`
+	IssueKey       string   `json:"issue_key"`
+	CommentID      string   `json:"comment_id"`
+	PostID         string   `json:"post_id"`
+	RootPostID     string   `json:"root_post_id"`
+	FromMattermost bool     `json:"from_mattermost"`
+}
+
+func keyThreadIssue(instanceID types.ID, issueKey string) string {
+	return hashkey(prefixThreadIssue, instanceID.String()+"/"+issueKey)
+}
+
+func keyThreadComment(instanceID types.ID, commentID string) string {
+	return hashkey(prefixThreadComment, instanceID.String()+"/"+commentID)
+}
+
+func keyThreadPending(instanceID types.ID, issueKey string) string {
+	return hashkey(prefixThreadPending, instanceID.String()+"/"+issueKey)
+}
+
+func (p *Plugin) loadThreadLink(rootPostID string) (*ThreadLink, error) {
+	var link *ThreadLink
+	if err := p.client.KV.Get(prefixThreadLink+rootPostID, &link); err != nil {
+		return nil, errors.Wrap(err, "failed to load the thread link")
+	}
+	return link, nil
+}
+
+func (p *Plugin) loadThreadLinkByIssue(instanceID types.ID, issueKey string) (*ThreadLink, error) {
+	var rootPostID string
+	if err := p.client.KV.Get(keyThreadIssue(instanceID, issueKey), &rootPostID); err != nil {
+		return nil, errors.Wrap(err, "failed to load the thread of the issue")
+	}
+	if rootPostID == "" {
+		return nil, nil
+	}
+	return p.loadThreadLink(rootPostID)
+}
+
+// linkThread stores the link, unless the issue is already linked to another thread.
+func (p *Plugin) linkThread(link *ThreadLink) error {
+	saved, err := p.client.KV.Set(keyThreadIssue(link.InstanceID, link.IssueKey), link.RootPostID, pluginapi.SetAtomic(nil))
+	if err != nil {
+		return errors.Wrap(err, "failed to store the thread link")
+	}
+	if !saved {
+		return errors.Errorf("%s is already linked to another thread", link.IssueKey)
+	}
+
+	if _, err = p.client.KV.Set(prefixThreadLink+link.RootPostID, link); err != nil {
+		_ = p.client.KV.Delete(keyThreadIssue(link.InstanceID, link.IssueKey))
+		return errors.Wrap(err, "failed to store the thread link")
+	}
+	return nil
+}
+
+func (p *Plugin) unlinkThread(link *ThreadLink) error {
+	if err := p.client.KV.Delete(prefixThreadLink + link.RootPostID); err != nil {
+		return errors.Wrap(err, "failed to remove the thread link")
+	}
+	if err := p.client.KV.Delete(keyThreadIssue(link.InstanceID, link.IssueKey)); err != nil {
+		return errors.Wrap(err, "failed to remove the thread link")
+	}
+
+	var synced map[string]string
+	if err := p.client.KV.Get(prefixThreadComments+link.RootPostID, &synced); err != nil {
+		return errors.Wrap(err, "failed to load the synced comments of the thread")
+	}
+	for commentID, postID := range synced {
+		if err := p.deleteThreadCommentKeys(link.InstanceID, commentID, postID); err != nil {
+			return err
+		}
+	}
+	if err := p.client.KV.Delete(prefixThreadComments + link.RootPostID); err != nil {
+		return errors.Wrap(err, "failed to remove the synced comments of the thread")
+	}
+	return nil
+}
+
+func (p *Plugin) loadThreadCommentByPost(postID string) (*ThreadComment, error) {
+	var tc *ThreadComment
+	if err := p.client.KV.Get(prefixThreadPost+postID, &tc); err != nil {
+		return nil, errors.Wrap(err, "failed to load the synced comment of the post")
+	}
+	return tc, nil
+}
+
+func (p *Plugin) loadThreadCommentByComment(instanceID types.ID, commentID string) (*ThreadComment, error) {
+	var tc *ThreadComment
+	if err := p.client.KV.Get(keyThreadComment(instanceID, commentID), &tc); err != nil {
+		return nil, errors.Wrap(err, "failed to load the synced post of the comment")
+	}
+	return tc, nil
+}
+
+// updateThreadComments changes the post IDs of the thread by synced comment ID, which are kept to
+// remove the mappings of the comments when the thread is unlinked.
+func (p *Plugin) updateThreadComments(rootPostID string, update func(synced map[string]string)) error {
+	return p.client.KV.SetAtomicWithRetries(prefixThreadComments+rootPostID, func(initialBytes []byte) (interface{}, error) {
+		synced := map[string]string{}
+		if len(initialBytes) != 0 {
+			if err := json.Unmarshal(initialBytes, &synced); err != nil {
+				return nil, err
+			}
+		}
+		update(synced)
+		if len(synced) == 0 {
+			return nil, nil
+		}
+		return synced, nil
+	})
+}
+
+func (p *Plugin) storeThreadComment(tc *ThreadComment) error {
+	err := p.updateThreadComments(tc.RootPostID, func(synced map[string]string) {
+		synced[tc.CommentID] = tc.PostID
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to store the synced comment")
+	}
+	if _, err = p.client.KV.Set(keyThreadComment(tc.InstanceID, tc.CommentID), tc); err != nil {
+		return errors.Wrap(err, "failed to store the synced comment")
+	}
+	if _, err = p.client.KV.Set(prefixThreadPost+tc.PostID, tc); err != nil {
+		return errors.Wrap(err, "failed to store the synced comment")
+	}
+	return nil
+}
+
+func (p *Plugin) deleteThreadComment(tc *ThreadComment) error {
+	if err := p.deleteThreadCommentKeys(tc.InstanceID, tc.CommentID, tc.PostID); err != nil {
+		return err
+	}
+	err := p.updateThreadComments(tc.RootPostID, func(synced map[string]string) {
+		delete(synced, tc.CommentID)
+	})
+	return errors.Wrap(err, "failed to remove the synced comment")
+}
+
+func (p *Plugin) deleteThreadCommentKeys(instanceID types.ID, commentID, postID string) error {
+	if err := p.client.KV.Delete(keyThreadComment(instanceID, commentID)); err != nil {
+		return errors.Wrap(err, "failed to remove the synced comment")
+	}
+	if err := p.client.KV.Delete(prefixThreadPost + postID); err != nil {
+		return errors.Wrap(err, "failed to remove the synced comment")
+	}
+	return nil
+}
+
+// setThreadReplyPending records, or clears, that the reply is being added as a comment of the
+// issue.
+func (p *Plugin) setThreadReplyPending(instanceID types.ID, issueKey, postID string, pending bool) error {
+	err := p.client.KV.SetAtomicWithRetries(keyThreadPending(instanceID, issueKey), func(initialBytes []byte) (interface{}, error) {
+		replies := map[string]time.Time{}
+		if len(initialBytes) != 0 {
+			if err := json.Unmarshal(initialBytes, &replies); err != nil {
+				return nil, err
+			}
+		}
+		now := time.Now()
+		for id, since := range replies {
+			if now.Sub(since) > threadPendingTTL {
+				delete(replies, id)
+			}
+		}
+		if pending {
+			replies[postID] = now
+		} else {
+			delete(replies, postID)
+		}
+		if len(replies) == 0 {
+			return nil, nil
+		}
+		return replies, nil
+	})
+	return errors.Wrap(err, "failed to store the pending comment")
+}
+
+func (p *Plugin) hasPendingThreadReplies(instanceID types.ID, issueKey string) (bool, error) {
+	var replies map[string]time.Time
+	if err := p.client.KV.Get(keyThreadPending(instanceID, issueKey), &replies); err != nil {
+		return false, errors.Wrap(err, "failed to load the pending comments")
+	}
+	for _, since := range replies {
+		if time.Since(since) <= threadPendingTTL {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// isThreadSyncCandidate reports whether a post may be a user reply of a linked thread.
+func (p *Plugin) isThreadSyncCandidate(post *model.Post) bool {
+	return post != nil && post.RootId != "" && post.Type == "" && post.UserId != p.getUserID()
+}
+
+// syncThreadReply adds a new reply of a linked thread as a comment of the issue, on behalf of
+// the author of the reply.
+func (p *Plugin) syncThreadReply(post *model.Post) error {
+	if !p.isThreadSyncCandidate(post) || strings.TrimSpace(post.Message) == "" {
+		return nil
+	}
+	link, err := p.loadThreadLink(post.RootId)
+	if err != nil || link == nil {
+		return err
+	}
+
+	client, _, _, err := p.getClient(link.InstanceID, types.ID(post.UserId))
+	if err != nil {
+		p.client.Post.SendEphemeralPost(post.UserId, makePost(p.getUserID(), post.ChannelId,
+			fmt.Sprintf("Your reply was not added to %s, because your Mattermost account is not connected to Jira.", link.IssueKey)))
+		return nil
+	}
+
+	// The webhook of the comment waits for the comment ID to be stored while the reply is pending.
+	if err = p.setThreadReplyPending(link.InstanceID, link.IssueKey, post.Id, true); err != nil {
+		return err
+	}
+	defer func() {
+		if clearErr := p.setThreadReplyPending(link.InstanceID, link.IssueKey, post.Id, false); clearErr != nil {
+			p.errorf("Failed to clear the pending reply %s: %v", post.Id, clearErr)
+		}
+	}()
+
+	added, err := client.AddComment(link.IssueKey, &jira.Comment{Body: post.Message})
+	if err != nil {
+		return errors.WithMessagef(err, "failed to add the reply %s to %s", post.Id, link.IssueKey)
+	}
+	return p.storeThreadComment(&ThreadComment{
+		InstanceID:     link.InstanceID,
+		IssueKey:       link.IssueKey,
+		CommentID:      added.ID,
+		PostID:         post.Id,
+		RootPostID:     link.RootPostID,
+		FromMattermost: true,
+	})
+}
+
+// syncThreadReplyUpdate mirrors the edit of a synced reply to its comment.
+func (p *Plugin) syncThreadReplyUpdate(newPost, oldPost *model.Post) error {
+	if !p.isThreadSyncCandidate(newPost) || newPost.Message == oldPost.Message {
+		return nil
+	}
+	tc, err := p.loadThreadCommentByPost(newPost.Id)
+	if err != nil || tc == nil || !tc.FromMattermost {
+		return err
+	}
+	link, err := p.loadThreadLink(newPost.RootId)
+	if err != nil || link == nil {
+		return err
+	}
+
+	client, _, _, err := p.getClient(tc.InstanceID, types.ID(newPost.UserId))
+	if err != nil {
+		return err
+	}
+	_, err = client.UpdateComment(tc.IssueKey, &jira.Comment{ID: tc.CommentID, Body: newPost.Message})
+	return err
+}
+
+// syncThreadReplyDelete deletes the comment of a deleted reply.
+func (p *Plugin) syncThreadReplyDelete(post *model.Post) error {
+	if post == nil || post.RootId == "" {
+		return nil
+	}
+	tc, err := p.loadThreadCommentByPost(post.Id)
+	if err != nil || tc == nil {
+		return err
+	}
+	if err = p.deleteThreadComment(tc); err != nil {
+		return err
+	}
+	if !tc.FromMattermost {
+		return nil
+	}
+	link, err := p.loadThreadLink(post.RootId)
+	if err != nil || link == nil {
+		return err
+	}
+
+	client, _, _, err := p.getClient(tc.InstanceID, types.ID(post.UserId))
+	if err != nil {
+		return err
+	}
+	return client.DeleteComment(tc.IssueKey, tc.CommentID)
+}
+
+func threadCommentMessage(jwh *JiraWebhook) string {
+	return fmt.Sprintf("%s **commented** in Jira:\n%s", mdUser(&jwh.Comment.UpdateAuthor), jwh.Comment.Body)
+}
+
+// syncThreadComment posts the comment events of an issue linked to a thread in the thread.
+func (p *Plugin) syncThreadComment(instanceID types.ID, wh *webhook) error {
+	if wh.Comment.ID == "" || wh.Events().Intersection(commentEvents).Len() == 0 {
+		return nil
+	}
+	link, err := p.loadThreadLinkByIssue(instanceID, wh.Issue.Key)
+	if err != nil || link == nil {
+		return err
+	}
+	tc, err := p.loadThreadCommentByComment(instanceID, wh.Comment.ID)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case wh.Events().ContainsAny(eventCreatedComment):
+		if tc != nil {
+			// The comment was added from a reply of the thread, or already posted.
+			return nil
+		}
+		// A reply is only mapped to its comment once Jira returned the comment ID, which may be
+		// after the webhook of the comment arrived. The event is retried later.
+		var pending bool
+		if pending, err = p.hasPendingThreadReplies(instanceID, link.IssueKey); err != nil {
+			return err
+		}
+		if pending {
+			return errThreadRepliesPending
+		}
+		if err = wh.CheckPermissions(instanceID, p, link.MattermostUserID); err != nil {
+			return errors.WithMessagef(err, "failed to check the permissions of %s to read the comment", link.MattermostUserID)
+		}
+
+		post := &model.Post{
+			UserId:    p.getUserID(),
+			ChannelId: link.ChannelID,
+			RootId:    link.RootPostID,
+			Message:   threadCommentMessage(wh.JiraWebhook),
+		}
+		if err = p.client.Post.CreatePost(post); err != nil {
+			return errors.WithMessage(err, "failed to post the comment in the thread")
+		}
+		return p.storeThreadComment(&ThreadComment{
+			InstanceID: instanceID,
+			IssueKey:   link.IssueKey,
+			CommentID:  wh.Comment.ID,
+			PostID:     post.Id,
+			RootPostID: link.RootPostID,
+		})
+
+	case wh.Events().ContainsAny(eventUpdatedComment):
+		if tc == nil || tc.FromMattermost {
+			return nil
+		}
+		post, err := p.client.Post.GetPost(tc.PostID)
+		if err != nil {
+			return errors.WithMessage(err, "failed to load the post of the comment")
+		}
+		post.Message = threadCommentMessage(wh.JiraWebhook)
+		return p.client.Post.UpdatePost(post)
+
+	case wh.Events().ContainsAny(eventDeletedComment):
+		if tc == nil || tc.FromMattermost {
+			return nil
+		}
+		if err = p.deleteThreadComment(tc); err != nil {
+			return err
+		}
+		return p.client.Post.DeletePost(tc.PostID)
+	}
+	return nil
+}
+
+// MessageHasBeenPosted adds the replies of linked threads to their issues.
+func (p *Plugin) MessageHasBeenPosted(c *plugin.Context, post *model.Post) {
+	if err := p.syncThreadReply(post); err != nil {
+		p.errorf("Failed to sync reply %s of a linked thread: %v", post.Id, err)
+	}
+}
+
+// MessageHasBeenUpdated mirrors the edits of synced replies to their comments.
+func (p *Plugin) MessageHasBeenUpdated(c *plugin.Context, newPost, oldPost *model.Post) {
+	if err := p.syncThreadReplyUpdate(newPost, oldPost); err != nil {
+		p.errorf("Failed to sync the edit of reply %s of a linked thread: %v", newPost.Id, err)
+	}
+}
+
+// MessageHasBeenDeleted deletes the comments of deleted synced replies.
+func (p *Plugin) MessageHasBeenDeleted(c *plugin.Context, post *model.Post) {
+	if err := p.syncThreadReplyDelete(post); err != nil {
+		p.errorf("Failed to sync the deletion of reply %s of a linked thread: %v", post.Id, err)
+	}
+}
+
+func executeThreadLink(p *Plugin, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	instanceURL, args, err := p.parseCommandFlagInstanceURL(args)
+	if err != nil {
+		return p.responsef(header, "Failed to load your connection to Jira. Error: %v.", err)
+	}
+	if len(args) != 1 {
+		return p.help(header)
+	}
+	if header.RootId == "" {
+		return p.responsef(header, "Run this command in a reply of the thread you want to link.")
+	}
+	issueKey := strings.ToUpper(args[0])
+
+	client, instance, _, err := p.getCommandClient(header, instanceURL)
+	if err != nil {
+		return p.responsef(header, "%v", err)
+	}
+	if _, err = client.GetIssue(issueKey, nil); err != nil {
+		return p.responsef(header, "Failed to load issue %s. Error: %v.", issueKey, err)
+	}
+
+	existing, err := p.loadThreadLink(header.RootId)
+	if err != nil {
+		return p.responsef(header, "%v", err)
+	}
+	if existing != nil {
+		return p.responsef(header, "This thread is already linked to %s. Unlink it first with `/jira thread unlink`.", existing.IssueKey)
+	}
+
+	err = p.linkThread(&ThreadLink{
+		RootPostID:       header.RootId,
+		ChannelID:        header.ChannelId,
+		InstanceID:       instance.GetID(),
+		IssueKey:         issueKey,
+		MattermostUserID: header.UserId,
+		LinkedAt:         time.Now(),
+	})
+	if err != nil {
+		return p.responsef(header, "Failed to link the thread: %v.", err)
+	}
+
+	issueLink := fmt.Sprintf("[%s](%s/browse/%s)", issueKey, instance.GetJiraBaseURL(), issueKey)
+	err = p.client.Post.CreatePost(&model.Post{
+		UserId:    p.getUserID(),
+		ChannelId: header.ChannelId,
+		RootId:    header.RootId,
+		Message:   fmt.Sprintf("This thread is now linked to %s. New replies are added to the issue as comments, and new comments of the issue are posted here.", issueLink),
+	})
+	if err != nil {
+		p.errorf("Failed to announce the link of thread %s: %v", header.RootId, err)
+	}
+	return &model.CommandResponse{}
+}
+
+func executeThreadUnlink(p *Plugin, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	if len(args) != 0 {
+		return p.help(header)
+	}
+	if header.RootId == "" {
+		return p.responsef(header, "Run this command in a reply of the thread you want to unlink.")
+	}
+
+	link, err := p.loadThreadLink(header.RootId)
+	if err != nil {
+		return p.responsef(header, "%v", err)
+	}
+	if link == nil {
+		return p.responsef(header, "This thread is not linked to an issue.")
+	}
+	if link.MattermostUserID != header.UserId {
+		authorized, err := authorizedSysAdmin(p, header.UserId)
+		if err != nil {
+			return p.responsef(header, "%v", err)
+		}
+		if !authorized {
+			return p.responsef(header, "Only the user who linked the thread or a system administrator can unlink it.")
+		}
+	}
+
+	if err = p.unlinkThread(link); err != nil {
+		return p.responsef(header, "%v", err)
+	}
+	return p.responsef(header, "The thread is no longer linked to %s.", link.IssueKey)
+}
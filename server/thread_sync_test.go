@@ -0,0 +1,145 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License for license information.
+
+package main
+
+import (
+	"testing"
+
+	jira "github.com/andygrunwald/go-jira"
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func makeTestCommentWebhook(eventType, commentID, body string) *webhook {
+	return &webhook{
+		JiraWebhook: &JiraWebhook{
+			Issue: jira.Issue{ID: "10000", Key: "TEST-1"},
+			Comment: jira.Comment{
+				ID:           commentID,
+				Body:         body,
+				UpdateAuthor: jira.User{DisplayName: "Jira User"},
+			},
+		},
+		eventTypes: NewStringSet(eventType),
+	}
+}
+
+func TestThreadSync(t *testing.T) {
+	setup := func(t *testing.T) (*Plugin, *plugintest.API, testKVStore) {
+		p, kv := setupTestWebhookQueue(t)
+		p.updateConfig(func(conf *config) {
+			conf.botUserID = "bot"
+		})
+		require.NoError(t, p.linkThread(&ThreadLink{
+			RootPostID:       "root1",
+			ChannelID:        "channel1",
+			InstanceID:       "jiraurl1",
+			IssueKey:         "TEST-1",
+			MattermostUserID: "user1",
+		}))
+		return p, p.API.(*plugintest.API), kv
+	}
+
+	t.Run("an issue is linked to one thread", func(t *testing.T) {
+		p, _, _ := setup(t)
+		err := p.linkThread(&ThreadLink{RootPostID: "root2", ChannelID: "channel1", InstanceID: "jiraurl1", IssueKey: "TEST-1"})
+		assert.Error(t, err)
+
+		link, err := p.loadThreadLinkByIssue("jiraurl1", "TEST-1")
+		require.NoError(t, err)
+		require.NotNil(t, link)
+		assert.Equal(t, "root1", link.RootPostID)
+
+		require.NoError(t, p.storeThreadComment(&ThreadComment{
+			InstanceID: "jiraurl1", IssueKey: "TEST-1", CommentID: "10", PostID: "post1", RootPostID: "root1",
+		}))
+		require.NoError(t, p.unlinkThread(link))
+		link, err = p.loadThreadLinkByIssue("jiraurl1", "TEST-1")
+		require.NoError(t, err)
+		assert.Nil(t, link)
+
+		tc, err := p.loadThreadCommentByComment("jiraurl1", "10")
+		require.NoError(t, err)
+		assert.Nil(t, tc)
+		tc, err = p.loadThreadCommentByPost("post1")
+		require.NoError(t, err)
+		assert.Nil(t, tc)
+	})
+
+	t.Run("comments of replies are not posted back", func(t *testing.T) {
+		p, _, _ := setup(t)
+		require.NoError(t, p.storeThreadComment(&ThreadComment{
+			InstanceID: "jiraurl1", IssueKey: "TEST-1", CommentID: "10", PostID: "post1", RootPostID: "root1", FromMattermost: true,
+		}))
+		require.NoError(t, p.syncThreadComment("jiraurl1", makeTestCommentWebhook(eventCreatedComment, "10", "hello")))
+
+		// The webhook of a comment is retried while replies are being added, as it may arrive
+		// before the comment ID of the reply is stored.
+		require.NoError(t, p.setThreadReplyPending("jiraurl1", "TEST-1", "post2", true))
+		assert.ErrorIs(t, p.syncThreadComment("jiraurl1", makeTestCommentWebhook(eventCreatedComment, "11", "reformatted")), errThreadRepliesPending)
+
+		require.NoError(t, p.storeThreadComment(&ThreadComment{
+			InstanceID: "jiraurl1", IssueKey: "TEST-1", CommentID: "11", PostID: "post2", RootPostID: "root1", FromMattermost: true,
+		}))
+		require.NoError(t, p.syncThreadComment("jiraurl1", makeTestCommentWebhook(eventCreatedComment, "11", "reformatted")))
+
+		require.NoError(t, p.setThreadReplyPending("jiraurl1", "TEST-1", "post2", false))
+		pending, err := p.hasPendingThreadReplies("jiraurl1", "TEST-1")
+		require.NoError(t, err)
+		assert.False(t, pending)
+	})
+
+	t.Run("edits and deletes are mirrored from Jira", func(t *testing.T) {
+		p, api, _ := setup(t)
+		require.NoError(t, p.storeThreadComment(&ThreadComment{
+			InstanceID: "jiraurl1", IssueKey: "TEST-1", CommentID: "10", PostID: "post1", RootPostID: "root1",
+		}))
+
+		api.On("GetPost", "post1").Return(&model.Post{Id: "post1", UserId: "bot", RootId: "root1"}, nil)
+		api.On("UpdatePost", mock.MatchedBy(func(post *model.Post) bool {
+			return post.Id == "post1" && post.Message == "Jira User **commented** in Jira:\nedited"
+		})).Return(&model.Post{}, nil).Once()
+		require.NoError(t, p.syncThreadComment("jiraurl1", makeTestCommentWebhook(eventUpdatedComment, "10", "edited")))
+
+		api.On("DeletePost", "post1").Return(nil).Once()
+		require.NoError(t, p.syncThreadComment("jiraurl1", makeTestCommentWebhook(eventDeletedComment, "10", "")))
+		api.AssertExpectations(t)
+
+		tc, err := p.loadThreadCommentByPost("post1")
+		require.NoError(t, err)
+		assert.Nil(t, tc)
+	})
+
+	t.Run("edits and deletes of replies are not mirrored from Jira", func(t *testing.T) {
+		p, _, _ := setup(t)
+		require.NoError(t, p.storeThreadComment(&ThreadComment{
+			InstanceID: "jiraurl1", IssueKey: "TEST-1", CommentID: "10", PostID: "post1", RootPostID: "root1", FromMattermost: true,
+		}))
+		require.NoError(t, p.syncThreadComment("jiraurl1", makeTestCommentWebhook(eventUpdatedComment, "10", "edited")))
+		require.NoError(t, p.syncThreadComment("jiraurl1", makeTestCommentWebhook(eventDeletedComment, "10", "")))
+
+		tc, err := p.loadThreadCommentByComment("jiraurl1", "10")
+		require.NoError(t, err)
+		assert.NotNil(t, tc)
+	})
+
+	t.Run("posts of the bot are not synced to Jira", func(t *testing.T) {
+		p, _, _ := setup(t)
+		require.NoError(t, p.syncThreadReply(&model.Post{Id: "post1", UserId: "bot", RootId: "root1", Message: "hello"}))
+		require.NoError(t, p.syncThreadReplyUpdate(
+			&model.Post{Id: "post1", UserId: "bot", RootId: "root1", Message: "edited"},
+			&model.Post{Id: "post1", UserId: "bot", RootId: "root1", Message: "hello"}))
+
+		require.NoError(t, p.storeThreadComment(&ThreadComment{
+			InstanceID: "jiraurl1", IssueKey: "TEST-1", CommentID: "10", PostID: "post1", RootPostID: "root1",
+		}))
+		require.NoError(t, p.syncThreadReplyDelete(&model.Post{Id: "post1", UserId: "bot", RootId: "root1"}))
+		tc, err := p.loadThreadCommentByComment("jiraurl1", "10")
+		require.NoError(t, err)
+		assert.Nil(t, tc)
+	})
+}
@@ -0,0 +1,219 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License for license information.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	jira "github.com/andygrunwald/go-jira"
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+	"github.com/mattermost/mattermost/server/public/pluginapi"
+	"github.com/mattermost/mattermost/server/public/pluginapi/cluster"
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-plugin-jira/server/utils/types"
+)
+
+const (
+	prefixWorkTimer = "timer_" // + Mattermost user ID, the running work timer of the user
+
+	workTimerReminderJobKey      = "work_timer_reminder"
+	workTimerReminderJobInterval = 5 * time.Minute
+)
+
+// WorkTimer is a running timer whose elapsed time is logged on the issue when it is stopped.
+type WorkTimer struct {
+	MattermostUserID string    `json:"mattermost_user_id"`
+	InstanceID       types.ID  `json:"instance_id"`
+	IssueKey         string    `json:"issue_key"`
+	StartedAt        time.Time `json:"started_at"`
+	RemindedAt       time.Time `json:"reminded_at,omitempty"`
+}
+
+func keyWorkTimer(mattermostUserID string) string {
+	return prefixWorkTimer + mattermostUserID
+}
+
+// workTimerGranularity is the duration the elapsed time of a timer is rounded to.
+func (p *Plugin) workTimerGranularity() time.Duration {
+	minutes := p.getConfig().WorkTimerRoundingMinutes
+	if minutes <= 0 {
+		minutes = 1
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// roundWorkTime rounds the elapsed time to the nearest multiple of the granularity, logging
+// at least one unit of it.
+func roundWorkTime(elapsed, granularity time.Duration) time.Duration {
+	rounded := elapsed.Round(granularity)
+	if rounded < granularity {
+		return granularity
+	}
+	return rounded
+}
+
+func (p *Plugin) loadWorkTimer(mattermostUserID string) (*WorkTimer, error) {
+	var timer *WorkTimer
+	if err := p.client.KV.Get(keyWorkTimer(mattermostUserID), &timer); err != nil {
+		return nil, errors.Wrap(err, "failed to load the work timer")
+	}
+	return timer, nil
+}
+
+// startWorkTimer stores a new timer, unless the user already has one running.
+func (p *Plugin) startWorkTimer(timer *WorkTimer) error {
+	saved, err := p.client.KV.Set(keyWorkTimer(timer.MattermostUserID), timer, pluginapi.SetAtomic(nil))
+	if err != nil {
+		return errors.Wrap(err, "failed to store the work timer")
+	}
+	if !saved {
+		running, err := p.loadWorkTimer(timer.MattermostUserID)
+		if err != nil || running == nil {
+			return errors.New("a timer is already running")
+		}
+		return errors.Errorf("a timer is already running on %s", running.IssueKey)
+	}
+	return nil
+}
+
+// stopWorkTimer logs the time elapsed since the timer was started on its issue and removes it.
+func (p *Plugin) stopWorkTimer(client Client, timer *WorkTimer, comment string, now time.Time) (time.Duration, error) {
+	spent := roundWorkTime(now.Sub(timer.StartedAt), p.workTimerGranularity())
+	started := jira.Time(timer.StartedAt)
+	_, _, err := client.createWorkLog(timer.IssueKey, &jira.WorklogRecord{
+		TimeSpentSeconds: int(spent.Seconds()),
+		Comment:          comment,
+		Started:          &started,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if err = p.client.KV.Delete(keyWorkTimer(timer.MattermostUserID)); err != nil {
+		return 0, errors.Wrap(err, "work was logged, but the timer could not be removed")
+	}
+	return spent, nil
+}
+
+// remindWorkTimers sends a DM to the users whose timer has been running for longer than
+// the configured number of hours. Each timer is reminded about once.
+func (p *Plugin) remindWorkTimers() {
+	hours := p.getConfig().WorkTimerReminderHours
+	if hours <= 0 {
+		return
+	}
+
+	keys, err := p.listKeysWithPrefix(prefixWorkTimer)
+	if err != nil {
+		p.errorf("Failed to list work timers: %v", err)
+		return
+	}
+
+	now := time.Now()
+	for _, key := range keys {
+		mattermostUserID := strings.TrimPrefix(key, prefixWorkTimer)
+		timer, err := p.loadWorkTimer(mattermostUserID)
+		if err != nil || timer == nil {
+			continue
+		}
+		if !timer.RemindedAt.IsZero() || now.Sub(timer.StartedAt) < time.Duration(hours)*time.Hour {
+			continue
+		}
+
+		reminded := *timer
+		reminded.RemindedAt = now
+		saved, err := p.client.KV.Set(key, &reminded, pluginapi.SetAtomic(timer))
+		if err != nil || !saved {
+			continue
+		}
+
+		_, err = p.CreateBotDMtoMMUserID(mattermostUserID,
+			"Your timer on %s has been running for %s. Use `/jira timer stop [comment]` to log the work.",
+			timer.IssueKey, formatWorklogDuration(int(now.Sub(timer.StartedAt).Seconds())))
+		if err != nil {
+			p.errorf("Failed to remind user %s of the work timer: %v", mattermostUserID, err)
+		}
+	}
+}
+
+func (p *Plugin) scheduleWorkTimerReminderJob() error {
+	job, err := cluster.Schedule(p.API, workTimerReminderJobKey, cluster.MakeWaitForInterval(workTimerReminderJobInterval), p.remindWorkTimers)
+	if err != nil {
+		return errors.Wrap(err, "failed to schedule work timer reminder job")
+	}
+	p.workTimerReminderJob = job
+	return nil
+}
+
+func executeTimerStart(p *Plugin, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	instanceURL, args, err := p.parseCommandFlagInstanceURL(args)
+	if err != nil {
+		return p.responsef(header, "Failed to load your connection to Jira. Error: %v.", err)
+	}
+	if len(args) != 1 {
+		return p.help(header)
+	}
+	issueKey := strings.ToUpper(args[0])
+
+	client, instance, _, err := p.getCommandClient(header, instanceURL)
+	if err != nil {
+		return p.responsef(header, "%v", err)
+	}
+	if _, err = client.GetIssue(issueKey, nil); err != nil {
+		return p.responsef(header, "Failed to load issue %s. Error: %v.", issueKey, err)
+	}
+
+	err = p.startWorkTimer(&WorkTimer{
+		MattermostUserID: header.UserId,
+		InstanceID:       instance.GetID(),
+		IssueKey:         issueKey,
+		StartedAt:        time.Now(),
+	})
+	if err != nil {
+		return p.responsef(header, "Failed to start the timer: %v. Stop it first with `/jira timer stop`.", err)
+	}
+
+	return p.responsef(header, "Timer started on [%s](%s/browse/%s).", issueKey, instance.GetJiraBaseURL(), issueKey)
+}
+
+func executeTimerStop(p *Plugin, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	timer, err := p.loadWorkTimer(header.UserId)
+	if err != nil {
+		return p.responsef(header, "%v", err)
+	}
+	if timer == nil {
+		return p.responsef(header, "You have no running timer. Start one with `/jira timer start [issue-key]`.")
+	}
+
+	client, instance, _, err := p.getClient(timer.InstanceID, types.ID(header.UserId))
+	if err != nil {
+		return p.responsef(header, "Failed load client. Error: %v.", err)
+	}
+
+	spent, err := p.stopWorkTimer(client, timer, strings.Join(args, " "), time.Now())
+	if err != nil {
+		return p.responsef(header, "Failed to log the work of the timer on %s. Error: %v.", timer.IssueKey, err)
+	}
+
+	issueLink := fmt.Sprintf("[%s](%v/browse/%v)", timer.IssueKey, instance.GetJiraBaseURL(), timer.IssueKey)
+	return p.responsef(header, "Timer stopped. A %s worklog for issue %s has been created.", formatWorklogDuration(int(spent.Seconds())), issueLink)
+}
+
+func executeTimerStatus(p *Plugin, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	timer, err := p.loadWorkTimer(header.UserId)
+	if err != nil {
+		return p.responsef(header, "%v", err)
+	}
+	if timer == nil {
+		return p.responsef(header, "You have no running timer.")
+	}
+
+	started := timer.StartedAt.In(p.userLocation(header.UserId)).Format("2006-01-02 15:04")
+	elapsed := formatWorklogDuration(int(time.Since(timer.StartedAt).Seconds()))
+	return p.responsef(header, "Your timer on %s has been running for %s, since %s.", timer.IssueKey, elapsed, started)
+}
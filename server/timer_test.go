@@ -0,0 +1,77 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License for license information.
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	jira "github.com/andygrunwald/go-jira"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type timerTestClient struct {
+	testClient
+	created map[string]*jira.WorklogRecord
+}
+
+func (client timerTestClient) createWorkLog(issueID string, record *jira.WorklogRecord) (*jira.WorklogRecord, *jira.Response, error) {
+	client.created[issueID] = record
+	return record, nil, nil
+}
+
+func TestRoundWorkTime(t *testing.T) {
+	for name, tc := range map[string]struct {
+		elapsed, granularity, expected time.Duration
+	}{
+		"minutes":              {elapsed: 42*time.Minute + 20*time.Second, granularity: time.Minute, expected: 42 * time.Minute},
+		"round down":           {elapsed: 37 * time.Minute, granularity: 15 * time.Minute, expected: 30 * time.Minute},
+		"round up":             {elapsed: 38 * time.Minute, granularity: 15 * time.Minute, expected: 45 * time.Minute},
+		"at least granularity": {elapsed: 10 * time.Second, granularity: 15 * time.Minute, expected: 15 * time.Minute},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, roundWorkTime(tc.elapsed, tc.granularity))
+		})
+	}
+}
+
+func TestWorkTimer(t *testing.T) {
+	p, kv := setupTestWebhookQueue(t)
+	p.updateConfig(func(conf *config) {
+		conf.WorkTimerRoundingMinutes = 15
+	})
+
+	startedAt := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	require.NoError(t, p.startWorkTimer(&WorkTimer{
+		MattermostUserID: "user1",
+		InstanceID:       "jiraurl1",
+		IssueKey:         "TEST-1",
+		StartedAt:        startedAt,
+	}))
+
+	stored := &WorkTimer{}
+	require.NoError(t, json.Unmarshal(kv[keyWorkTimer("user1")], stored))
+	assert.Equal(t, "TEST-1", stored.IssueKey)
+
+	timer, err := p.loadWorkTimer("user1")
+	require.NoError(t, err)
+	require.NotNil(t, timer)
+
+	client := timerTestClient{created: map[string]*jira.WorklogRecord{}}
+	spent, err := p.stopWorkTimer(client, timer, "pairing", startedAt.Add(52*time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, 45*time.Minute, spent)
+
+	record := client.created["TEST-1"]
+	require.NotNil(t, record)
+	assert.Equal(t, 45*60, record.TimeSpentSeconds)
+	assert.Equal(t, "pairing", record.Comment)
+	assert.Equal(t, startedAt, time.Time(*record.Started))
+
+	timer, err = p.loadWorkTimer("user1")
+	require.NoError(t, err)
+	assert.Nil(t, timer)
+}
@@ -0,0 +1,383 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License for license information.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	jira "github.com/andygrunwald/go-jira"
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-plugin-jira/server/utils/types"
+)
+
+const (
+	prefixUnfurlDisabled = "unfurl_off_" // + channel ID, set when the channel opted out of issue previews
+
+	// projectKeyPatternTTL is how long the project keys of an instance are reused before they
+	// are listed again, so that new projects are eventually recognized.
+	projectKeyPatternTTL = time.Hour
+
+	defaultIssueUnfurlMaxPerPost = 3
+
+	// issueUnfurlTimeout bounds the time a post waits for its previews, the issues that are
+	// not loaded in time are not previewed.
+	issueUnfurlTimeout = 2 * time.Second
+
+	// projectKeyListTimeout bounds the time a request waits for the projects to be listed.
+	projectKeyListTimeout = 30 * time.Second
+
+	projectKeyPatternCacheMaxSize = 1000
+)
+
+// issueKeyCandidateRegexp is a cheap check for anything that looks like an issue key, done
+// before any store or Jira call.
+var issueKeyCandidateRegexp = regexp.MustCompile(`[[:alpha:]][[:alnum:]_]*-[[:digit:]]+`)
+
+var issueBrowseURLRegexp = regexp.MustCompile(`/browse/([[:alpha:]][[:alnum:]_]*-[[:digit:]]+)\b`)
+
+type projectKeyPattern struct {
+	re        *regexp.Regexp
+	expiresAt time.Time
+	lastUsed  time.Time
+	building  bool
+	ready     chan struct{} // closed once the pattern was built the first time
+}
+
+// projectKeyPatternCache holds, per instance and user, a regexp matching the issue keys of the
+// projects the user can see. The patterns are built in the background, so that a slow Jira does
+// not hold back the posts.
+type projectKeyPatternCache struct {
+	lock     sync.Mutex
+	patterns map[string]*projectKeyPattern
+}
+
+func projectKeyPatternKey(instanceID, mattermostUserID types.ID) string {
+	return instanceID.String() + "/" + mattermostUserID.String()
+}
+
+// get returns the pattern of the user, building it if it is missing or expired. While a pattern
+// is built for the first time, get waits for it at most timeout, and returns nil if it is not
+// ready by then. An expired pattern is returned while it is built again.
+func (c *projectKeyPatternCache) get(instanceID, mattermostUserID types.ID, now time.Time, timeout time.Duration, build func() (*regexp.Regexp, error)) *regexp.Regexp {
+	key := projectKeyPatternKey(instanceID, mattermostUserID)
+	c.lock.Lock()
+	if c.patterns == nil {
+		c.patterns = map[string]*projectKeyPattern{}
+	}
+	pattern, ok := c.patterns[key]
+	if !ok {
+		c.makeRoom(now)
+		pattern = &projectKeyPattern{ready: make(chan struct{})}
+		c.patterns[key] = pattern
+	}
+	pattern.lastUsed = now
+	if !pattern.building && (!ok || now.After(pattern.expiresAt)) {
+		pattern.building = true
+		go c.build(pattern, build)
+	}
+	c.lock.Unlock()
+
+	select {
+	case <-pattern.ready:
+	case <-time.After(timeout):
+		return nil
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return pattern.re
+}
+
+// makeRoom drops the patterns not used for a while when the cache is full, or else the least
+// recently used one. Must be called with the lock held.
+func (c *projectKeyPatternCache) makeRoom(now time.Time) {
+	if len(c.patterns) < projectKeyPatternCacheMaxSize {
+		return
+	}
+
+	oldestKey := ""
+	for key, pattern := range c.patterns {
+		if now.Sub(pattern.lastUsed) > projectKeyPatternTTL {
+			delete(c.patterns, key)
+			continue
+		}
+		if oldestKey == "" || pattern.lastUsed.Before(c.patterns[oldestKey].lastUsed) {
+			oldestKey = key
+		}
+	}
+	if len(c.patterns) >= projectKeyPatternCacheMaxSize {
+		delete(c.patterns, oldestKey)
+	}
+}
+
+func (c *projectKeyPatternCache) build(pattern *projectKeyPattern, build func() (*regexp.Regexp, error)) {
+	re, err := build()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	pattern.building = false
+	if err == nil {
+		// On errors the previous pattern is kept, and built again on the next post.
+		pattern.re = re
+		pattern.expiresAt = time.Now().Add(projectKeyPatternTTL)
+	}
+	select {
+	case <-pattern.ready:
+	default:
+		close(pattern.ready)
+	}
+}
+
+// makeProjectKeyRegexp returns a regexp matching the issue keys of the projects, or nil when
+// there are no projects.
+func makeProjectKeyRegexp(projects jira.ProjectList) *regexp.Regexp {
+	var keys []string
+	for _, project := range projects {
+		if project.Key != "" {
+			keys = append(keys, regexp.QuoteMeta(project.Key))
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	return regexp.MustCompile(fmt.Sprintf(`(?i)\b(?:%s)-\d+\b`, join(keys, "|")))
+}
+
+// projectKeyRegexp returns the cached issue key pattern of the projects the user can see, listing
+// them with the client in the background when the pattern is missing or expired. It returns nil
+// if the projects are not listed within the timeout.
+func (p *Plugin) projectKeyRegexp(instanceID, mattermostUserID types.ID, client Client, timeout time.Duration) *regexp.Regexp {
+	return p.projectKeyPatterns.get(instanceID, mattermostUserID, time.Now(), timeout, func() (*regexp.Regexp, error) {
+		projects, err := client.ListProjects("", -1, false)
+		if err != nil {
+			p.errorf("Failed to list the projects of %s for issue keys: %v", instanceID, err)
+			return nil, err
+		}
+		return makeProjectKeyRegexp(projects), nil
+	})
+}
+
+// findIssueKeys returns the unique issue keys of the message, in order of appearance: the
+// keys of the projects matched by re, and the keys of the issue links of the instance.
+func findIssueKeys(message, baseURL string, re *regexp.Regexp, limit int) []string {
+	type match struct {
+		index int
+		key   string
+	}
+	var matches []match
+	if re != nil {
+		for _, loc := range re.FindAllStringIndex(message, -1) {
+			matches = append(matches, match{loc[0], message[loc[0]:loc[1]]})
+		}
+	}
+	if baseURL != "" {
+		for _, loc := range issueBrowseURLRegexp.FindAllStringSubmatchIndex(message, -1) {
+			if strings.HasSuffix(message[:loc[0]], baseURL) {
+				matches = append(matches, match{loc[2], message[loc[2]:loc[3]]})
+			}
+		}
+	}
+
+	keys := []string{}
+	seen := map[string]bool{}
+	for len(matches) > 0 && len(keys) < limit {
+		first := 0
+		for i := range matches {
+			if matches[i].index < matches[first].index {
+				first = i
+			}
+		}
+		key := strings.ToUpper(matches[first].key)
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+		matches = append(matches[:first], matches[first+1:]...)
+	}
+	return keys
+}
+
+func (p *Plugin) isUnfurlDisabled(channelID string) (bool, error) {
+	var disabled bool
+	if err := p.client.KV.Get(prefixUnfurlDisabled+channelID, &disabled); err != nil {
+		return false, errors.Wrap(err, "failed to load the issue preview setting of the channel")
+	}
+	return disabled, nil
+}
+
+func (p *Plugin) setUnfurlDisabled(channelID string, disabled bool) error {
+	if !disabled {
+		return p.client.KV.Delete(prefixUnfurlDisabled + channelID)
+	}
+	_, err := p.client.KV.Set(prefixUnfurlDisabled+channelID, true)
+	return err
+}
+
+// anonymousClient returns a client of the instance that is not signed in, which only sees the
+// issues Jira shows to anyone.
+func anonymousClient(instance Instance) (Client, error) {
+	jiraClient, err := jira.NewClient(&http.Client{Timeout: issueUnfurlTimeout}, instance.GetJiraBaseURL())
+	if err != nil {
+		return nil, err
+	}
+	if instance.Common().IsCloudInstance() {
+		return newCloudClient(jiraClient), nil
+	}
+	return newServerClient(jiraClient), nil
+}
+
+// loadIssues loads the issues concurrently. The issues that fail or are not loaded within the
+// timeout are nil, at the index of their key.
+func loadIssues(client Client, keys []string, timeout time.Duration) []*jira.Issue {
+	type loaded struct {
+		index int
+		issue *jira.Issue
+	}
+	results := make(chan loaded, len(keys))
+	for i, key := range keys {
+		go func(index int, key string) {
+			issue, err := client.GetIssue(key, nil)
+			if err != nil {
+				issue = nil
+			}
+			results <- loaded{index, issue}
+		}(i, key)
+	}
+
+	issues := make([]*jira.Issue, len(keys))
+	deadline := time.After(timeout)
+	for range keys {
+		select {
+		case r := <-results:
+			issues[r.index] = r.issue
+		case <-deadline:
+			return issues
+		}
+	}
+	return issues
+}
+
+// unfurlIssues returns the previews of the issues mentioned in the post. Everyone in the channel
+// sees them, so only the issues Jira shows to anonymous users are previewed with their details,
+// the other issues the author can see only with their key.
+func (p *Plugin) unfurlIssues(post *model.Post) ([]*model.SlackAttachment, error) {
+	conf := p.getConfig()
+	if !conf.EnableIssueUnfurl || post.Type != "" || post.UserId == conf.botUserID ||
+		post.GetProp("from_webhook") == "true" || post.GetProp("from_bot") == "true" ||
+		len(post.Attachments()) > 0 || !issueKeyCandidateRegexp.MatchString(post.Message) {
+		return nil, nil
+	}
+
+	disabled, err := p.isUnfurlDisabled(post.ChannelId)
+	if err != nil || disabled {
+		return nil, err
+	}
+
+	mattermostUserID := types.ID(post.UserId)
+	_, instanceID, err := p.ResolveUserInstanceURL(mattermostUserID, "")
+	if err != nil {
+		// Not connected, the issues are not previewed.
+		return nil, nil
+	}
+	client, instance, _, err := p.getClient(instanceID, mattermostUserID)
+	if err != nil {
+		return nil, nil
+	}
+
+	// The project keys and the issues share the timeout, only the issue links are previewed
+	// while the project keys are listed.
+	deadline := time.Now().Add(issueUnfurlTimeout)
+	re := p.projectKeyRegexp(instanceID, mattermostUserID, client, issueUnfurlTimeout)
+	limit := conf.IssueUnfurlMaxPerPost
+	if limit <= 0 {
+		limit = defaultIssueUnfurlMaxPerPost
+	}
+	keys := findIssueKeys(post.Message, instance.GetJiraBaseURL(), re, limit)
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	anonymous, err := anonymousClient(instance)
+	if err != nil {
+		return nil, err
+	}
+	var public []*jira.Issue
+	loaded := make(chan struct{})
+	go func() {
+		public = loadIssues(anonymous, keys, time.Until(deadline))
+		close(loaded)
+	}()
+	visible := loadIssues(client, keys, time.Until(deadline))
+	<-loaded
+
+	return makeUnfurlAttachments(instance, keys, public, visible), nil
+}
+
+func makeUnfurlAttachments(instance Instance, keys []string, public, visible []*jira.Issue) []*model.SlackAttachment {
+	var attachments []*model.SlackAttachment
+	for i := range keys {
+		switch {
+		case public[i] != nil:
+			attachments = append(attachments, asCompactSlackAttachment(instance, public[i]))
+		case visible[i] != nil:
+			attachments = append(attachments, asIssueKeySlackAttachment(instance, visible[i].Key))
+		}
+	}
+	return attachments
+}
+
+// MessageWillBePosted attaches the previews of the mentioned issues to the post.
+func (p *Plugin) MessageWillBePosted(c *plugin.Context, post *model.Post) (*model.Post, string) {
+	attachments, err := p.unfurlIssues(post)
+	if err != nil {
+		p.errorf("Failed to unfurl the issues of a post in channel %s: %v", post.ChannelId, err)
+		return nil, ""
+	}
+	if len(attachments) == 0 {
+		return nil, ""
+	}
+
+	model.ParseSlackAttachment(post, attachments)
+	return post, ""
+}
+
+func (p *Plugin) hasPermissionToManageChannel(userID, channelID string) bool {
+	channel, err := p.client.Channel.Get(channelID)
+	if err != nil {
+		return false
+	}
+	switch channel.Type {
+	case model.ChannelTypeOpen:
+		return p.client.User.HasPermissionToChannel(userID, channelID, model.PermissionManagePublicChannelProperties)
+	case model.ChannelTypePrivate:
+		return p.client.User.HasPermissionToChannel(userID, channelID, model.PermissionManagePrivateChannelProperties)
+	default:
+		// Direct and group messages have no admins, every member manages them.
+		return p.client.User.HasPermissionToChannel(userID, channelID, model.PermissionReadChannel)
+	}
+}
+
+func executeUnfurl(p *Plugin, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	if len(args) != 1 || (args[0] != "on" && args[0] != "off") {
+		return p.help(header)
+	}
+	if !p.hasPermissionToManageChannel(header.UserId, header.ChannelId) {
+		return p.responsef(header, "You do not have permission to change the issue previews of this channel.")
+	}
+
+	if err := p.setUnfurlDisabled(header.ChannelId, args[0] == "off"); err != nil {
+		return p.responsef(header, "Failed to change the issue previews of this channel: %v.", err)
+	}
+	if args[0] == "off" {
+		return p.responsef(header, "Jira issues mentioned in this channel will no longer be previewed.")
+	}
+	return p.responsef(header, "Jira issues mentioned in this channel will be previewed.")
+}
@@ -0,0 +1,128 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License for license information.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	jira "github.com/andygrunwald/go-jira"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mattermost/mattermost-plugin-jira/server/utils/types"
+)
+
+func makeTestProjectKeyRegexp(t *testing.T) *regexp.Regexp {
+	projects := jira.ProjectList{}
+	require.NoError(t, json.Unmarshal([]byte(`[{"key": "API"}, {"key": "WEB"}, {"key": ""}]`), &projects))
+	re := makeProjectKeyRegexp(projects)
+	require.NotNil(t, re)
+	return re
+}
+
+func TestMakeProjectKeyRegexp(t *testing.T) {
+	assert.Nil(t, makeProjectKeyRegexp(nil))
+
+	re := makeTestProjectKeyRegexp(t)
+	assert.Equal(t, []string{"API-1", "web-22"}, re.FindAllString("API-1, web-22 and OTHER-3, XAPI-4", -1))
+}
+
+func TestFindIssueKeys(t *testing.T) {
+	re := makeTestProjectKeyRegexp(t)
+	baseURL := "https://jira.example.com"
+
+	for name, tc := range map[string]struct {
+		message  string
+		limit    int
+		expected []string
+	}{
+		"none":          {message: "nothing to see", limit: 3, expected: []string{}},
+		"keys":          {message: "see API-1 and web-2", limit: 3, expected: []string{"API-1", "WEB-2"}},
+		"unique":        {message: "API-1, api-1 and API-1", limit: 3, expected: []string{"API-1"}},
+		"unknown":       {message: "OTHER-1 is not a project", limit: 3, expected: []string{}},
+		"limit":         {message: "API-1 API-2 API-3 API-4", limit: 2, expected: []string{"API-1", "API-2"}},
+		"link":          {message: "look at https://jira.example.com/browse/OTHER-5 first, then API-1", limit: 3, expected: []string{"OTHER-5", "API-1"}},
+		"foreign link":  {message: "https://elsewhere.com/browse/OTHER-5", limit: 3, expected: []string{}},
+		"link and key":  {message: "API-1 https://jira.example.com/browse/API-1", limit: 3, expected: []string{"API-1"}},
+		"no project re": {message: "API-1", limit: 3, expected: []string{}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			projectRe := re
+			if name == "no project re" {
+				projectRe = nil
+			}
+			assert.Equal(t, tc.expected, findIssueKeys(tc.message, baseURL, projectRe, tc.limit))
+		})
+	}
+}
+
+func TestProjectKeyPatternCache(t *testing.T) {
+	cache := projectKeyPatternCache{}
+	now := time.Now()
+	instanceID := types.ID("https://jira.example.com")
+	re := makeTestProjectKeyRegexp(t)
+
+	// A slow Jira does not hold back the caller, the pattern is used once it is built.
+	release := make(chan struct{})
+	var builds int32
+	build := func() (*regexp.Regexp, error) {
+		atomic.AddInt32(&builds, 1)
+		<-release
+		return re, nil
+	}
+	assert.Nil(t, cache.get(instanceID, "user1", now, time.Millisecond, build))
+	close(release)
+	assert.Equal(t, re, cache.get(instanceID, "user1", now, time.Second, build))
+	assert.Equal(t, re, cache.get(instanceID, "user1", now.Add(time.Minute), time.Second, build))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&builds))
+
+	// The patterns are kept per user, who may see different projects.
+	assert.Nil(t, cache.get(instanceID, "user2", now, time.Second, func() (*regexp.Regexp, error) {
+		return nil, nil
+	}))
+
+	// An expired pattern is used while it is built again.
+	assert.Equal(t, re, cache.get(instanceID, "user1", now.Add(projectKeyPatternTTL+time.Minute), time.Second, build))
+	assert.Eventually(t, func() bool {
+		cache.lock.Lock()
+		defer cache.lock.Unlock()
+		return atomic.LoadInt32(&builds) == 2 && !cache.patterns[projectKeyPatternKey(instanceID, "user1")].building
+	}, time.Second, time.Millisecond)
+}
+
+func TestProjectKeyPatternCacheMaxSize(t *testing.T) {
+	cache := projectKeyPatternCache{}
+	now := time.Now()
+	build := func() (*regexp.Regexp, error) {
+		return nil, nil
+	}
+	for i := 0; i < projectKeyPatternCacheMaxSize+10; i++ {
+		cache.get("https://jira.example.com", types.ID(fmt.Sprintf("user%d", i)), now.Add(time.Duration(i)*time.Millisecond), 0, build)
+	}
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	assert.Len(t, cache.patterns, projectKeyPatternCacheMaxSize)
+	assert.NotContains(t, cache.patterns, projectKeyPatternKey("https://jira.example.com", "user0"))
+}
+
+func TestMakeUnfurlAttachments(t *testing.T) {
+	issue := func(key string) *jira.Issue {
+		return &jira.Issue{Key: key, Fields: &jira.IssueFields{Summary: "Summary of " + key}}
+	}
+	keys := []string{"API-1", "API-2", "API-3"}
+	public := []*jira.Issue{issue("API-1"), nil, nil}
+	visible := []*jira.Issue{issue("API-1"), issue("API-2"), nil}
+
+	attachments := makeUnfurlAttachments(testInstance1, keys, public, visible)
+	require.Len(t, attachments, 2)
+	assert.Equal(t, "API-1: Summary of API-1", attachments[0].Title)
+	assert.Equal(t, "API-2", attachments[1].Title, "issues not shown to anonymous users are previewed without details")
+	assert.NotContains(t, attachments[1].Text, "Summary of API-2")
+}
@@ -49,6 +49,15 @@ func (c *Connection) JiraAccountID() types.ID {
 type ConnectionSettings struct {
 	Notifications         bool `json:"notifications"`
 	DisplayHiddenMessages bool `json:"displayHiddenMessages"`
+
+	// MutedEvents are the kinds of notifications the user turned off.
+	MutedEvents []string `json:"muted_events,omitempty"`
+	// MutedProjects are the keys of the projects the user gets no notifications for.
+	MutedProjects []string `json:"muted_projects,omitempty"`
+	// QuietHours hold notifications back until they end.
+	QuietHours *QuietHours `json:"quiet_hours,omitempty"`
+	// NotificationDigest, if set, sends the notifications together on its schedule instead of right away.
+	NotificationDigest *DigestSchedule `json:"notification_digest,omitempty"`
 }
 
 func boolSettingsToString(value bool) string {
@@ -59,7 +68,23 @@ func boolSettingsToString(value bool) string {
 }
 
 func (s *ConnectionSettings) String() string {
-	return fmt.Sprintf("\tNotifications: %s\n\tDisplay hidden messages: %s", boolSettingsToString(s.Notifications), boolSettingsToString(s.DisplayHiddenMessages))
+	if s == nil {
+		s = &ConnectionSettings{}
+	}
+	text := fmt.Sprintf("\tNotifications: %s\n\tDisplay hidden messages: %s", boolSettingsToString(s.Notifications), boolSettingsToString(s.DisplayHiddenMessages))
+	if len(s.MutedEvents) > 0 {
+		text += fmt.Sprintf("\n\tMuted events: %s", strings.Join(s.MutedEvents, ", "))
+	}
+	if len(s.MutedProjects) > 0 {
+		text += fmt.Sprintf("\n\tMuted projects: %s", strings.Join(s.MutedProjects, ", "))
+	}
+	if s.QuietHours != nil {
+		text += fmt.Sprintf("\n\tQuiet hours: %s", s.QuietHours.String())
+	}
+	if s.NotificationDigest != nil {
+		text += fmt.Sprintf("\n\tNotification digest: %s", s.NotificationDigest.String())
+	}
+	return text
 }
 
 func NewUser(mattermostUserID types.ID) *User {
@@ -76,10 +101,10 @@ func (p *Plugin) httpUserConnect(w http.ResponseWriter, r *http.Request, instanc
 		return respondErr(w, http.StatusInternalServerError, err)
 	}
 
-	// Users shouldn't be able to make multiple connections.
+	// Users shouldn't be able to make multiple connections, unless their token stopped working.
 	// TODO <> this block needs to be updated. Though idk if this route will still get called?
 	connection, err := p.userStore.LoadConnection(instance.GetID(), types.ID(mattermostUserID))
-	if err == nil && len(connection.JiraAccountID()) != 0 {
+	if err == nil && len(connection.JiraAccountID()) != 0 && !p.isConnectionBroken(instance.GetID(), types.ID(mattermostUserID)) {
 		return respondErr(w, http.StatusBadRequest,
 			errors.New("you already have a Jira account linked to your Mattermost account. Please use `/jira disconnect` to disconnect"))
 	}
@@ -226,6 +251,7 @@ func (p *Plugin) connectUser(instance Instance, mattermostUserID types.ID, conne
 	if err != nil {
 		return err
 	}
+	p.clearConnectionHealth(instance.GetID(), mattermostUserID)
 
 	_ = p.setupFlow.ForUser(string(mattermostUserID)).Go(stepConnected)
 
@@ -270,6 +296,8 @@ func (p *Plugin) disconnectUser(instance Instance, user *User) (*Connection, err
 	if err != nil && errors.Cause(err) != kvstore.ErrNotFound {
 		return nil, err
 	}
+	p.oauth2Clients.remove(instance.GetID(), user.MattermostUserID)
+	p.clearConnectionHealth(instance.GetID(), user.MattermostUserID)
 	err = p.userStore.StoreUser(user)
 	if err != nil {
 		return nil, err
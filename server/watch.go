@@ -0,0 +1,315 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License for license information.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	jira "github.com/andygrunwald/go-jira"
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-plugin-jira/server/utils/types"
+)
+
+const (
+	prefixIssueWatchers = "watchers_" // + hash of instance ID and issue ID, the users watching the issue from Mattermost
+	prefixWatchedIssues = "watching_" // + hash of instance ID and user ID, the issues the user watches from Mattermost
+)
+
+// IssueWatchers are the Mattermost users who get a DM for every change of an issue.
+type IssueWatchers struct {
+	IssueID           string     `json:"issue_id"`
+	IssueKey          string     `json:"issue_key"`
+	MattermostUserIDs []types.ID `json:"mattermost_user_ids"`
+}
+
+// WatchedIssues are the issues a Mattermost user watches, by issue ID.
+type WatchedIssues struct {
+	IssueKeys map[string]string `json:"issue_keys"`
+}
+
+func keyIssueWatchers(instanceID types.ID, issueID string) string {
+	return hashkey(prefixIssueWatchers, instanceID.String()+"/"+issueID)
+}
+
+func keyWatchedIssues(instanceID, mattermostUserID types.ID) string {
+	return hashkey(prefixWatchedIssues, instanceID.String()+"/"+mattermostUserID.String())
+}
+
+func (p *Plugin) loadIssueWatchers(instanceID types.ID, issueID string) (*IssueWatchers, error) {
+	watchers := &IssueWatchers{}
+	if err := p.client.KV.Get(keyIssueWatchers(instanceID, issueID), watchers); err != nil {
+		return nil, errors.WithMessage(err, "failed to load the watchers of the issue")
+	}
+	return watchers, nil
+}
+
+func (p *Plugin) loadWatchedIssues(instanceID, mattermostUserID types.ID) (*WatchedIssues, error) {
+	watched := &WatchedIssues{}
+	if err := p.client.KV.Get(keyWatchedIssues(instanceID, mattermostUserID), watched); err != nil {
+		return nil, errors.WithMessage(err, "failed to load the watched issues")
+	}
+	if watched.IssueKeys == nil {
+		watched.IssueKeys = map[string]string{}
+	}
+	return watched, nil
+}
+
+// storeIssueWatch adds or removes a user from the watchers of an issue, and the issue from the
+// issues watched by the user.
+func (p *Plugin) storeIssueWatch(instanceID, mattermostUserID types.ID, issueID, issueKey string, watch bool) error {
+	err := p.client.KV.SetAtomicWithRetries(keyIssueWatchers(instanceID, issueID), func(initialBytes []byte) (interface{}, error) {
+		watchers := &IssueWatchers{}
+		if len(initialBytes) > 0 {
+			if err := json.Unmarshal(initialBytes, watchers); err != nil {
+				return nil, err
+			}
+		}
+		watchers.IssueID = issueID
+		watchers.IssueKey = issueKey
+
+		var userIDs []types.ID
+		for _, userID := range watchers.MattermostUserIDs {
+			if userID != mattermostUserID {
+				userIDs = append(userIDs, userID)
+			}
+		}
+		if watch {
+			userIDs = append(userIDs, mattermostUserID)
+		}
+		if len(userIDs) == 0 {
+			return nil, nil
+		}
+		watchers.MattermostUserIDs = userIDs
+		return watchers, nil
+	})
+	if err != nil {
+		return errors.WithMessage(err, "failed to store the watchers of the issue")
+	}
+
+	err = p.client.KV.SetAtomicWithRetries(keyWatchedIssues(instanceID, mattermostUserID), func(initialBytes []byte) (interface{}, error) {
+		watched := &WatchedIssues{IssueKeys: map[string]string{}}
+		if len(initialBytes) > 0 {
+			if err := json.Unmarshal(initialBytes, watched); err != nil {
+				return nil, err
+			}
+		}
+		if watched.IssueKeys == nil {
+			watched.IssueKeys = map[string]string{}
+		}
+		if watch {
+			watched.IssueKeys[issueID] = issueKey
+		} else {
+			delete(watched.IssueKeys, issueID)
+		}
+		if len(watched.IssueKeys) == 0 {
+			return nil, nil
+		}
+		return watched, nil
+	})
+	if err != nil {
+		return errors.WithMessage(err, "failed to store the watched issues")
+	}
+	return nil
+}
+
+// WatchIssue makes the user watch the issue in Jira, and sends the user a DM for its changes.
+func (p *Plugin) WatchIssue(client Client, instanceID types.ID, connection *Connection, issue *jira.Issue, watch bool) error {
+	var err error
+	if watch {
+		err = client.AddWatcher(issue.Key, &connection.User)
+	} else {
+		err = client.RemoveWatcher(issue.Key, &connection.User)
+	}
+	if err != nil {
+		return err
+	}
+	p.issueCache.invalidate(instanceID, issue.ID, issue.Key)
+
+	return p.storeIssueWatch(instanceID, connection.MattermostUserID, issue.ID, issue.Key, watch)
+}
+
+// appendWatcherNotifications replaces the notifications to the watchers of the issue with one
+// for each user watching it, from Mattermost or in Jira. Without such notifications, the users
+// watching the issue from Mattermost get the headline of every change. PostNotifications skips
+// watchers who already get a notification, or who made the change.
+func (p *Plugin) appendWatcherNotifications(wh *webhook, instance Instance) {
+	var notifications, toWatchers []webhookUserNotification
+	for _, notification := range wh.notifications {
+		if notification.watchers {
+			toWatchers = append(toWatchers, notification)
+		} else {
+			notifications = append(notifications, notification)
+		}
+	}
+	wh.notifications = notifications
+	if wh.Issue.ID == "" {
+		return
+	}
+
+	var jiraWatchers []jira.User
+	if len(toWatchers) > 0 {
+		jiraWatchers = p.loadJiraWatchers(wh, instance)
+	} else {
+		if wh.headline == "" {
+			return
+		}
+		message := wh.headline
+		if wh.text != "" {
+			message += "\n" + wh.text
+		}
+		toWatchers = append(toWatchers, webhookUserNotification{
+			message:     message,
+			commentSelf: wh.Comment.Self,
+			kind:        notificationKindWatching,
+		})
+	}
+
+	watchers, err := p.loadIssueWatchers(instance.GetID(), wh.Issue.ID)
+	if err != nil {
+		p.errorf("appendWatcherNotifications: %v", err)
+		watchers = &IssueWatchers{}
+	}
+
+	for _, template := range toWatchers {
+		template.watchers = false
+		for _, mattermostUserID := range watchers.MattermostUserIDs {
+			notification := template
+			notification.mattermostUserID = mattermostUserID
+			wh.notifications = append(wh.notifications, notification)
+		}
+		for _, user := range jiraWatchers {
+			notification := template
+			notification.jiraAccountID = user.AccountID
+			notification.jiraUsername = user.Name
+			wh.notifications = append(wh.notifications, notification)
+		}
+	}
+}
+
+// loadJiraWatchers returns the watchers of the issue in Jira. They are only visible to Jira users,
+// so they are loaded with the connection of the user who made the change, or else of the reporter.
+func (p *Plugin) loadJiraWatchers(wh *webhook, instance Instance) []jira.User {
+	users := []*jira.User{&wh.User}
+	if wh.Issue.Fields != nil && wh.Issue.Fields.Reporter != nil {
+		users = append(users, wh.Issue.Fields.Reporter)
+	}
+
+	for _, user := range users {
+		jiraUserID := user.AccountID
+		if jiraUserID == "" {
+			jiraUserID = user.Name
+		}
+		if jiraUserID == "" {
+			continue
+		}
+		mattermostUserID, err := p.userStore.LoadMattermostUserID(instance.GetID(), jiraUserID)
+		if err != nil {
+			continue
+		}
+		connection, err := p.userStore.LoadConnection(instance.GetID(), mattermostUserID)
+		if err != nil {
+			continue
+		}
+		client, err := instance.GetClient(connection)
+		if err != nil {
+			continue
+		}
+		watchers, err := client.GetWatchers(wh.Issue.Key)
+		if err != nil {
+			p.debugf("loadJiraWatchers: failed to load the watchers of %s: %v", wh.Issue.Key, err)
+			continue
+		}
+		return watchers
+	}
+	return nil
+}
+
+func (p *Plugin) loadWatchCommandIssue(header *model.CommandArgs, args []string) (Client, Instance, *Connection, *jira.Issue, *model.CommandResponse) {
+	instanceURL, args, err := p.parseCommandFlagInstanceURL(args)
+	if err != nil {
+		return nil, nil, nil, nil, p.responsef(header, "Failed to load your connection to Jira. Error: %v.", err)
+	}
+	if len(args) != 1 {
+		return nil, nil, nil, nil, p.help(header)
+	}
+	issueKey := strings.ToUpper(args[0])
+
+	client, instance, connection, err := p.getCommandClient(header, instanceURL)
+	if err != nil {
+		return nil, nil, nil, nil, p.responsef(header, "%v", err)
+	}
+	issue, err := client.GetIssue(issueKey, nil)
+	if err != nil {
+		return nil, nil, nil, nil, p.responsef(header, "Failed to load issue %s. Error: %v.", issueKey, err)
+	}
+	return client, instance, connection, issue, nil
+}
+
+func executeWatch(p *Plugin, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	client, instance, connection, issue, resp := p.loadWatchCommandIssue(header, args)
+	if resp != nil {
+		return resp
+	}
+	if err := p.WatchIssue(client, instance.GetID(), connection, issue, true); err != nil {
+		return p.responsef(header, "Failed to watch %s. Error: %v.", issue.Key, err)
+	}
+
+	msg := fmt.Sprintf("You are now watching [%s](%s/browse/%s), its changes will be sent to you as direct messages.",
+		issue.Key, instance.GetJiraBaseURL(), issue.Key)
+	if connection.Settings == nil || !connection.Settings.Notifications {
+		msg += " Turn your notifications on with `/jira instance settings notifications on` to receive them."
+	}
+	return p.responsef(header, "%s", msg)
+}
+
+func executeUnwatch(p *Plugin, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	client, instance, connection, issue, resp := p.loadWatchCommandIssue(header, args)
+	if resp != nil {
+		return resp
+	}
+	if err := p.WatchIssue(client, instance.GetID(), connection, issue, false); err != nil {
+		return p.responsef(header, "Failed to stop watching %s. Error: %v.", issue.Key, err)
+	}
+	return p.responsef(header, "You stopped watching [%s](%s/browse/%s).", issue.Key, instance.GetJiraBaseURL(), issue.Key)
+}
+
+func executeWatching(p *Plugin, c *plugin.Context, header *model.CommandArgs, args ...string) *model.CommandResponse {
+	instanceURL, args, err := p.parseCommandFlagInstanceURL(args)
+	if err != nil {
+		return p.responsef(header, "Failed to load your connection to Jira. Error: %v.", err)
+	}
+	if len(args) != 0 {
+		return p.help(header)
+	}
+	_, instance, _, err := p.getCommandClient(header, instanceURL)
+	if err != nil {
+		return p.responsef(header, "%v", err)
+	}
+
+	watched, err := p.loadWatchedIssues(instance.GetID(), types.ID(header.UserId))
+	if err != nil {
+		return p.responsef(header, "%v", err)
+	}
+	if len(watched.IssueKeys) == 0 {
+		return p.responsef(header, "You are not watching any issues. Watch one with `/jira watch <issue-key>`.")
+	}
+
+	var keys []string
+	for _, key := range watched.IssueKeys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	text := "You are watching:\n"
+	for _, key := range keys {
+		text += fmt.Sprintf("* [%s](%s/browse/%s)\n", key, instance.GetJiraBaseURL(), key)
+	}
+	return p.responsef(header, "%s", text)
+}
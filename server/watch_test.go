@@ -0,0 +1,86 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License for license information.
+
+package main
+
+import (
+	"testing"
+
+	jira "github.com/andygrunwald/go-jira"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mattermost/mattermost-plugin-jira/server/utils/types"
+)
+
+func TestStoreIssueWatch(t *testing.T) {
+	p, _ := setupTestWebhookQueue(t)
+
+	require.NoError(t, p.storeIssueWatch("jiraurl1", "user1", "10000", "TEST-1", true))
+	require.NoError(t, p.storeIssueWatch("jiraurl1", "user2", "10000", "TEST-1", true))
+	require.NoError(t, p.storeIssueWatch("jiraurl1", "user1", "10001", "TEST-2", true))
+	require.NoError(t, p.storeIssueWatch("jiraurl1", "user1", "10000", "TEST-1", true))
+
+	watchers, err := p.loadIssueWatchers("jiraurl1", "10000")
+	require.NoError(t, err)
+	assert.Equal(t, []types.ID{"user2", "user1"}, watchers.MattermostUserIDs)
+
+	watched, err := p.loadWatchedIssues("jiraurl1", "user1")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"10000": "TEST-1", "10001": "TEST-2"}, watched.IssueKeys)
+
+	require.NoError(t, p.storeIssueWatch("jiraurl1", "user1", "10000", "TEST-1", false))
+	require.NoError(t, p.storeIssueWatch("jiraurl1", "user2", "10000", "TEST-1", false))
+	watchers, err = p.loadIssueWatchers("jiraurl1", "10000")
+	require.NoError(t, err)
+	assert.Empty(t, watchers.MattermostUserIDs)
+	watched, err = p.loadWatchedIssues("jiraurl1", "user1")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"10001": "TEST-2"}, watched.IssueKeys)
+}
+
+func TestAppendWatcherNotifications(t *testing.T) {
+	p, _ := setupTestWebhookQueue(t)
+	p.userStore = mockUserStore{}
+	require.NoError(t, p.storeIssueWatch(testInstance1.GetID(), "user1", "10000", "TEST-1", true))
+
+	t.Run("every change", func(t *testing.T) {
+		wh := &webhook{
+			JiraWebhook: &JiraWebhook{Issue: jira.Issue{ID: "10000", Key: "TEST-1"}},
+			headline:    "Jira User **transitioned** TEST-1",
+			text:        "from To Do to Done",
+		}
+		p.appendWatcherNotifications(wh, testInstance1)
+		require.Len(t, wh.notifications, 1)
+		assert.Equal(t, types.ID("user1"), wh.notifications[0].mattermostUserID)
+		assert.Equal(t, "Jira User **transitioned** TEST-1\nfrom To Do to Done", wh.notifications[0].message)
+
+		other := &webhook{
+			JiraWebhook: &JiraWebhook{Issue: jira.Issue{ID: "10001", Key: "TEST-2"}},
+			headline:    "Jira User **transitioned** TEST-2",
+		}
+		p.appendWatcherNotifications(other, testInstance1)
+		assert.Empty(t, other.notifications)
+	})
+
+	t.Run("status change", func(t *testing.T) {
+		wh := &webhook{
+			JiraWebhook: &JiraWebhook{
+				User:  jira.User{AccountID: "author"},
+				Issue: jira.Issue{ID: "10000", Key: "TEST-1"},
+			},
+			headline: "Jira User **updated** TEST-1",
+		}
+		appendNotificationsForStatusChange(wh, "Jira User **resolved** TEST-1 as `Done`")
+		p.appendWatcherNotifications(wh, testInstance1)
+
+		require.Len(t, wh.notifications, 2)
+		for _, notification := range wh.notifications {
+			assert.False(t, notification.watchers)
+			assert.Equal(t, "Jira User **resolved** TEST-1 as `Done`", notification.message)
+			assert.Equal(t, notificationKindWatching, notification.kind)
+		}
+		assert.Equal(t, types.ID("user1"), wh.notifications[0].mattermostUserID)
+		assert.Equal(t, "jiraWatcher", wh.notifications[1].jiraAccountID)
+	})
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/pkg/errors"
 
@@ -54,6 +55,16 @@ type webhookUserNotification struct {
 	message       string
 	postType      string
 	commentSelf   string
+
+	// mattermostUserID is set instead of the Jira user for the users watching the issue.
+	mattermostUserID types.ID
+
+	// watchers is set instead of a user for a notification to all the watchers of the issue,
+	// replaced by one notification per watcher before it is sent.
+	watchers bool
+
+	// kind is one of the notificationKind values users can turn off.
+	kind string
 }
 
 func (wh *webhook) Events() StringSet {
@@ -99,31 +110,46 @@ func (wh webhook) PostToChannel(p *Plugin, instanceID types.ID, channelID, fromU
 }
 
 func (wh *webhook) PostNotifications(p *Plugin, instanceID types.ID) ([]*model.Post, int, error) {
-	if len(wh.notifications) == 0 {
-		return nil, http.StatusOK, nil
-	}
+	posts, _, _ := wh.postUserNotifications(p, instanceID, nil)
+	return posts, http.StatusOK, nil
+}
 
+// postUserNotifications notifies the users of the change, except the ones already notified. It
+// returns the users notified so far, and an error if some of them could not be notified.
+func (wh *webhook) postUserNotifications(p *Plugin, instanceID types.ID, alreadyNotified StringSet) ([]*model.Post, StringSet, error) {
 	// We will only send webhook events if we have a connected instance.
 	instance, err := p.instanceStore.LoadInstance(instanceID)
 	if err != nil {
 		// This isn't an internal server error. There's just no instance installed.
-		return nil, http.StatusOK, nil
+		return nil, alreadyNotified, nil
 	}
 
+	p.appendWatcherNotifications(wh, instance)
+	if len(wh.notifications) == 0 {
+		return nil, alreadyNotified, nil
+	}
+	sortNotificationsByKind(wh.notifications)
+
 	posts := []*model.Post{}
+	notified := map[types.ID]bool{}
+	failed := 0
 	for _, notification := range wh.notifications {
-		var mattermostUserID types.ID
+		mattermostUserID := notification.mattermostUserID
 		var err error
 
 		// prefer accountId to username when looking up UserIds
-		if notification.jiraAccountID != "" {
+		if mattermostUserID == "" && notification.jiraAccountID != "" {
 			mattermostUserID, err = p.userStore.LoadMattermostUserID(instance.GetID(), notification.jiraAccountID)
-		} else {
+		} else if mattermostUserID == "" {
 			mattermostUserID, err = p.userStore.LoadMattermostUserID(instance.GetID(), notification.jiraUsername)
 		}
 		if err != nil {
 			continue
 		}
+		// A user gets a single notification per change, the one of the kind that concerns them most.
+		if notified[mattermostUserID] || alreadyNotified.ContainsAny(mattermostUserID.String()) {
+			continue
+		}
 
 		// Check if the user has permissions.
 		c, err2 := p.userStore.LoadConnection(instance.GetID(), mattermostUserID)
@@ -131,6 +157,15 @@ func (wh *webhook) PostNotifications(p *Plugin, instanceID types.ID) ([]*model.P
 			// Not connected to Jira, so can't check permissions
 			continue
 		}
+		// Users are not notified of their own changes.
+		if (c.AccountID != "" && c.AccountID == wh.User.AccountID) || (c.Name != "" && c.Name == wh.User.Name) {
+			continue
+		}
+		if !c.Settings.AllowsNotification(notification.kind, wh.projectKey()) {
+			continue
+		}
+		notified[mattermostUserID] = true
+
 		client, err2 := instance.GetClient(c)
 		if err2 != nil {
 			p.errorf("PostNotifications: error while getting jiraClient, err: %v", err2)
@@ -147,7 +182,7 @@ func (wh *webhook) PostNotifications(p *Plugin, instanceID types.ID) ([]*model.P
 				err = client.RESTGet(notification.commentSelf, nil, &struct{}{})
 			}
 		} else {
-			_, err = client.GetIssue(wh.Issue.ID, nil)
+			_, err = p.getIssueCached(client, instance.GetID(), mattermostUserID, wh.Issue.ID)
 		}
 		if err != nil {
 			p.errorf("PostNotifications: failed to get self: %v", err)
@@ -156,14 +191,30 @@ func (wh *webhook) PostNotifications(p *Plugin, instanceID types.ID) ([]*model.P
 
 		notification.message = p.replaceJiraAccountIds(instance.GetID(), notification.message)
 
+		if deliverAt, ok := c.Settings.DeliverAt(time.Now()); ok {
+			if err = p.deferNotification(instance.GetID(), mattermostUserID, deliverAt, notification.message); err != nil {
+				p.errorf("PostNotifications: failed to defer notification, err: %v", err)
+				failed++
+				continue
+			}
+			alreadyNotified = alreadyNotified.Add(mattermostUserID.String())
+			continue
+		}
+
 		post, err := p.CreateBotDMPost(instance.GetID(), mattermostUserID, notification.message, notification.postType)
 		if err != nil {
 			p.errorf("PostNotifications: failed to create notification post, err: %v", err)
+			failed++
 			continue
 		}
 		posts = append(posts, post)
+		alreadyNotified = alreadyNotified.Add(mattermostUserID.String())
 	}
-	return posts, http.StatusOK, nil
+
+	if failed > 0 {
+		return posts, alreadyNotified, errors.Errorf("failed to notify %d users", failed)
+	}
+	return posts, alreadyNotified, nil
 }
 
 func newWebhook(jwh *JiraWebhook, eventType string, format string, args ...interface{}) *webhook {
@@ -228,7 +279,7 @@ func (wh *webhook) CheckPermissions(instanceID types.ID, p *Plugin, mattermostUs
 		return err
 	}
 
-	_, err = client.GetIssue(wh.Issue.ID, nil)
+	_, err = p.getIssueCached(client, instance.GetID(), types.ID(mattermostUserID), wh.Issue.ID)
 	if err != nil {
 		return err
 	}
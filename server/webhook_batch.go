@@ -0,0 +1,278 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License for license information.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/pluginapi"
+	"github.com/mattermost/mattermost/server/public/pluginapi/cluster"
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-plugin-jira/server/utils/types"
+)
+
+const (
+	prefixWebhookBatch = "whb_" // + subscription ID, events collected during the subscription's batching window
+
+	webhookBatchJobKey      = "webhook_batch_flush"
+	webhookBatchJobInterval = time.Minute
+
+	// webhookBatchMaxAttempts is how many times the issues of a batch are posted before they are
+	// dropped.
+	webhookBatchMaxAttempts = 5
+
+	// webhookBatchMaxBytes bounds the events a batch holds, as they are all stored in a single
+	// value. A batch that would grow past it is posted before its window ends.
+	webhookBatchMaxBytes = 1 << 20
+)
+
+// webhookBatch holds the events a batching subscription received during its current window,
+// grouped by issue key in the order the issues were first seen.
+type webhookBatch struct {
+	SubscriptionID   string                       `json:"subscription_id"`
+	SubscriptionName string                       `json:"subscription_name"`
+	InstanceID       types.ID                     `json:"instance_id"`
+	ChannelID        string                       `json:"channel_id"`
+	FlushAt          time.Time                    `json:"flush_at"`
+	IssueKeys        []string                     `json:"issue_keys"`
+	Events           map[string][]json.RawMessage `json:"events"`
+	Attempts         int                          `json:"attempts,omitempty"`
+}
+
+func keyWebhookBatch(subscriptionID string) string {
+	return prefixWebhookBatch + subscriptionID
+}
+
+// size returns the number of bytes of the events of the batch.
+func (batch *webhookBatch) size() int {
+	size := 0
+	for _, events := range batch.Events {
+		for _, event := range events {
+			size += len(event)
+		}
+	}
+	return size
+}
+
+// addToWebhookBatch stores the (already expanded) webhook event in the subscription's
+// current batch, opening a new batching window if there is none. When the event would make the
+// batch too large, the batch is posted now and the event opens the next window.
+func (p *Plugin) addToWebhookBatch(instanceID types.ID, sub *ChannelSubscription, jwh *JiraWebhook) error {
+	event, err := json.Marshal(jwh)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal webhook event")
+	}
+	issueKey := jwh.Issue.Key
+
+	newBatch := func() *webhookBatch {
+		return &webhookBatch{
+			SubscriptionID:   sub.ID,
+			SubscriptionName: sub.Name,
+			InstanceID:       instanceID,
+			ChannelID:        sub.ChannelID,
+			FlushAt:          time.Now().Add(time.Duration(sub.BatchMinutes) * time.Minute),
+			Events:           map[string][]json.RawMessage{},
+		}
+	}
+
+	var full *webhookBatch
+	err = p.client.KV.SetAtomicWithRetries(keyWebhookBatch(sub.ID), func(initialBytes []byte) (interface{}, error) {
+		full = nil
+		batch := newBatch()
+		if len(initialBytes) != 0 {
+			if err := json.Unmarshal(initialBytes, batch); err != nil {
+				return nil, err
+			}
+		}
+		if len(batch.IssueKeys) > 0 && batch.size()+len(event) > webhookBatchMaxBytes {
+			full = batch
+			batch = newBatch()
+		}
+
+		if _, ok := batch.Events[issueKey]; !ok {
+			batch.IssueKeys = append(batch.IssueKeys, issueKey)
+		}
+		batch.Events[issueKey] = append(batch.Events[issueKey], event)
+		return batch, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if full != nil {
+		p.postTakenWebhookBatch(full)
+	}
+	return nil
+}
+
+// flushWebhookBatches posts the summaries of every batch whose window has ended.
+func (p *Plugin) flushWebhookBatches() {
+	keys, err := p.listKeysWithPrefix(prefixWebhookBatch)
+	if err != nil {
+		p.errorf("Failed to list webhook batches: %v", err)
+		return
+	}
+
+	now := time.Now()
+	for _, key := range keys {
+		var data []byte
+		if err = p.client.KV.Get(key, &data); err != nil {
+			p.errorf("Failed to load webhook batch %s: %v", key, err)
+			continue
+		}
+		if len(data) == 0 {
+			continue
+		}
+
+		batch := &webhookBatch{}
+		if err = json.Unmarshal(data, batch); err != nil {
+			p.errorf("Failed to unmarshal webhook batch %s, discarding it: %v", key, err)
+			_ = p.client.KV.Delete(key)
+			continue
+		}
+		if batch.FlushAt.After(now) {
+			continue
+		}
+
+		// Take the batch out of the store first, so that events arriving while it is
+		// being posted open the next window instead of being lost.
+		deleted, err := p.client.KV.Set(key, nil, pluginapi.SetAtomic(data))
+		if err != nil {
+			p.errorf("Failed to remove webhook batch %s: %v", key, err)
+			continue
+		}
+		if !deleted {
+			// Updated since it was loaded, it will be flushed on the next run.
+			continue
+		}
+
+		p.postTakenWebhookBatch(batch)
+	}
+}
+
+// postTakenWebhookBatch posts a batch taken out of the store, and queues the issues that failed
+// to post again.
+func (p *Plugin) postTakenWebhookBatch(batch *webhookBatch) {
+	failed, err := p.postWebhookBatch(batch)
+	if err == nil {
+		return
+	}
+	p.errorf("Failed to post webhook batch for subscription %s: %v", batch.SubscriptionID, err)
+	if err = p.requeueWebhookBatch(failed); err != nil {
+		p.errorf("Failed to queue webhook batch for subscription %s again, its events are dropped: %v", batch.SubscriptionID, err)
+	}
+}
+
+// postWebhookBatch posts one summary per issue of the batch, with the events that still match
+// the filters of the subscription. It returns the issues that failed to post as a batch of
+// their own.
+func (p *Plugin) postWebhookBatch(batch *webhookBatch) (*webhookBatch, error) {
+	subs, err := p.getSubscriptions(batch.InstanceID)
+	if err != nil {
+		return batch, err
+	}
+	sub, ok := subs.Channel.ByID[batch.SubscriptionID]
+	if !ok {
+		// The subscription was deleted during the batching window.
+		return nil, nil
+	}
+
+	failed := &webhookBatch{
+		SubscriptionID:   batch.SubscriptionID,
+		SubscriptionName: batch.SubscriptionName,
+		InstanceID:       batch.InstanceID,
+		ChannelID:        batch.ChannelID,
+		FlushAt:          batch.FlushAt,
+		Events:           map[string][]json.RawMessage{},
+		Attempts:         batch.Attempts,
+	}
+	botUserID := p.getUserID()
+	var errs []string
+	for _, issueKey := range batch.IssueKeys {
+		var events []*webhook
+		for _, data := range batch.Events[issueKey] {
+			wh, err := ParseWebhook(data)
+			if err != nil {
+				continue
+			}
+			if !p.matchesSubsciptionFilters(wh.(*webhook), sub.Filters, batch.InstanceID, sub.MattermostUserID) {
+				continue
+			}
+			events = append(events, wh.(*webhook))
+		}
+		if len(events) == 0 {
+			continue
+		}
+
+		if _, _, err := mergeBatchedWebhookEvents(events).PostToChannel(p, batch.InstanceID, sub.ChannelID, botUserID, sub.Name); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", issueKey, err))
+			failed.IssueKeys = append(failed.IssueKeys, issueKey)
+			failed.Events[issueKey] = batch.Events[issueKey]
+		}
+	}
+
+	if len(errs) > 0 {
+		return failed, errors.New(strings.Join(errs, "; "))
+	}
+	return nil, nil
+}
+
+// requeueWebhookBatch puts the issues of a batch that failed to post back in the store, ahead of
+// the events that arrived meanwhile, to post them on the next run.
+func (p *Plugin) requeueWebhookBatch(failed *webhookBatch) error {
+	if failed.Attempts+1 >= webhookBatchMaxAttempts {
+		return errors.Errorf("failed to post after %d attempts", webhookBatchMaxAttempts)
+	}
+
+	return p.client.KV.SetAtomicWithRetries(keyWebhookBatch(failed.SubscriptionID), func(initialBytes []byte) (interface{}, error) {
+		batch := *failed
+		batch.Attempts++
+		batch.IssueKeys = append([]string{}, failed.IssueKeys...)
+		batch.Events = map[string][]json.RawMessage{}
+		for issueKey, events := range failed.Events {
+			batch.Events[issueKey] = append([]json.RawMessage{}, events...)
+		}
+		if len(initialBytes) == 0 {
+			return &batch, nil
+		}
+
+		next := &webhookBatch{}
+		if err := json.Unmarshal(initialBytes, next); err != nil {
+			return nil, err
+		}
+		for _, issueKey := range next.IssueKeys {
+			if _, ok := batch.Events[issueKey]; !ok {
+				batch.IssueKeys = append(batch.IssueKeys, issueKey)
+			}
+			batch.Events[issueKey] = append(batch.Events[issueKey], next.Events[issueKey]...)
+		}
+		return &batch, nil
+	})
+}
+
+// mergeBatchedWebhookEvents merges the events of a single issue collected during a batching window.
+func mergeBatchedWebhookEvents(events []*webhook) Webhook {
+	if len(events) == 1 {
+		return events[0]
+	}
+
+	merged := mergeWebhookEvents(events).(*webhook)
+	last := events[len(events)-1]
+	merged.JiraWebhook = last.JiraWebhook
+	merged.headline = fmt.Sprintf("%s **had %d updates**", last.mdKeySummaryLink(), len(events))
+	return merged
+}
+
+func (p *Plugin) scheduleWebhookBatchJob() error {
+	job, err := cluster.Schedule(p.API, webhookBatchJobKey, cluster.MakeWaitForInterval(webhookBatchJobInterval), p.flushWebhookBatches)
+	if err != nil {
+		return errors.Wrap(err, "failed to schedule webhook batch job")
+	}
+	p.webhookBatchJob = job
+	return nil
+}
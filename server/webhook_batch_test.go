@@ -0,0 +1,136 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License for license information.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookBatch(t *testing.T) {
+	p, kv := setupTestSubscriptionStore(t)
+	sub := &ChannelSubscription{
+		ID:           "subscription1",
+		ChannelID:    "channel1",
+		Name:         "Batched",
+		BatchMinutes: 5,
+	}
+
+	for _, filename := range []string{
+		"testdata/webhook-issue-created.json",
+		"testdata/webhook-issue-updated-assigned.json",
+		"testdata/webhook-issue-updated-labels.json",
+	} {
+		bb, err := os.ReadFile(filename)
+		require.NoError(t, err)
+		wh, err := ParseWebhook(bb)
+		require.NoError(t, err)
+		require.NoError(t, p.addToWebhookBatch("jiraurl1", sub, wh.(*webhook).JiraWebhook))
+	}
+
+	batch := &webhookBatch{}
+	require.NoError(t, json.Unmarshal(kv[keyWebhookBatch(sub.ID)], batch))
+	assert.Equal(t, []string{"TES-41"}, batch.IssueKeys)
+	require.Len(t, batch.Events["TES-41"], 3)
+	assert.Equal(t, "channel1", batch.ChannelID)
+	assert.WithinDuration(t, time.Now().Add(5*time.Minute), batch.FlushAt, time.Minute)
+
+	var events []*webhook
+	eventTypes := NewStringSet()
+	for _, data := range batch.Events["TES-41"] {
+		wh, err := ParseWebhook(data)
+		require.NoError(t, err)
+		events = append(events, wh.(*webhook))
+		eventTypes = eventTypes.Union(wh.Events())
+	}
+
+	merged := mergeBatchedWebhookEvents(events).(*webhook)
+	assert.Equal(t,
+		"story [TES-41: Unit test summary 1](https://some-instance-test.atlassian.net/browse/TES-41) **had 3 updates**",
+		merged.headline)
+	require.Len(t, merged.fields, 4)
+	assert.Contains(t, merged.fields[0].Value, "**created**")
+	assert.Equal(t, "Priority", merged.fields[1].Title)
+	assert.Contains(t, merged.fields[2].Value, "**Assignee:**")
+	assert.Contains(t, merged.fields[3].Value, "**Labels:**")
+	assert.Equal(t, eventTypes, merged.Events())
+
+	// Events of a deleted subscription, or that no longer match its filters, are not posted.
+	failed, err := p.postWebhookBatch(batch)
+	require.NoError(t, err)
+	assert.Nil(t, failed)
+	stored := testSubscription(sub.ID, sub.ChannelID, "OTHER", "10001", eventCreated)
+	require.NoError(t, p.addSubscribedChannel(batch.InstanceID, sub.ChannelID))
+	require.NoError(t, p.updateChannelSubscriptions(batch.InstanceID, sub.ChannelID, func(byID map[string]ChannelSubscription) error {
+		byID[sub.ID] = stored
+		return nil
+	}))
+	failed, err = p.postWebhookBatch(batch)
+	require.NoError(t, err)
+	assert.Nil(t, failed)
+
+	// Issues that failed to post are queued again ahead of the events that arrived meanwhile.
+	delete(kv, keyWebhookBatch(sub.ID))
+	bb, err := os.ReadFile("testdata/webhook-issue-created.json")
+	require.NoError(t, err)
+	wh, err := ParseWebhook(bb)
+	require.NoError(t, err)
+	jwh := wh.(*webhook).JiraWebhook
+	jwh.Issue.Key = "TES-42"
+	require.NoError(t, p.addToWebhookBatch("jiraurl1", sub, jwh))
+	require.NoError(t, p.requeueWebhookBatch(batch))
+
+	requeued := &webhookBatch{}
+	require.NoError(t, json.Unmarshal(kv[keyWebhookBatch(sub.ID)], requeued))
+	assert.Equal(t, []string{"TES-41", "TES-42"}, requeued.IssueKeys)
+	assert.Len(t, requeued.Events["TES-41"], 3)
+	assert.Equal(t, batch.FlushAt.Unix(), requeued.FlushAt.Unix())
+	assert.Equal(t, 1, requeued.Attempts)
+
+	requeued.Attempts = webhookBatchMaxAttempts - 1
+	assert.Error(t, p.requeueWebhookBatch(requeued), "batches are dropped after the last attempt")
+}
+
+func TestWebhookBatchMaxBytes(t *testing.T) {
+	p, kv := setupTestSubscriptionStore(t)
+	sub := &ChannelSubscription{
+		ID:           "subscription1",
+		ChannelID:    "channel1",
+		Name:         "Batched",
+		BatchMinutes: 5,
+	}
+
+	bb, err := os.ReadFile("testdata/webhook-issue-created.json")
+	require.NoError(t, err)
+	addEvent := func(issueKey string) {
+		wh, err := ParseWebhook(bb)
+		require.NoError(t, err)
+		jwh := wh.(*webhook).JiraWebhook
+		jwh.Issue.Key = issueKey
+		jwh.Issue.Fields.Description = strings.Repeat("x", webhookBatchMaxBytes/3)
+		require.NoError(t, p.addToWebhookBatch("jiraurl1", sub, jwh))
+	}
+	stored := func() *webhookBatch {
+		batch := &webhookBatch{}
+		require.NoError(t, json.Unmarshal(kv[keyWebhookBatch(sub.ID)], batch))
+		return batch
+	}
+
+	addEvent("TES-41")
+	addEvent("TES-42")
+	assert.Equal(t, []string{"TES-41", "TES-42"}, stored().IssueKeys)
+
+	// The subscription is not stored, so the full batch is dropped when it is posted.
+	addEvent("TES-43")
+	batch := stored()
+	assert.Equal(t, []string{"TES-43"}, batch.IssueKeys)
+	assert.Less(t, batch.size(), webhookBatchMaxBytes)
+	assert.WithinDuration(t, time.Now().Add(5*time.Minute), batch.FlushAt, time.Minute)
+}
@@ -87,7 +87,7 @@ func (jwh *JiraWebhook) expandIssue(p *Plugin, instanceID types.ID) error {
 				return err
 			}
 
-			issue, err := client.GetIssue(jwh.Issue.ID, nil)
+			issue, err := p.getIssueCached(client, instanceID, mmUserID, jwh.Issue.ID)
 			if err != nil {
 				return err
 			}
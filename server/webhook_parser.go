@@ -141,6 +141,8 @@ func parseWebhookChangeLog(jwh *JiraWebhook) Webhook {
 			event = parseWebhookResolved(jwh, to)
 		case field == statusField:
 			event = parseWebhookUpdatedField(jwh, eventUpdatedStatus, field, fieldID, fromWithDefault, toWithDefault)
+			appendNotificationsForStatusChange(event, fmt.Sprintf("%s **changed the status** of %s from `%s` to `%s`",
+				jwh.mdUser(), jwh.mdKeySummaryLink(), fromWithDefault, toWithDefault))
 		case field == priorityField:
 			event = parseWebhookUpdatedField(jwh, eventUpdatedPriority, field, fieldID, fromWithDefault, toWithDefault)
 		case field == "summary":
@@ -283,6 +285,7 @@ func appendCommentNotifications(wh *webhook, verb string) {
 			message:     message,
 			postType:    PostTypeMention,
 			commentSelf: jwh.Comment.Self,
+			kind:        notificationKindMention,
 		}
 
 		if isAccountID {
@@ -309,6 +312,7 @@ func appendCommentNotifications(wh *webhook, verb string) {
 		message:       fmt.Sprintf("%s **commented** on %s:\n>%s", commentAuthor, jwh.mdKeySummaryLink(), jwh.Comment.Body),
 		postType:      PostTypeComment,
 		commentSelf:   jwh.Comment.Self,
+		kind:          notificationKindComment,
 	})
 }
 
@@ -388,18 +392,44 @@ func appendNotificationForAssignee(wh *webhook) {
 		jiraUsername:  jwh.Issue.Fields.Assignee.Name,
 		jiraAccountID: jwh.Issue.Fields.Assignee.AccountID,
 		message:       fmt.Sprintf("%s **assigned** you to %s", jwh.mdUser(), jwh.mdKeySummaryLink()),
+		kind:          notificationKindAssignment,
+	})
+}
+
+// appendNotificationsForStatusChange modifies wh, notifying the reporter and the watchers of
+// the issue of a change to its status or resolution.
+func appendNotificationsForStatusChange(wh *webhook, message string) {
+	jwh := wh.JiraWebhook
+	if jwh.Issue.Fields != nil && jwh.Issue.Fields.Reporter != nil &&
+		// Don't send a notification to the reporter if they are the one who made the change.
+		(jwh.User.Name == "" || jwh.User.Name != jwh.Issue.Fields.Reporter.Name) &&
+		(jwh.User.AccountID == "" || jwh.User.AccountID != jwh.Issue.Fields.Reporter.AccountID) {
+		wh.notifications = append(wh.notifications, webhookUserNotification{
+			jiraUsername:  jwh.Issue.Fields.Reporter.Name,
+			jiraAccountID: jwh.Issue.Fields.Reporter.AccountID,
+			message:       message,
+			kind:          notificationKindStatus,
+		})
+	}
+
+	wh.notifications = append(wh.notifications, webhookUserNotification{
+		watchers: true,
+		message:  message,
+		kind:     notificationKindWatching,
 	})
 }
 
 func parseWebhookReopened(jwh *JiraWebhook, from string) *webhook {
 	wh := newWebhook(jwh, eventUpdatedReopened, "**reopened**")
 	wh.fieldInfo = webhookField{"reopened", resolutionField, from, "Open"}
+	appendNotificationsForStatusChange(wh, fmt.Sprintf("%s **reopened** %s", jwh.mdUser(), jwh.mdKeySummaryLink()))
 	return wh
 }
 
 func parseWebhookResolved(jwh *JiraWebhook, to string) *webhook {
 	wh := newWebhook(jwh, eventUpdatedResolved, "**resolved**")
 	wh.fieldInfo = webhookField{"resolved", resolutionField, "Open", to}
+	appendNotificationsForStatusChange(wh, fmt.Sprintf("%s **resolved** %s as `%s`", jwh.mdUser(), jwh.mdKeySummaryLink(), to))
 	return wh
 }
 
@@ -440,6 +470,17 @@ func mergeWebhookEvents(events []*webhook) Webhook {
 
 	for _, event := range events {
 		merged.eventTypes = merged.eventTypes.Union(event.eventTypes)
+		merged.notifications = append(merged.notifications, event.notifications...)
+		if event.fieldInfo.name == "" {
+			// Not a single field change (e.g. a comment, or an already merged changelog),
+			// summarize it by its headline and the fields it carries.
+			merged.fields = append(merged.fields, &model.SlackAttachmentField{
+				Value: event.headline,
+				Short: false,
+			})
+			merged.fields = append(merged.fields, event.fields...)
+			continue
+		}
 		strike := "~~"
 		if event.fieldInfo.name == descriptionField || strings.HasPrefix(event.fieldInfo.from, strike) {
 			strike = ""
@@ -136,3 +136,34 @@ func TestWebhookQuotedComment(t *testing.T) {
 		assert.True(t, strings.HasPrefix(w.text, ">"))
 	}
 }
+
+func TestStatusChangeNotifications(t *testing.T) {
+	reporter := &jira.User{Name: "reporter", AccountID: "reporterID"}
+	jwh := &JiraWebhook{
+		User:  jira.User{Name: "author", AccountID: "authorID"},
+		Issue: jira.Issue{ID: "10000", Key: "TEST-1", Fields: &jira.IssueFields{Reporter: reporter, Summary: "Summary"}},
+	}
+
+	wh := parseWebhookResolved(jwh, "Done")
+	require.Len(t, wh.notifications, 2)
+	assert.Equal(t, "reporterID", wh.notifications[0].jiraAccountID)
+	assert.Equal(t, notificationKindStatus, wh.notifications[0].kind)
+	assert.Contains(t, wh.notifications[0].message, "**resolved**")
+	assert.Contains(t, wh.notifications[0].message, "as `Done`")
+	assert.True(t, wh.notifications[1].watchers)
+	assert.Equal(t, notificationKindWatching, wh.notifications[1].kind)
+
+	jwh.User = *reporter
+	wh = parseWebhookReopened(jwh, "Done")
+	require.Len(t, wh.notifications, 1)
+	assert.True(t, wh.notifications[0].watchers)
+
+	notifications := []webhookUserNotification{
+		{jiraAccountID: "a", kind: notificationKindWatching},
+		{jiraAccountID: "a", kind: notificationKindStatus},
+		{jiraAccountID: "a", kind: notificationKindMention},
+	}
+	sortNotificationsByKind(notifications)
+	assert.Equal(t, []string{notificationKindMention, notificationKindStatus, notificationKindWatching},
+		[]string{notifications[0].kind, notifications[1].kind, notifications[2].kind})
+}
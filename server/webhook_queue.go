@@ -0,0 +1,391 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License for license information.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/pluginapi/cluster"
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-plugin-jira/server/utils/types"
+)
+
+const (
+	prefixWebhookQueue      = "whq_"  // + message ID, webhook events waiting to be (re)processed
+	prefixWebhookDeadLetter = "whdl_" // + message ID, webhook events that ran out of attempts
+	prefixWebhookQueueIndex = "whqi_" // + shard, the next attempt of the queued webhook events by message ID
+
+	// webhookQueueIndexShards spreads the index of the queue over several keys, so that
+	// concurrent webhook events rarely update the same one.
+	webhookQueueIndexShards = 16
+
+	// WebhookMaxAttempts is how many times a webhook event is processed before it is moved to the dead letters.
+	WebhookMaxAttempts = 8
+
+	webhookRetryBaseDelay = 30 * time.Second
+	webhookRetryMaxDelay  = time.Hour
+
+	// webhookLease is how long a dispatched message is considered in flight. A message
+	// that is still in the queue after its lease expired (e.g. the server restarted while
+	// it was being processed) is picked up again by the retry job.
+	webhookLease = 5 * time.Minute
+
+	webhookRetryJobKey      = "webhook_retry"
+	webhookRetryJobInterval = time.Minute
+)
+
+// errWebhookPermanent marks failures that would fail the same way on every retry.
+var errWebhookPermanent = errors.New("webhook event can not be processed")
+
+func newWebhookMessage(instanceID types.ID, data []byte) *webhookMessage {
+	return &webhookMessage{
+		ID:         model.NewId(),
+		InstanceID: instanceID,
+		Data:       data,
+		CreatedAt:  time.Now(),
+	}
+}
+
+func keyWebhookMessage(id string) string {
+	return prefixWebhookQueue + id
+}
+
+func keyWebhookDeadLetter(id string) string {
+	return prefixWebhookDeadLetter + id
+}
+
+func keyWebhookQueueIndex(shard int) string {
+	return prefixWebhookQueueIndex + strconv.Itoa(shard)
+}
+
+func webhookQueueIndexShard(id string) int {
+	if id == "" {
+		return 0
+	}
+	return int(id[len(id)-1]) % webhookQueueIndexShards
+}
+
+// updateWebhookQueueIndex changes the next attempts of the queued messages of the shard, which
+// the retry job reads instead of going through every key of the plugin.
+func (p *Plugin) updateWebhookQueueIndex(shard int, update func(index map[string]time.Time)) error {
+	err := p.client.KV.SetAtomicWithRetries(keyWebhookQueueIndex(shard), func(initialBytes []byte) (interface{}, error) {
+		index := map[string]time.Time{}
+		if len(initialBytes) != 0 {
+			if err := json.Unmarshal(initialBytes, &index); err != nil {
+				return nil, err
+			}
+		}
+		update(index)
+		if len(index) == 0 {
+			return nil, nil
+		}
+		return index, nil
+	})
+	return errors.Wrap(err, "failed to update the webhook queue index")
+}
+
+func (p *Plugin) indexWebhookMessage(msg *webhookMessage) error {
+	return p.updateWebhookQueueIndex(webhookQueueIndexShard(msg.ID), func(index map[string]time.Time) {
+		index[msg.ID] = msg.NextAttemptAt
+	})
+}
+
+func (p *Plugin) unindexWebhookMessage(id string) error {
+	return p.updateWebhookQueueIndex(webhookQueueIndexShard(id), func(index map[string]time.Time) {
+		delete(index, id)
+	})
+}
+
+func (p *Plugin) deleteWebhookMessage(id string) error {
+	if err := p.client.KV.Delete(keyWebhookMessage(id)); err != nil {
+		return err
+	}
+	return p.unindexWebhookMessage(id)
+}
+
+// webhookRetryDelay returns the backoff before the given attempt is retried.
+func webhookRetryDelay(attempts int) time.Duration {
+	delay := webhookRetryBaseDelay
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= webhookRetryMaxDelay {
+			return webhookRetryMaxDelay
+		}
+	}
+	return delay
+}
+
+// dispatchWebhookMessage persists the message with a new lease and offers it to the
+// workers, so that it survives a full queue or a restart of the plugin. If the
+// in-memory queue is full, the message stays in the KV store and the retry job
+// dispatches it again when the lease expires.
+func (p *Plugin) dispatchWebhookMessage(msg *webhookMessage) error {
+	msg.LeaseID = model.NewId()
+	msg.NextAttemptAt = time.Now().Add(webhookLease)
+	if _, err := p.client.KV.Set(keyWebhookMessage(msg.ID), msg); err != nil {
+		return errors.Wrapf(err, "failed to store webhook message %s", msg.ID)
+	}
+	if err := p.indexWebhookMessage(msg); err != nil {
+		return err
+	}
+
+	select {
+	case p.webhookQueue <- msg:
+	default:
+		p.debugf("Webhook queue is full, message %s will be dispatched by the retry job", msg.ID)
+	}
+	return nil
+}
+
+// claimWebhookMessage reports whether msg is still the current dispatch of the stored
+// message. It is false if the message was already processed, or re-dispatched after
+// its lease expired while waiting in the queue.
+func (p *Plugin) claimWebhookMessage(msg *webhookMessage) bool {
+	var stored *webhookMessage
+	if err := p.client.KV.Get(keyWebhookMessage(msg.ID), &stored); err != nil {
+		p.errorf("Failed to load webhook message %s: %v", msg.ID, err)
+		return false
+	}
+	return stored != nil && stored.LeaseID == msg.LeaseID
+}
+
+// finishWebhookMessage removes a processed message from the queue, or schedules the
+// next attempt for a failed one, moving it to the dead letters once it runs out of attempts.
+func (p *Plugin) finishWebhookMessage(msg *webhookMessage, procErr error) error {
+	if procErr == nil || errors.Is(procErr, errWebhookeventUnsupported) {
+		return p.deleteWebhookMessage(msg.ID)
+	}
+
+	msg.Attempts++
+	msg.LastError = procErr.Error()
+	if errors.Is(procErr, errWebhookPermanent) || msg.Attempts >= WebhookMaxAttempts {
+		return p.deadLetterWebhookMessage(msg)
+	}
+
+	msg.NextAttemptAt = time.Now().Add(webhookRetryDelay(msg.Attempts))
+	if _, err := p.client.KV.Set(keyWebhookMessage(msg.ID), msg); err != nil {
+		return errors.Wrapf(err, "failed to reschedule webhook message %s", msg.ID)
+	}
+	return p.indexWebhookMessage(msg)
+}
+
+func (p *Plugin) deadLetterWebhookMessage(msg *webhookMessage) error {
+	msg.LeaseID = ""
+	if _, err := p.client.KV.Set(keyWebhookDeadLetter(msg.ID), msg); err != nil {
+		return errors.Wrapf(err, "failed to store dead letter %s", msg.ID)
+	}
+	p.errorf("Webhook message %s moved to dead letters after %d attempts, last error: %s", msg.ID, msg.Attempts, msg.LastError)
+	return p.deleteWebhookMessage(msg.ID)
+}
+
+// listKeysWithPrefix returns all the plugin's KV keys that start with prefix.
+func (p *Plugin) listKeysWithPrefix(prefix string) ([]string, error) {
+	var result []string
+	for i := 0; ; i++ {
+		keys, err := p.client.KV.ListKeys(i, listPerPage)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key := range keys {
+			if strings.HasPrefix(key, prefix) {
+				result = append(result, key)
+			}
+		}
+
+		if len(keys) < listPerPage {
+			break
+		}
+	}
+	return result, nil
+}
+
+// retryWebhookMessages dispatches every queued message whose next attempt is due.
+func (p *Plugin) retryWebhookMessages() {
+	now := time.Now()
+	for shard := 0; shard < webhookQueueIndexShards; shard++ {
+		if !p.retryWebhookMessagesOfShard(shard, now) {
+			return
+		}
+	}
+}
+
+// retryWebhookMessagesOfShard dispatches the messages of the shard whose next attempt is due,
+// and returns false once the queue is full.
+func (p *Plugin) retryWebhookMessagesOfShard(shard int, now time.Time) bool {
+	var index map[string]time.Time
+	if err := p.client.KV.Get(keyWebhookQueueIndex(shard), &index); err != nil {
+		p.errorf("Failed to load the webhook queue index: %v", err)
+		return true
+	}
+
+	gone := map[string]time.Time{}
+	defer func() {
+		if len(gone) == 0 {
+			return
+		}
+		// A message replayed meanwhile is indexed again with a later attempt.
+		err := p.updateWebhookQueueIndex(shard, func(index map[string]time.Time) {
+			for id, at := range gone {
+				if current, ok := index[id]; ok && current.Equal(at) {
+					delete(index, id)
+				}
+			}
+		})
+		if err != nil {
+			p.errorf("Failed to remove processed webhook messages from the index: %v", err)
+		}
+	}()
+
+	for id, at := range index {
+		if at.After(now) {
+			continue
+		}
+		var msg *webhookMessage
+		if err := p.client.KV.Get(keyWebhookMessage(id), &msg); err != nil {
+			p.errorf("Failed to load webhook message %s: %v", id, err)
+			continue
+		}
+		if msg == nil {
+			gone[id] = at
+			continue
+		}
+		if msg.NextAttemptAt.After(now) {
+			continue
+		}
+		if len(p.webhookQueue) == cap(p.webhookQueue) {
+			return false
+		}
+		if err := p.dispatchWebhookMessage(msg); err != nil {
+			p.errorf("Failed to dispatch webhook message %s: %v", msg.ID, err)
+		}
+	}
+	return true
+}
+
+func (p *Plugin) scheduleWebhookRetryJob() error {
+	job, err := cluster.Schedule(p.API, webhookRetryJobKey, cluster.MakeWaitForInterval(webhookRetryJobInterval), p.retryWebhookMessages)
+	if err != nil {
+		return errors.Wrap(err, "failed to schedule webhook retry job")
+	}
+	p.webhookRetryJob = job
+	return nil
+}
+
+// webhookDeadLetter is the summary of a dead letter shown to admins.
+type webhookDeadLetter struct {
+	ID         string    `json:"id"`
+	InstanceID types.ID  `json:"instance_id"`
+	Event      string    `json:"event"`
+	IssueKey   string    `json:"issue_key"`
+	Attempts   int       `json:"attempts"`
+	LastError  string    `json:"last_error"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+func (msg *webhookMessage) deadLetter() webhookDeadLetter {
+	var event struct {
+		WebhookEvent string `json:"webhookEvent"`
+		Issue        struct {
+			Key string `json:"key"`
+		} `json:"issue"`
+	}
+	_ = json.Unmarshal(msg.Data, &event)
+
+	return webhookDeadLetter{
+		ID:         msg.ID,
+		InstanceID: msg.InstanceID,
+		Event:      event.WebhookEvent,
+		IssueKey:   event.Issue.Key,
+		Attempts:   msg.Attempts,
+		LastError:  msg.LastError,
+		CreatedAt:  msg.CreatedAt,
+	}
+}
+
+func (p *Plugin) loadWebhookDeadLetter(id string) (*webhookMessage, error) {
+	var msg *webhookMessage
+	if err := p.client.KV.Get(keyWebhookDeadLetter(id), &msg); err != nil {
+		return nil, err
+	}
+	if msg == nil {
+		return nil, errors.Errorf("dead letter %q not found", id)
+	}
+	return msg, nil
+}
+
+func (p *Plugin) listWebhookDeadLetters() ([]webhookDeadLetter, error) {
+	keys, err := p.listKeysWithPrefix(prefixWebhookDeadLetter)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []webhookDeadLetter{}
+	for _, key := range keys {
+		msg, err := p.loadWebhookDeadLetter(strings.TrimPrefix(key, prefixWebhookDeadLetter))
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, msg.deadLetter())
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].CreatedAt.Before(result[j].CreatedAt)
+	})
+	return result, nil
+}
+
+// replayWebhookDeadLetter puts a dead letter back in the queue with a fresh set of
+// attempts. Subscriptions that were already notified are not notified again.
+func (p *Plugin) replayWebhookDeadLetter(id string) error {
+	msg, err := p.loadWebhookDeadLetter(id)
+	if err != nil {
+		return err
+	}
+
+	msg.Attempts = 0
+	msg.LastError = ""
+	if err = p.dispatchWebhookMessage(msg); err != nil {
+		return err
+	}
+	return p.client.KV.Delete(keyWebhookDeadLetter(id))
+}
+
+func (p *Plugin) deleteWebhookDeadLetter(id string) error {
+	if _, err := p.loadWebhookDeadLetter(id); err != nil {
+		return err
+	}
+	return p.client.KV.Delete(keyWebhookDeadLetter(id))
+}
+
+func (p *Plugin) httpGetWebhookDeadLetters(w http.ResponseWriter, r *http.Request) (int, error) {
+	deadLetters, err := p.listWebhookDeadLetters()
+	if err != nil {
+		return respondErr(w, http.StatusInternalServerError,
+			errors.WithMessage(err, "failed to load failed webhook events"))
+	}
+	return respondJSON(w, deadLetters)
+}
+
+func (p *Plugin) httpReplayWebhookDeadLetter(w http.ResponseWriter, r *http.Request) (int, error) {
+	if err := p.replayWebhookDeadLetter(mux.Vars(r)["id"]); err != nil {
+		return respondErr(w, http.StatusBadRequest, err)
+	}
+	return respondJSON(w, map[string]interface{}{"status": "OK"})
+}
+
+func (p *Plugin) httpDeleteWebhookDeadLetter(w http.ResponseWriter, r *http.Request) (int, error) {
+	if err := p.deleteWebhookDeadLetter(mux.Vars(r)["id"]); err != nil {
+		return respondErr(w, http.StatusBadRequest, err)
+	}
+	return respondJSON(w, map[string]interface{}{"status": "OK"})
+}
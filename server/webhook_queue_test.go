@@ -0,0 +1,151 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License for license information.
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/mattermost/mattermost/server/public/pluginapi"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func setupTestWebhookQueue(t *testing.T) (*Plugin, testKVStore) {
+	api := &plugintest.API{}
+	api.On("LogError", mock.AnythingOfTypeArgument("string")).Maybe().Return(nil)
+	api.On("LogDebug", mock.AnythingOfTypeArgument("string")).Maybe().Return(nil)
+	kv := makeTestKVStore(api, nil)
+
+	p := &Plugin{}
+	p.SetAPI(api)
+	p.client = pluginapi.NewClient(p.API, p.Driver)
+	p.webhookQueue = make(chan *webhookMessage, 1)
+	return p, kv
+}
+
+func loadTestWebhookMessage(t *testing.T, kv testKVStore, key string) *webhookMessage {
+	data := kv[key]
+	if len(data) == 0 {
+		return nil
+	}
+	msg := &webhookMessage{}
+	require.NoError(t, json.Unmarshal(data, msg))
+	return msg
+}
+
+func TestWebhookRetryDelay(t *testing.T) {
+	assert.Equal(t, 30*time.Second, webhookRetryDelay(1))
+	assert.Equal(t, time.Minute, webhookRetryDelay(2))
+	assert.Equal(t, 4*time.Minute, webhookRetryDelay(4))
+	assert.Equal(t, time.Hour, webhookRetryDelay(WebhookMaxAttempts))
+	assert.Equal(t, time.Hour, webhookRetryDelay(100))
+}
+
+func TestWebhookQueue(t *testing.T) {
+	t.Run("dispatched message is stored and claimed once", func(t *testing.T) {
+		p, kv := setupTestWebhookQueue(t)
+
+		msg := newWebhookMessage("jiraurl1", []byte(`{}`))
+		require.NoError(t, p.dispatchWebhookMessage(msg))
+		queued := <-p.webhookQueue
+		assert.True(t, p.claimWebhookMessage(queued))
+
+		stale := *queued
+		require.NoError(t, p.dispatchWebhookMessage(msg))
+		assert.False(t, p.claimWebhookMessage(&stale))
+
+		require.NoError(t, p.finishWebhookMessage(msg, nil))
+		assert.Nil(t, loadTestWebhookMessage(t, kv, keyWebhookMessage(msg.ID)))
+		assert.False(t, p.claimWebhookMessage(msg))
+	})
+
+	t.Run("message is kept when the queue is full", func(t *testing.T) {
+		p, kv := setupTestWebhookQueue(t)
+
+		require.NoError(t, p.dispatchWebhookMessage(newWebhookMessage("jiraurl1", []byte(`{}`))))
+		msg := newWebhookMessage("jiraurl1", []byte(`{}`))
+		require.NoError(t, p.dispatchWebhookMessage(msg))
+
+		assert.Len(t, p.webhookQueue, 1)
+		assert.NotNil(t, loadTestWebhookMessage(t, kv, keyWebhookMessage(msg.ID)))
+	})
+
+	t.Run("failed message is rescheduled, then dead-lettered", func(t *testing.T) {
+		p, kv := setupTestWebhookQueue(t)
+
+		msg := newWebhookMessage("jiraurl1", []byte(`{"webhookEvent":"jira:issue_updated","issue":{"key":"TEST-1"}}`))
+		require.NoError(t, p.dispatchWebhookMessage(msg))
+
+		require.NoError(t, p.finishWebhookMessage(msg, errors.New("jira is down")))
+		stored := loadTestWebhookMessage(t, kv, keyWebhookMessage(msg.ID))
+		require.NotNil(t, stored)
+		assert.Equal(t, 1, stored.Attempts)
+		assert.Equal(t, "jira is down", stored.LastError)
+		assert.True(t, stored.NextAttemptAt.After(time.Now()))
+
+		for i := 1; i < WebhookMaxAttempts; i++ {
+			require.NoError(t, p.finishWebhookMessage(msg, errors.New("jira is down")))
+		}
+		assert.Nil(t, loadTestWebhookMessage(t, kv, keyWebhookMessage(msg.ID)))
+
+		dl, err := p.loadWebhookDeadLetter(msg.ID)
+		require.NoError(t, err)
+		assert.Equal(t, WebhookMaxAttempts, dl.Attempts)
+		assert.Equal(t, "jira:issue_updated", dl.deadLetter().Event)
+		assert.Equal(t, "TEST-1", dl.deadLetter().IssueKey)
+
+		require.NoError(t, p.replayWebhookDeadLetter(msg.ID))
+		stored = loadTestWebhookMessage(t, kv, keyWebhookMessage(msg.ID))
+		require.NotNil(t, stored)
+		assert.Equal(t, 0, stored.Attempts)
+		_, err = p.loadWebhookDeadLetter(msg.ID)
+		assert.Error(t, err)
+	})
+
+	t.Run("permanent failure is dead-lettered immediately", func(t *testing.T) {
+		p, kv := setupTestWebhookQueue(t)
+
+		msg := newWebhookMessage("jiraurl1", []byte(`not json`))
+		require.NoError(t, p.dispatchWebhookMessage(msg))
+		require.NoError(t, p.finishWebhookMessage(msg, errors.Wrap(errWebhookPermanent, "bad payload")))
+
+		assert.Nil(t, loadTestWebhookMessage(t, kv, keyWebhookMessage(msg.ID)))
+		assert.NotNil(t, loadTestWebhookMessage(t, kv, keyWebhookDeadLetter(msg.ID)))
+	})
+
+	t.Run("retry job dispatches the due messages of the index", func(t *testing.T) {
+		p, kv := setupTestWebhookQueue(t)
+
+		msg := newWebhookMessage("jiraurl1", []byte(`{}`))
+		require.NoError(t, p.dispatchWebhookMessage(msg))
+		<-p.webhookQueue
+		stored := loadTestWebhookMessage(t, kv, keyWebhookMessage(msg.ID))
+		stored.NextAttemptAt = time.Now().Add(-time.Minute)
+		_, err := p.client.KV.Set(keyWebhookMessage(msg.ID), stored)
+		require.NoError(t, err)
+		require.NoError(t, p.indexWebhookMessage(stored))
+
+		processed := newWebhookMessage("jiraurl1", []byte(`{}`))
+		processed.NextAttemptAt = time.Now().Add(-time.Minute)
+		require.NoError(t, p.indexWebhookMessage(processed))
+
+		p.retryWebhookMessages()
+		require.Len(t, p.webhookQueue, 1)
+		assert.Equal(t, msg.ID, (<-p.webhookQueue).ID)
+
+		index := map[string]time.Time{}
+		require.NoError(t, p.client.KV.Get(keyWebhookQueueIndex(webhookQueueIndexShard(processed.ID)), &index))
+		assert.NotContains(t, index, processed.ID)
+
+		require.NoError(t, p.finishWebhookMessage(msg, nil))
+		index = map[string]time.Time{}
+		require.NoError(t, p.client.KV.Get(keyWebhookQueueIndex(webhookQueueIndexShard(msg.ID)), &index))
+		assert.NotContains(t, index, msg.ID)
+	})
+}
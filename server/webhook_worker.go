@@ -5,6 +5,8 @@ package main
 
 import (
 	"fmt"
+	"time"
+
 	"github.com/pkg/errors"
 
 	"github.com/mattermost/mattermost-plugin-jira/server/utils/types"
@@ -17,20 +19,38 @@ type webhookWorker struct {
 }
 
 type webhookMessage struct {
-	InstanceID types.ID
-	Data       []byte
+	ID            string    `json:"id"`
+	InstanceID    types.ID  `json:"instance_id"`
+	Data          []byte    `json:"data"`
+	CreatedAt     time.Time `json:"created_at"`
+	LeaseID       string    `json:"lease_id,omitempty"`
+	Attempts      int       `json:"attempts"`
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+	LastError     string    `json:"last_error,omitempty"`
+
+	// Progress of the previous attempts, so that a retry does not notify anyone twice.
+	Notified  StringSet `json:"notified,omitempty"`
+	Delivered StringSet `json:"delivered,omitempty"`
 }
 
 func (ww webhookWorker) work() {
 	for msg := range ww.workQueue {
+		if !ww.p.claimWebhookMessage(msg) {
+			continue
+		}
+
 		err := ww.process(msg)
 		if err != nil {
 			if errors.Is(err, errWebhookeventUnsupported) {
 				ww.p.debugf("WebhookWorker id: %d, error processing, err: %v", ww.id, err)
 			} else {
-				ww.p.errorf("WebhookWorker id: %d, error processing, err: %v", ww.id, err)
+				ww.p.errorf("WebhookWorker id: %d, error processing message %s, attempt %d, err: %v", ww.id, msg.ID, msg.Attempts+1, err)
 			}
 		}
+
+		if err = ww.p.finishWebhookMessage(msg, err); err != nil {
+			ww.p.errorf("WebhookWorker id: %d, error updating the webhook queue, err: %v", ww.id, err)
+		}
 	}
 }
 
@@ -44,14 +64,31 @@ func (ww webhookWorker) process(msg *webhookMessage) (err error) {
 	wh, err := ParseWebhook(msg.Data)
 
 	if err != nil {
-		return err
+		if err == ErrWebhookIgnored || errors.Is(err, errWebhookeventUnsupported) {
+			return err
+		}
+		return errors.Wrap(errWebhookPermanent, err.Error())
 	}
 
-	if _, _, err = wh.PostNotifications(ww.p, msg.InstanceID); err != nil {
-		ww.p.errorf("WebhookWorker id: %d, error posting notifications, err: %v", ww.id, err)
+	v := wh.(*webhook)
+	// The issue changed, it is loaded again with the changes.
+	ww.p.issueCache.invalidate(msg.InstanceID, v.Issue.ID, v.Issue.Key)
+
+	// Only the users notified are skipped by the next attempt.
+	_, msg.Notified, err = v.postUserNotifications(ww.p, msg.InstanceID, msg.Notified)
+	notificationsErr := err
+	if notificationsErr != nil {
+		ww.p.errorf("WebhookWorker id: %d, error posting notifications, err: %v", ww.id, notificationsErr)
+	}
+
+	// A comment that may have been added from the linked thread is synced again when the event
+	// is retried, other errors of the thread are only logged.
+	threadErr := ww.p.syncThreadComment(msg.InstanceID, v)
+	if threadErr != nil && !errors.Is(threadErr, errThreadRepliesPending) {
+		ww.p.errorf("WebhookWorker id: %d, error syncing the comment with the linked thread, err: %v", ww.id, threadErr)
+		threadErr = nil
 	}
 
-	v := wh.(*webhook)
 	if err = v.JiraWebhook.expandIssue(ww.p, msg.InstanceID); err != nil {
 		return err
 	}
@@ -62,12 +99,17 @@ func (ww webhookWorker) process(msg *webhookMessage) (err error) {
 	}
 
 	botUserID := ww.p.getUserID()
+	failed := 0
 	for _, channelSubscribed := range channelsSubscribed {
 		// Костыль, нужен для фильтра старых подписок
 		if channelSubscribed.MattermostUserID == "" {
 			continue
 		}
 
+		if msg.Delivered.ContainsAny(channelSubscribed.ID) {
+			continue
+		}
+
 		c, err2 := ww.p.userStore.LoadConnection(msg.InstanceID, types.ID(channelSubscribed.MattermostUserID))
 		if err2 == nil {
 			if v.User.Self == c.Self {
@@ -80,12 +122,30 @@ func (ww webhookWorker) process(msg *webhookMessage) (err error) {
 			continue
 		}
 
+		if channelSubscribed.BatchMinutes > 0 {
+			if err1 := ww.p.addToWebhookBatch(msg.InstanceID, &channelSubscribed, v.JiraWebhook); err1 != nil {
+				ww.p.errorf("WebhookWorker id: %d, error adding event to the batch of subscription %s, err: %v", ww.id, channelSubscribed.ID, err1)
+				failed++
+			} else {
+				msg.Delivered = msg.Delivered.Add(channelSubscribed.ID)
+			}
+			continue
+		}
+
 		if _, _, err1 := wh.PostToChannel(ww.p, msg.InstanceID, channelSubscribed.ChannelID, botUserID, channelSubscribed.Name); err1 != nil {
 			ww.p.errorf("WebhookWorker id: %d, error posting to channel, err: %v", ww.id, err1)
+			failed++
 		} else {
 			ww.p.API.LogInfo(fmt.Sprintf("Create post notification to user: %s, from subs: %s", channelSubscribed.MattermostUserID, channelSubscribed.ID))
+			msg.Delivered = msg.Delivered.Add(channelSubscribed.ID)
 		}
 	}
 
-	return nil
+	if failed > 0 {
+		return errors.Errorf("failed to post to %d of %d subscribed channels", failed, len(channelsSubscribed))
+	}
+	if notificationsErr != nil {
+		return notificationsErr
+	}
+	return threadErr
 }
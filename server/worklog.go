@@ -0,0 +1,422 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License for license information.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	jira "github.com/andygrunwald/go-jira"
+	"github.com/pkg/errors"
+)
+
+// Jira's default time tracking settings: a working day is 8 hours, a working week is 5 days.
+const (
+	worklogHoursPerDay = 8
+	worklogDaysPerWeek = 5
+)
+
+var worklogDurationPartRegexp = regexp.MustCompile(`(\d+(?:\.\d+)?)([wdhm])`)
+
+var worklogDurationRegexp = regexp.MustCompile(`^(?:\d+(?:\.\d+)?[wdhm])+$`)
+
+var worklogUnitSeconds = map[string]float64{
+	"w": worklogDaysPerWeek * worklogHoursPerDay * 3600,
+	"d": worklogHoursPerDay * 3600,
+	"h": 3600,
+	"m": 60,
+}
+
+// parseWorklogDuration parses a Jira style duration, such as "1w 2d 3h 15m" or "1h30m", from
+// the leading args and returns it in seconds with the remaining args. A single plain number
+// is read as minutes.
+func parseWorklogDuration(args []string) (int, []string, error) {
+	if len(args) > 0 {
+		if minutes, err := strconv.Atoi(args[0]); err == nil {
+			if minutes <= 0 {
+				return 0, nil, errors.New("duration must be greater than zero")
+			}
+			return minutes * 60, args[1:], nil
+		}
+	}
+
+	seconds := 0.0
+	n := 0
+	for ; n < len(args); n++ {
+		arg := strings.ToLower(args[n])
+		if !worklogDurationRegexp.MatchString(arg) {
+			break
+		}
+		for _, part := range worklogDurationPartRegexp.FindAllStringSubmatch(arg, -1) {
+			value, err := strconv.ParseFloat(part[1], 64)
+			if err != nil {
+				return 0, nil, errors.Wrapf(err, "invalid duration %q", args[n])
+			}
+			seconds += value * worklogUnitSeconds[part[2]]
+		}
+	}
+
+	if n == 0 {
+		return 0, nil, errors.New("please provide a duration such as `90`, `1h 30m` or `2d`")
+	}
+	if seconds < 60 {
+		return 0, nil, errors.New("duration must be at least one minute")
+	}
+	return int(seconds), args[n:], nil
+}
+
+// formatWorklogDuration formats seconds the way Jira does, e.g. "1w 2d 3h 15m".
+func formatWorklogDuration(seconds int) string {
+	minutes := seconds / 60
+	parts := []string{}
+	for _, unit := range []struct {
+		suffix  string
+		minutes int
+	}{
+		{"w", worklogDaysPerWeek * worklogHoursPerDay * 60},
+		{"d", worklogHoursPerDay * 60},
+		{"h", 60},
+		{"m", 1},
+	} {
+		if minutes >= unit.minutes {
+			parts = append(parts, fmt.Sprintf("%d%s", minutes/unit.minutes, unit.suffix))
+			minutes %= unit.minutes
+		}
+	}
+	if len(parts) == 0 {
+		return "0m"
+	}
+	return strings.Join(parts, " ")
+}
+
+// parseWorklogStarted extracts the optional `--started` flag from args. The value is a date
+// ("2024-03-01"), a time of the current day ("09:30"), or both ("2024-03-01T09:30" or
+// "2024-03-01 09:30"), in the given location.
+func parseWorklogStarted(args []string, loc *time.Location, now time.Time) (*time.Time, []string, error) {
+	var value []string
+	remaining := []string{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "--started") {
+			remaining = append(remaining, arg)
+			continue
+		}
+		if value != nil {
+			return nil, nil, errors.New("--started may not be specified multiple times")
+		}
+
+		switch {
+		case strings.HasPrefix(arg, "--started="):
+			value = []string{arg[len("--started="):]}
+		case arg == "--started" && i+1 < len(args):
+			i++
+			value = []string{args[i]}
+		default:
+			return nil, nil, errors.Errorf("invalid flag %s, use `--started=YYYY-MM-DD[THH:MM]`", arg)
+		}
+
+		// --started 2024-03-01 09:30
+		if i+1 < len(args) && !strings.Contains(value[0], ":") {
+			if _, err := time.Parse("15:04", args[i+1]); err == nil {
+				i++
+				value = append(value, args[i])
+			}
+		}
+	}
+	if value == nil {
+		return nil, args, nil
+	}
+
+	started, err := parseWorklogTime(strings.Join(value, "T"), loc, now)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &started, remaining, nil
+}
+
+func parseWorklogTime(value string, loc *time.Location, now time.Time) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, loc); err == nil {
+			return t, nil
+		}
+	}
+	if t, err := time.ParseInLocation("15:04", value, loc); err == nil {
+		today := now.In(loc)
+		return time.Date(today.Year(), today.Month(), today.Day(), t.Hour(), t.Minute(), 0, 0, loc), nil
+	}
+	return time.Time{}, errors.Errorf("invalid start %q, use `YYYY-MM-DD`, `HH:MM` or `YYYY-MM-DDTHH:MM`", value)
+}
+
+// userLocation returns the timezone the user has set in Mattermost, or UTC.
+func (p *Plugin) userLocation(mattermostUserID string) *time.Location {
+	user, err := p.client.User.Get(mattermostUserID)
+	if err != nil {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(user.GetPreferredTimezone())
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+const (
+	worklogReportDateFormat = "2006-01-02"
+	worklogReportMaxIssues  = 500
+)
+
+// WorklogReportEntry is the time a user logged on an issue in a single day.
+type WorklogReportEntry struct {
+	Date     string `json:"date"`
+	IssueKey string `json:"issue_key"`
+	Summary  string `json:"summary"`
+	Seconds  int    `json:"seconds"`
+}
+
+// WorklogReport is the time a user logged per day and per issue, over [From, To).
+type WorklogReport struct {
+	From         time.Time            `json:"from"`
+	To           time.Time            `json:"to"`
+	Entries      []WorklogReportEntry `json:"entries"`
+	TotalSeconds int                  `json:"total_seconds"`
+
+	// Truncated is true when the user logged work on more issues than a report includes.
+	Truncated bool `json:"truncated"`
+}
+
+// parseWorklogReportRange returns the range of a report: "today", "week" (since Monday), a single
+// day ("2024-03-01") or an inclusive range of days ("2024-03-01..2024-03-07").
+func parseWorklogReportRange(spec string, loc *time.Location, now time.Time) (from, to time.Time, err error) {
+	local := now.In(loc)
+	today := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+
+	switch spec {
+	case "", "today":
+		return today, today.AddDate(0, 0, 1), nil
+	case "week":
+		daysSinceMonday := (int(today.Weekday()) + 6) % 7
+		return today.AddDate(0, 0, -daysSinceMonday), today.AddDate(0, 0, 1), nil
+	}
+
+	fromStr, toStr := spec, spec
+	if parts := strings.SplitN(spec, "..", 2); len(parts) == 2 {
+		fromStr, toStr = parts[0], parts[1]
+	}
+	from, err = time.ParseInLocation(worklogReportDateFormat, fromStr, loc)
+	if err != nil {
+		return from, to, errors.Errorf("invalid range %q, use `today`, `week` or `YYYY-MM-DD..YYYY-MM-DD`", spec)
+	}
+	to, err = time.ParseInLocation(worklogReportDateFormat, toStr, loc)
+	if err != nil {
+		return from, to, errors.Errorf("invalid range %q, use `today`, `week` or `YYYY-MM-DD..YYYY-MM-DD`", spec)
+	}
+	to = to.AddDate(0, 0, 1)
+	if !to.After(from) {
+		return from, to, errors.Errorf("invalid range %q, the end is before the start", spec)
+	}
+	return from, to, nil
+}
+
+// isWorklogAuthor reports whether the worklog was created by the connected Jira user.
+func isWorklogAuthor(record *jira.WorklogRecord, connection *Connection) bool {
+	if record.Author == nil {
+		return false
+	}
+	if connection.AccountID != "" {
+		return record.Author.AccountID == connection.AccountID
+	}
+	return (connection.Key != "" && record.Author.Key == connection.Key) ||
+		(connection.Name != "" && record.Author.Name == connection.Name)
+}
+
+// getWorklogReport aggregates the worklogs the connected user logged in [from, to), per day and issue.
+func getWorklogReport(client Client, connection *Connection, from, to time.Time) (*WorklogReport, error) {
+	// Jira evaluates worklogDate in the user's Jira timezone, widen the query by a day on
+	// each side and filter the records precisely below.
+	jql := fmt.Sprintf(`worklogAuthor = currentUser() AND worklogDate >= "%s" AND worklogDate <= "%s" ORDER BY key`,
+		from.AddDate(0, 0, -1).Format(worklogReportDateFormat), to.Format(worklogReportDateFormat))
+	issues, total, err := searchWorklogReportIssues(client, jql)
+	if err != nil {
+		return nil, err
+	}
+
+	type entryKey struct{ date, issueKey string }
+	byKey := map[entryKey]*WorklogReportEntry{}
+	report := &WorklogReport{From: from, To: to, Entries: []WorklogReportEntry{}, Truncated: len(issues) < total}
+	for _, issue := range issues {
+		records, err := client.GetWorklogs(issue.Key)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "failed to get the worklogs of %s", issue.Key)
+		}
+
+		summary := ""
+		if issue.Fields != nil {
+			summary = issue.Fields.Summary
+		}
+		for i := range records {
+			record := &records[i]
+			if record.Started == nil || !isWorklogAuthor(record, connection) {
+				continue
+			}
+			started := time.Time(*record.Started).In(from.Location())
+			if started.Before(from) || !started.Before(to) {
+				continue
+			}
+
+			key := entryKey{started.Format(worklogReportDateFormat), issue.Key}
+			entry := byKey[key]
+			if entry == nil {
+				entry = &WorklogReportEntry{Date: key.date, IssueKey: issue.Key, Summary: summary}
+				byKey[key] = entry
+			}
+			entry.Seconds += record.TimeSpentSeconds
+			report.TotalSeconds += record.TimeSpentSeconds
+		}
+	}
+
+	for _, entry := range byKey {
+		report.Entries = append(report.Entries, *entry)
+	}
+	sort.Slice(report.Entries, func(i, j int) bool {
+		if report.Entries[i].Date != report.Entries[j].Date {
+			return report.Entries[i].Date < report.Entries[j].Date
+		}
+		return report.Entries[i].IssueKey < report.Entries[j].IssueKey
+	})
+	return report, nil
+}
+
+// searchWorklogReportIssues pages through the issues matching jql, up to worklogReportMaxIssues,
+// and returns the number of issues matching in total.
+func searchWorklogReportIssues(client Client, jql string) ([]jira.Issue, int, error) {
+	issues := []jira.Issue{}
+	for {
+		page, total, err := client.SearchIssuesPage(jql, &jira.SearchOptions{
+			StartAt:    len(issues),
+			MaxResults: worklogReportMaxIssues - len(issues),
+			Fields:     []string{"summary"},
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+		issues = append(issues, page...)
+		if len(page) == 0 || len(issues) >= total || len(issues) >= worklogReportMaxIssues {
+			return issues, total, nil
+		}
+	}
+}
+
+// Markdown renders the report as a table with a subtotal per day and the total.
+func (r *WorklogReport) Markdown(jiraBaseURL string) string {
+	period := r.From.Format(worklogReportDateFormat)
+	if last := r.To.AddDate(0, 0, -1); !last.Equal(r.From) {
+		period += " – " + last.Format(worklogReportDateFormat)
+	}
+	text := fmt.Sprintf("#### Work logged %s\n", period)
+	if r.Truncated {
+		text += fmt.Sprintf("Only the work logged on the first %d issues is included, choose a shorter period for a full report.\n",
+			worklogReportMaxIssues)
+	}
+	if len(r.Entries) == 0 {
+		return text + "No work logged."
+	}
+
+	text += "\n|Date|Issue|Summary|Time|\n|--|--|--|--|\n"
+	daySeconds := 0
+	for i, entry := range r.Entries {
+		text += fmt.Sprintf("|%s|[%s](%s/browse/%s)|%s|%s|\n", entry.Date, entry.IssueKey, jiraBaseURL, entry.IssueKey,
+			strings.ReplaceAll(entry.Summary, "|", "\\|"), formatWorklogDuration(entry.Seconds))
+		daySeconds += entry.Seconds
+		if i == len(r.Entries)-1 || r.Entries[i+1].Date != entry.Date {
+			text += fmt.Sprintf("|||**%s total**|**%s**|\n", entry.Date, formatWorklogDuration(daySeconds))
+			daySeconds = 0
+		}
+	}
+	text += fmt.Sprintf("|||**Total**|**%s**|\n", formatWorklogDuration(r.TotalSeconds))
+	return text
+}
+
+var errWorklogNotOwned = errors.New("you can only change your own worklogs")
+
+// getOwnWorklogs returns the worklogs of the issue created by the connected user.
+func getOwnWorklogs(client Client, connection *Connection, issueKey string) ([]jira.WorklogRecord, error) {
+	records, err := client.GetWorklogs(issueKey)
+	if err != nil {
+		return nil, err
+	}
+
+	own := []jira.WorklogRecord{}
+	for i := range records {
+		if isWorklogAuthor(&records[i], connection) {
+			own = append(own, records[i])
+		}
+	}
+	return own, nil
+}
+
+// loadOwnWorklog loads a worklog of the issue, making sure the connected user created it.
+func loadOwnWorklog(client Client, connection *Connection, issueKey, worklogID string) (*jira.WorklogRecord, error) {
+	record, _, err := client.getWorkLog(issueKey, worklogID)
+	if err != nil {
+		return nil, err
+	}
+	if !isWorklogAuthor(record, connection) {
+		return nil, errWorklogNotOwned
+	}
+	return record, nil
+}
+
+// updateOwnWorklog changes the duration, and the comment and start if set, of a worklog
+// the connected user created.
+func updateOwnWorklog(client Client, connection *Connection, issueKey, worklogID string, update *jira.WorklogRecord) (*jira.WorklogRecord, error) {
+	record, err := loadOwnWorklog(client, connection, issueKey, worklogID)
+	if err != nil {
+		return nil, err
+	}
+
+	changed := &jira.WorklogRecord{
+		TimeSpentSeconds: update.TimeSpentSeconds,
+		Comment:          record.Comment,
+		Started:          record.Started,
+	}
+	if update.Comment != "" {
+		changed.Comment = update.Comment
+	}
+	if update.Started != nil {
+		changed.Started = update.Started
+	}
+
+	updated, _, err := client.updateWorkLog(issueKey, worklogID, changed)
+	return updated, err
+}
+
+// deleteOwnWorklog deletes a worklog the connected user created.
+func deleteOwnWorklog(client Client, connection *Connection, issueKey, worklogID string) error {
+	if _, err := loadOwnWorklog(client, connection, issueKey, worklogID); err != nil {
+		return err
+	}
+	_, err := client.deleteWorkLog(issueKey, worklogID)
+	return err
+}
+
+func formatWorklogs(issueKey string, records []jira.WorklogRecord, loc *time.Location) string {
+	if len(records) == 0 {
+		return fmt.Sprintf("You have not logged any work on %s.", issueKey)
+	}
+
+	text := fmt.Sprintf("#### Your worklogs on %s\n\n|ID|Started|Time|Comment|\n|--|--|--|--|\n", issueKey)
+	for _, record := range records {
+		started := ""
+		if record.Started != nil {
+			started = time.Time(*record.Started).In(loc).Format("2006-01-02 15:04")
+		}
+		comment := strings.ReplaceAll(strings.ReplaceAll(record.Comment, "\n", " "), "|", "\\|")
+		text += fmt.Sprintf("|`%s`|%s|%s|%s|\n", record.ID, started, formatWorklogDuration(record.TimeSpentSeconds), comment)
+	}
+	return text
+}
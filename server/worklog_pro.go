@@ -1,9 +1,71 @@
 package main
 
 import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
 	"github.com/andygrunwald/go-jira"
 )
 
+// jiraWorklogTimeFormat is the only format Jira accepts for the started date of a worklog,
+// go-jira drops the milliseconds when they are zero.
+const jiraWorklogTimeFormat = "2006-01-02T15:04:05.000-0700"
+
+type worklogRecordPayload struct {
+	*jira.WorklogRecord
+	Started string `json:"started,omitempty"`
+}
+
+func newWorklogRecordPayload(record *jira.WorklogRecord) *worklogRecordPayload {
+	payload := &worklogRecordPayload{WorklogRecord: record}
+	if record.Started != nil {
+		payload.Started = time.Time(*record.Started).Format(jiraWorklogTimeFormat)
+	}
+	return payload
+}
+
+func (c JiraClient) doWorkLogRequest(method, endpoint string, body interface{}) (*jira.WorklogRecord, *jira.Response, error) {
+	req, err := c.Jira.NewRequest(method, endpoint, body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var record *jira.WorklogRecord
+	var v interface{}
+	if method != http.MethodDelete {
+		record = &jira.WorklogRecord{}
+		v = record
+	}
+	resp, err := c.Jira.Do(req, v)
+	if err != nil {
+		return nil, resp, userFriendlyJiraError(resp, err)
+	}
+	return record, resp, nil
+}
+
 func (c JiraClient) createWorkLog(issueID string, record *jira.WorklogRecord) (*jira.WorklogRecord, *jira.Response, error) {
-	return c.Jira.Issue.AddWorklogRecord(issueID, record)
+	return c.doWorkLogRequest(http.MethodPost, fmt.Sprintf("rest/api/2/issue/%s/worklog", url.PathEscape(issueID)), newWorklogRecordPayload(record))
+}
+
+func (c JiraClient) getWorkLog(issueID, worklogID string) (*jira.WorklogRecord, *jira.Response, error) {
+	return c.doWorkLogRequest(http.MethodGet, fmt.Sprintf("rest/api/2/issue/%s/worklog/%s", url.PathEscape(issueID), url.PathEscape(worklogID)), nil)
+}
+
+func (c JiraClient) updateWorkLog(issueID, worklogID string, record *jira.WorklogRecord) (*jira.WorklogRecord, *jira.Response, error) {
+	return c.doWorkLogRequest(http.MethodPut, fmt.Sprintf("rest/api/2/issue/%s/worklog/%s", url.PathEscape(issueID), url.PathEscape(worklogID)), newWorklogRecordPayload(record))
+}
+
+func (c JiraClient) deleteWorkLog(issueID, worklogID string) (*jira.Response, error) {
+	_, resp, err := c.doWorkLogRequest(http.MethodDelete, fmt.Sprintf("rest/api/2/issue/%s/worklog/%s", url.PathEscape(issueID), url.PathEscape(worklogID)), nil)
+	return resp, err
+}
+
+func (c JiraClient) GetWorklogs(issueKey string) ([]jira.WorklogRecord, error) {
+	worklog, resp, err := c.Jira.Issue.GetWorklogs(issueKey)
+	if err != nil {
+		return nil, userFriendlyJiraError(resp, err)
+	}
+	return worklog.Worklogs, nil
 }
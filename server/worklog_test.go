@@ -0,0 +1,276 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License for license information.
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	jira "github.com/andygrunwald/go-jira"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseWorklogDuration(t *testing.T) {
+	for name, tc := range map[string]struct {
+		args              string
+		expectedSeconds   int
+		expectedRemaining []string
+		expectedErr       bool
+	}{
+		"plain minutes":          {args: "90", expectedSeconds: 90 * 60, expectedRemaining: []string{}},
+		"plain minutes, comment": {args: "30 2 bugs fixed", expectedSeconds: 30 * 60, expectedRemaining: []string{"2", "bugs", "fixed"}},
+		"jira duration":          {args: "1w 2d 3h 15m", expectedSeconds: ((5+2)*8*60 + 3*60 + 15) * 60, expectedRemaining: []string{}},
+		"compact duration":       {args: "1h30m code review", expectedSeconds: 90 * 60, expectedRemaining: []string{"code", "review"}},
+		"fractional hours":       {args: "1.5H", expectedSeconds: 90 * 60, expectedRemaining: []string{}},
+		"zero minutes":           {args: "0", expectedErr: true},
+		"no duration":            {args: "review", expectedErr: true},
+		"less than a minute":     {args: "0.5m", expectedErr: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			seconds, remaining, err := parseWorklogDuration(strings.Fields(tc.args))
+			if tc.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedSeconds, seconds)
+			assert.Equal(t, tc.expectedRemaining, remaining)
+		})
+	}
+}
+
+func TestFormatWorklogDuration(t *testing.T) {
+	assert.Equal(t, "1w 2d 3h 15m", formatWorklogDuration(((5+2)*8*60+3*60+15)*60))
+	assert.Equal(t, "1h 30m", formatWorklogDuration(90*60))
+	assert.Equal(t, "0m", formatWorklogDuration(30))
+}
+
+func TestParseWorklogStarted(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Moscow")
+	require.NoError(t, err)
+	now := time.Date(2024, 3, 1, 18, 0, 0, 0, loc)
+
+	for name, tc := range map[string]struct {
+		args              string
+		expected          *time.Time
+		expectedRemaining []string
+		expectedErr       bool
+	}{
+		"no flag":          {args: "TEST-1 1h", expectedRemaining: []string{"TEST-1", "1h"}},
+		"date":             {args: "TEST-1 --started=2024-02-28 1h", expected: timePtr(time.Date(2024, 2, 28, 0, 0, 0, 0, loc)), expectedRemaining: []string{"TEST-1", "1h"}},
+		"date and time":    {args: "TEST-1 1h --started=2024-02-28T09:30", expected: timePtr(time.Date(2024, 2, 28, 9, 30, 0, 0, loc)), expectedRemaining: []string{"TEST-1", "1h"}},
+		"separate values":  {args: "TEST-1 --started 2024-02-28 09:30 1h", expected: timePtr(time.Date(2024, 2, 28, 9, 30, 0, 0, loc)), expectedRemaining: []string{"TEST-1", "1h"}},
+		"time of today":    {args: "TEST-1 --started 09:30 1h", expected: timePtr(time.Date(2024, 3, 1, 9, 30, 0, 0, loc)), expectedRemaining: []string{"TEST-1", "1h"}},
+		"invalid value":    {args: "TEST-1 --started yesterday 1h", expectedErr: true},
+		"missing value":    {args: "TEST-1 1h --started", expectedErr: true},
+		"specified twice":  {args: "--started=09:00 --started=10:00", expectedErr: true},
+		"unknown flag arg": {args: "--startedX", expectedErr: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			started, remaining, err := parseWorklogStarted(strings.Fields(tc.args), loc, now)
+			if tc.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, started)
+			assert.Equal(t, tc.expectedRemaining, remaining)
+		})
+	}
+}
+
+func TestWorklogRecordPayload(t *testing.T) {
+	loc := time.FixedZone("MSK", 3*3600)
+	started := jira.Time(time.Date(2024, 2, 28, 9, 30, 0, 0, loc))
+
+	data, err := json.Marshal(&worklogRecordPayload{
+		WorklogRecord: &jira.WorklogRecord{
+			TimeSpentSeconds: 3600,
+			Comment:          "review",
+			Started:          &started,
+		},
+		Started: time.Time(started).Format(jiraWorklogTimeFormat),
+	})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"comment":"review","timeSpentSeconds":3600,"started":"2024-02-28T09:30:00.000+0300"}`, string(data))
+}
+
+func TestParseWorklogReportRange(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Moscow")
+	require.NoError(t, err)
+	// Friday
+	now := time.Date(2024, 3, 1, 18, 0, 0, 0, loc)
+
+	for name, tc := range map[string]struct {
+		spec         string
+		expectedFrom time.Time
+		expectedTo   time.Time
+		expectedErr  bool
+	}{
+		"default":    {spec: "", expectedFrom: time.Date(2024, 3, 1, 0, 0, 0, 0, loc), expectedTo: time.Date(2024, 3, 2, 0, 0, 0, 0, loc)},
+		"today":      {spec: "today", expectedFrom: time.Date(2024, 3, 1, 0, 0, 0, 0, loc), expectedTo: time.Date(2024, 3, 2, 0, 0, 0, 0, loc)},
+		"week":       {spec: "week", expectedFrom: time.Date(2024, 2, 26, 0, 0, 0, 0, loc), expectedTo: time.Date(2024, 3, 2, 0, 0, 0, 0, loc)},
+		"single day": {spec: "2024-02-20", expectedFrom: time.Date(2024, 2, 20, 0, 0, 0, 0, loc), expectedTo: time.Date(2024, 2, 21, 0, 0, 0, 0, loc)},
+		"range":      {spec: "2024-02-20..2024-02-22", expectedFrom: time.Date(2024, 2, 20, 0, 0, 0, 0, loc), expectedTo: time.Date(2024, 2, 23, 0, 0, 0, 0, loc)},
+		"reversed":   {spec: "2024-02-22..2024-02-20", expectedErr: true},
+		"invalid":    {spec: "month", expectedErr: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			from, to, err := parseWorklogReportRange(tc.spec, loc, now)
+			if tc.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedFrom, from)
+			assert.Equal(t, tc.expectedTo, to)
+		})
+	}
+}
+
+type worklogTestClient struct {
+	testClient
+	issues   []jira.Issue
+	worklogs map[string][]jira.WorklogRecord
+}
+
+func (client worklogTestClient) SearchIssues(jql string, options *jira.SearchOptions) ([]jira.Issue, error) {
+	return client.issues, nil
+}
+
+// SearchIssuesPage returns a single issue per page, as Jira may return fewer issues than asked for.
+func (client worklogTestClient) SearchIssuesPage(jql string, options *jira.SearchOptions) ([]jira.Issue, int, error) {
+	if options.StartAt >= len(client.issues) {
+		return nil, len(client.issues), nil
+	}
+	return client.issues[options.StartAt : options.StartAt+1], len(client.issues), nil
+}
+
+func (client worklogTestClient) GetWorklogs(issueKey string) ([]jira.WorklogRecord, error) {
+	return client.worklogs[issueKey], nil
+}
+
+func TestGetWorklogReport(t *testing.T) {
+	loc := time.UTC
+	at := func(day, hour int) *jira.Time {
+		started := jira.Time(time.Date(2024, 3, day, hour, 0, 0, 0, loc))
+		return &started
+	}
+	me := &jira.User{AccountID: "me"}
+	other := &jira.User{AccountID: "other"}
+
+	client := worklogTestClient{
+		issues: []jira.Issue{
+			{Key: "TEST-2", Fields: &jira.IssueFields{Summary: "Second"}},
+			{Key: "TEST-1", Fields: &jira.IssueFields{Summary: "First"}},
+		},
+		worklogs: map[string][]jira.WorklogRecord{
+			"TEST-1": {
+				{Author: me, Started: at(1, 9), TimeSpentSeconds: 3600},
+				{Author: me, Started: at(1, 14), TimeSpentSeconds: 1800},
+				{Author: other, Started: at(1, 10), TimeSpentSeconds: 7200},
+				{Author: me, Started: at(3, 10), TimeSpentSeconds: 600},
+			},
+			"TEST-2": {
+				{Author: me, Started: at(2, 9), TimeSpentSeconds: 900},
+			},
+		},
+	}
+	connection := &Connection{User: jira.User{AccountID: "me"}}
+
+	report, err := getWorklogReport(client, connection, time.Date(2024, 3, 1, 0, 0, 0, 0, loc), time.Date(2024, 3, 3, 0, 0, 0, 0, loc))
+	require.NoError(t, err)
+	assert.Equal(t, []WorklogReportEntry{
+		{Date: "2024-03-01", IssueKey: "TEST-1", Summary: "First", Seconds: 5400},
+		{Date: "2024-03-02", IssueKey: "TEST-2", Summary: "Second", Seconds: 900},
+	}, report.Entries)
+	assert.Equal(t, 6300, report.TotalSeconds)
+	assert.False(t, report.Truncated)
+
+	text := report.Markdown("https://jira.example.com")
+	assert.Contains(t, text, "#### Work logged 2024-03-01 – 2024-03-02")
+	assert.Contains(t, text, "|2024-03-01|[TEST-1](https://jira.example.com/browse/TEST-1)|First|1h 30m|")
+	assert.Contains(t, text, "|||**2024-03-02 total**|**15m**|")
+	assert.Contains(t, text, "|||**Total**|**1h 45m**|")
+
+	report.Truncated = true
+	assert.Contains(t, report.Markdown("https://jira.example.com"), "Only the work logged on the first 500 issues is included")
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
+
+type worklogEditTestClient struct {
+	worklogTestClient
+	updated map[string]*jira.WorklogRecord
+	deleted []string
+}
+
+func (client *worklogEditTestClient) getWorkLog(issueID, worklogID string) (*jira.WorklogRecord, *jira.Response, error) {
+	for _, record := range client.worklogs[issueID] {
+		if record.ID == worklogID {
+			return &record, nil, nil
+		}
+	}
+	return nil, nil, errors.New("worklog not found")
+}
+
+func (client *worklogEditTestClient) updateWorkLog(issueID, worklogID string, record *jira.WorklogRecord) (*jira.WorklogRecord, *jira.Response, error) {
+	client.updated[worklogID] = record
+	return record, nil, nil
+}
+
+func (client *worklogEditTestClient) deleteWorkLog(issueID, worklogID string) (*jira.Response, error) {
+	client.deleted = append(client.deleted, worklogID)
+	return nil, nil
+}
+
+func TestOwnWorklogs(t *testing.T) {
+	started := jira.Time(time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC))
+	client := &worklogEditTestClient{
+		worklogTestClient: worklogTestClient{
+			worklogs: map[string][]jira.WorklogRecord{
+				"TEST-1": {
+					{ID: "1", Author: &jira.User{AccountID: "me"}, Started: &started, TimeSpentSeconds: 3600, Comment: "review"},
+					{ID: "2", Author: &jira.User{AccountID: "other"}, Started: &started, TimeSpentSeconds: 1800},
+				},
+			},
+		},
+		updated: map[string]*jira.WorklogRecord{},
+	}
+	connection := &Connection{User: jira.User{AccountID: "me"}}
+
+	own, err := getOwnWorklogs(client, connection, "TEST-1")
+	require.NoError(t, err)
+	require.Len(t, own, 1)
+	assert.Equal(t, "1", own[0].ID)
+
+	text := formatWorklogs("TEST-1", own, time.UTC)
+	assert.Contains(t, text, "|`1`|2024-03-01 09:00|1h|review|")
+
+	t.Run("update keeps comment and start", func(t *testing.T) {
+		updated, err := updateOwnWorklog(client, connection, "TEST-1", "1", &jira.WorklogRecord{TimeSpentSeconds: 5400})
+		require.NoError(t, err)
+		assert.Equal(t, 5400, updated.TimeSpentSeconds)
+		assert.Equal(t, "review", updated.Comment)
+		assert.Equal(t, &started, updated.Started)
+	})
+
+	t.Run("update of another user's worklog", func(t *testing.T) {
+		_, err := updateOwnWorklog(client, connection, "TEST-1", "2", &jira.WorklogRecord{TimeSpentSeconds: 60})
+		assert.ErrorIs(t, err, errWorklogNotOwned)
+		assert.NotContains(t, client.updated, "2")
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		assert.ErrorIs(t, deleteOwnWorklog(client, connection, "TEST-1", "2"), errWorklogNotOwned)
+		require.NoError(t, deleteOwnWorklog(client, connection, "TEST-1", "1"))
+		assert.Equal(t, []string{"1"}, client.deleted)
+	})
+}
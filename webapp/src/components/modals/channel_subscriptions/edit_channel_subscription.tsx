@@ -56,6 +56,14 @@ const MeRoles: ReactSelectOption[] = [
     {label: 'Watcher', value: 'watcher'},
 ]
 
+const BatchWindows: ReactSelectOption[] = [
+    {label: 'Post every event', value: '0'},
+    {label: 'Every 5 minutes', value: '5'},
+    {label: 'Every 15 minutes', value: '15'},
+    {label: 'Hourly', value: '60'},
+    {label: 'Daily', value: '1440'},
+];
+
 export type Props = SharedProps & {
     finishEditSubscription: () => void;
     selectedSubscription: ChannelSubscription | null;
@@ -71,6 +79,7 @@ export type State = {
     getMetaDataErr: string | null;
     submitting: boolean;
     subscriptionName: string | null;
+    batchMinutes: number;
     showConfirmModal: boolean;
     conflictingError: string | null;
 };
@@ -90,9 +99,11 @@ export default class EditChannelSubscription extends PureComponent<Props, State>
         };
 
         let subscriptionName = null;
+        let batchMinutes = 0;
         if (props.selectedSubscription) {
             filters = Object.assign({}, filters, props.selectedSubscription.filters);
             subscriptionName = props.selectedSubscription.name;
+            batchMinutes = props.selectedSubscription.batch_minutes || 0;
         }
 
         filters.fields = filters.fields || [];
@@ -110,6 +121,7 @@ export default class EditChannelSubscription extends PureComponent<Props, State>
             filters,
             jiraIssueMetadata: null,
             subscriptionName,
+            batchMinutes,
             showConfirmModal: false,
             conflictingError: null,
             instanceID,
@@ -129,6 +141,14 @@ export default class EditChannelSubscription extends PureComponent<Props, State>
         this.setState({subscriptionName: value});
     };
 
+    handleJQLChange = (id: string, value: string) => {
+        this.setState({filters: {...this.state.filters, jql: value}});
+    };
+
+    handleBatchMinutesChange = (id: string, value: string) => {
+        this.setState({batchMinutes: parseInt(value, 10) || 0});
+    };
+
     deleteChannelSubscription = () => {
         if (this.props.selectedSubscription) {
             this.props.deleteChannelSubscription(this.props.selectedSubscription).then((res) => {
@@ -259,6 +279,7 @@ export default class EditChannelSubscription extends PureComponent<Props, State>
             filters: this.state.filters,
             name: this.state.subscriptionName,
             instance_id: this.state.instanceID,
+            batch_minutes: this.state.batchMinutes,
         } as ChannelSubscription;
 
         this.setState({submitting: true, error: null});
@@ -333,6 +354,25 @@ export default class EditChannelSubscription extends PureComponent<Props, State>
                             value={MeRoles.filter(option => (this.state.filters.self || []).includes(option.value))}
                             closeMenuOnSelect={false}
                         />
+                        <Input
+                            id={'jql'}
+                            label={'JQL filter'}
+                            placeholder={'Optional, e.g. priority = High AND labels != wontfix'}
+                            type={'textarea'}
+                            onChange={this.handleJQLChange}
+                            value={this.state.filters.jql || ''}
+                            readOnly={false}
+                            addValidate={this.validator.addComponent}
+                            removeValidate={this.validator.removeComponent}
+                        />
+                        <ReactSelectSetting
+                            name={'batch_minutes'}
+                            label={'Batching'}
+                            theme={this.props.theme}
+                            options={BatchWindows}
+                            onChange={this.handleBatchMinutesChange}
+                            value={BatchWindows.find((option) => option.value === String(this.state.batchMinutes))}
+                        />
                     </React.Fragment>
                 );
             }
@@ -158,6 +158,7 @@ export type ChannelSubscriptionFilters = {
     issue_types: string[];
     fields: FilterValue[];
     self: string[]
+    jql?: string;
 };
 
 export type ChannelSubscription = {
@@ -166,6 +167,7 @@ export type ChannelSubscription = {
     filters: ChannelSubscriptionFilters;
     name: string;
     instance_id: string;
+    batch_minutes?: number;
 }
 
 export enum InstanceType {